@@ -74,12 +74,13 @@ func TestRPCSharedRoundRobin(t *testing.T) {
 		}
 	}
 
-	// Unregister callee2 and make sure round robin still works.
+	// Unregister callee2 and make sure round robin still works.  The last
+	// call went to callee2, so the next call goes to callee3.
 	if err = callee2.Unregister(procName); err != nil {
 		t.Fatal("failed to unregister procedure:", err)
 	}
 
-	expect = int64(1)
+	expect = int64(3)
 	for i := 0; i < 5; i++ {
 		// Test calling the procedure - expect callee1-3
 		ctx := context.Background()
@@ -48,7 +48,7 @@ type ClientConfig struct {
 	// Enable debug logging for client.
 	Debug bool
 
-	// Set to JSON or MSGPACK.  Default (zero-value) is JSON.
+	// Set to JSON, MSGPACK, or CBOR.  Default (zero-value) is JSON.
 	Serialization serialize.Serialization
 
 	// Provide a tls.Config to connect the client using TLS.  The zero
@@ -60,6 +60,9 @@ type ClientConfig struct {
 	// See https://godoc.org/github.com/gorilla/websocket#Dialer
 	Dial transport.DialFunc
 
+	// Websocket settings, such as compression, for websocket clients.
+	WsCfg transport.WebsocketConfig
+
 	// Client receive limit for use with RawSocket transport.
 	// If recvLimit is > 0, then the client will not receive messages with size
 	// larger than the nearest power of 2 greater than or equal to recvLimit.
@@ -75,6 +78,7 @@ type ClientConfig struct {
 const (
 	JSON    = serialize.JSON
 	MSGPACK = serialize.MSGPACK
+	CBOR    = serialize.CBOR
 )
 
 // Features supported by nexus client.
@@ -89,6 +93,7 @@ var clientRoles = wamp.Dict{
 		"features": wamp.Dict{
 			"pattern_based_subscription": true,
 			"publisher_identification":   true,
+			"subscription_revocation":    true,
 		},
 	},
 	"callee": wamp.Dict{
@@ -99,6 +104,7 @@ var clientRoles = wamp.Dict{
 			"call_timeout":               true,
 			"caller_identification":      true,
 			"progressive_call_results":   true,
+			"registration_revocation":    true,
 		},
 	},
 	"caller": wamp.Dict{
@@ -774,11 +780,16 @@ func joinRealm(peer wamp.Peer, cfg ClientConfig) (*wamp.Welcome, error) {
 // router.
 func (c *Client) leaveRealm() {
 	// Send GOODBYE to router.  The router will respond with a GOODBYE message
-	// which is handled by receiveFromRouter, and causes it to exit.
-	c.sess.Send(&wamp.Goodbye{
-		Details: wamp.Dict{},
-		Reason:  wamp.ErrCloseRealm,
-	})
+	// which is handled by receiveFromRouter, and causes it to exit.  If the
+	// router already sent GOODBYE, then the client has left the realm.
+	select {
+	case <-c.done:
+	default:
+		c.sess.Send(&wamp.Goodbye{
+			Details: wamp.Dict{},
+			Reason:  wamp.ErrCloseRealm,
+		})
+	}
 
 	// Close the peer.  This causes receiveFromRouter to exit if it has not
 	// already done so after receiving GOODBYE from router.
@@ -924,8 +935,16 @@ func (c *Client) receiveFromRouter() {
 		case *wamp.Subscribed:
 			c.signalReply(msg, msg.Request)
 		case *wamp.Unsubscribed:
+			if msg.Request == 0 {
+				c.handleRevokedSubscription(msg)
+				continue
+			}
 			c.signalReply(msg, msg.Request)
 		case *wamp.Unregistered:
+			if msg.Request == 0 {
+				c.handleRevokedRegistration(msg)
+				continue
+			}
 			c.signalReply(msg, msg.Request)
 		case *wamp.Result:
 			c.signalReply(msg, msg.Request)
@@ -935,6 +954,14 @@ func (c *Client) receiveFromRouter() {
 			c.signalReply(msg, msg.Request)
 
 		case *wamp.Goodbye:
+			// Reply to a GOODBYE sent by the router, and not to the reply
+			// to a GOODBYE sent by this client.
+			if msg.Reason != wamp.ErrGoodbyeAndOut {
+				c.sess.TrySend(&wamp.Goodbye{
+					Reason:  wamp.ErrGoodbyeAndOut,
+					Details: wamp.Dict{},
+				})
+			}
 			return
 
 		default:
@@ -988,6 +1015,40 @@ func (c *Client) SendProgress(ctx context.Context, args wamp.List, kwArgs wamp.D
 	})
 }
 
+// handleRevokedSubscription removes the handler for a subscription that the
+// router removed.
+func (c *Client) handleRevokedSubscription(msg *wamp.Unsubscribed) {
+	subID, _ := wamp.AsID(msg.Details["subscription"])
+	reason := wamp.OptionString(msg.Details, "reason")
+	c.actionChan <- func() {
+		delete(c.eventHandlers, subID)
+		for topic, id := range c.topicSubID {
+			if id == subID {
+				delete(c.topicSubID, topic)
+				c.log.Println("Router revoked subscription to", topic,
+					"reason:", reason)
+			}
+		}
+	}
+}
+
+// handleRevokedRegistration removes the handler for a registration that the
+// router removed the client from.
+func (c *Client) handleRevokedRegistration(msg *wamp.Unregistered) {
+	regID, _ := wamp.AsID(msg.Details["registration"])
+	reason := wamp.OptionString(msg.Details, "reason")
+	c.actionChan <- func() {
+		delete(c.invHandlers, regID)
+		for procedure, id := range c.nameProcID {
+			if id == regID {
+				delete(c.nameProcID, procedure)
+				c.log.Println("Router revoked registration for", procedure,
+					"reason:", reason)
+			}
+		}
+	}
+}
+
 func (c *Client) handleInvocation(msg *wamp.Invocation) {
 	c.actionChan <- func() {
 		handler, ok := c.invHandlers[msg.Registration]
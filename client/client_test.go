@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -352,6 +353,45 @@ func TestRemoteProcedureCall(t *testing.T) {
 	r.Close()
 }
 
+func TestRegistrationRevoked(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	regID, _ := callee.RegistrationID(procName)
+
+	// The router removes the callee from the registration, and the callee
+	// forgets the registration.
+	ctx := context.Background()
+	_, err = caller.Call(ctx, string(wamp.MetaProcRegRemoveCallee), nil,
+		wamp.List{regID, callee.ID()}, nil, "")
+	if err != nil {
+		t.Fatal("failed to remove callee:", err)
+	}
+	for i := 0; ; i++ {
+		if _, ok := callee.RegistrationID(procName); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("registration not revoked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	caller.Close()
+	callee.Close()
+	r.Close()
+}
+
 func TestProgressiveCall(t *testing.T) {
 	// Connect two clients to the same server
 	callee, caller, r, err := connectedTestClients()
@@ -616,6 +656,177 @@ func TestTimeoutRemoteProcedureCall(t *testing.T) {
 	r.Close()
 }
 
+func TestRouterShutdown(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	c1, c2, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+
+	// Clients reply to the router's GOODBYE, so none are left over.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if n := r.(router.GracefulCloser).Shutdown(ctx); n != 0 {
+		t.Fatal("expected all clients to reply to GOODBYE,", n, "did not")
+	}
+	for _, c := range []*Client{c1, c2} {
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Expected client done")
+		}
+		c.Close()
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	realmConfig := &router.RealmConfig{
+		URI:           wamp.URI(testRealm),
+		AnonymousAuth: true,
+	}
+	r1, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	// Connect to whichever router is current.
+	var lock sync.Mutex
+	current := r1
+	connect := func() (*Client, error) {
+		lock.Lock()
+		r := current
+		lock.Unlock()
+		return newTestClient(r)
+	}
+
+	disconnected := make(chan struct{}, 1)
+	reconnected := make(chan *Client, 1)
+	rcfg := ReconnectConfig{
+		MinDelay:     10 * time.Millisecond,
+		OnDisconnect: func() { disconnected <- struct{}{} },
+		OnReconnect:  func(c *Client) { reconnected <- c },
+	}
+	rc, err := newReconnectingClient(connect, rcfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	testTopic := "nexus.test.topic"
+	events := make(chan struct{}, 1)
+	evtHandler := func(args wamp.List, kwargs wamp.Dict, details wamp.Dict) {
+		events <- struct{}{}
+	}
+	if err = rc.Subscribe(testTopic, evtHandler, nil); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	procName := "nexus.test.proc"
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{Args: wamp.List{"pong"}}
+	}
+	if err = rc.Register(procName, handler, nil); err != nil {
+		t.Fatal("register error:", err)
+	}
+
+	// Lose the connection by closing the router, and let the client
+	// reconnect to the new router.
+	lock.Lock()
+	current = r2
+	lock.Unlock()
+	r1.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+	var c *Client
+	select {
+	case c = <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("OnReconnect not called")
+	}
+	if rc.ID() == 0 || rc.ID() != c.ID() {
+		t.Fatal("expected session ID of new client, got", rc.ID())
+	}
+
+	// Check that the subscription and registration were restored.
+	other, err := newTestClient(r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err = other.Publish(testTopic, nil, nil, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("did not get event after reconnect")
+	}
+	result, err := other.Call(context.Background(), procName, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal("call error after reconnect:", err)
+	}
+	if s, _ := wamp.AsString(result.Arguments[0]); s != "pong" {
+		t.Fatal("wrong call result:", result.Arguments)
+	}
+
+	rc.Close()
+	select {
+	case <-rc.Done():
+	default:
+		t.Fatal("expected reconnecting client done after Close")
+	}
+}
+
+func TestReconnectAfterLifetime(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	realmConfig := &router.RealmConfig{
+		URI:                wamp.URI(testRealm),
+		AnonymousAuth:      true,
+		MaxSessionLifetime: 200 * time.Millisecond,
+	}
+	r, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	reconnected := make(chan *Client, 1)
+	rcfg := ReconnectConfig{
+		MinDelay:    10 * time.Millisecond,
+		OnReconnect: func(c *Client) { reconnected <- c },
+	}
+	rc, err := newReconnectingClient(func() (*Client, error) {
+		return newTestClient(r)
+	}, rcfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	firstID := rc.ID()
+
+	// The router closes the expired session, and the client joins again.
+	select {
+	case c := <-reconnected:
+		if c.ID() == firstID {
+			t.Fatal("expected new session after lifetime expired")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect after session lifetime expired")
+	}
+}
+
 // ---- authentication test stuff ------
 
 func clientAuthFunc(c *wamp.Challenge) (string, wamp.Dict) {
@@ -42,8 +42,8 @@ func ConnectNet(routerURL string, cfg ClientConfig) (*Client, error) {
 	var p wamp.Peer
 	switch u.Scheme {
 	case "ws", "wss":
-		p, err = transport.ConnectWebsocketPeer(routerURL, cfg.Serialization,
-			cfg.TlsCfg, cfg.Dial, cfg.Logger)
+		p, err = transport.ConnectWebsocketPeerConfig(routerURL, cfg.Serialization,
+			cfg.TlsCfg, cfg.Dial, cfg.Logger, &cfg.WsCfg)
 	case "tcp":
 		p, err = transport.ConnectRawSocketPeer(u.Scheme, u.Host,
 			cfg.Serialization, cfg.Logger, cfg.RecvLimit)
@@ -0,0 +1,352 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Default delays between attempts to reconnect to the router.
+const (
+	defaultReconnectMinDelay = time.Second
+	defaultReconnectMaxDelay = time.Minute
+)
+
+// errNotConnected is returned when a ReconnectingClient is used while it is
+// not connected to the router.
+var errNotConnected = errors.New("not connected to router")
+
+// ReconnectConfig configures how a ReconnectingClient reconnects to the
+// router after losing its connection.
+type ReconnectConfig struct {
+	// Delay before the first attempt to reconnect.  The delay is doubled
+	// after each failed attempt, up to MaxDelay.  The defaults are one second
+	// and one minute.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Maximum number of consecutive failed attempts to reconnect, after
+	// which the client gives up and is done.  Zero, the default, means keep
+	// trying until the client is closed.
+	MaxAttempts int
+
+	// OnDisconnect, if set, is called when the connection to the router is
+	// lost, before trying to reconnect.
+	OnDisconnect func()
+
+	// OnReconnect, if set, is called with the new client after reconnecting,
+	// once the subscriptions and registrations are restored.  The new client
+	// has a new session ID, and new subscription and registration IDs.
+	OnReconnect func(*Client)
+}
+
+// ReconnectingClient is a client that reconnects to the router when its
+// connection is lost.  After reconnecting, it subscribes and registers again
+// for the topics and procedures it was subscribed and registered for.
+//
+// Each connection uses a new Client, returned by the Client method.
+type ReconnectingClient struct {
+	connect func() (*Client, error)
+	rcfg    ReconnectConfig
+	log     stdlog.StdLog
+
+	// Protects client, subs, and regs.
+	lock   sync.Mutex
+	client *Client
+	subs   map[string]subscription
+	regs   map[string]registration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type subscription struct {
+	handler EventHandler
+	options wamp.Dict
+}
+
+type registration struct {
+	handler InvocationHandler
+	options wamp.Dict
+}
+
+// ConnectWithReconnect creates a new client connected to a WAMP router, in
+// the same way as ConnectNet.  When the connection to the router is lost, the
+// client tries to reconnect, waiting longer after each failed attempt, as
+// configured by rcfg.
+//
+// An error is returned if the first connection cannot be made.
+func ConnectWithReconnect(routerURL string, cfg ClientConfig, rcfg ReconnectConfig) (*ReconnectingClient, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(os.Stderr, "", 0)
+	}
+	return newReconnectingClient(func() (*Client, error) {
+		return ConnectNet(routerURL, cfg)
+	}, rcfg, cfg.Logger)
+}
+
+// newReconnectingClient creates a ReconnectingClient that uses the connect
+// function to connect to the router.
+func newReconnectingClient(connect func() (*Client, error), rcfg ReconnectConfig, logger stdlog.StdLog) (*ReconnectingClient, error) {
+	if rcfg.MinDelay <= 0 {
+		rcfg.MinDelay = defaultReconnectMinDelay
+	}
+	if rcfg.MaxDelay <= 0 {
+		rcfg.MaxDelay = defaultReconnectMaxDelay
+	}
+	if rcfg.MaxDelay < rcfg.MinDelay {
+		rcfg.MaxDelay = rcfg.MinDelay
+	}
+	c, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectingClient{
+		connect: connect,
+		rcfg:    rcfg,
+		log:     logger,
+		client:  c,
+		subs:    map[string]subscription{},
+		regs:    map[string]registration{},
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go rc.monitor(c)
+	return rc, nil
+}
+
+// Client returns the client for the current connection to the router, or
+// nil if the client is not connected.
+func (rc *ReconnectingClient) Client() *Client {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.client
+}
+
+// ID returns the session ID of the current connection to the router, or zero
+// if the client is not connected.  The session ID changes each time the
+// client reconnects.
+func (rc *ReconnectingClient) ID() wamp.ID {
+	if c := rc.Client(); c != nil {
+		return c.ID()
+	}
+	return 0
+}
+
+// Done returns a channel that is closed when the client is closed, or has
+// given up trying to reconnect.
+func (rc *ReconnectingClient) Done() <-chan struct{} { return rc.done }
+
+// Subscribe subscribes the client to the topic, as Client.Subscribe does.
+// The subscription is made again each time the client reconnects.  If the
+// client is not connected, then the subscription is made when it reconnects.
+func (rc *ReconnectingClient) Subscribe(topic string, fn EventHandler, options wamp.Dict) error {
+	rc.lock.Lock()
+	rc.subs[topic] = subscription{fn, options}
+	c := rc.client
+	rc.lock.Unlock()
+	if c == nil {
+		return nil
+	}
+	err := c.Subscribe(topic, fn, options)
+	if err != nil {
+		rc.lock.Lock()
+		delete(rc.subs, topic)
+		rc.lock.Unlock()
+	}
+	return err
+}
+
+// Unsubscribe removes the subscription to the topic, so that it is not made
+// again when the client reconnects.
+func (rc *ReconnectingClient) Unsubscribe(topic string) error {
+	rc.lock.Lock()
+	delete(rc.subs, topic)
+	c := rc.client
+	rc.lock.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.Unsubscribe(topic)
+}
+
+// Register registers the procedure, as Client.Register does.  The
+// registration is made again each time the client reconnects.  If the client
+// is not connected, then the registration is made when it reconnects.
+func (rc *ReconnectingClient) Register(procedure string, fn InvocationHandler, options wamp.Dict) error {
+	rc.lock.Lock()
+	rc.regs[procedure] = registration{fn, options}
+	c := rc.client
+	rc.lock.Unlock()
+	if c == nil {
+		return nil
+	}
+	err := c.Register(procedure, fn, options)
+	if err != nil {
+		rc.lock.Lock()
+		delete(rc.regs, procedure)
+		rc.lock.Unlock()
+	}
+	return err
+}
+
+// Unregister removes the registration of the procedure, so that it is not
+// made again when the client reconnects.
+func (rc *ReconnectingClient) Unregister(procedure string) error {
+	rc.lock.Lock()
+	delete(rc.regs, procedure)
+	c := rc.client
+	rc.lock.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.Unregister(procedure)
+}
+
+// Publish publishes an event, as Client.Publish does.  An error is returned
+// if the client is not connected.
+func (rc *ReconnectingClient) Publish(topic string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
+	c := rc.Client()
+	if c == nil {
+		return errNotConnected
+	}
+	return c.Publish(topic, options, args, kwargs)
+}
+
+// Call calls a procedure, as Client.Call does.  An error is returned if the
+// client is not connected.
+func (rc *ReconnectingClient) Call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, cancelMode string) (*wamp.Result, error) {
+	c := rc.Client()
+	if c == nil {
+		return nil, errNotConnected
+	}
+	return c.Call(ctx, procedure, options, args, kwargs, cancelMode)
+}
+
+// Close stops the client from reconnecting, and closes the current
+// connection to the router.
+func (rc *ReconnectingClient) Close() error {
+	rc.closeOnce.Do(func() {
+		close(rc.closing)
+	})
+	if c := rc.Client(); c != nil {
+		c.Close()
+	}
+	<-rc.done
+	return nil
+}
+
+// monitor waits for the client's connection to be lost, and then reconnects,
+// until the ReconnectingClient is closed or gives up.
+func (rc *ReconnectingClient) monitor(c *Client) {
+	defer close(rc.done)
+	for {
+		select {
+		case <-c.Done():
+		case <-rc.closing:
+			return
+		}
+		select {
+		case <-rc.closing:
+			return
+		default:
+		}
+
+		rc.lock.Lock()
+		rc.client = nil
+		rc.lock.Unlock()
+		c.Close()
+		rc.log.Println("Lost connection to router, reconnecting")
+		if rc.rcfg.OnDisconnect != nil {
+			rc.rcfg.OnDisconnect()
+		}
+
+		if c = rc.reconnect(); c == nil {
+			return
+		}
+		rc.log.Println("Reconnected to router with session ID", c.ID())
+		if rc.rcfg.OnReconnect != nil {
+			rc.rcfg.OnReconnect(c)
+		}
+	}
+}
+
+// reconnect tries to connect to the router, doubling the delay between
+// attempts, and restores the subscriptions and registrations once connected.
+// Returns nil if the ReconnectingClient is closed, or if there have been too
+// many attempts.
+func (rc *ReconnectingClient) reconnect() *Client {
+	delay := rc.rcfg.MinDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-rc.closing:
+			return nil
+		}
+		c, err := rc.connect()
+		if err == nil {
+			if err = rc.restore(c); err == nil {
+				return c
+			}
+			c.Close()
+		}
+		rc.log.Println("Failed to reconnect to router:", err)
+		if rc.rcfg.MaxAttempts > 0 && attempt >= rc.rcfg.MaxAttempts {
+			rc.log.Println("Giving up reconnecting after", attempt, "attempts")
+			return nil
+		}
+		if delay *= 2; delay > rc.rcfg.MaxDelay {
+			delay = rc.rcfg.MaxDelay
+		}
+	}
+}
+
+// restore makes the client current, and subscribes and registers it for all
+// the topics and procedures the ReconnectingClient is subscribed and
+// registered for.
+func (rc *ReconnectingClient) restore(c *Client) error {
+	rc.lock.Lock()
+	select {
+	case <-rc.closing:
+		rc.lock.Unlock()
+		return errors.New("client closed")
+	default:
+	}
+	rc.client = c
+	subs := make(map[string]subscription, len(rc.subs))
+	for topic, sub := range rc.subs {
+		subs[topic] = sub
+	}
+	regs := make(map[string]registration, len(rc.regs))
+	for procedure, reg := range rc.regs {
+		regs[procedure] = reg
+	}
+	rc.lock.Unlock()
+
+	var err error
+	for topic, sub := range subs {
+		if err = c.Subscribe(topic, sub.handler, sub.options); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		for procedure, reg := range regs {
+			if err = c.Register(procedure, reg.handler, reg.options); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		rc.lock.Lock()
+		rc.client = nil
+		rc.lock.Unlock()
+	}
+	return err
+}
@@ -17,6 +17,10 @@ type Config struct {
 		// Files containing a certificate and matching private key.
 		CertFile string `json:"cert_file"`
 		KeyFile  string `json:"key_file"`
+		// Websocket ping interval, and time to wait for pong, in seconds.
+		// Set ping interval to 0 to disable.
+		PingInterval time.Duration `json:"ping_interval"`
+		PongTimeout  time.Duration `json:"pong_timeout"`
 	}
 
 	// RawSocket configuration parameters.
@@ -53,6 +57,8 @@ func LoadConfig(path string) *Config {
 		log.Fatal("Config Parse Error: ", err)
 	}
 
+	config.WebSocket.PingInterval *= time.Second
+	config.WebSocket.PongTimeout *= time.Second
 	if config.RawSocket.TCPKeepAliveInterval != 0 {
 		config.RawSocket.TCPKeepAliveInterval *= time.Second
 	}
@@ -59,6 +59,8 @@ func main() {
 	if conf.WebSocket.Address != "" {
 		// Create a new websocket server with the router.
 		wss := router.NewWebsocketServer(r)
+		wss.PingInterval = conf.WebSocket.PingInterval
+		wss.PongTimeout = conf.WebSocket.PongTimeout
 		var closer io.Closer
 		var sockDesc string
 		if conf.WebSocket.CertFile != "" && conf.WebSocket.KeyFile != "" {
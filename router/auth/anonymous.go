@@ -1,6 +1,10 @@
 package auth
 
-import "github.com/gammazero/nexus/wamp"
+import (
+	"strconv"
+
+	"github.com/gammazero/nexus/wamp"
+)
 
 // anonAuth implements Authenticator interface.
 type anonymousAuth struct{}
@@ -15,7 +19,7 @@ func (a *anonymousAuth) AuthMethod() string { return "anonymous" }
 func (a *anonymousAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
 	// Create welcome details containing auth info.
 	details = wamp.Dict{
-		"authid":       string(wamp.GlobalID()),
+		"authid":       strconv.FormatUint(uint64(wamp.GlobalID()), 10),
 		"authmethod":   a.AuthMethod(),
 		"authrole":     "anonymous",
 		"authprovider": "static",
@@ -4,7 +4,7 @@ WAMP router can use.
 
 In addition in authentication and challenge-response authentication interface,
 this package provides default implementations for the following authentication
-methods: "wampcra", ticket", "anonymous".
+methods: "wampcra", "cryptosign", "ticket", "cookie", "anonymous".
 
 */
 package auth
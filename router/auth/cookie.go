@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// CookieTransportDetail is the transport detail that holds the token of the
+// tracking cookie that the websocket server set for the client, if any.
+const CookieTransportDetail = "cbtid"
+
+// CookieAuth is the authentication remembered for a tracking cookie.
+type CookieAuth struct {
+	AuthID       string
+	AuthRole     string
+	AuthMethod   string
+	AuthProvider string
+	// Realm that the authentication was remembered in.  The cookie only
+	// authenticates the client in this realm.
+	Realm wamp.URI
+	// When the cookie stops authenticating the client.
+	Expires time.Time
+}
+
+// CookieStore stores the authentication remembered for each tracking cookie,
+// keyed by the cookie's random token.  It must be safe for concurrent use.
+type CookieStore interface {
+	// Get returns the authentication for the token, or false if there is
+	// none.
+	Get(token string) (CookieAuth, bool)
+	// Set stores the authentication for the token, replacing any that the
+	// token already has.
+	Set(token string, ca CookieAuth)
+	// Delete removes the authentication for the token.
+	Delete(token string)
+}
+
+// CookieAuthenticator authenticates a client by the tracking cookie that the
+// websocket server set for it, if a previous session of the client with the
+// same cookie was authenticated by another method.  This lets a returning
+// browser client join with the "cookie" authmethod, instead of giving its
+// credentials again.
+//
+// The websocket server's CookieStore must be the same store given to the
+// authenticator.  If the cookie is not valid, then the router authenticates
+// the client using the other authmethods that it offered.  A cookie only
+// authenticates the client in the realm that it was remembered in.
+type CookieAuthenticator struct {
+	store  CookieStore
+	maxAge time.Duration
+	realm  wamp.URI
+}
+
+// NewCookieAuthenticator creates a cookie authenticator that remembers the
+// authentication of each cookie in the store for maxAge.
+func NewCookieAuthenticator(store CookieStore, maxAge time.Duration) *CookieAuthenticator {
+	return &CookieAuthenticator{
+		store:  store,
+		maxAge: maxAge,
+	}
+}
+
+// ForRealm returns a cookie authenticator that uses the same store, and
+// remembers and authenticates cookies in the given realm.  The router calls
+// this for each realm that the authenticator is configured for.
+func (ca *CookieAuthenticator) ForRealm(realm wamp.URI) *CookieAuthenticator {
+	return &CookieAuthenticator{
+		store:  ca.store,
+		maxAge: ca.maxAge,
+		realm:  realm,
+	}
+}
+
+func (ca *CookieAuthenticator) AuthMethod() string { return "cookie" }
+
+// Authenticate authenticates the client as the authid and authrole that its
+// cookie was remembered for.
+func (ca *CookieAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	token := cookieToken(details)
+	if token == "" {
+		return nil, errors.New("no cookie")
+	}
+	remembered, ok := ca.store.Get(token)
+	if !ok {
+		return nil, errors.New("unknown cookie")
+	}
+	if time.Now().After(remembered.Expires) {
+		ca.store.Delete(token)
+		return nil, errors.New("expired cookie")
+	}
+	if remembered.Realm != ca.realm {
+		return nil, errors.New("cookie not valid for realm")
+	}
+
+	// Create welcome details containing auth info.
+	welcomeDetails := wamp.Dict{
+		"authid":       remembered.AuthID,
+		"authrole":     remembered.AuthRole,
+		"authmethod":   ca.AuthMethod(),
+		"authprovider": remembered.AuthProvider,
+	}
+	return &wamp.Welcome{Details: welcomeDetails}, nil
+}
+
+// Remember remembers the authentication in the WELCOME details for the
+// client's cookie, given the HELLO details of the client.  This is called by
+// the router when a client with a cookie is authenticated by another method.
+// The authentication of a cookie that is already remembered is replaced, so
+// that the cookie authenticates the client as the identity it last
+// authenticated as.
+func (ca *CookieAuthenticator) Remember(details, welcomeDetails wamp.Dict) {
+	token := cookieToken(details)
+	if token == "" {
+		return
+	}
+	ca.store.Set(token, CookieAuth{
+		AuthID:       wamp.OptionString(welcomeDetails, "authid"),
+		AuthRole:     wamp.OptionString(welcomeDetails, "authrole"),
+		AuthMethod:   wamp.OptionString(welcomeDetails, "authmethod"),
+		AuthProvider: wamp.OptionString(welcomeDetails, "authprovider"),
+		Realm:        ca.realm,
+		Expires:      time.Now().Add(ca.maxAge),
+	})
+}
+
+// cookieToken returns the token of the client's tracking cookie from the
+// transport details in the HELLO details.
+func cookieToken(details wamp.Dict) string {
+	return wamp.OptionString(wamp.DictChild(details, "transport"),
+		CookieTransportDetail)
+}
+
+// memoryCookieStore is a CookieStore that keeps cookies in memory.
+type memoryCookieStore struct {
+	lock      sync.Mutex
+	cookies   map[string]CookieAuth
+	nextPrune time.Time
+}
+
+// cookiePruneInterval is how often a memory cookie store removes expired
+// cookies.
+const cookiePruneInterval = time.Minute
+
+// NewMemoryCookieStore returns a CookieStore that keeps cookies in memory.
+// Expired cookies are removed as new ones are added.
+func NewMemoryCookieStore() CookieStore {
+	return &memoryCookieStore{cookies: map[string]CookieAuth{}}
+}
+
+func (s *memoryCookieStore) Get(token string) (CookieAuth, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ca, ok := s.cookies[token]
+	return ca, ok
+}
+
+func (s *memoryCookieStore) Set(token string, ca CookieAuth) {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.After(s.nextPrune) {
+		for t, c := range s.cookies {
+			if now.After(c.Expires) {
+				delete(s.cookies, t)
+			}
+		}
+		s.nextPrune = now.Add(cookiePruneInterval)
+	}
+	s.cookies[token] = ca
+}
+
+func (s *memoryCookieStore) Delete(token string) {
+	s.lock.Lock()
+	delete(s.cookies, token)
+	s.lock.Unlock()
+}
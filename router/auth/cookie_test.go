@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestCookieAuth(t *testing.T) {
+	store := NewMemoryCookieStore()
+	cookieAuth := NewCookieAuthenticator(store, time.Minute)
+
+	details := wamp.Dict{
+		"authmethods": []string{"cookie"},
+		"transport":   wamp.Dict{CookieTransportDetail: "abc123"},
+	}
+	if _, err := cookieAuth.Authenticate(wamp.ID(101), details, nil); err == nil {
+		t.Fatal("expected error for unknown cookie")
+	}
+
+	cookieAuth.Remember(details, wamp.Dict{
+		"authid":       "jdoe",
+		"authrole":     "user",
+		"authmethod":   "ticket",
+		"authprovider": "static",
+	})
+	welcome, err := cookieAuth.Authenticate(wamp.ID(102), details, nil)
+	if err != nil {
+		t.Fatal("authenticate failed: ", err.Error())
+	}
+	if wamp.OptionString(welcome.Details, "authmethod") != "cookie" {
+		t.Fatal("invalid authmethod in welcome details")
+	}
+	if wamp.OptionString(welcome.Details, "authid") != "jdoe" {
+		t.Fatal("incorrect authid in welcome details")
+	}
+	if wamp.OptionString(welcome.Details, "authrole") != "user" {
+		t.Fatal("incorrect authrole in welcome details")
+	}
+
+	// Reauthenticating as a different identity replaces the one remembered
+	// for the cookie.
+	cookieAuth.Remember(details, wamp.Dict{
+		"authid":       "jsmith",
+		"authrole":     "admin",
+		"authmethod":   "wampcra",
+		"authprovider": "static",
+	})
+	welcome, err = cookieAuth.Authenticate(wamp.ID(103), details, nil)
+	if err != nil {
+		t.Fatal("authenticate failed: ", err.Error())
+	}
+	if wamp.OptionString(welcome.Details, "authid") != "jsmith" {
+		t.Fatal("remembered authid was not replaced")
+	}
+	if wamp.OptionString(welcome.Details, "authrole") != "admin" {
+		t.Fatal("remembered authrole was not replaced")
+	}
+
+	// The cookie does not authenticate the client in another realm.
+	realmAuth := cookieAuth.ForRealm("realm.a")
+	realmAuth.Remember(details, wamp.Dict{"authid": "eve", "authrole": "guest"})
+	if _, err = cookieAuth.ForRealm("realm.b").Authenticate(wamp.ID(104), details, nil); err == nil {
+		t.Fatal("expected error for cookie from another realm")
+	}
+	welcome, err = realmAuth.Authenticate(wamp.ID(105), details, nil)
+	if err != nil {
+		t.Fatal("authenticate failed: ", err.Error())
+	}
+	if wamp.OptionString(welcome.Details, "authid") != "eve" {
+		t.Fatal("incorrect authid in welcome details")
+	}
+
+	// No cookie.
+	if _, err = cookieAuth.Authenticate(wamp.ID(106), wamp.Dict{}, nil); err == nil {
+		t.Fatal("expected error for missing cookie")
+	}
+
+	// Expired cookie.
+	expiring := NewCookieAuthenticator(store, -time.Second)
+	details = wamp.Dict{
+		"transport": wamp.Dict{CookieTransportDetail: "def456"},
+	}
+	expiring.Remember(details, wamp.Dict{"authid": "jdoe"})
+	if _, err = expiring.Authenticate(wamp.ID(107), details, nil); err == nil {
+		t.Fatal("expected error for expired cookie")
+	}
+	if _, ok := store.Get("def456"); ok {
+		t.Fatal("expired cookie not removed")
+	}
+}
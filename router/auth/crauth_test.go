@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/sha256"
 	"errors"
 	"testing"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/wamp"
 	"github.com/gammazero/nexus/wamp/crsign"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type testKeyStore struct {
@@ -182,3 +184,71 @@ func TestCRAuth(t *testing.T) {
 		t.Fatal("expected error with bad key")
 	}
 }
+
+func TestCRAuthSecretKeyStore(t *testing.T) {
+	const (
+		password   = "hunter2"
+		salt       = "salt123"
+		keylen     = 32
+		iterations = 1000
+	)
+	// Store the PBKDF2 derived key, not the password.
+	derivedKey := pbkdf2.Key([]byte(password), []byte(salt), iterations,
+		keylen, sha256.New)
+
+	keyStore := &SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			if authid != "jdoe" {
+				return "", errors.New("no such user: " + authid)
+			}
+			return string(derivedKey), nil
+		},
+		Salt: func(authid string) (string, int, int) {
+			return salt, keylen, iterations
+		},
+	}
+
+	cp, rp := transport.LinkedPeers()
+	defer cp.Close()
+	defer rp.Close()
+	go func() {
+		for msg := range cp.Recv() {
+			ch, ok := msg.(*wamp.Challenge)
+			if !ok {
+				continue
+			}
+			if wamp.OptionString(ch.Extra, "salt") != salt {
+				t.Error("missing salt in challenge extra")
+			}
+			if wamp.OptionInt64(ch.Extra, "keylen") != keylen {
+				t.Error("missing keylen in challenge extra")
+			}
+			if wamp.OptionInt64(ch.Extra, "iterations") != iterations {
+				t.Error("missing iterations in challenge extra")
+			}
+			cp.Send(&wamp.Authenticate{
+				Signature: crsign.RespondChallenge(password, ch, nil),
+				Extra:     wamp.Dict{},
+			})
+		}
+	}()
+
+	crAuth := NewCRAuthenticator(keyStore, time.Second)
+	details := wamp.Dict{"authid": "jdoe"}
+	welcome, err := crAuth.Authenticate(wamp.ID(212), details, rp)
+	if err != nil {
+		t.Fatal("challenge failed: ", err.Error())
+	}
+	if wamp.OptionString(welcome.Details, "authrole") != "user" {
+		t.Fatal("incorrect authrole in welcome details")
+	}
+	if wamp.OptionString(welcome.Details, "authprovider") != "static" {
+		t.Fatal("incorrect authprovider in welcome details")
+	}
+
+	// Test with wrong secret.
+	derivedKey = []byte("bad")
+	if _, err = crAuth.Authenticate(wamp.ID(213), details, rp); err == nil {
+		t.Fatal("expected error with bad secret")
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Size of the random challenge sent to the client.
+const cryptosignChallengeSize = 32
+
+// CryptoSignAuthenticator authenticates clients using Ed25519 public keys,
+// implementing the WAMP-cryptosign authmethod.
+type CryptoSignAuthenticator struct {
+	authRole func(authid, pubkey string) (string, error)
+	timeout  time.Duration
+}
+
+// NewCryptoSignAuthenticator creates a new CryptoSignAuthenticator.
+//
+// The authRole function is called with the authid and the hex-encoded public
+// key that the client declares in HELLO.Details.authextra.pubkey.  It returns
+// the authrole for a known key, or an error to reject an unknown key.  The
+// timeout is the maximum time to wait for a client to respond to a CHALLENGE
+// message.
+func NewCryptoSignAuthenticator(authRole func(authid, pubkey string) (authrole string, err error), timeout time.Duration) *CryptoSignAuthenticator {
+	return &CryptoSignAuthenticator{
+		authRole: authRole,
+		timeout:  timeout,
+	}
+}
+
+func (cs *CryptoSignAuthenticator) AuthMethod() string { return "cryptosign" }
+
+func (cs *CryptoSignAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	authid := wamp.OptionString(details, "authid")
+
+	// The client declares its public key in HELLO.Details.authextra.pubkey.
+	pubkeyHex := wamp.OptionString(wamp.DictChild(details, "authextra"),
+		"pubkey")
+	if pubkeyHex == "" {
+		return nil, errors.New("missing pubkey")
+	}
+	pubkey, err := hex.DecodeString(pubkeyHex)
+	if err != nil || len(pubkey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid pubkey")
+	}
+
+	authrole, err := cs.authRole(authid, pubkeyHex)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := make([]byte, cryptosignChallengeSize)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %s", err)
+	}
+
+	// Challenge response needed.  Send CHALLENGE message to client.
+	err = client.Send(&wamp.Challenge{
+		AuthMethod: cs.AuthMethod(),
+		Extra:      wamp.Dict{"challenge": hex.EncodeToString(challenge)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read AUTHENTICATE response from client.
+	msg, err := wamp.RecvTimeout(client, cs.timeout)
+	if err != nil {
+		return nil, err
+	}
+	authRsp, ok := msg.(*wamp.Authenticate)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %v message received from client %v",
+			msg.MessageType(), client)
+	}
+
+	// The signature is the hex-encoded Ed25519 signature of the challenge,
+	// optionally followed by the challenge itself.
+	sig, err := hex.DecodeString(authRsp.Signature)
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	switch len(sig) {
+	case ed25519.SignatureSize:
+	case ed25519.SignatureSize + cryptosignChallengeSize:
+		if subtle.ConstantTimeCompare(sig[ed25519.SignatureSize:], challenge) != 1 {
+			return nil, errors.New("invalid signature")
+		}
+		sig = sig[:ed25519.SignatureSize]
+	default:
+		return nil, errors.New("malformed signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubkey), challenge, sig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	// Create welcome details containing auth info.
+	welcomeDetails := wamp.Dict{
+		"authid":       authid,
+		"authrole":     authrole,
+		"authmethod":   cs.AuthMethod(),
+		"authprovider": "static",
+		"authextra":    wamp.Dict{"pubkey": pubkeyHex},
+	}
+
+	return &wamp.Welcome{Details: welcomeDetails}, nil
+}
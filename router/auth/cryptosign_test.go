@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// cryptosignRsp responds to each CHALLENGE using the given function to make
+// the signature from the challenge bytes.
+func cryptosignRsp(p wamp.Peer, sign func(challenge []byte) string) {
+	for msg := range p.Recv() {
+		ch, ok := msg.(*wamp.Challenge)
+		if !ok {
+			continue
+		}
+		challenge, _ := hex.DecodeString(wamp.OptionString(ch.Extra, "challenge"))
+		p.Send(&wamp.Authenticate{
+			Signature: sign(challenge),
+			Extra:     wamp.Dict{},
+		})
+	}
+}
+
+func TestCryptoSignAuth(t *testing.T) {
+	pubkey, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkeyHex := hex.EncodeToString(pubkey)
+
+	authRole := func(authid, pubkey string) (string, error) {
+		if pubkey != pubkeyHex {
+			return "", errors.New("unknown pubkey")
+		}
+		return "device", nil
+	}
+	csAuth := NewCryptoSignAuthenticator(authRole, time.Second)
+	sid := wamp.ID(212)
+
+	authenticate := func(pubkey string, sign func([]byte) string) (*wamp.Welcome, error) {
+		cp, rp := transport.LinkedPeers()
+		defer cp.Close()
+		defer rp.Close()
+		go cryptosignRsp(cp, sign)
+		details := wamp.Dict{
+			"authid":    "device-1",
+			"authextra": wamp.Dict{"pubkey": pubkey},
+		}
+		return csAuth.Authenticate(sid, details, rp)
+	}
+	goodSig := func(challenge []byte) string {
+		return hex.EncodeToString(ed25519.Sign(privkey, challenge))
+	}
+
+	// Test with missing pubkey.
+	if _, err = authenticate("", goodSig); err == nil {
+		t.Fatal("expected error with missing pubkey")
+	}
+
+	// Test with unknown pubkey.
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = authenticate(hex.EncodeToString(otherPub), goodSig); err == nil {
+		t.Fatal("expected error with unknown pubkey")
+	}
+
+	// Test with good signature.
+	welcome, err := authenticate(pubkeyHex, goodSig)
+	if err != nil {
+		t.Fatal("challenge failed: ", err.Error())
+	}
+	if welcome.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME message, got: ", welcome.MessageType())
+	}
+	if wamp.OptionString(welcome.Details, "authmethod") != "cryptosign" {
+		t.Fatal("invalid authmethod in welcome details")
+	}
+	if wamp.OptionString(welcome.Details, "authrole") != "device" {
+		t.Fatal("incorrect authrole in welcome details")
+	}
+
+	// Test with signature followed by challenge.
+	_, err = authenticate(pubkeyHex, func(challenge []byte) string {
+		sig := ed25519.Sign(privkey, challenge)
+		return hex.EncodeToString(append(sig, challenge...))
+	})
+	if err != nil {
+		t.Fatal("challenge failed: ", err.Error())
+	}
+
+	// Test with signature made by a different key.
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	_, err = authenticate(pubkeyHex, func(challenge []byte) string {
+		return hex.EncodeToString(ed25519.Sign(otherPriv, challenge))
+	})
+	if err == nil {
+		t.Fatal("expected error with bad signature")
+	}
+
+	// Test with malformed signatures.
+	_, err = authenticate(pubkeyHex, func(challenge []byte) string {
+		return "not-hex"
+	})
+	if err == nil {
+		t.Fatal("expected error with non-hex signature")
+	}
+	_, err = authenticate(pubkeyHex, func(challenge []byte) string {
+		return hex.EncodeToString(ed25519.Sign(privkey, challenge)[:10])
+	})
+	if err == nil {
+		t.Fatal("expected error with short signature")
+	}
+}
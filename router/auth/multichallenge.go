@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// DefaultMaxChallenges is the number of CHALLENGE messages that
+// ExchangeChallenges sends a client, if not given a limit.
+const DefaultMaxChallenges = 5
+
+// MultiChallengeAuthenticator is an Authenticator that may send a client more
+// than one CHALLENGE, such as one for a password followed by one for a
+// one-time code.  Instead of calling Authenticate, the router gets the
+// Challenges for the client and exchanges the CHALLENGE and AUTHENTICATE
+// messages with the client, up to the realm's limit of challenges.
+type MultiChallengeAuthenticator interface {
+	Authenticator
+
+	// Challenges starts authenticating the client that sent the HELLO
+	// details.
+	Challenges(sid wamp.ID, details wamp.Dict) (Challenges, error)
+}
+
+// Challenges is the authentication of a single client by a
+// MultiChallengeAuthenticator.
+type Challenges interface {
+	// Next is given the client's AUTHENTICATE response to the last
+	// CHALLENGE, or nil before the first CHALLENGE is sent.  It returns
+	// either the next CHALLENGE to send to the client, or the WELCOME once
+	// the client is authenticated.  An error fails the authentication.
+	Next(rsp *wamp.Authenticate) (*wamp.Challenge, *wamp.Welcome, error)
+}
+
+// ExchangeChallenges authenticates a client by sending it each CHALLENGE
+// returned by challenges, and giving the client's AUTHENTICATE response back
+// to challenges, until challenges returns a WELCOME or an error.
+//
+// An error is returned if the client does not respond to a CHALLENGE within
+// the timeout, or if challenges asks to send more than maxChallenges CHALLENGE
+// messages.  A timeout of zero or less means no time limit, and maxChallenges
+// of zero or less means DefaultMaxChallenges.  A MultiChallengeAuthenticator
+// can use this to implement Authenticate.
+func ExchangeChallenges(challenges Challenges, client wamp.Peer, timeout time.Duration, maxChallenges int) (*wamp.Welcome, error) {
+	if maxChallenges <= 0 {
+		maxChallenges = DefaultMaxChallenges
+	}
+	var rsp *wamp.Authenticate
+	for sent := 0; ; sent++ {
+		challenge, welcome, err := challenges.Next(rsp)
+		if err != nil {
+			return nil, err
+		}
+		if welcome != nil {
+			return welcome, nil
+		}
+		if challenge == nil {
+			return nil, errors.New("authenticator returned no challenge")
+		}
+		if sent == maxChallenges {
+			return nil, fmt.Errorf("more than %d authentication challenges",
+				maxChallenges)
+		}
+		if err = client.Send(challenge); err != nil {
+			return nil, err
+		}
+
+		// Read AUTHENTICATE response from client.
+		var msg wamp.Message
+		if timeout > 0 {
+			if msg, err = wamp.RecvTimeout(client, timeout); err != nil {
+				return nil, err
+			}
+		} else {
+			var open bool
+			if msg, open = <-client.Recv(); !open {
+				return nil, errors.New("receive channel closed")
+			}
+		}
+		var ok bool
+		if rsp, ok = msg.(*wamp.Authenticate); !ok {
+			return nil, fmt.Errorf("unexpected %v message received from client %v",
+				msg.MessageType(), client)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// endlessChallenges challenges a client forever.
+type endlessChallenges struct{ responses int }
+
+func (c *endlessChallenges) Next(rsp *wamp.Authenticate) (*wamp.Challenge, *wamp.Welcome, error) {
+	if rsp != nil {
+		c.responses++
+	}
+	return &wamp.Challenge{AuthMethod: "endless", Extra: wamp.Dict{}}, nil, nil
+}
+
+func TestExchangeChallenges(t *testing.T) {
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go func(client wamp.Peer) {
+		for msg := range client.Recv() {
+			if _, ok := msg.(*wamp.Challenge); ok {
+				client.Send(&wamp.Authenticate{Extra: wamp.Dict{}})
+			}
+		}
+	}(client)
+
+	challenges := &endlessChallenges{}
+	if _, err := ExchangeChallenges(challenges, server, time.Second, 3); err == nil {
+		t.Fatal("expected error after too many challenges")
+	}
+	if challenges.responses != 3 {
+		t.Fatal("expected 3 responses, got", challenges.responses)
+	}
+	server.Close()
+
+	// Client that does not respond.
+	client, server = transport.LinkedPeers()
+	defer client.Close()
+	defer server.Close()
+	_, err := ExchangeChallenges(&endlessChallenges{}, server, 10*time.Millisecond, 0)
+	if err == nil {
+		t.Fatal("expected error when client does not respond")
+	}
+}
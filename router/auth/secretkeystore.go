@@ -0,0 +1,64 @@
+package auth
+
+import "errors"
+
+// SecretKeyStore is a KeyStore that looks up user information using callback
+// functions.  This allows a CRAuthenticator to be backed by any credential
+// store, without having to implement the entire KeyStore interface.
+type SecretKeyStore struct {
+	// Secret returns the secret used to sign the WAMP-CRA challenge for the
+	// user.  If the secret is a key derived using PBKDF2, then Salt must also
+	// be set.  This is required.
+	Secret func(authid string) (secret string, err error)
+
+	// Salt returns the PBKDF2 parameters used to derive the user's secret.
+	// These are sent to the client in the CHALLENGE extra.  If nil, the
+	// secret is not salted.
+	Salt func(authid string) (salt string, keylen, iterations int)
+
+	// Role returns the authrole for the user.  If nil, the authrole is "user".
+	Role func(authid string) (string, error)
+
+	// Name is returned as the authprovider.  If empty, "static" is used.
+	Name string
+}
+
+// AuthKey returns the user's secret, looked up using the Secret function.
+func (ks *SecretKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if ks.Secret == nil {
+		return nil, errors.New("no secret lookup function")
+	}
+	secret, err := ks.Secret(authid)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(secret), nil
+}
+
+// PasswordInfo returns the salt, key length, and iterations used to derive
+// the user's secret, looked up using the Salt function.  If Salt is nil, then
+// the secret is not salted and empty values are returned.
+func (ks *SecretKeyStore) PasswordInfo(authid string) (string, int, int) {
+	if ks.Salt == nil {
+		return "", 0, 0
+	}
+	return ks.Salt(authid)
+}
+
+// AuthRole returns the user's authrole, looked up using the Role function.
+// If Role is nil, then "user" is returned.
+func (ks *SecretKeyStore) AuthRole(authid string) (string, error) {
+	if ks.Role == nil {
+		return "user", nil
+	}
+	return ks.Role(authid)
+}
+
+// Provider returns the name of the key store, which is Name or "static" if
+// Name is empty.
+func (ks *SecretKeyStore) Provider() string {
+	if ks.Name == "" {
+		return "static"
+	}
+	return ks.Name
+}
@@ -29,3 +29,42 @@ func NewAuthorizer() Authorizer {
 func (a *authorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
 	return true, nil
 }
+
+// catchAllAuthorizer only authorizes catch-all subscriptions for sessions
+// that have one of the allowed authroles.  All other messages are authorized
+// by the wrapped Authorizer.
+type catchAllAuthorizer struct {
+	Authorizer
+	roles map[string]struct{}
+}
+
+// newCatchAllAuthorizer returns an Authorizer that only allows sessions with
+// the given authroles to make catch-all subscriptions, and otherwise defers to
+// the given Authorizer.
+func newCatchAllAuthorizer(authz Authorizer, roles []string) Authorizer {
+	roleSet := make(map[string]struct{}, len(roles))
+	for _, role := range roles {
+		roleSet[role] = struct{}{}
+	}
+	return &catchAllAuthorizer{
+		Authorizer: authz,
+		roles:      roleSet,
+	}
+}
+
+func (a *catchAllAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if sub, ok := msg.(*wamp.Subscribe); ok && isCatchAll(sub) {
+		authrole := wamp.OptionString(sess.Details, "authrole")
+		if _, ok = a.roles[authrole]; !ok {
+			return false, nil
+		}
+	}
+	return a.Authorizer.Authorize(sess, msg)
+}
+
+// isCatchAll returns true if the subscription matches every topic, which is
+// a prefix subscription to the empty URI.
+func isCatchAll(msg *wamp.Subscribe) bool {
+	return msg.Topic == "" &&
+		wamp.OptionString(msg.Options, wamp.OptMatch) == wamp.MatchPrefix
+}
@@ -1,7 +1,13 @@
 package router
 
 import (
+	"container/list"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/wamp"
@@ -16,8 +22,13 @@ const (
 	featurePubExclusion         = "publisher_exclusion"
 	featurePubIdent             = "publisher_identification"
 	featureSubMetaAPI           = "subscription_meta_api"
+	featurePayloadPassthru      = "payload_passthru_mode"
+	featureSubRevocation        = "subscription_revocation"
 
-	detailTopic = "topic"
+	detailRetained        = "retained"
+	detailSubscriberCount = "count"
+	detailTopic           = "topic"
+	detailTopicSuffix     = "topic_suffix"
 )
 
 // Role information for this broker.
@@ -28,9 +39,19 @@ var brokerRole = wamp.Dict{
 		featurePubExclusion:         true,
 		featurePubIdent:             true,
 		featureSubMetaAPI:           true,
+		featurePayloadPassthru:      true,
+		featureSubRevocation:        true,
 	},
 }
 
+// Broker routes publications to the subscribers of their topics.
+//
+// Publications are dispatched one at a time by the broker's goroutine, in the
+// order that Publish is called.  So, each subscriber receives the EVENTs for a
+// subscription in the order the publications were made.  This includes EVENTs
+// held for a blocked subscriber while sending is retried, which are delivered
+// before any later EVENTs for that subscriber.  Publications from different
+// publishers are ordered by when the broker receives them.
 type Broker struct {
 	// topic URI -> {subscription ID -> subscribed Session}
 	topicSubscribers    map[wamp.URI]map[wamp.ID]*wamp.Session
@@ -45,13 +66,84 @@ type Broker struct {
 	// Session -> subscription ID set
 	sessionSubIDSet map[*wamp.Session]map[wamp.ID]struct{}
 
+	// Sessions that have left the realm, but are not yet removed from their
+	// subscriptions.  These are not counted as subscribers.
+	departed map[*wamp.Session]struct{}
+
+	// Session -> IDs of subscriptions revoked by the router, which the
+	// session may still try to unsubscribe from.
+	revoked map[*wamp.Session]map[wamp.ID]struct{}
+
+	// IDs of prefix subscriptions that requested the topic suffix in events.
+	topicSuffixSubs map[wamp.ID]struct{}
+
+	// subscription ID -> when subscription was created
+	subCreated map[wamp.ID]string
+
+	// subscription ID -> description of the topic, from the describe option
+	// of the SUBSCRIBE
+	subDescribe map[wamp.ID]interface{}
+
+	// Recent events for each subscription, if eventHistorySize is not zero.
+	history          map[subscriptionKey]*eventHistory
+	eventHistorySize int
+
 	actionChan chan func()
+	// Closed when the broker's goroutine has exited.
+	stopped chan struct{}
 
 	// Generate subscription IDs.
 	idGen *wamp.IDGen
+	// Generate publication IDs.
+	reqIDGen wamp.IDGenerator
 
 	strictURI     bool
 	allowDisclose bool
+	// Disclose the publisher of every event, whether or not requested.
+	requireDisclose bool
+
+	// Role information advertised in WELCOME, and the features disabled by
+	// SetFeatures.
+	role     wamp.Dict
+	disabled map[string]bool
+
+	// Maximum number of subscribers per topic.  Zero means no limit.
+	maxTopicSubscribers int
+	// Maximum number of subscriptions per session.  Zero means no limit.
+	maxSessionSubs int
+	// Authroles not limited by maxSessionSubs or disabled features.
+	exemptRoles roleSet
+
+	// Log publications that take longer than this to dispatch.
+	slowDispatch time.Duration
+
+	// Retry sending an EVENT to a blocked subscriber, and what to do with a
+	// subscriber that cannot be sent an EVENT.
+	eventRetries    int
+	eventRetryDelay time.Duration
+	eventDropped    func(*wamp.Session)
+
+	// Subscriber -> EVENTs waiting to be retried.
+	retrying map[*wamp.Session]*eventRetry
+
+	// Latest retained event for each topic, as a *retainedEvent in
+	// retainedOrder, which is ordered from least to most recently retained.
+	retained      map[wamp.URI]*list.Element
+	retainedOrder *list.List
+	// Maximum number of topics with a retained event.  Zero means events are
+	// not retained.
+	maxRetained int
+
+	// Prevents event retries from submitting actions after broker is closed.
+	closed    bool
+	closeLock sync.RWMutex
+
+	// Statistics, updated atomically.
+	stats *brokerStats
+
+	// Notified of publication dispatch times, if not nil.
+	metrics      MetricsRecorder
+	metricsRealm wamp.URI
 
 	log   stdlog.StdLog
 	debug bool
@@ -72,16 +164,30 @@ func NewBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *Brok
 		wcSubscriptions:  map[wamp.ID]wamp.URI{},
 
 		sessionSubIDSet: map[*wamp.Session]map[wamp.ID]struct{}{},
+		departed:        map[*wamp.Session]struct{}{},
+		revoked:         map[*wamp.Session]map[wamp.ID]struct{}{},
+		topicSuffixSubs: map[wamp.ID]struct{}{},
+		subCreated:      map[wamp.ID]string{},
+		subDescribe:     map[wamp.ID]interface{}{},
+		history:         map[subscriptionKey]*eventHistory{},
+		retrying:        map[*wamp.Session]*eventRetry{},
+		retained:        map[wamp.URI]*list.Element{},
+		retainedOrder:   list.New(),
 
 		// The action handler should be nearly always runable, since it is the
 		// critical section that does the only routing.  So, and unbuffered
 		// channel is appropriate.
 		actionChan: make(chan func()),
+		stopped:    make(chan struct{}),
 
-		idGen: wamp.NewIDGen(),
+		idGen:    wamp.NewIDGen(),
+		reqIDGen: wamp.RandomIDGen{},
 
 		strictURI:     strictURI,
 		allowDisclose: allowDisclose,
+		role:          brokerRole,
+
+		stats: &brokerStats{},
 
 		log:   logger,
 		debug: debug,
@@ -90,10 +196,144 @@ func NewBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *Brok
 	return b
 }
 
+// SetMaxTopicSubscribers sets the maximum number of sessions that may
+// subscribe to any one topic.  A SUBSCRIBE that would exceed this limit is
+// answered with a wamp.error.not_authorized ERROR.  Subscriptions by prefix
+// and wildcard match are each limited separately for their topic pattern.  A
+// value of 0, the default, means no limit.
+func (b *Broker) SetMaxTopicSubscribers(max int) {
+	b.actionChan <- func() {
+		b.maxTopicSubscribers = max
+	}
+}
+
+// SetMaxSessionSubscriptions sets the maximum number of subscriptions that
+// each session may have.  A SUBSCRIBE that would exceed this limit is
+// answered with a wamp.error.not_authorized ERROR.  Sessions internal to the
+// router, and sessions with an authrole given to SetExemptRoles, are not
+// limited.  A value of 0, the default, means no limit.
+func (b *Broker) SetMaxSessionSubscriptions(max int) {
+	b.actionChan <- func() {
+		b.maxSessionSubs = max
+	}
+}
+
+// SetExemptRoles sets the authroles of sessions that are not limited by
+// SetMaxSessionSubscriptions, and that may use the features disabled by
+// SetFeatures.  Sessions internal to the router, such as the
+// meta session, are always exempt.  Roles are checked outside of the broker's
+// goroutine, so this must be called before the broker is used.
+func (b *Broker) SetExemptRoles(roles []string) {
+	b.exemptRoles = newRoleSet(roles)
+}
+
+// SetMaxRetainedEvents sets the maximum number of topics for which the
+// broker keeps a retained event.  A PUBLISH with the retain option replaces
+// the retained event for its topic, and a SUBSCRIBE with the get_retained
+// option is sent the retained events for the topics it matches.  When the
+// limit is reached, the event for the topic retained longest ago is
+// discarded.  A value of 0, the default, means events are not retained.
+func (b *Broker) SetMaxRetainedEvents(max int) {
+	b.actionChan <- func() {
+		b.maxRetained = max
+		for b.retainedOrder.Len() > max {
+			b.discardRetained(b.retainedOrder.Front())
+		}
+	}
+}
+
+// SetEventHistorySize sets the number of recent events kept for each
+// subscription, which are retrieved using the wamp.subscription.get_events
+// meta procedure.  Once a subscription's history is full, its oldest event is
+// discarded for each new event.  A value of 0, the default, means no history
+// is kept.
+func (b *Broker) SetEventHistorySize(size int) {
+	b.actionChan <- func() {
+		b.eventHistorySize = size
+	}
+}
+
+// SetSlowDispatchThreshold sets the amount of time that dispatching a
+// publication to all its subscribers may take before a warning is logged.  A
+// value of 0, the default, disables logging of slow dispatch.
+func (b *Broker) SetSlowDispatchThreshold(threshold time.Duration) {
+	b.actionChan <- func() {
+		b.slowDispatch = threshold
+	}
+}
+
+// SetEventRetries sets the number of times to retry sending an EVENT to a
+// subscriber that is temporarily blocked, and the delay before the first
+// retry.  The delay doubles for each subsequent retry.  Retries are made by
+// timers, so the broker keeps routing other messages while waiting to retry.
+// Later EVENTs for the same subscriber are held until the blocked EVENT is
+// sent, so that they are delivered in order.  Errors other than
+// wamp.ErrBlocked are not retried.  A value of 0, the default, means no
+// retries.
+func (b *Broker) SetEventRetries(retries int, delay time.Duration) {
+	b.actionChan <- func() {
+		b.eventRetries = retries
+		b.eventRetryDelay = delay
+	}
+}
+
+// SetRequestIDGenerator sets the generator of publication IDs.  The default
+// generates random IDs.  Publication IDs are generated outside of the
+// broker's goroutine, so this must be called before the broker is used.
+func (b *Broker) SetRequestIDGenerator(gen wamp.IDGenerator) {
+	b.reqIDGen = gen
+}
+
+// SetRequireDisclosure sets whether the identity of the publisher is disclosed
+// in every EVENT, even if the publisher did not request disclosure, and to
+// subscribers that do not announce the publisher_identification feature.
+// Publishers cannot opt out.  Disclosure is decided outside of the broker's
+// goroutine, so this must be called before the broker is used.
+func (b *Broker) SetRequireDisclosure(require bool) {
+	b.requireDisclose = require
+}
+
+// SetFeatures disables the broker features that are false in features.  A
+// disabled feature is not advertised in the broker role, and a SUBSCRIBE or
+// PUBLISH that uses it is answered with a wamp.error.option_not_allowed
+// ERROR, unless it is from a session exempted by SetExemptRoles.  An error is
+// returned if features names a feature the broker does not have.  Requests are
+// checked outside of the broker's goroutine, so this must be called before the
+// broker is used.
+func (b *Broker) SetFeatures(features map[string]bool) error {
+	role, disabled, err := roleFeatures(brokerRole, features)
+	if err != nil {
+		return err
+	}
+	b.role = role
+	b.disabled = disabled
+	return nil
+}
+
+// SetEventDropHandler sets a function that is called with the subscriber
+// session when an EVENT could not be sent to that subscriber, after any
+// retries.  The function is called from the broker's goroutine, so it must
+// not block or call the broker.
+func (b *Broker) SetEventDropHandler(f func(*wamp.Session)) {
+	b.actionChan <- func() {
+		b.eventDropped = f
+	}
+}
+
+// SetMetricsRecorder sets the MetricsRecorder that is given the time taken to
+// dispatch each publication, for the named realm.  A nil recorder, the
+// default, disables recording.
+func (b *Broker) SetMetricsRecorder(realm wamp.URI, metrics MetricsRecorder) {
+	b.actionChan <- func() {
+		b.metrics = metrics
+		b.metricsRealm = realm
+	}
+}
+
 // Role returns the role information for the "broker" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (b *Broker) Role() wamp.Dict {
-	return brokerRole
+	return b.role
 }
 
 // Publish finds all subscriptions for the topic being published to, including
@@ -109,6 +349,7 @@ func (b *Broker) Publish(pub *wamp.Session, msg *wamp.Publish) {
 	if pub == nil || msg == nil {
 		panic("broker.Publish with nil session or message")
 	}
+	atomic.AddUint64(&b.stats.routed, 1)
 	// Validate URI.  For PUBLISH, must be valid URI (either strict or loose),
 	// and all URI components must be non-empty.
 	if !msg.Topic.ValidURI(b.strictURI, "") {
@@ -127,6 +368,29 @@ func (b *Broker) Publish(pub *wamp.Session, msg *wamp.Publish) {
 		return
 	}
 
+	if feature := b.disabledPubFeature(pub, msg); feature != "" {
+		if pubAck, _ := msg.Options[wamp.OptAcknowledge].(bool); pubAck {
+			b.trySend(pub, featureNotAllowed(msg, msg.Request, feature))
+		}
+		return
+	}
+
+	// A publication in payload passthru mode must have a valid scheme and a
+	// single binary argument, which is relayed without being decoded.
+	ppt, err := newPPTPayload(msg)
+	if err != nil {
+		if pubAck, _ := msg.Options[wamp.OptAcknowledge].(bool); !pubAck {
+			return
+		}
+		b.trySend(pub, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{err.Error()},
+		})
+		return
+	}
+
 	excludePub := true
 	if exclude, ok := msg.Options[wamp.OptExcludeMe].(bool); ok {
 		excludePub = exclude
@@ -134,11 +398,11 @@ func (b *Broker) Publish(pub *wamp.Session, msg *wamp.Publish) {
 
 	// A Broker may also (automatically) disclose the identity of a
 	// publisher even without the publisher having explicitly requested to
-	// do so when the Broker configuration (for the publication topic) is
-	// set up to do so.  TODO: Currently no broker config for this.
-	var disclose bool
-	if wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) {
+	// do so when the Broker configuration is set up to do so.
+	disclose := b.requireDisclose
+	if !disclose && wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) {
 		// Broker MAY deny a publisher's request to disclose its identity.
+		// The publication is not delivered if disclosure is denied.
 		if !b.allowDisclose {
 			b.trySend(pub, &wamp.Error{
 				Type:    msg.MessageType(),
@@ -146,16 +410,32 @@ func (b *Broker) Publish(pub *wamp.Session, msg *wamp.Publish) {
 				Details: wamp.Dict{},
 				Error:   wamp.ErrOptionDisallowedDiscloseMe,
 			})
+			return
 		}
 		disclose = true
 	}
-	pubID := wamp.GlobalID()
 
-	// Get blacklists and whitelists, if any, from publish message.
-	filter := newPublishFilter(msg)
+	// Get blacklists and whitelists, if any, from publish message.  A
+	// publication with malformed lists is not delivered, since it is not
+	// known which subscribers it is meant for.
+	filter, err := newPublishFilter(msg)
+	if err != nil {
+		if pubAck, _ := msg.Options[wamp.OptAcknowledge].(bool); pubAck {
+			b.trySend(pub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{err.Error()},
+			})
+		}
+		return
+	}
+	pubID := b.reqIDGen.Next()
 
+	atomic.AddUint64(&b.stats.publications, 1)
 	b.actionChan <- func() {
-		b.publish(pub, msg, pubID, excludePub, disclose, filter)
+		b.publish(pub, msg, pubID, excludePub, disclose, filter, ppt)
 	}
 
 	// Send Published message if acknowledge is present and true.
@@ -178,6 +458,7 @@ func (b *Broker) Subscribe(sub *wamp.Session, msg *wamp.Subscribe) {
 	if sub == nil || msg == nil {
 		panic("broker.Subscribe with nil session or message")
 	}
+	atomic.AddUint64(&b.stats.routed, 1)
 	// Validate topic URI.  For SUBSCRIBE, must be valid URI (either strict or
 	// loose), and all URI components must be non-empty for normal
 	// subscriptions, may be empty for wildcard subscriptions and must be
@@ -195,17 +476,51 @@ func (b *Broker) Subscribe(sub *wamp.Session, msg *wamp.Subscribe) {
 		})
 		return
 	}
+	if match != "" && match != wamp.MatchExact && b.disabled[featurePatternSub] &&
+		!b.exemptRoles.exempt(sub) {
+		b.trySend(sub, featureNotAllowed(msg, msg.Request, featurePatternSub))
+		return
+	}
 
 	b.actionChan <- func() {
 		b.subscribe(sub, msg, match)
 	}
 }
 
+// disabledPubFeature returns the disabled feature, if any, used by the options
+// of a PUBLISH from a session that is not exempt.
+func (b *Broker) disabledPubFeature(pub *wamp.Session, msg *wamp.Publish) string {
+	if len(b.disabled) == 0 || b.exemptRoles.exempt(pub) {
+		return ""
+	}
+	for opt := range msg.Options {
+		var feature string
+		switch {
+		case opt == wamp.OptExcludeMe:
+			feature = featurePubExclusion
+		case opt == wamp.OptDiscloseMe:
+			feature = featurePubIdent
+		case strings.HasPrefix(opt, "ppt_"):
+			feature = featurePayloadPassthru
+		case strings.HasPrefix(opt, wamp.BlacklistKey),
+			strings.HasPrefix(opt, wamp.WhitelistKey):
+			feature = featureSubBlackWhiteListing
+		default:
+			continue
+		}
+		if b.disabled[feature] {
+			return feature
+		}
+	}
+	return ""
+}
+
 // Unsubscribe removes the requested subscription.
 func (b *Broker) Unsubscribe(sub *wamp.Session, msg *wamp.Unsubscribe) {
 	if sub == nil || msg == nil {
 		panic("broker.Unsubscribe with nil session or message")
 	}
+	atomic.AddUint64(&b.stats.routed, 1)
 	b.actionChan <- func() {
 		b.unsubscribe(sub, msg)
 	}
@@ -224,12 +539,23 @@ func (b *Broker) RemoveSession(sess *wamp.Session) {
 	}
 }
 
-// Close stops the broker, letting already queued actions finish.
+// Close stops the broker, letting already queued actions finish, and waits
+// for the broker's goroutine to exit.  Any pending event retries are stopped.
 func (b *Broker) Close() {
+	b.closeLock.Lock()
+	defer b.closeLock.Unlock()
+	b.actionChan <- func() {
+		for _, r := range b.retrying {
+			r.timer.Stop()
+		}
+	}
+	b.closed = true
 	close(b.actionChan)
+	<-b.stopped
 }
 
 func (b *Broker) run() {
+	defer close(b.stopped)
 	for action := range b.actionChan {
 		action()
 	}
@@ -238,56 +564,73 @@ func (b *Broker) run() {
 	}
 }
 
-func (b *Broker) publish(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter *publishFilter) {
+func (b *Broker) publish(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter *publishFilter, ppt *pptPayload) {
+	var subCount int
+	if b.slowDispatch > 0 || b.metrics != nil {
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			if b.metrics != nil {
+				b.metrics.Published(b.metricsRealm, elapsed)
+			}
+			if b.slowDispatch > 0 && elapsed > b.slowDispatch {
+				b.log.Printf("!!! Slow dispatch of publication to %v: %d "+
+					"subscribers took %v", msg.Topic, subCount, elapsed)
+			}
+		}()
+	}
+
 	// Publish to subscribers with exact match.
-	subs := b.topicSubscribers[msg.Topic]
-	b.pubEvent(pub, msg, pubID, subs, excludePub, false, disclose, filter)
+	subs, ok := b.topicSubscribers[msg.Topic]
+	if ok {
+		b.pubEvent(pub, msg, pubID, subs, excludePub, false, disclose, filter, ppt)
+		b.recordEvent(subscriptionKey{msg.Topic, wamp.MatchExact}, msg, pubID)
+		subCount += len(subs)
+	}
 
 	// Publish to subscribers with prefix match.
 	for pfxTopic, subs := range b.pfxTopicSubscribers {
 		if msg.Topic.PrefixMatch(pfxTopic) {
-			b.pubEvent(pub, msg, pubID, subs, excludePub, true, disclose, filter)
+			b.pubEvent(pub, msg, pubID, subs, excludePub, true, disclose, filter, ppt)
+			b.recordEvent(subscriptionKey{pfxTopic, wamp.MatchPrefix}, msg, pubID)
+			subCount += len(subs)
 		}
 	}
 
 	// Publish to subscribers with wildcard match.
 	for wcTopic, subs := range b.wcTopicSubscribers {
 		if msg.Topic.WildcardMatch(wcTopic) {
-			b.pubEvent(pub, msg, pubID, subs, excludePub, true, disclose, filter)
+			b.pubEvent(pub, msg, pubID, subs, excludePub, true, disclose, filter, ppt)
+			b.recordEvent(subscriptionKey{wcTopic, wamp.MatchWildcard}, msg, pubID)
+			subCount += len(subs)
 		}
 	}
+
+	if wamp.OptionFlag(msg.Options, wamp.OptRetain) {
+		b.retainEvent(pub, msg, pubID, disclose, filter, ppt)
+	}
 }
 
 func (b *Broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe, match string) {
-	var idSub map[wamp.ID]*wamp.Session
+	var topicSubscribers map[wamp.URI]map[wamp.ID]*wamp.Session
 	var subscriptions map[wamp.ID]wamp.URI
-	var ok bool
 	switch match {
 	case wamp.MatchPrefix:
 		// Subscribe to any topic that matches by the given prefix URI
-		idSub, ok = b.pfxTopicSubscribers[msg.Topic]
-		if !ok {
-			idSub = map[wamp.ID]*wamp.Session{}
-			b.pfxTopicSubscribers[msg.Topic] = idSub
-		}
+		topicSubscribers = b.pfxTopicSubscribers
 		subscriptions = b.pfxSubscriptions
 	case wamp.MatchWildcard:
 		// Subscribe to any topic that matches by the given wildcard URI.
-		idSub, ok = b.wcTopicSubscribers[msg.Topic]
-		if !ok {
-			idSub = map[wamp.ID]*wamp.Session{}
-			b.wcTopicSubscribers[msg.Topic] = idSub
-		}
+		topicSubscribers = b.wcTopicSubscribers
 		subscriptions = b.wcSubscriptions
 	default:
 		// Subscribe to the topic that exactly matches the given URI.
-		idSub, ok = b.topicSubscribers[msg.Topic]
-		if !ok {
-			idSub = map[wamp.ID]*wamp.Session{}
-			b.topicSubscribers[msg.Topic] = idSub
-		}
+		topicSubscribers = b.topicSubscribers
 		subscriptions = b.subscriptions
 	}
+	// The subscriber map for a new topic is only added once the subscription
+	// is allowed, so that a rejected SUBSCRIBE leaves no empty topic behind.
+	idSub, ok := topicSubscribers[msg.Topic]
 
 	// If the topic already has subscribers, then see if the session requesting
 	// a subscription is already subscribed to the topic.
@@ -306,10 +649,61 @@ func (b *Broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe, match string)
 		}
 	}
 
+	// Do not allow a session to have more than the maximum number of
+	// subscriptions.
+	if b.maxSessionSubs > 0 && len(b.sessionSubIDSet[sub]) >= b.maxSessionSubs &&
+		!b.exemptRoles.exempt(sub) {
+		b.log.Println("SUBSCRIBE to", msg.Topic, "from", sub,
+			"exceeds maximum subscriptions for session")
+		errMsg := fmt.Sprintf("session has maximum number of subscriptions (%d)",
+			b.maxSessionSubs)
+		b.trySend(sub, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: errorDetails(b.debug, wamp.Dict{
+				"cause":       "maximum subscriptions for session",
+				wamp.OptMatch: match,
+			}),
+			Error:     wamp.ErrNotAuthorized,
+			Arguments: wamp.List{errMsg},
+		})
+		return
+	}
+
+	// Do not allow a hot topic to collect more than the maximum number of
+	// subscribers.
+	if b.maxTopicSubscribers > 0 && len(idSub) >= b.maxTopicSubscribers {
+		b.log.Println("SUBSCRIBE to", msg.Topic, "from", sub,
+			"exceeds maximum subscribers for topic")
+		errMsg := fmt.Sprintf("topic %v has maximum number of subscribers (%d)",
+			msg.Topic, b.maxTopicSubscribers)
+		b.trySend(sub, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: errorDetails(b.debug, wamp.Dict{
+				"cause":       "maximum subscribers for topic",
+				wamp.OptMatch: match,
+			}),
+			Error:     wamp.ErrNotAuthorized,
+			Arguments: wamp.List{errMsg},
+		})
+		return
+	}
+
 	// Create a new subscription.
+	if !ok {
+		idSub = map[wamp.ID]*wamp.Session{}
+		topicSubscribers[msg.Topic] = idSub
+	}
 	id := b.idGen.Next()
 	subscriptions[id] = msg.Topic
 	idSub[id] = sub
+	atomic.AddInt64(&b.stats.subscriptions, 1)
+	created := wamp.NowISO8601()
+	b.subCreated[id] = created
+	if describe, ok := msg.Options[wamp.OptDescribe]; ok {
+		b.subDescribe[id] = describe
+	}
 
 	idSet, ok := b.sessionSubIDSet[sub]
 	if !ok {
@@ -318,86 +712,179 @@ func (b *Broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe, match string)
 	}
 	idSet[id] = struct{}{}
 
+	// A prefix subscriber may ask for the part of the topic beyond the prefix
+	// to be included in event details.
+	if match == wamp.MatchPrefix && wamp.OptionFlag(msg.Options, wamp.OptTopicSuffix) {
+		b.topicSuffixSubs[id] = struct{}{}
+	}
+
 	// Tell sender the new subscription ID.
 	b.trySend(sub, &wamp.Subscribed{Request: msg.Request, Subscription: id})
 
 	if newSub {
-		b.pubSubCreateMeta(msg.Topic, sub.ID, id, match)
+		b.pubSubCreateMeta(msg.Topic, sub.ID, id, match, created)
 	}
 
 	// Publish WAMP on_subscribe meta event.
-	b.pubSubMeta(wamp.MetaEventSubOnSubscribe, sub.ID, id)
+	b.pubSubMeta(wamp.MetaEventSubOnSubscribe, sub.ID, id, b.countLive(idSub))
+
+	if wamp.OptionFlag(msg.Options, wamp.OptGetRetained) {
+		b.sendRetained(sub, id, msg.Topic, match)
+	}
 }
 
 func (b *Broker) unsubscribe(sub *wamp.Session, msg *wamp.Unsubscribe) {
-	var delLastSub bool
+	found, delLastSub, count := b.delSubscription(sub, msg.Subscription)
+	if !found {
+		// The subscription may have been revoked while the UNSUBSCRIBE was
+		// on its way, in which case the subscriber got what it asked for.
+		if ids, ok := b.revoked[sub]; ok {
+			if _, ok = ids[msg.Subscription]; ok {
+				delete(ids, msg.Subscription)
+				b.trySend(sub, &wamp.Unsubscribed{Request: msg.Request})
+				return
+			}
+		}
+		b.trySend(sub, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: errorDetails(b.debug, wamp.Dict{
+				"cause": "subscription not found for any match policy",
+			}),
+			Error: wamp.ErrNoSuchSubscription,
+		})
+		b.log.Println("Error unsubscribing: no such subscription",
+			msg.Subscription)
+		return
+	}
+
+	// Tell sender they are unsubscribed.
+	b.trySend(sub, &wamp.Unsubscribed{Request: msg.Request})
+
+	b.pubUnsubscribeMeta(sub.ID, msg.Subscription, count, delLastSub)
+}
+
+// delSubscription deletes the subscriber's subscription with the given ID.
+// Returns false if there is no such subscription.  Otherwise, returns whether
+// the last subscriber to the topic was removed, and the number of subscribers
+// that are left.
+func (b *Broker) delSubscription(sub *wamp.Session, id wamp.ID) (found, delLastSub bool, count int) {
 	var topicSubscribers map[wamp.URI]map[wamp.ID]*wamp.Session
-	topic, ok := b.subscriptions[msg.Subscription]
+	var match string
+	topic, ok := b.subscriptions[id]
 	if !ok {
-		if topic, ok = b.pfxSubscriptions[msg.Subscription]; !ok {
-			if topic, ok = b.wcSubscriptions[msg.Subscription]; !ok {
-				b.trySend(sub, &wamp.Error{
-					Type:    msg.MessageType(),
-					Request: msg.Request,
-					Error:   wamp.ErrNoSuchSubscription,
-				})
-				b.log.Println("Error unsubscribing: no such subscription",
-					msg.Subscription)
-				return
+		if topic, ok = b.pfxSubscriptions[id]; !ok {
+			if topic, ok = b.wcSubscriptions[id]; !ok {
+				return false, false, 0
 			}
-			delete(b.wcSubscriptions, msg.Subscription)
+			delete(b.wcSubscriptions, id)
 			topicSubscribers = b.wcTopicSubscribers
+			match = wamp.MatchWildcard
 		} else {
-			delete(b.pfxSubscriptions, msg.Subscription)
+			delete(b.pfxSubscriptions, id)
 			topicSubscribers = b.pfxTopicSubscribers
+			match = wamp.MatchPrefix
 		}
 	} else {
-		delete(b.subscriptions, msg.Subscription)
+		delete(b.subscriptions, id)
 		topicSubscribers = b.topicSubscribers
+		match = wamp.MatchExact
 	}
+	atomic.AddInt64(&b.stats.subscriptions, -1)
+	delete(b.topicSuffixSubs, id)
+	delete(b.subCreated, id)
+	delete(b.subDescribe, id)
 
 	// clean up topic -> subscribed session
 	if subs, ok := topicSubscribers[topic]; !ok {
 		b.log.Println("Error unsubscribing: unable to find subscribers for",
 			topic, "topic")
-	} else if _, ok := subs[msg.Subscription]; !ok {
+	} else if _, ok := subs[id]; !ok {
 		b.log.Println("Error unsubscribing: topic", topic,
-			"does not have subscription", msg.Subscription)
+			"does not have subscription", id)
 	} else {
-		delete(subs, msg.Subscription)
+		delete(subs, id)
 		if len(subs) == 0 {
-			delete(b.topicSubscribers, topic)
+			delete(topicSubscribers, topic)
+			delete(b.history, subscriptionKey{topic, match})
 			delLastSub = true
 		}
+		count = b.countLive(subs)
 	}
 
 	// clean up sender's subscription
 	if s, ok := b.sessionSubIDSet[sub]; !ok {
 		b.log.Print("Error unsubscribing: no subscriptions for sender")
-	} else if _, ok := s[msg.Subscription]; !ok {
-		b.log.Println("Error unsubscribing: cannot find subscription",
-			msg.Subscription, "for sender")
+	} else if _, ok := s[id]; !ok {
+		b.log.Println("Error unsubscribing: cannot find subscription", id,
+			"for sender")
 	} else {
-		delete(s, msg.Subscription)
+		delete(s, id)
 		if len(s) == 0 {
 			delete(b.sessionSubIDSet, sub)
 		}
 	}
+	return true, delLastSub, count
+}
 
-	// Tell sender they are unsubscribed.
-	b.trySend(sub, &wamp.Unsubscribed{Request: msg.Request})
-
+// pubUnsubscribeMeta publishes the meta events for a subscriber that is
+// removed from a subscription, and for the subscription if it was deleted.
+func (b *Broker) pubUnsubscribeMeta(subSessID, subID wamp.ID, count int, delLastSub bool) {
 	// Publish WAMP unsubscribe meta event.
-	b.pubSubMeta(wamp.MetaEventSubOnUnsubscribe, sub.ID, msg.Subscription)
+	b.pubSubMeta(wamp.MetaEventSubOnUnsubscribe, subSessID, subID, count)
 	if delLastSub {
 		// Fired when a subscription is deleted after the last session attached
 		// to it has been removed.
-		b.pubSubMeta(wamp.MetaEventSubOnDelete, sub.ID, msg.Subscription)
+		b.pubSubMeta(wamp.MetaEventSubOnDelete, subSessID, subID, 0)
 	}
 }
 
+// revokeSub tells a subscriber that the router removed its subscription, by
+// sending it an UNSUBSCRIBED message with the reason, if the subscriber
+// supports subscription revocation.  The subscription is remembered as
+// revoked, so that an UNSUBSCRIBE for it that is already on its way is
+// answered with UNSUBSCRIBED.
+func (b *Broker) revokeSub(sub *wamp.Session, id wamp.ID, reason string) {
+	ids, ok := b.revoked[sub]
+	if !ok {
+		ids = map[wamp.ID]struct{}{}
+		b.revoked[sub] = ids
+	}
+	ids[id] = struct{}{}
+	if b.disabled[featureSubRevocation] || !sub.HasFeature(roleSub, featureSubRevocation) {
+		return
+	}
+	b.trySend(sub, &wamp.Unsubscribed{
+		Details: wamp.Dict{
+			"subscription": id,
+			"reason":       reason,
+		},
+	})
+}
+
+// revokeAll tells all subscribers that their subscriptions are revoked,
+// without removing them, as when the realm is shut down.  This waits until
+// all are told, so that they are told before they are sent GOODBYE.
+func (b *Broker) revokeAll(reason string) {
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		for sub, ids := range b.sessionSubIDSet {
+			for id := range ids {
+				b.revokeSub(sub, id, reason)
+			}
+		}
+		close(sync)
+	}
+	<-sync
+}
+
 func (b *Broker) removeSession(sub *wamp.Session) {
+	if r, ok := b.retrying[sub]; ok {
+		r.timer.Stop()
+		delete(b.retrying, sub)
+	}
 	var topicSubscribers map[wamp.URI]map[wamp.ID]*wamp.Session
+	var match string
 	for id := range b.sessionSubIDSet[sub] {
 		// For each subscription ID, delete the subscription: topic map entry.
 		topic, ok := b.subscriptions[id]
@@ -408,34 +895,72 @@ func (b *Broker) removeSession(sub *wamp.Session) {
 				}
 				delete(b.wcSubscriptions, id)
 				topicSubscribers = b.wcTopicSubscribers
+				match = wamp.MatchWildcard
 			} else {
 				delete(b.pfxSubscriptions, id)
 				topicSubscribers = b.pfxTopicSubscribers
+				match = wamp.MatchPrefix
 			}
 		} else {
 			delete(b.subscriptions, id)
 			topicSubscribers = b.topicSubscribers
+			match = wamp.MatchExact
 		}
+		atomic.AddInt64(&b.stats.subscriptions, -1)
+		delete(b.topicSuffixSubs, id)
+		delete(b.subCreated, id)
+		delete(b.subDescribe, id)
 
 		// clean up topic -> subscriber session
 		if subs, ok := topicSubscribers[topic]; ok {
 			if _, ok := subs[id]; ok {
 				delete(subs, id)
+				// Fired when a session is removed from a subscription.
+				b.pubSubMeta(wamp.MetaEventSubOnUnsubscribe, sub.ID, id,
+					b.countLive(subs))
 				if len(subs) == 0 {
-					delete(b.topicSubscribers, topic)
+					delete(topicSubscribers, topic)
+					delete(b.history, subscriptionKey{topic, match})
 					// Fired when a subscription is deleted after the last
 					// session attached to it has been removed.
-					b.pubSubMeta(wamp.MetaEventSubOnDelete, sub.ID, id)
+					b.pubSubMeta(wamp.MetaEventSubOnDelete, sub.ID, id, 0)
 				}
 			}
 		}
 	}
 	delete(b.sessionSubIDSet, sub)
+	delete(b.departed, sub)
+	delete(b.revoked, sub)
+}
+
+// sessionLeaving stops counting the session as a subscriber, as soon as the
+// session leaves the realm.  The session stays attached to its subscriptions
+// until it is removed by RemoveSession.
+func (b *Broker) sessionLeaving(sess *wamp.Session) {
+	b.actionChan <- func() {
+		if _, ok := b.sessionSubIDSet[sess]; ok {
+			b.departed[sess] = struct{}{}
+		}
+	}
+}
+
+// countLive returns the number of subscribers in the subscription group that
+// have not left the realm.
+func (b *Broker) countLive(subs map[wamp.ID]*wamp.Session) int {
+	count := len(subs)
+	if len(b.departed) != 0 {
+		for _, sub := range subs {
+			if _, ok := b.departed[sub]; ok {
+				count--
+			}
+		}
+	}
+	return count
 }
 
 // pubEvent sends an event to all subscribers that are not excluded from
 // receiving the event.
-func (b *Broker) pubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, subs map[wamp.ID]*wamp.Session, excludePublisher, sendTopic, disclose bool, filter *publishFilter) {
+func (b *Broker) pubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, subs map[wamp.ID]*wamp.Session, excludePublisher, sendTopic, disclose bool, filter *publishFilter, ppt *pptPayload) {
 	for id, sub := range subs {
 		// Do not send event to publisher.
 		if sub == pub && excludePublisher {
@@ -454,15 +979,28 @@ func (b *Broker) pubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, s
 		// by the Publisher in EVENT.Details.topic|uri.
 		if sendTopic {
 			details[detailTopic] = msg.Topic
+			if _, ok := b.topicSuffixSubs[id]; ok {
+				details[detailTopicSuffix] = topicSuffix(msg.Topic,
+					b.pfxSubscriptions[id])
+			}
 		}
 
-		if disclose && sub.HasFeature(roleSub, featurePubIdent) {
-			details[rolePub] = pub.ID
+		if disclose && (b.requireDisclose || sub.HasFeature(roleSub, featurePubIdent)) {
+			disclosePublisher(pub, details)
+		}
+
+		// Pass on the marker of an event forwarded by a realm link.
+		if origin, ok := msg.Options[optNexusOrigin]; ok {
+			details[optNexusOrigin] = origin
 		}
 
 		// TODO: Handle publication trust levels
 
-		b.trySend(sub, &wamp.Event{
+		if ppt != nil {
+			ppt.addDetails(details)
+		}
+
+		b.sendEvent(sub, &wamp.Event{
 			Publication:  pubID,
 			Subscription: id,
 			Arguments:    msg.Arguments,
@@ -472,6 +1010,258 @@ func (b *Broker) pubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, s
 	}
 }
 
+// subscriptionKey identifies the subscription shared by all subscribers to a
+// topic with the same match policy.
+type subscriptionKey struct {
+	topic wamp.URI
+	match string
+}
+
+// historyEvent is an event kept in a subscription's history.
+type historyEvent struct {
+	pubID     wamp.ID
+	timestamp string
+	args      wamp.List
+	kwargs    wamp.Dict
+}
+
+// eventHistory is a ring buffer of a subscription's most recent events.
+type eventHistory struct {
+	events []historyEvent
+	start  int // index of oldest event, once buffer is full
+}
+
+// add adds an event to the history, discarding the oldest event if the
+// history has reached its size.
+func (h *eventHistory) add(ev historyEvent, size int) {
+	if len(h.events) < size {
+		h.events = append(h.events, ev)
+		return
+	}
+	h.events[h.start] = ev
+	h.start = (h.start + 1) % len(h.events)
+}
+
+// latest returns up to limit of the most recent events, oldest first.  A limit
+// of 0 returns all events.
+func (h *eventHistory) latest(limit int) []historyEvent {
+	n := len(h.events)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	events := make([]historyEvent, 0, limit)
+	for i := n - limit; i < n; i++ {
+		events = append(events, h.events[(h.start+i)%n])
+	}
+	return events
+}
+
+// recordEvent adds a publication to the history of the subscription.
+func (b *Broker) recordEvent(key subscriptionKey, msg *wamp.Publish, pubID wamp.ID) {
+	if b.eventHistorySize <= 0 {
+		return
+	}
+	h, ok := b.history[key]
+	if !ok {
+		h = &eventHistory{}
+		b.history[key] = h
+	}
+	h.add(historyEvent{
+		pubID:     pubID,
+		timestamp: wamp.NowISO8601(),
+		args:      msg.Arguments,
+		kwargs:    msg.ArgumentsKw,
+	}, b.eventHistorySize)
+}
+
+// retainedEvent is the latest event published, with the retain option, to a
+// topic.
+type retainedEvent struct {
+	topic   wamp.URI
+	pubID   wamp.ID
+	args    wamp.List
+	kwargs  wamp.Dict
+	filter  *publishFilter
+	pubInfo wamp.Dict   // disclosed publisher details, if any
+	ppt     *pptPayload // payload, if published in payload passthru mode
+}
+
+// retainEvent keeps the publication as the retained event for its topic.  A
+// publication with no arguments clears the retained event instead.
+func (b *Broker) retainEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, disclose bool, filter *publishFilter, ppt *pptPayload) {
+	if elem, ok := b.retained[msg.Topic]; ok {
+		b.discardRetained(elem)
+	}
+	if b.maxRetained == 0 || (len(msg.Arguments) == 0 && len(msg.ArgumentsKw) == 0) {
+		return
+	}
+	if b.retainedOrder.Len() >= b.maxRetained {
+		b.discardRetained(b.retainedOrder.Front())
+	}
+	ev := &retainedEvent{
+		topic:  msg.Topic,
+		pubID:  pubID,
+		args:   msg.Arguments,
+		kwargs: msg.ArgumentsKw,
+		filter: filter,
+		ppt:    ppt,
+	}
+	if disclose {
+		ev.pubInfo = wamp.Dict{}
+		disclosePublisher(pub, ev.pubInfo)
+	}
+	b.retained[msg.Topic] = b.retainedOrder.PushBack(ev)
+}
+
+// discardRetained removes a retained event.
+func (b *Broker) discardRetained(elem *list.Element) {
+	ev := b.retainedOrder.Remove(elem).(*retainedEvent)
+	delete(b.retained, ev.topic)
+}
+
+// sendRetained sends a new subscription the retained events for the topics
+// that it matches.
+func (b *Broker) sendRetained(sub *wamp.Session, id wamp.ID, topic wamp.URI, match string) {
+	send := func(ev *retainedEvent) {
+		if ev.filter != nil && !ev.filter.publishAllowed(sub) {
+			return
+		}
+		details := wamp.Dict{detailRetained: true}
+		if match == wamp.MatchPrefix || match == wamp.MatchWildcard {
+			details[detailTopic] = ev.topic
+			if _, ok := b.topicSuffixSubs[id]; ok {
+				details[detailTopicSuffix] = topicSuffix(ev.topic, topic)
+			}
+		}
+		if ev.pubInfo != nil && (b.requireDisclose || sub.HasFeature(roleSub, featurePubIdent)) {
+			for k, v := range ev.pubInfo {
+				details[k] = v
+			}
+		}
+		if ev.ppt != nil {
+			ev.ppt.addDetails(details)
+		}
+		b.sendEvent(sub, &wamp.Event{
+			Publication:  ev.pubID,
+			Subscription: id,
+			Arguments:    ev.args,
+			ArgumentsKw:  ev.kwargs,
+			Details:      details,
+		})
+	}
+
+	switch match {
+	case wamp.MatchPrefix:
+		for elem := b.retainedOrder.Front(); elem != nil; elem = elem.Next() {
+			if ev := elem.Value.(*retainedEvent); ev.topic.PrefixMatch(topic) {
+				send(ev)
+			}
+		}
+	case wamp.MatchWildcard:
+		for elem := b.retainedOrder.Front(); elem != nil; elem = elem.Next() {
+			if ev := elem.Value.(*retainedEvent); ev.topic.WildcardMatch(topic) {
+				send(ev)
+			}
+		}
+	default:
+		if elem, ok := b.retained[topic]; ok {
+			send(elem.Value.(*retainedEvent))
+		}
+	}
+}
+
+// eventRetry holds the EVENTs for a blocked subscriber, oldest first, while
+// waiting to retry sending them.
+type eventRetry struct {
+	events  []*wamp.Event
+	retries int           // retries made for the oldest EVENT
+	delay   time.Duration // delay before next retry
+	timer   *time.Timer
+}
+
+// sendEvent sends an EVENT to a subscriber.  If the subscriber is blocked,
+// then sending is retried, with backoff, up to the configured number of
+// retries.  If the EVENT still cannot be sent, then it is dropped and the
+// drop handler, if any, is called.
+func (b *Broker) sendEvent(sub *wamp.Session, event *wamp.Event) {
+	if r, ok := b.retrying[sub]; ok {
+		// Keep the EVENT behind the ones waiting to be retried.
+		r.events = append(r.events, event)
+		return
+	}
+	err := sub.TrySend(event)
+	if err == nil {
+		atomic.AddUint64(&b.stats.events, 1)
+		return
+	}
+	if err == wamp.ErrBlocked && b.eventRetries > 0 {
+		r := &eventRetry{
+			events: []*wamp.Event{event},
+			delay:  b.eventRetryDelay,
+		}
+		b.retrying[sub] = r
+		b.scheduleRetry(sub, r)
+		return
+	}
+	b.dropEvents(sub, 1, err)
+}
+
+// scheduleRetry starts a timer to retry sending the subscriber's EVENTs, and
+// doubles the delay for the next retry.
+func (b *Broker) scheduleRetry(sub *wamp.Session, r *eventRetry) {
+	r.timer = time.AfterFunc(r.delay, func() {
+		b.closeLock.RLock()
+		defer b.closeLock.RUnlock()
+		if b.closed {
+			return
+		}
+		b.actionChan <- func() {
+			b.retryEvents(sub)
+		}
+	})
+	r.delay *= 2
+}
+
+// retryEvents sends a blocked subscriber's EVENTs, in order, until they are
+// all sent or the subscriber is blocked again.  If the oldest EVENT has used
+// all its retries, then all the subscriber's waiting EVENTs are dropped.
+func (b *Broker) retryEvents(sub *wamp.Session) {
+	r, ok := b.retrying[sub]
+	if !ok {
+		// Subscriber was removed.
+		return
+	}
+	r.retries++
+	for len(r.events) != 0 {
+		err := sub.TrySend(r.events[0])
+		if err == nil {
+			atomic.AddUint64(&b.stats.events, 1)
+			r.events[0] = nil
+			r.events = r.events[1:]
+			r.retries = 0
+			r.delay = b.eventRetryDelay
+			continue
+		}
+		if err == wamp.ErrBlocked && r.retries < b.eventRetries {
+			b.scheduleRetry(sub, r)
+			return
+		}
+		delete(b.retrying, sub)
+		b.dropEvents(sub, len(r.events), err)
+		return
+	}
+	delete(b.retrying, sub)
+}
+
+// dropEvents logs that a number of EVENTs for the subscriber were dropped,
+// and calls the drop handler, if any.
+func (b *Broker) dropEvents(sub *wamp.Session, count int, err error) {
+	b.log.Println("!!! broker dropped", count, "EVENT for", sub, "error:", err)
+	if b.eventDropped != nil {
+		b.eventDropped(sub)
+	}
+}
+
 // pubMeta publishes the subscription meta event, using the supplied function,
 // to the matching subscribers.
 func (b *Broker) pubMeta(metaTopic wamp.URI, sendMeta func(subs map[wamp.ID]*wamp.Session, sendTopic bool)) {
@@ -493,9 +1283,11 @@ func (b *Broker) pubMeta(metaTopic wamp.URI, sendMeta func(subs map[wamp.ID]*wam
 }
 
 // pubSubMeta publishes a subscription meta event when a subscription is added,
-// removed, or deleted.
-func (b *Broker) pubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
-	pubID := wamp.GlobalID()
+// removed, or deleted.  The number of sessions attached to the subscription
+// after the change is given in the "count" detail of the event, so that
+// subscribers can follow it without calling count_subscribers.
+func (b *Broker) pubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID, count int) {
+	pubID := b.reqIDGen.Next()
 	sendMeta := func(subs map[wamp.ID]*wamp.Session, sendTopic bool) {
 		for id, sub := range subs {
 			// Do not send the meta event to the session that is causing the
@@ -504,7 +1296,7 @@ func (b *Broker) pubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
 			if sub.ID == subSessID {
 				continue
 			}
-			details := wamp.Dict{}
+			details := wamp.Dict{detailSubscriberCount: count}
 			if sendTopic {
 				details[detailTopic] = metaTopic
 			}
@@ -523,9 +1315,8 @@ func (b *Broker) pubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
 //
 // Fired when a subscription is created through a subscription request for a
 // topic which was previously without subscribers.
-func (b *Broker) pubSubCreateMeta(subTopic wamp.URI, subSessID, subID wamp.ID, match string) {
-	created := wamp.NowISO8601()
-	pubID := wamp.GlobalID()
+func (b *Broker) pubSubCreateMeta(subTopic wamp.URI, subSessID, subID wamp.ID, match, created string) {
+	pubID := b.reqIDGen.Next()
 	sendMeta := func(subs map[wamp.ID]*wamp.Session, sendTopic bool) {
 		for id, sub := range subs {
 			// Do not send the meta event to the session that is causing the
@@ -555,6 +1346,420 @@ func (b *Broker) pubSubCreateMeta(subTopic wamp.URI, subSessID, subID wamp.ID, m
 	b.pubMeta(wamp.MetaEventSubOnCreate, sendMeta)
 }
 
+// ----- Meta Procedure Handlers -----
+//
+// Each subscriber has its own subscription ID, so all the subscriptions to the
+// same topic with the same match policy are treated as one subscription by the
+// meta procedures.  That subscription is identified by the ID of its oldest
+// subscription, and any of its IDs may be used to refer to it.
+
+// topicSubscribersFor returns the topic subscribers map for the match policy.
+func (b *Broker) topicSubscribersFor(match string) map[wamp.URI]map[wamp.ID]*wamp.Session {
+	switch match {
+	case wamp.MatchPrefix:
+		return b.pfxTopicSubscribers
+	case wamp.MatchWildcard:
+		return b.wcTopicSubscribers
+	}
+	return b.topicSubscribers
+}
+
+// subscriptionGroup returns the topic, match policy, and subscribers of the
+// subscription that the subscription ID belongs to.
+func (b *Broker) subscriptionGroup(id wamp.ID) (wamp.URI, string, map[wamp.ID]*wamp.Session, bool) {
+	if topic, ok := b.subscriptions[id]; ok {
+		return topic, wamp.MatchExact, b.topicSubscribers[topic], true
+	}
+	if topic, ok := b.pfxSubscriptions[id]; ok {
+		return topic, wamp.MatchPrefix, b.pfxTopicSubscribers[topic], true
+	}
+	if topic, ok := b.wcSubscriptions[id]; ok {
+		return topic, wamp.MatchWildcard, b.wcTopicSubscribers[topic], true
+	}
+	return "", "", nil, false
+}
+
+// groupID returns the ID of the oldest of the subscriptions.
+func groupID(subs map[wamp.ID]*wamp.Session) wamp.ID {
+	var oldest wamp.ID
+	for id := range subs {
+		if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// groupDescribe returns the description given by the oldest of the
+// subscriptions that has one, or nil if none has.
+func (b *Broker) groupDescribe(subs map[wamp.ID]*wamp.Session) interface{} {
+	var oldest wamp.ID
+	var describe interface{}
+	for id := range subs {
+		if d, ok := b.subDescribe[id]; ok && (oldest == 0 || id < oldest) {
+			oldest, describe = id, d
+		}
+	}
+	return describe
+}
+
+// subscriptionArg returns the subscription ID from the first argument of the
+// meta procedure invocation.
+func subscriptionArg(msg *wamp.Invocation) (wamp.ID, bool) {
+	if len(msg.Arguments) == 0 {
+		return 0, false
+	}
+	i64, ok := wamp.AsInt64(msg.Arguments[0])
+	return wamp.ID(i64), ok
+}
+
+func noSuchSubscription(msg *wamp.Invocation) wamp.Message {
+	return &wamp.Error{
+		Type:    msg.MessageType(),
+		Request: msg.Request,
+		Details: wamp.Dict{},
+		Error:   wamp.ErrNoSuchSubscription,
+	}
+}
+
+// SubList retrieves subscription IDs listed according to match policies.
+func (b *Broker) SubList(msg *wamp.Invocation) wamp.Message {
+	listIDs := func(topicSubs map[wamp.URI]map[wamp.ID]*wamp.Session) []wamp.ID {
+		var ids []wamp.ID
+		for _, subs := range topicSubs {
+			ids = append(ids, groupID(subs))
+		}
+		return ids
+	}
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		dict = wamp.Dict{
+			wamp.MatchExact:    listIDs(b.topicSubscribers),
+			wamp.MatchPrefix:   listIDs(b.pfxTopicSubscribers),
+			wamp.MatchWildcard: listIDs(b.wcTopicSubscribers),
+		}
+		close(sync)
+	}
+	<-sync
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
+// subCounts returns the number of subscriptions for each match policy, which
+// are the numbers of subscription IDs returned by SubList.
+func (b *Broker) subCounts() wamp.Dict {
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		dict = wamp.Dict{
+			wamp.MatchExact:    len(b.topicSubscribers),
+			wamp.MatchPrefix:   len(b.pfxTopicSubscribers),
+			wamp.MatchWildcard: len(b.wcTopicSubscribers),
+		}
+		close(sync)
+	}
+	<-sync
+	return dict
+}
+
+// SubLookup obtains the subscription (if any) managing a topic, according to
+// some match policy.
+func (b *Broker) SubLookup(msg *wamp.Invocation) wamp.Message {
+	var subID wamp.ID
+	if len(msg.Arguments) != 0 {
+		if topic, ok := wamp.AsURI(msg.Arguments[0]); ok {
+			var match string
+			if len(msg.Arguments) > 1 {
+				if opts, ok := wamp.AsDict(msg.Arguments[1]); ok {
+					match = wamp.OptionString(opts, wamp.OptMatch)
+				}
+			}
+			sync := make(chan struct{})
+			b.actionChan <- func() {
+				subID = groupID(b.topicSubscribersFor(match)[topic])
+				close(sync)
+			}
+			<-sync
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{subID},
+	}
+}
+
+// SubMatch retrieves a list of IDs of subscriptions matching a topic URI,
+// irrespective of match policy.
+func (b *Broker) SubMatch(msg *wamp.Invocation) wamp.Message {
+	var subIDs []wamp.ID
+	if len(msg.Arguments) != 0 {
+		if topic, ok := wamp.AsURI(msg.Arguments[0]); ok {
+			sync := make(chan struct{})
+			b.actionChan <- func() {
+				if subs, ok := b.topicSubscribers[topic]; ok {
+					subIDs = append(subIDs, groupID(subs))
+				}
+				for pfxTopic, subs := range b.pfxTopicSubscribers {
+					if topic.PrefixMatch(pfxTopic) {
+						subIDs = append(subIDs, groupID(subs))
+					}
+				}
+				for wcTopic, subs := range b.wcTopicSubscribers {
+					if topic.WildcardMatch(wcTopic) {
+						subIDs = append(subIDs, groupID(subs))
+					}
+				}
+				close(sync)
+			}
+			<-sync
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{subIDs},
+	}
+}
+
+// SubGet retrieves information on a particular subscription.
+func (b *Broker) SubGet(msg *wamp.Invocation) wamp.Message {
+	var dict wamp.Dict
+	if subID, ok := subscriptionArg(msg); ok {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if topic, match, subs, ok := b.subscriptionGroup(subID); ok {
+				id := groupID(subs)
+				dict = wamp.Dict{
+					"id":          id,
+					"created":     b.subCreated[id],
+					"uri":         topic,
+					wamp.OptMatch: match,
+				}
+				if describe := b.groupDescribe(subs); describe != nil {
+					dict[wamp.OptDescribe] = describe
+				}
+			}
+			close(sync)
+		}
+		<-sync
+	}
+	if dict == nil {
+		return noSuchSubscription(msg)
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
+// SubListSubscribers retrieves a list of session IDs for sessions currently
+// attached to the subscription.
+func (b *Broker) SubListSubscribers(msg *wamp.Invocation) wamp.Message {
+	var subscriberIDs []wamp.ID
+	if subID, ok := subscriptionArg(msg); ok {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if _, _, subs, ok := b.subscriptionGroup(subID); ok {
+				subscriberIDs = make([]wamp.ID, 0, len(subs))
+				for _, sub := range subs {
+					if _, ok := b.departed[sub]; ok {
+						continue
+					}
+					subscriberIDs = append(subscriberIDs, sub.ID)
+				}
+			}
+			close(sync)
+		}
+		<-sync
+	}
+	if subscriberIDs == nil {
+		return noSuchSubscription(msg)
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{subscriberIDs},
+	}
+}
+
+// SubCountSubscribers obtains the number of sessions currently attached to
+// the subscription.
+func (b *Broker) SubCountSubscribers(msg *wamp.Invocation) wamp.Message {
+	count := -1
+	if subID, ok := subscriptionArg(msg); ok {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if _, _, subs, ok := b.subscriptionGroup(subID); ok {
+				count = b.countLive(subs)
+			}
+			close(sync)
+		}
+		<-sync
+	}
+	if count == -1 {
+		return noSuchSubscription(msg)
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{count},
+	}
+}
+
+// SubGetEvents retrieves the recent events of a subscription.  The optional
+// second argument limits the number of events returned to the most recent.
+// Each event is a dictionary with the "publication" ID, "timestamp", "args",
+// and "kwargs" of the event, and the events are listed oldest first.
+func (b *Broker) SubGetEvents(msg *wamp.Invocation) wamp.Message {
+	var limit int
+	if len(msg.Arguments) > 1 {
+		i64, ok := wamp.AsInt64(msg.Arguments[1])
+		if !ok || i64 < 0 {
+			return &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{"limit must be a non-negative integer"},
+			}
+		}
+		limit = int(i64)
+	}
+	var events wamp.List
+	if subID, ok := subscriptionArg(msg); ok {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if topic, match, _, ok := b.subscriptionGroup(subID); ok {
+				events = wamp.List{}
+				if h, ok := b.history[subscriptionKey{topic, match}]; ok {
+					for _, ev := range h.latest(limit) {
+						events = append(events, wamp.Dict{
+							"publication": ev.pubID,
+							"timestamp":   ev.timestamp,
+							"args":        ev.args,
+							"kwargs":      ev.kwargs,
+						})
+					}
+				}
+			}
+			close(sync)
+		}
+		<-sync
+	}
+	if events == nil {
+		return noSuchSubscription(msg)
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{events},
+	}
+}
+
+// SubRemoveSubscriber removes the subscriber, whose session ID is the second
+// argument, from the subscription given as the first argument.  The
+// subscriber is sent an UNSUBSCRIBED message with the reason given by the
+// "reason" keyword argument, if it supports subscription revocation.
+func (b *Broker) SubRemoveSubscriber(msg *wamp.Invocation) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+	if len(msg.Arguments) < 2 {
+		return makeErr(wamp.ErrInvalidArgument,
+			"expected subscription ID and subscriber session ID")
+	}
+	subID, ok := subscriptionArg(msg)
+	if !ok {
+		return makeErr(wamp.ErrNoSuchSubscription)
+	}
+	subscriberID, ok := wamp.AsID(msg.Arguments[1])
+	if !ok {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	reason := wamp.OptionString(msg.ArgumentsKw, "reason")
+	if reason == "" {
+		reason = defaultRevokeReason
+	}
+
+	var errMsg *wamp.Error
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		defer close(sync)
+		_, _, subs, ok := b.subscriptionGroup(subID)
+		if !ok {
+			errMsg = makeErr(wamp.ErrNoSuchSubscription)
+			return
+		}
+		for id, sub := range subs {
+			if sub.ID != subscriberID {
+				continue
+			}
+			_, delLastSub, count := b.delSubscription(sub, id)
+			b.revokeSub(sub, id, reason)
+			b.pubUnsubscribeMeta(sub.ID, id, count, delLastSub)
+			return
+		}
+		errMsg = makeErr(wamp.ErrNoSuchSession)
+	}
+	<-sync
+	if errMsg != nil {
+		return errMsg
+	}
+	return &wamp.Yield{Request: msg.Request}
+}
+
+// TopicStats retrieves the number of subscribers for each topic, listed
+// according to match policies.  The configured maximum number of subscribers
+// per topic, where 0 means no limit, is returned as "max_subscribers".
+func (b *Broker) TopicStats(msg *wamp.Invocation) wamp.Message {
+	countSubs := func(topicSubs map[wamp.URI]map[wamp.ID]*wamp.Session) wamp.Dict {
+		counts := make(wamp.Dict, len(topicSubs))
+		for topic, subs := range topicSubs {
+			counts[string(topic)] = len(subs)
+		}
+		return counts
+	}
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		dict = wamp.Dict{
+			wamp.MatchExact:    countSubs(b.topicSubscribers),
+			wamp.MatchPrefix:   countSubs(b.pfxTopicSubscribers),
+			wamp.MatchWildcard: countSubs(b.wcTopicSubscribers),
+			"max_subscribers":  b.maxTopicSubscribers,
+		}
+		close(sync)
+	}
+	<-sync
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
+// disclosePublisher adds the publisher's session ID, and authid and authrole if
+// the publisher has them, to the event details.
+func disclosePublisher(pub *wamp.Session, details wamp.Dict) {
+	details[rolePub] = pub.ID
+	if authid := wamp.OptionString(pub.Details, "authid"); authid != "" {
+		details["publisher_authid"] = authid
+	}
+	if authrole := wamp.OptionString(pub.Details, "authrole"); authrole != "" {
+		details["publisher_authrole"] = authrole
+	}
+}
+
+// topicSuffix returns the part of the topic beyond the prefix, without any
+// leading separator.
+func topicSuffix(topic, prefix wamp.URI) string {
+	return strings.TrimPrefix(string(topic[len(prefix):]), ".")
+}
+
 func (b *Broker) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	if err := sess.TrySend(msg); err != nil {
 		b.log.Println("!!! broker dropped", msg.MessageType(), "message:", err)
@@ -562,3 +1767,57 @@ func (b *Broker) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	}
 	return true
 }
+
+// ReflectTopicList retrieves the sorted URIs of all subscribed topics,
+// whatever their match policy.
+func (b *Broker) ReflectTopicList(msg *wamp.Invocation) wamp.Message {
+	var topics []string
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		for _, topicSubs := range []map[wamp.URI]map[wamp.ID]*wamp.Session{
+			b.topicSubscribers, b.pfxTopicSubscribers, b.wcTopicSubscribers} {
+			for topic := range topicSubs {
+				topics = append(topics, string(topic))
+			}
+		}
+		close(sync)
+	}
+	<-sync
+	sort.Strings(topics)
+	uris := make(wamp.List, len(topics))
+	for i := range topics {
+		uris[i] = wamp.URI(topics[i])
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{uris},
+	}
+}
+
+// describeTopic returns the URI, match policy, and description of the
+// subscription to the topic, or nil if the topic has no subscribers.  An
+// exact subscription is looked for first, then a prefix or wildcard
+// subscription whose pattern is the topic URI.
+func (b *Broker) describeTopic(topic wamp.URI) wamp.Dict {
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		for _, match := range []string{wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard} {
+			subs, ok := b.topicSubscribersFor(match)[topic]
+			if !ok {
+				continue
+			}
+			dict = wamp.Dict{
+				"uri":         topic,
+				wamp.OptMatch: match,
+			}
+			if describe := b.groupDescribe(subs); describe != nil {
+				dict[wamp.OptDescribe] = describe
+			}
+			break
+		}
+		close(sync)
+	}
+	<-sync
+	return dict
+}
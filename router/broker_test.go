@@ -1,10 +1,16 @@
 package router
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gammazero/nexus/transport/serialize"
 	"github.com/gammazero/nexus/wamp"
 )
 
@@ -22,7 +28,7 @@ func (p *testPeer) TrySend(msg wamp.Message) error {
 	select {
 	case p.in <- msg:
 	default:
-		return errors.New("try again")
+		return wamp.ErrBlocked
 	}
 	return nil
 }
@@ -34,9 +40,41 @@ func (p *testPeer) Send(msg wamp.Message) error {
 func (p *testPeer) Recv() <-chan wamp.Message { return p.in }
 func (p *testPeer) Close()                    { return }
 
+// slowPeer is a testPeer that takes a long time to send each message.
+type slowPeer struct {
+	*testPeer
+	delay time.Duration
+}
+
+func (p *slowPeer) TrySend(msg wamp.Message) error {
+	time.Sleep(p.delay)
+	return p.testPeer.TrySend(msg)
+}
+
+// serialPeer is a testPeer that serializes and deserializes each message
+// sent to it, as a transport using the serializer would.
+type serialPeer struct {
+	*testPeer
+	s serialize.Serializer
+}
+
+func (p *serialPeer) TrySend(msg wamp.Message) error {
+	b, err := p.s.Serialize(msg)
+	if err != nil {
+		return err
+	}
+	if msg, err = p.s.Deserialize(b); err != nil {
+		return err
+	}
+	return p.testPeer.TrySend(msg)
+}
+
+func (p *serialPeer) Send(msg wamp.Message) error { return p.TrySend(msg) }
+
 func TestBasicSubscribe(t *testing.T) {
 	// Test subscribing to a topic.
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -123,6 +161,7 @@ func TestBasicSubscribe(t *testing.T) {
 func TestUnsubscribe(t *testing.T) {
 	// Subscribe to topic
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -157,6 +196,7 @@ func TestUnsubscribe(t *testing.T) {
 func TestRemove(t *testing.T) {
 	// Subscribe to topic
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -199,6 +239,7 @@ func TestRemove(t *testing.T) {
 
 func TestBasicPubSub(t *testing.T) {
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -238,6 +279,7 @@ func TestBasicPubSub(t *testing.T) {
 func TestPrefxPatternBasedSubscription(t *testing.T) {
 	// Test match=prefix
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -295,9 +337,126 @@ func TestPrefxPatternBasedSubscription(t *testing.T) {
 	}
 }
 
+func TestPatternSubscriptionsMixed(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscriptions that match testTopic, and some that do not.
+	subs := []struct {
+		topic wamp.URI
+		match string
+		recv  bool
+	}{
+		{testTopic, wamp.MatchExact, true},
+		{"nexus.test", wamp.MatchPrefix, true},
+		{"nexus..topic", wamp.MatchWildcard, true},
+		{"nexus.test.other", wamp.MatchExact, false},
+		{"nexus.other", wamp.MatchPrefix, false},
+		{"nexus..topic.x", wamp.MatchWildcard, false},
+	}
+	sessions := make([]*wamp.Session, len(subs))
+	for i, s := range subs {
+		sessions[i] = &wamp.Session{Peer: newTestPeer(), ID: wamp.ID(i + 1)}
+		broker.Subscribe(sessions[i], &wamp.Subscribe{
+			Request: wamp.ID(100 + i),
+			Topic:   s.topic,
+			Options: wamp.Dict{wamp.OptMatch: s.match},
+		})
+		if _, ok := (<-sessions[i].Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+	}
+
+	pubSess := &wamp.Session{Peer: newTestPeer()}
+	broker.Publish(pubSess, &wamp.Publish{Request: 200, Topic: testTopic})
+	// Sync with the broker goroutine.
+	sync := make(chan struct{})
+	broker.actionChan <- func() { close(sync) }
+	<-sync
+
+	for i, s := range subs {
+		select {
+		case rsp := <-sessions[i].Recv():
+			if !s.recv {
+				t.Fatal(s.match, "subscription to", s.topic, "got event")
+			}
+			evt := rsp.(*wamp.Event)
+			topic, ok := evt.Details[detailTopic]
+			if s.match == wamp.MatchExact {
+				if ok {
+					t.Fatal("exact subscription event should not have topic")
+				}
+			} else if topic != testTopic {
+				t.Fatal(s.match, "subscription event has wrong topic:", topic)
+			}
+		default:
+			if s.recv {
+				t.Fatal(s.match, "subscription to", s.topic, "missed event")
+			}
+		}
+	}
+}
+
+func TestPrefixTopicSuffix(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	subscriber := newTestPeer()
+	sess := &wamp.Session{Peer: subscriber}
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 123,
+		Topic:   wamp.URI("nexus.test"),
+		Options: wamp.Dict{
+			wamp.OptMatch:       wamp.MatchPrefix,
+			wamp.OptTopicSuffix: true,
+		},
+	})
+	rsp := <-sess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	pubSess := &wamp.Session{Peer: newTestPeer()}
+	for topic, suffix := range map[wamp.URI]string{
+		"nexus.test.topic":     "topic",
+		"nexus.test.a.b":       "a.b",
+		"nexus.testing.suffix": "ing.suffix",
+	} {
+		broker.Publish(pubSess, &wamp.Publish{Request: 124, Topic: topic})
+		rsp = <-sess.Recv()
+		evt, ok := rsp.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		if evt.Details[detailTopic] != topic {
+			t.Fatal("wrong topic received")
+		}
+		if evt.Details[detailTopicSuffix] != suffix {
+			t.Fatalf("expected topic suffix %q, got %v", suffix,
+				evt.Details[detailTopicSuffix])
+		}
+	}
+
+	// A prefix subscription without the option gets no suffix.
+	sess2 := &wamp.Session{Peer: newTestPeer()}
+	broker.Subscribe(sess2, &wamp.Subscribe{
+		Request: 125,
+		Topic:   wamp.URI("nexus.test"),
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	<-sess2.Recv()
+	broker.Publish(pubSess, &wamp.Publish{Request: 126, Topic: "nexus.test.x"})
+	<-sess.Recv()
+	evt := (<-sess2.Recv()).(*wamp.Event)
+	if _, ok := evt.Details[detailTopicSuffix]; ok {
+		t.Fatal("topic suffix should not be included without option")
+	}
+}
+
 func TestWildcardPatternBasedSubscription(t *testing.T) {
 	// Test match=prefix
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -355,8 +514,59 @@ func TestWildcardPatternBasedSubscription(t *testing.T) {
 	}
 }
 
+func TestPatternSubscriptionTopicDetail(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+
+	subscribe := func(topic wamp.URI, match string) *wamp.Session {
+		sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: wamp.SetOption(nil, wamp.OptMatch, match),
+		})
+		if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		return sess
+	}
+	exactSub := subscribe("some.x.endpoint", wamp.MatchExact)
+	wcSub := subscribe("some..endpoint", wamp.MatchWildcard)
+	pfxSub := subscribe("some", wamp.MatchPrefix)
+
+	pubTopic := wamp.URI("some.x.endpoint")
+	broker.Publish(&wamp.Session{Peer: newTestPeer()},
+		&wamp.Publish{Request: wamp.GlobalID(), Topic: pubTopic})
+
+	getEvent := func(sess *wamp.Session) *wamp.Event {
+		select {
+		case msg := <-sess.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", msg.MessageType())
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for EVENT")
+		}
+		return nil
+	}
+
+	// Pattern-based subscribers are told the topic that was published to.
+	for _, sess := range []*wamp.Session{wcSub, pfxSub} {
+		if topic := getEvent(sess).Details["topic"]; topic != pubTopic {
+			t.Fatal("expected topic", pubTopic, "got:", topic)
+		}
+	}
+	// An exact subscriber already knows the topic, so it is omitted.
+	if topic, ok := getEvent(exactSub).Details["topic"]; ok {
+		t.Fatal("exact subscription event has topic:", topic)
+	}
+}
+
 func TestSubscriberBlackwhiteListing(t *testing.T) {
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	details := wamp.Dict{
 		"authid":   "jdoe",
@@ -466,8 +676,76 @@ func TestSubscriberBlackwhiteListing(t *testing.T) {
 	}
 }
 
+func TestPublishFilterValidation(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	testTopic := wamp.URI("nexus.test.topic")
+	sess := &wamp.Session{
+		Peer:    newTestPeer(),
+		ID:      wamp.ID(1234),
+		Details: wamp.Dict{"authid": "jdoe", "authrole": "admin"},
+	}
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED)
+	}
+	pubSess := &wamp.Session{Peer: newTestPeer()}
+
+	publish := func(opts wamp.Dict) wamp.Message {
+		opts[wamp.OptAcknowledge] = true
+		broker.Publish(pubSess, &wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: opts,
+		})
+		rsp, err := wamp.RecvTimeout(pubSess, time.Second)
+		if err != nil {
+			t.Fatal("publisher did not get response")
+		}
+		return rsp
+	}
+
+	// Well-formed lists, including session IDs decoded from JSON as float64.
+	for _, opts := range []wamp.Dict{
+		{"eligible": wamp.List{float64(1234), int64(99)}},
+		{"exclude": []wamp.ID{99}},
+		{"eligible_authid": []string{"jdoe"}},
+		{"exclude_authrole": wamp.List{"guest"}, wamp.OptExcludeMe: false},
+	} {
+		if rsp := publish(opts); rsp.MessageType() != wamp.PUBLISHED {
+			t.Fatalf("options %v: expected PUBLISHED, got %v", opts, rsp)
+		}
+		if _, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+			t.Fatalf("options %v: event not delivered", opts)
+		}
+	}
+
+	// Malformed lists are rejected, and the event is not delivered.
+	for _, opts := range []wamp.Dict{
+		{"eligible": 1234},
+		{"eligible": wamp.List{"1234"}},
+		{"exclude": wamp.List{1.5}},
+		{"eligible_authid": "jdoe"},
+		{"eligible_authrole": wamp.List{"admin", 7}},
+		{"exclude_authid": wamp.List{""}},
+	} {
+		rsp := publish(opts)
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatalf("options %v: expected ERROR, got %v", opts, rsp)
+		}
+		if errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatalf("options %v: wrong error %v", opts, errMsg.Error)
+		}
+		if _, err := wamp.RecvTimeout(sess, 10*time.Millisecond); err == nil {
+			t.Fatalf("options %v: event delivered", opts)
+		}
+	}
+}
+
 func TestPublisherExclusion(t *testing.T) {
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 	sess := &wamp.Session{Peer: subscriber}
 	testTopic := wamp.URI("nexus.test.topic")
@@ -540,8 +818,97 @@ func TestPublisherExclusion(t *testing.T) {
 	}
 }
 
+func TestPublishFilterSubscriberSet(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribers with different authid and authrole.
+	attrs := [][2]string{
+		{"alice", "admin"},
+		{"bob", "user"},
+		{"carol", "user"},
+		{"dave", "guest"},
+	}
+	subs := make([]*wamp.Session, len(attrs))
+	for i := range attrs {
+		subs[i] = &wamp.Session{
+			Peer: newTestPeer(),
+			ID:   wamp.ID(i + 1),
+			Details: wamp.Dict{
+				"authid":   attrs[i][0],
+				"authrole": attrs[i][1],
+			},
+		}
+		broker.Subscribe(subs[i], &wamp.Subscribe{
+			Request: wamp.ID(100 + i),
+			Topic:   testTopic,
+		})
+		if _, ok := (<-subs[i].Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+	}
+	// The publisher, alice, is also a subscriber.
+	pubSess := subs[0]
+
+	// checkReceivers publishes with the given options and checks that only
+	// the expected subscribers receive the event.
+	checkReceivers := func(opts wamp.Dict, expect ...int) {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: opts,
+		})
+		// Sync with the broker goroutine.
+		sync := make(chan struct{})
+		broker.actionChan <- func() { close(sync) }
+		<-sync
+		for i := range subs {
+			var want bool
+			for _, e := range expect {
+				if e == i {
+					want = true
+				}
+			}
+			select {
+			case <-subs[i].Recv():
+				if !want {
+					t.Error("options", opts, "subscriber", attrs[i][0],
+						"should not receive event")
+				}
+			default:
+				if want {
+					t.Error("options", opts, "subscriber", attrs[i][0],
+						"did not receive event")
+				}
+			}
+		}
+	}
+
+	// The publisher is excluded by default.
+	checkReceivers(nil, 1, 2, 3)
+	checkReceivers(wamp.Dict{wamp.OptExcludeMe: false}, 0, 1, 2, 3)
+
+	// Eligible subscribers, minus excluded subscribers.
+	checkReceivers(wamp.Dict{
+		"eligible":        wamp.List{subs[0].ID, subs[1].ID, subs[2].ID},
+		"exclude_authid":  wamp.List{"bob"},
+		wamp.OptExcludeMe: false,
+	}, 0, 2)
+	checkReceivers(wamp.Dict{
+		"eligible_authrole": wamp.List{"user", "guest"},
+		"exclude":           wamp.List{subs[3].ID},
+	}, 1, 2)
+	checkReceivers(wamp.Dict{
+		"eligible_authid":  wamp.List{"alice", "carol", "dave"},
+		"exclude_authrole": wamp.List{"guest"},
+		wamp.OptExcludeMe:  false,
+	}, 0, 2)
+}
+
 func TestPublisherIdentification(t *testing.T) {
 	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
 	subscriber := newTestPeer()
 
 	details := wamp.Dict{
@@ -567,7 +934,11 @@ func TestPublisherIdentification(t *testing.T) {
 	}
 
 	publisher := newTestPeer()
-	pubSess := &wamp.Session{Peer: publisher, ID: wamp.GlobalID()}
+	pubSess := &wamp.Session{
+		Peer:    publisher,
+		ID:      wamp.GlobalID(),
+		Details: wamp.Dict{"authid": "jdoe", "authrole": "admin"},
+	}
 	broker.Publish(pubSess, &wamp.Publish{
 		Request: 124,
 		Topic:   testTopic,
@@ -585,4 +956,1040 @@ func TestPublisherIdentification(t *testing.T) {
 	if pub.(wamp.ID) != pubSess.ID {
 		t.Fatal("incorrect publisher ID disclosed")
 	}
+	if evt.Details["publisher_authid"] != "jdoe" {
+		t.Fatal("incorrect publisher authid disclosed")
+	}
+	if evt.Details["publisher_authrole"] != "admin" {
+		t.Fatal("incorrect publisher authrole disclosed")
+	}
+
+	// Without disclose_me, publisher is not disclosed.
+	broker.Publish(pubSess, &wamp.Publish{Request: 125, Topic: testTopic})
+	evt = (<-sess.Recv()).(*wamp.Event)
+	if _, ok = evt.Details["publisher"]; ok {
+		t.Fatal("publisher disclosed without disclose_me")
+	}
+
+	// Broker that does not allow disclosure rejects the publication.
+	broker2 := NewBroker(logger, false, false, debug)
+	defer broker2.Close()
+	broker2.Subscribe(sess, &wamp.Subscribe{Request: 126, Topic: testTopic})
+	if _, ok = (<-sess.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED)
+	}
+	broker2.Publish(pubSess, &wamp.Publish{
+		Request: 127,
+		Topic:   testTopic,
+		Options: wamp.Dict{"disclose_me": true},
+	})
+	rsp = <-pubSess.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrOptionDisallowedDiscloseMe {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+	select {
+	case rsp = <-sess.Recv():
+		t.Fatal("event delivered when disclosure disallowed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxTopicSubscribers(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetMaxTopicSubscribers(2)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribe up to the maximum number of subscribers.
+	for i := 0; i < 2; i++ {
+		sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+		broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+		rsp := <-sess.Recv()
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	// Subscribing beyond the maximum must fail.
+	sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 124, Topic: testTopic})
+	rsp := <-sess.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Other topics are not affected by the subscribers to testTopic.
+	testTopic2 := wamp.URI("nexus.test.topic2")
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 125, Topic: testTopic2})
+	rsp = <-sess.Recv()
+	if _, ok = rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Check that topic stats report the current subscriber counts.
+	rsp = broker.TopicStats(&wamp.Invocation{Request: 126})
+	yield, ok := rsp.(*wamp.Yield)
+	if !ok {
+		t.Fatal("expected", wamp.YIELD, "got:", rsp.MessageType())
+	}
+	stats := yield.Arguments[0].(wamp.Dict)
+	exact := stats[wamp.MatchExact].(wamp.Dict)
+	if exact[string(testTopic)] != 2 {
+		t.Fatal("wrong subscriber count for", testTopic)
+	}
+	if exact[string(testTopic2)] != 1 {
+		t.Fatal("wrong subscriber count for", testTopic2)
+	}
+	if stats["max_subscribers"] != 2 {
+		t.Fatal("wrong max_subscribers in topic stats")
+	}
+}
+
+func TestRetainedEvents(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetMaxRetainedEvents(2)
+
+	pubSess := &wamp.Session{Peer: newTestPeer()}
+	publish := func(topic wamp.URI, args wamp.List) {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     topic,
+			Options:   wamp.Dict{wamp.OptRetain: true},
+			Arguments: args,
+		})
+	}
+	// subscribe returns the EVENTs sent with the SUBSCRIBED message.
+	subscribe := func(topic wamp.URI, options wamp.Dict) []*wamp.Event {
+		sess := &wamp.Session{Peer: &testPeer{in: make(chan wamp.Message, 8)}}
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: options,
+		})
+		if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		// The ERROR for this invalid UNSUBSCRIBE follows any retained events.
+		broker.Unsubscribe(sess, &wamp.Unsubscribe{Request: wamp.GlobalID()})
+		var events []*wamp.Event
+		for msg := range sess.Recv() {
+			if evt, ok := msg.(*wamp.Event); ok {
+				events = append(events, evt)
+				continue
+			}
+			break
+		}
+		return events
+	}
+	getRetained := wamp.Dict{wamp.OptGetRetained: true}
+
+	// Only the latest event for the topic is retained.
+	publish("nexus.test.a", wamp.List{1})
+	publish("nexus.test.a", wamp.List{2})
+	events := subscribe("nexus.test.a", getRetained)
+	if len(events) != 1 {
+		t.Fatal("expected 1 retained event, got", len(events))
+	}
+	if events[0].Arguments[0] != 2 {
+		t.Fatal("wrong retained event:", events[0].Arguments)
+	}
+	if !wamp.OptionFlag(events[0].Details, detailRetained) {
+		t.Fatal("retained event missing retained detail")
+	}
+
+	// Retained events are only sent when requested.
+	if events = subscribe("nexus.test.a", nil); len(events) != 0 {
+		t.Fatal("retained event sent without get_retained option")
+	}
+
+	// Pattern subscriptions get the retained events of matching topics.
+	publish("nexus.test.b", wamp.List{3})
+	events = subscribe("nexus.test", wamp.Dict{
+		wamp.OptGetRetained: true,
+		wamp.OptMatch:       wamp.MatchPrefix,
+	})
+	if len(events) != 2 {
+		t.Fatal("expected 2 retained events, got", len(events))
+	}
+	for _, evt := range events {
+		if evt.Details[detailTopic] == nil {
+			t.Fatal("retained event for prefix subscription missing topic")
+		}
+	}
+
+	// Retaining a third topic discards the one retained longest ago.
+	publish("nexus.test.c", wamp.List{4})
+	if events = subscribe("nexus.test.a", getRetained); len(events) != 0 {
+		t.Fatal("oldest retained event not discarded")
+	}
+	if events = subscribe("nexus.test.c", getRetained); len(events) != 1 {
+		t.Fatal("expected retained event for new topic")
+	}
+
+	// Publishing with no payload clears the retained event.
+	publish("nexus.test.c", nil)
+	if events = subscribe("nexus.test.c", getRetained); len(events) != 0 {
+		t.Fatal("retained event not cleared")
+	}
+}
+
+func TestPayloadPassthru(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+
+	payload := []byte{0x00, 0x01, 0xfe, 0xff}
+	transportSess := func(serializer string) *wamp.Session {
+		details := wamp.Dict{}
+		if serializer != "" {
+			details["transport"] = wamp.Dict{"serializer": serializer}
+		}
+		return &wamp.Session{Peer: newTestPeer(), Details: details}
+	}
+
+	// Subscribers using JSON, msgpack, and no serializer.
+	testTopic := wamp.URI("nexus.test.topic")
+	subs := map[string]*wamp.Session{}
+	for _, serializer := range []string{"json", "msgpack", ""} {
+		sess := transportSess(serializer)
+		broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+		if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		subs[serializer] = sess
+	}
+
+	pptOptions := wamp.Dict{
+		wamp.OptAcknowledge: true,
+		"ppt_scheme":        "x_custom",
+		"ppt_serializer":    "cbor",
+	}
+	recvEvent := func(sess *wamp.Session) *wamp.Event {
+		select {
+		case msg := <-sess.Recv():
+			evt, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got:", msg.MessageType())
+			}
+			if evt.Details["ppt_scheme"] != "x_custom" ||
+				evt.Details["ppt_serializer"] != "cbor" {
+				t.Fatal("EVENT missing ppt details:", evt.Details)
+			}
+			return evt
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for EVENT")
+		}
+		return nil
+	}
+
+	// The payload is relayed unchanged to every subscriber.  The serializer
+	// of a JSON session converts it to and from a JSON binary string.
+	for _, pubSerializer := range []string{"json", "cbor"} {
+		pubSess := transportSess(pubSerializer)
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     testTopic,
+			Options:   pptOptions,
+			Arguments: wamp.List{payload},
+		})
+		if _, ok := (<-pubSess.Recv()).(*wamp.Published); !ok {
+			t.Fatal("expected PUBLISHED")
+		}
+		for serializer, sess := range subs {
+			evt := recvEvent(sess)
+			if len(evt.Arguments) != 1 {
+				t.Fatal("wrong number of EVENT arguments")
+			}
+			b, ok := evt.Arguments[0].([]byte)
+			if !ok || !bytes.Equal(b, payload) {
+				t.Fatal(serializer, "subscriber got wrong payload:", evt.Arguments[0])
+			}
+		}
+	}
+
+	// Publications that are not valid in passthru mode are rejected.
+	for _, msg := range []*wamp.Publish{
+		{Options: wamp.Dict{"ppt_serializer": "cbor"}, Arguments: wamp.List{payload}},
+		{Options: wamp.Dict{"ppt_scheme": "bogus"}, Arguments: wamp.List{payload}},
+		{Options: wamp.Dict{"ppt_scheme": "wamp", "ppt_bogus": "x"}, Arguments: wamp.List{payload}},
+		{Options: wamp.Dict{"ppt_scheme": "wamp"}, Arguments: wamp.List{"not binary"}},
+		{Options: wamp.Dict{"ppt_scheme": "wamp"}, Arguments: wamp.List{payload, payload}},
+		{Options: wamp.Dict{"ppt_scheme": "wamp"}, Arguments: wamp.List{payload},
+			ArgumentsKw: wamp.Dict{"key": "value"}},
+	} {
+		pubSess := transportSess("msgpack")
+		msg.Request = wamp.GlobalID()
+		msg.Topic = testTopic
+		msg.Options[wamp.OptAcknowledge] = true
+		broker.Publish(pubSess, msg)
+		rsp := <-pubSess.Recv()
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR for", msg.Options, "got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+	}
+	for _, sess := range subs {
+		select {
+		case msg := <-sess.Recv():
+			t.Fatal("unexpected", msg.MessageType(), "for invalid publication")
+		default:
+		}
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetEventHistorySize(3)
+
+	sess := &wamp.Session{Peer: &testPeer{in: make(chan wamp.Message, 16)}}
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 123,
+		Topic:   wamp.URI("nexus.test"),
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	rsp := <-sess.Recv()
+	subscribed, ok := rsp.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	subID := subscribed.Subscription
+
+	getEvents := func(args ...interface{}) wamp.List {
+		rsp := broker.SubGetEvents(&wamp.Invocation{Request: 1, Arguments: args})
+		yield, ok := rsp.(*wamp.Yield)
+		if !ok {
+			t.Fatal("expected", wamp.YIELD, "got:", rsp.MessageType())
+		}
+		events, _ := wamp.AsList(yield.Arguments[0])
+		return events
+	}
+
+	if events := getEvents(subID); len(events) != 0 {
+		t.Fatal("expected no events, got", len(events))
+	}
+
+	// Publish more events than the history holds.
+	pubSess := &wamp.Session{Peer: newTestPeer()}
+	for i := 0; i < 5; i++ {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     wamp.URI(fmt.Sprint("nexus.test.topic", i)),
+			Arguments: wamp.List{i},
+		})
+		<-sess.Recv()
+	}
+
+	// Oldest events are evicted first.
+	events := getEvents(subID)
+	if len(events) != 3 {
+		t.Fatal("expected 3 events, got", len(events))
+	}
+	for i, ev := range events {
+		dict, _ := wamp.AsDict(ev)
+		args, _ := wamp.AsList(dict["args"])
+		if args[0] != i+2 {
+			t.Fatal("wrong event in history:", dict)
+		}
+		if dict["publication"] == nil || dict["timestamp"] == nil {
+			t.Fatal("event missing publication or timestamp:", dict)
+		}
+	}
+
+	// Limit returns the most recent events.
+	events = getEvents(subID, 1)
+	if len(events) != 1 {
+		t.Fatal("expected 1 event, got", len(events))
+	}
+	dict, _ := wamp.AsDict(events[0])
+	if args, _ := wamp.AsList(dict["args"]); args[0] != 4 {
+		t.Fatal("expected most recent event, got:", dict)
+	}
+
+	// History is removed with the subscription.
+	broker.Unsubscribe(sess, &wamp.Unsubscribe{Request: 124, Subscription: subID})
+	<-sess.Recv()
+	rsp = broker.SubGetEvents(&wamp.Invocation{Request: 2, Arguments: wamp.List{subID}})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription)
+	}
+	if len(broker.history) != 0 {
+		t.Fatal("history not removed with subscription")
+	}
+}
+
+func TestSlowDispatchLogging(t *testing.T) {
+	var logBuf bytes.Buffer
+	broker := NewBroker(log.New(&logBuf, "", 0), false, true, false)
+	defer broker.Close()
+	testTopic := wamp.URI("nexus.test.topic")
+
+	sub := &wamp.Session{Peer: newTestPeer()}
+	broker.Subscribe(sub, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	<-sub.Recv()
+	slowSub := &wamp.Session{
+		Peer: &slowPeer{testPeer: newTestPeer(), delay: 20 * time.Millisecond},
+	}
+	broker.Subscribe(slowSub, &wamp.Subscribe{Request: 124, Topic: testTopic})
+	<-slowSub.Recv()
+
+	// publishLog publishes an event and returns what was logged.
+	publishLog := func() string {
+		logBuf.Reset()
+		pubSess := &wamp.Session{Peer: newTestPeer()}
+		broker.Publish(pubSess, &wamp.Publish{Request: 125, Topic: testTopic})
+		<-sub.Recv()
+		<-slowSub.Recv()
+		// Sync with the broker goroutine.
+		sync := make(chan struct{})
+		broker.actionChan <- func() { close(sync) }
+		<-sync
+		return logBuf.String()
+	}
+
+	// No warning without threshold.
+	if out := publishLog(); strings.Contains(out, "Slow dispatch") {
+		t.Fatal("unexpected slow dispatch warning:", out)
+	}
+
+	// Warning when slow subscriber makes dispatch exceed threshold.
+	broker.SetSlowDispatchThreshold(10 * time.Millisecond)
+	out := publishLog()
+	if !strings.Contains(out, "Slow dispatch") {
+		t.Fatal("expected slow dispatch warning")
+	}
+	if !strings.Contains(out, string(testTopic)) ||
+		!strings.Contains(out, "2 subscribers") {
+		t.Fatal("slow dispatch warning missing topic or subscriber count:", out)
+	}
+
+	// No warning when dispatch is faster than threshold.
+	broker.SetSlowDispatchThreshold(time.Second)
+	if out = publishLog(); strings.Contains(out, "Slow dispatch") {
+		t.Fatal("unexpected slow dispatch warning:", out)
+	}
+}
+
+// flakyPeer is a testPeer that fails to send a number of times before
+// sending successfully.
+type flakyPeer struct {
+	*testPeer
+	failures int
+	err      error
+	tries    int
+}
+
+func (p *flakyPeer) TrySend(msg wamp.Message) error {
+	p.tries++
+	if p.failures > 0 {
+		p.failures--
+		return p.err
+	}
+	return p.testPeer.TrySend(msg)
+}
+
+func TestEventRetries(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetEventRetries(3, time.Millisecond)
+	dropped := make(chan *wamp.Session, 1)
+	broker.SetEventDropHandler(func(sess *wamp.Session) { dropped <- sess })
+
+	testTopic := wamp.URI("nexus.test.topic")
+	subscribe := func(peer *flakyPeer, failures int, err error) *wamp.Session {
+		sub := &wamp.Session{Peer: peer, ID: wamp.GlobalID()}
+		broker.Subscribe(sub, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		<-peer.Recv()
+		peer.failures, peer.err, peer.tries = failures, err, 0
+		return sub
+	}
+	publish := func(arg int) {
+		broker.Publish(&wamp.Session{Peer: newTestPeer()},
+			&wamp.Publish{
+				Request:   wamp.GlobalID(),
+				Topic:     testTopic,
+				Arguments: wamp.List{arg},
+			})
+	}
+
+	// Transient failures are retried until the event is sent.  Events
+	// published while retrying are delivered after it, in order.
+	peer := &flakyPeer{testPeer: newTestPeer()}
+	sub := subscribe(peer, 2, wamp.ErrBlocked)
+	publish(1)
+	publish(2)
+	for _, expect := range []int{1, 2} {
+		select {
+		case msg := <-peer.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got:", msg.MessageType())
+			}
+			if event.Arguments[0] != expect {
+				t.Fatal("expected event", expect, "got", event.Arguments[0])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered after retries")
+		}
+	}
+	if peer.tries != 4 {
+		t.Fatal("expected 4 tries, got", peer.tries)
+	}
+	select {
+	case <-dropped:
+		t.Fatal("drop handler called for delivered event")
+	default:
+	}
+	broker.RemoveSession(sub)
+
+	// Event is dropped when retries are exhausted.
+	peer = &flakyPeer{testPeer: newTestPeer()}
+	sub = subscribe(peer, 10, wamp.ErrBlocked)
+	publish(1)
+	select {
+	case sess := <-dropped:
+		if sess != sub {
+			t.Fatal("drop handler called with wrong session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drop handler not called")
+	}
+	if peer.tries != 4 {
+		t.Fatal("expected 4 tries, got", peer.tries)
+	}
+	broker.RemoveSession(sub)
+
+	// Fatal errors are not retried.
+	peer = &flakyPeer{testPeer: newTestPeer()}
+	sub = subscribe(peer, 10, errors.New("connection lost"))
+	publish(1)
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatal("drop handler not called")
+	}
+	if peer.tries != 1 {
+		t.Fatal("expected 1 try for fatal error, got", peer.tries)
+	}
+	broker.RemoveSession(sub)
+
+	// Other subscribers are not delayed while waiting to retry.
+	broker.SetEventRetries(1, time.Hour)
+	slow := &flakyPeer{testPeer: newTestPeer()}
+	sub = subscribe(slow, 1, wamp.ErrBlocked)
+	peer = &flakyPeer{testPeer: newTestPeer()}
+	subscribe(peer, 0, nil)
+	publish(1)
+	select {
+	case <-peer.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("event delayed by retry for other subscriber")
+	}
+	broker.RemoveSession(sub)
+}
+
+func TestSubscriberCount(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+
+	subscribe := func(sess *wamp.Session, topic wamp.URI) wamp.ID {
+		broker.Subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		rsp, ok := (<-sess.Recv()).(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		return rsp.Subscription
+	}
+	countSubscribers := func(subID wamp.ID) interface{} {
+		msg := broker.SubCountSubscribers(&wamp.Invocation{
+			Request:   wamp.GlobalID(),
+			Arguments: wamp.List{subID},
+		})
+		yield, ok := msg.(*wamp.Yield)
+		if !ok {
+			t.Fatal("expected", wamp.YIELD, "got:", msg.MessageType())
+		}
+		return yield.Arguments[0]
+	}
+
+	observer := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	subscribe(observer, wamp.MetaEventSubOnSubscribe)
+	subscribe(observer, wamp.MetaEventSubOnUnsubscribe)
+	checkCount := func(sessID wamp.ID, count int) {
+		select {
+		case msg := <-observer.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", msg.MessageType())
+			}
+			if event.Arguments[0] != sessID {
+				t.Fatal("meta event for wrong session")
+			}
+			if n := event.Details["count"]; n != count {
+				t.Fatal("expected count", count, "got:", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for meta event")
+		}
+	}
+
+	testTopic := wamp.URI("nexus.test.topic")
+	sess1 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	sess2 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	subID := subscribe(sess1, testTopic)
+	checkCount(sess1.ID, 1)
+	subscribe(sess2, testTopic)
+	checkCount(sess2.ID, 2)
+	if n := countSubscribers(subID); n != 2 {
+		t.Fatal("expected 2 subscribers, got", n)
+	}
+
+	// A session that has left is not counted, even before it is removed.
+	broker.sessionLeaving(sess2)
+	if n := countSubscribers(subID); n != 1 {
+		t.Fatal("expected 1 subscriber, got", n)
+	}
+	broker.RemoveSession(sess2)
+	checkCount(sess2.ID, 1)
+
+	broker.Unsubscribe(sess1, &wamp.Unsubscribe{Request: wamp.GlobalID(), Subscription: subID})
+	<-sess1.Recv()
+	checkCount(sess1.ID, 0)
+}
+
+func TestSubscriptionRevocation(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+
+	revocationRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"subscriber": wamp.Dict{
+				"features": wamp.Dict{
+					"subscription_revocation": true,
+				},
+			},
+		},
+	}
+	testTopic := wamp.URI("nexus.test.topic")
+	subscribe := func(sess *wamp.Session) wamp.ID {
+		broker.Subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		rsp, ok := (<-sess.Recv()).(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		return rsp.Subscription
+	}
+	remove := func(subID, sessID wamp.ID) wamp.Message {
+		return broker.SubRemoveSubscriber(&wamp.Invocation{
+			Request:     wamp.GlobalID(),
+			Arguments:   wamp.List{subID, sessID},
+			ArgumentsKw: wamp.Dict{"reason": "test"},
+		})
+	}
+	checkRevoked := func(sess *wamp.Session, subID wamp.ID, reason string) {
+		select {
+		case msg := <-sess.Recv():
+			unsub, ok := msg.(*wamp.Unsubscribed)
+			if !ok {
+				t.Fatal("expected", wamp.UNSUBSCRIBED, "got:", msg.MessageType())
+			}
+			if unsub.Request != 0 {
+				t.Fatal("revocation has non-zero request ID")
+			}
+			if id, _ := wamp.AsID(unsub.Details["subscription"]); id != subID {
+				t.Fatal("wrong subscription revoked:", unsub.Details)
+			}
+			if r := wamp.OptionString(unsub.Details, "reason"); r != reason {
+				t.Fatal("wrong revocation reason:", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for UNSUBSCRIBED")
+		}
+	}
+
+	sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID(), Details: revocationRoles}
+	other := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	subID := subscribe(sess)
+	otherSubID := subscribe(other)
+
+	// The subscriber is removed, and told why.
+	if msg := remove(otherSubID, sess.ID); msg.MessageType() != wamp.YIELD {
+		t.Fatal("expected", wamp.YIELD, "got:", msg)
+	}
+	checkRevoked(sess, subID, "test")
+
+	// An UNSUBSCRIBE sent before the subscriber learned of the revocation is
+	// acknowledged, once.
+	unsubscribe := func() wamp.Message {
+		broker.Unsubscribe(sess, &wamp.Unsubscribe{Request: 123, Subscription: subID})
+		return <-sess.Recv()
+	}
+	if unsub, ok := unsubscribe().(*wamp.Unsubscribed); !ok || unsub.Request != 123 {
+		t.Fatal("expected", wamp.UNSUBSCRIBED, "for request")
+	}
+	if errMsg, ok := unsubscribe().(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription)
+	}
+
+	// A subscriber that does not support revocation is removed silently.
+	if msg := remove(otherSubID, other.ID); msg.MessageType() != wamp.YIELD {
+		t.Fatal("expected", wamp.YIELD, "got:", msg)
+	}
+	if msg := remove(otherSubID, other.ID); msg.MessageType() != wamp.ERROR {
+		t.Fatal("expected", wamp.ERROR, "got:", msg)
+	}
+	select {
+	case msg := <-other.Recv():
+		t.Fatal("unexpected message:", msg.MessageType())
+	default:
+	}
+
+	// All subscriptions are revoked when the realm shuts down.
+	subID = subscribe(sess)
+	broker.revokeAll(string(wamp.ErrSystemShutdown))
+	checkRevoked(sess, subID, string(wamp.ErrSystemShutdown))
+}
+
+func TestRequirePublisherDisclosure(t *testing.T) {
+	broker := NewBroker(logger, false, false, debug)
+	broker.SetRequireDisclosure(true)
+	defer broker.Close()
+
+	// The subscriber does not announce publisher_identification.
+	subscriber := newTestPeer()
+	sess := &wamp.Session{Peer: subscriber}
+	testTopic := wamp.URI("nexus.test.topic")
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED)
+	}
+
+	pubSess := &wamp.Session{
+		Peer:    newTestPeer(),
+		ID:      wamp.GlobalID(),
+		Details: wamp.Dict{"authid": "jdoe", "authrole": "admin"},
+	}
+	// The publisher cannot opt out, and requesting disclosure is allowed.
+	for i, opts := range []wamp.Dict{
+		{"disclose_me": false},
+		{"disclose_me": true},
+	} {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request: wamp.ID(124 + i),
+			Topic:   testTopic,
+			Options: opts,
+		})
+		rsp := <-sess.Recv()
+		evt, ok := rsp.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		if wamp.OptionID(evt.Details, "publisher") != pubSess.ID {
+			t.Fatal("publisher not disclosed with options", opts)
+		}
+		if evt.Details["publisher_authid"] != "jdoe" {
+			t.Fatal("incorrect publisher authid disclosed")
+		}
+	}
+}
+
+func TestMaxSessionSubscriptions(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetMaxSessionSubscriptions(2)
+
+	sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	subscribe := func(s *wamp.Session, topic wamp.URI) wamp.Message {
+		broker.Subscribe(s, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		return <-s.Recv()
+	}
+
+	// Subscribe up to the maximum number of subscriptions.
+	var subID wamp.ID
+	for _, topic := range []wamp.URI{"nexus.test.a", "nexus.test.b"} {
+		rsp := subscribe(sess, topic)
+		subscribed, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		subID = subscribed.Subscription
+	}
+
+	// Subscribing beyond the maximum must fail.
+	rsp := subscribe(sess, "nexus.test.c")
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+	}
+
+	// Other sessions have their own limit.
+	sess2 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	if rsp = subscribe(sess2, "nexus.test.c"); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Unsubscribing makes room for another subscription.
+	broker.Unsubscribe(sess, &wamp.Unsubscribe{Request: wamp.GlobalID(), Subscription: subID})
+	if rsp = <-sess.Recv(); rsp.MessageType() != wamp.UNSUBSCRIBED {
+		t.Fatal("expected", wamp.UNSUBSCRIBED, "got:", rsp.MessageType())
+	}
+	if rsp = subscribe(sess, "nexus.test.c"); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Removing the session frees its subscriptions.
+	broker.RemoveSession(sess)
+	if rsp = subscribe(sess, "nexus.test.d"); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+}
+
+func TestRejectedSubscriptionLeavesNoTopic(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetMaxSessionSubscriptions(1)
+
+	subscribe := func(s *wamp.Session, topic wamp.URI) wamp.Message {
+		broker.Subscribe(s, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		return <-s.Recv()
+	}
+
+	// Watch for subscriptions being created.
+	metaSess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	if rsp := subscribe(metaSess, wamp.MetaEventSubOnCreate); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	if rsp := subscribe(sess, "nexus.test.a"); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	<-metaSess.Recv()
+
+	// Subscribing to a new topic beyond the maximum must fail, and must not
+	// create the topic.
+	rsp := subscribe(sess, "nexus.test.b")
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+	}
+	select {
+	case msg := <-metaSess.Recv():
+		t.Fatal("unexpected meta event for rejected subscription:", msg)
+	default:
+	}
+
+	// The next subscriber to the topic creates the subscription.
+	sess2 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	if rsp = subscribe(sess2, "nexus.test.b"); rsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	select {
+	case msg := <-metaSess.Recv():
+		evt, ok := msg.(*wamp.Event)
+		if !ok || len(evt.Arguments) != 2 {
+			t.Fatal("expected on_create event, got:", msg)
+		}
+		details, _ := wamp.AsDict(evt.Arguments[1])
+		if details["uri"] != wamp.URI("nexus.test.b") {
+			t.Fatal("on_create event for wrong topic:", details["uri"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not get on_create event for new subscription")
+	}
+}
+
+func TestBinaryAcrossSerializers(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+
+	payload := []byte{0x00, 0x01, 0xfe, 0xff}
+	testTopic := wamp.URI("nexus.test.topic")
+	serializers := map[string]serialize.Serializer{
+		"json":    &serialize.JSONSerializer{},
+		"msgpack": &serialize.MessagePackSerializer{},
+		"cbor":    &serialize.CBORSerializer{},
+	}
+	subs := map[string]*wamp.Session{}
+	for name, s := range serializers {
+		sess := &wamp.Session{
+			Peer: &serialPeer{testPeer: newTestPeer(), s: s},
+			Details: wamp.Dict{
+				"transport": wamp.Dict{"serializer": name},
+			},
+		}
+		broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+		if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		subs[name] = sess
+	}
+
+	for pubName, s := range serializers {
+		// Decode the PUBLISH as the router would from a publisher using the
+		// serializer.
+		b, err := s.Serialize(&wamp.Publish{
+			Request:     wamp.GlobalID(),
+			Options:     wamp.Dict{},
+			Topic:       testTopic,
+			Arguments:   wamp.List{payload, "text"},
+			ArgumentsKw: wamp.Dict{"bin": payload},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := s.Deserialize(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := &wamp.Session{Peer: newTestPeer()}
+		broker.Publish(pub, msg.(*wamp.Publish))
+
+		for subName, sub := range subs {
+			var evt *wamp.Event
+			select {
+			case msg := <-sub.Recv():
+				var ok bool
+				if evt, ok = msg.(*wamp.Event); !ok {
+					t.Fatal("expected EVENT, got:", msg.MessageType())
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for EVENT")
+			}
+			if len(evt.Arguments) != 2 {
+				t.Fatal("wrong number of arguments:", len(evt.Arguments))
+			}
+			if b, ok := evt.Arguments[0].([]byte); !ok || !bytes.Equal(b, payload) {
+				t.Errorf("%s to %s: binary argument not preserved: %#v",
+					pubName, subName, evt.Arguments[0])
+			}
+			if evt.Arguments[1] != "text" {
+				t.Errorf("%s to %s: string argument not preserved: %#v",
+					pubName, subName, evt.Arguments[1])
+			}
+			if b, ok := evt.ArgumentsKw["bin"].([]byte); !ok || !bytes.Equal(b, payload) {
+				t.Errorf("%s to %s: binary kwarg not preserved: %#v",
+					pubName, subName, evt.ArgumentsKw["bin"])
+			}
+		}
+	}
+}
+
+// stutterPeer is a peer that keeps the messages sent to it, but is blocked for
+// every few EVENTs.
+type stutterPeer struct {
+	testPeer
+	lock  sync.Mutex
+	tries int
+	msgs  []wamp.Message
+}
+
+func (p *stutterPeer) TrySend(msg wamp.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := msg.(*wamp.Event); ok {
+		p.tries++
+		if p.tries%3 == 0 {
+			return wamp.ErrBlocked
+		}
+	}
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *stutterPeer) received() []wamp.Message {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]wamp.Message(nil), p.msgs...)
+}
+
+func TestEventOrder(t *testing.T) {
+	const (
+		pubCount   = 8
+		eventCount = 200
+	)
+	broker := NewBroker(logger, false, true, debug)
+	defer broker.Close()
+	broker.SetEventRetries(1000, time.Microsecond)
+
+	// Subscribe with exact and prefix match to the topic.
+	peer := &stutterPeer{}
+	sub := &wamp.Session{Peer: peer}
+	testTopic := wamp.URI("nexus.test.topic")
+	broker.Subscribe(sub, &wamp.Subscribe{Request: 1, Topic: testTopic})
+	broker.Subscribe(sub, &wamp.Subscribe{
+		Request: 2,
+		Topic:   "nexus.test",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	subIDs := map[wamp.ID]bool{}
+	for start := time.Now(); len(subIDs) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out waiting for SUBSCRIBED")
+		}
+		for _, msg := range peer.received() {
+			if s, ok := msg.(*wamp.Subscribed); ok {
+				subIDs[s.Subscription] = true
+			}
+		}
+	}
+
+	// Publish ordered events from many publishers at once.
+	var wg sync.WaitGroup
+	for p := 0; p < pubCount; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			pub := &wamp.Session{Peer: newTestPeer()}
+			for i := 0; i < eventCount; i++ {
+				broker.Publish(pub, &wamp.Publish{
+					Request:   wamp.GlobalID(),
+					Topic:     testTopic,
+					Arguments: wamp.List{p, i},
+				})
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// Each subscription gets each publisher's events in order.
+	expect := len(subIDs) * pubCount * eventCount
+	deadline := time.Now().Add(5 * time.Second)
+	var events []*wamp.Event
+	for {
+		events = events[:0]
+		for _, msg := range peer.received() {
+			if evt, ok := msg.(*wamp.Event); ok {
+				events = append(events, evt)
+			}
+		}
+		if len(events) >= expect || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != expect {
+		t.Fatalf("expected %d events, got %d", expect, len(events))
+	}
+	next := map[wamp.ID][]int64{}
+	for id := range subIDs {
+		next[id] = make([]int64, pubCount)
+	}
+	for _, evt := range events {
+		p, _ := wamp.AsInt64(evt.Arguments[0])
+		i, _ := wamp.AsInt64(evt.Arguments[1])
+		if i != next[evt.Subscription][p] {
+			t.Fatalf("subscription %v: publisher %d event %d arrived, expected %d",
+				evt.Subscription, p, i, next[evt.Subscription][p])
+		}
+		next[evt.Subscription][p]++
+	}
 }
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// startCallTimeout starts a timer that cancels the pending call if it does not
+// finish within the timeout, in milliseconds, given by CALL.Options.timeout.
+// The caller is sent an ERROR with wamp.error.canceled, and the callee is
+// sent an INTERRUPT, as if the caller sent a CANCEL with mode killnowait.  A
+// timeout of zero or less means the call has no time limit.
+func (d *Dealer) startCallTimeout(caller *wamp.Session, callID, invocationID wamp.ID, timeout int64) {
+	if timeout <= 0 {
+		return
+	}
+	d.invocations[invocationID].timer = time.AfterFunc(
+		d.timeoutDuration(timeout), func() {
+			d.callTimeout(caller, callID, invocationID)
+		})
+}
+
+// startInvocationLimit starts a timer that cancels the pending call if the
+// callee does not respond within the dealer's maximum invocation duration,
+// whether or not the caller gave a timeout.  Each progressive result sent to
+// the caller restarts the limit, so that a call that keeps making progress is
+// not canceled.
+func (d *Dealer) startInvocationLimit(caller *wamp.Session, callID, invocationID wamp.ID) {
+	if d.maxInvocation <= 0 {
+		return
+	}
+	invk := d.invocations[invocationID]
+	invk.lastActive = time.Now()
+	invk.limitTimer = time.AfterFunc(d.maxInvocation, func() {
+		d.invocationLimit(caller, callID, invocationID)
+	})
+}
+
+// stopTimeout stops the invocation's call timeout and invocation limit, if
+// any.  This must be called whenever the call finishes, so that a timeout
+// cannot cancel a different call.
+func (invk *invocation) stopTimeout() {
+	if invk.timer != nil {
+		invk.timer.Stop()
+	}
+	if invk.limitTimer != nil {
+		invk.limitTimer.Stop()
+	}
+}
+
+// callTimeout cancels a pending call when its timeout expires.  This is called
+// by the call's timer, so the cancellation is submitted to the dealer's action
+// goroutine, unless the dealer is already closed.
+func (d *Dealer) callTimeout(caller *wamp.Session, callID, invocationID wamp.ID) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return
+	}
+	d.actionChan <- func() {
+		// Check that the call did not already finish.
+		if id, ok := d.invocationByCall[callID]; !ok || id != invocationID {
+			return
+		}
+		if invk, ok := d.invocations[invocationID]; ok {
+			invk.reg.timeouts++
+			d.callFinished(invk, CallTimedOut)
+		}
+		// Cancel the call as if the caller sent a CANCEL with mode killnowait.
+		d.cancel(caller, &wamp.Cancel{
+			Request: callID,
+			Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+		}, wamp.List{"call timeout"})
+	}
+}
+
+// invocationLimit cancels a pending call when its invocation limit expires,
+// unless the callee sent a progressive result since the limit was started, in
+// which case the limit is restarted from the time of that result.  This is
+// called by the invocation's limit timer.
+func (d *Dealer) invocationLimit(caller *wamp.Session, callID, invocationID wamp.ID) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return
+	}
+	d.actionChan <- func() {
+		// Check that the call did not already finish.
+		if id, ok := d.invocationByCall[callID]; !ok || id != invocationID {
+			return
+		}
+		invk, ok := d.invocations[invocationID]
+		if !ok {
+			return
+		}
+		if remaining := d.maxInvocation - time.Since(invk.lastActive); remaining > 0 {
+			invk.limitTimer.Reset(remaining)
+			return
+		}
+		invk.reg.timeouts++
+		d.callFinished(invk, CallTimedOut)
+		d.log.Println("Invocation", invocationID, "of", invk.reg.procedure,
+			"exceeded maximum duration of", d.maxInvocation)
+		d.cancel(caller, &wamp.Cancel{
+			Request: callID,
+			Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+		}, wamp.List{"maximum invocation duration exceeded"})
+	}
+}
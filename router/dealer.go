@@ -2,8 +2,12 @@ package router
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gammazero/nexus/stdlog"
@@ -21,8 +25,18 @@ const (
 	featureProgCallResults = "progressive_call_results"
 	featureSharedReg       = "shared_registration"
 	featureRegMetaAPI      = "registration_meta_api"
+	featureRegRevocation   = "registration_revocation"
 )
 
+// Reason given to a callee or subscriber removed by the
+// wamp.registration.remove_callee or wamp.subscription.remove_subscriber meta
+// procedure, if none is specified.
+const defaultRevokeReason = "removed by router"
+
+// Time limit for a gather call that does not specify a timeout, so that the
+// caller always gets a RESULT even if a callee never responds.
+const defaultGatherTimeout = time.Minute
+
 // Role information for this broker.
 var dealerRole = wamp.Dict{
 	"features": wamp.Dict{
@@ -33,6 +47,7 @@ var dealerRole = wamp.Dict{
 		featureProgCallResults: true,
 		featureSharedReg:       true,
 		featureRegMetaAPI:      true,
+		featureRegRevocation:   true,
 	},
 }
 
@@ -44,8 +59,19 @@ type registration struct {
 	match      string   // how procedure uri is matched to registration
 	policy     string   // how callee is selected if shared registration
 	disclose   bool     // callee requests disclosure of caller identity
+	fallback   bool     // only invoked if no other registration matches
 	nextCallee int      // choose callee for round-robin invocation.
 
+	// Description of the procedure, from the describe option of the first
+	// callee that gave one.
+	describe interface{}
+
+	// Number of invocations that finished with a YIELD, with an ERROR, and
+	// that timed out.
+	yields   uint64
+	errors   uint64
+	timeouts uint64
+
 	// Multiple sessions can register as callees depending on invocation policy
 	// resulting in multiple procedures for the same registration ID.
 	callees []*wamp.Session
@@ -55,7 +81,31 @@ type registration struct {
 type invocation struct {
 	callID   wamp.ID
 	callee   *wamp.Session
+	reg      *registration // registration that was invoked
 	canceled bool
+	progress bool        // caller accepts progressive results
+	timer    *time.Timer // cancels call on timeout
+	gather   *gatherCall // call that gathers results from all callees
+
+	// Cancels call when the dealer's maximum invocation duration passes
+	// without a response from the callee.
+	limitTimer *time.Timer
+	// When the invocation was sent, or the last progressive result received.
+	lastActive time.Time
+	// When the invocation was sent, if call metrics are recorded and the
+	// invocation has not yet finished.
+	sent time.Time
+}
+
+// gatherCall tracks a call that invokes all callees of a registration, and
+// gathers their results into a single RESULT.
+type gatherCall struct {
+	caller  *wamp.Session
+	callID  wamp.ID
+	results wamp.List       // result dict for each callee, in callee order
+	pending map[wamp.ID]int // invocation ID -> index of result
+	timer   *time.Timer     // returns partial results on timeout
+	done    bool
 }
 
 type Dealer struct {
@@ -63,6 +113,7 @@ type Dealer struct {
 	procRegMap    map[wamp.URI]*registration
 	pfxProcRegMap map[wamp.URI]*registration
 	wcProcRegMap  map[wamp.URI]*registration
+	fbProcRegMap  map[wamp.URI]*registration
 
 	// registration ID -> registration
 	// Used to lookup registration by ID, needed for unregister.
@@ -77,14 +128,22 @@ type Dealer struct {
 	// call ID -> invocation ID (for cancel)
 	invocationByCall map[wamp.ID]wamp.ID
 
+	// Gather calls waiting for results.  These are not in calls, since each
+	// has an invocation for every callee.
+	gathers map[*gatherCall]struct{}
+
 	// callee session -> registration ID set.
 	// Used to lookup registrations when removing a callee session.
 	calleeRegIDSet map[*wamp.Session]map[wamp.ID]struct{}
 
 	actionChan chan func()
+	// Closed when the dealer's goroutine has exited.
+	stopped chan struct{}
 
 	// Generate registration IDs.
 	idGen *wamp.IDGen
+	// Generate request IDs of meta events.
+	reqIDGen wamp.IDGenerator
 
 	// Used for round-robin call invocation.
 	prng *rand.Rand
@@ -92,6 +151,42 @@ type Dealer struct {
 	// Dealer behavior flags.
 	strictURI     bool
 	allowDisclose bool
+	// Disclose the caller of every call, whether or not requested.
+	requireDisclose bool
+
+	// Role information advertised in WELCOME, and the features disabled by
+	// SetFeatures.
+	role     wamp.Dict
+	disabled map[string]bool
+
+	// Maximum random time added to call timeouts.
+	timeoutJitter time.Duration
+	// Maximum time to wait for a callee to respond, 0 for no limit.
+	maxInvocation time.Duration
+
+	// Maximum number of registrations, 0 for no limit.
+	maxRegistrations int
+	// Maximum number of registrations per session, 0 for no limit.
+	maxSessionRegs int
+	// Authroles not limited by maxSessionRegs or disabled features.
+	exemptRoles roleSet
+
+	// Log calls that take longer than this to dispatch.
+	slowDispatch time.Duration
+
+	// Prevents call timeouts from submitting actions after dealer is closed.
+	closed    bool
+	closeLock sync.RWMutex
+
+	// Statistics, updated atomically.  The number of registrations does not
+	// include meta procedure registrations.
+	stats *dealerStats
+
+	// Notified of the number of calls in flight, if not nil.
+	metrics      MetricsRecorder
+	callMetrics  CallMetricsRecorder
+	metricsRealm wamp.URI
+	inFlight     int
 
 	metaPeer wamp.Peer
 
@@ -113,24 +208,31 @@ func NewDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *Deal
 		procRegMap:    map[wamp.URI]*registration{},
 		pfxProcRegMap: map[wamp.URI]*registration{},
 		wcProcRegMap:  map[wamp.URI]*registration{},
+		fbProcRegMap:  map[wamp.URI]*registration{},
 
 		registrations: map[wamp.ID]*registration{},
 
 		calls:            map[wamp.ID]*wamp.Session{},
 		invocations:      map[wamp.ID]*invocation{},
 		invocationByCall: map[wamp.ID]wamp.ID{},
+		gathers:          map[*gatherCall]struct{}{},
 		calleeRegIDSet:   map[*wamp.Session]map[wamp.ID]struct{}{},
 
 		// The action handler should be nearly always runable, since it is the
 		// critical section that does the only routing.  So, and unbuffered
 		// channel is appropriate.
 		actionChan: make(chan func()),
+		stopped:    make(chan struct{}),
 
-		idGen: wamp.NewIDGen(),
-		prng:  rand.New(rand.NewSource(time.Now().Unix())),
+		idGen:    wamp.NewIDGen(),
+		reqIDGen: wamp.RandomIDGen{},
+		prng:     rand.New(rand.NewSource(time.Now().Unix())),
 
 		strictURI:     strictURI,
 		allowDisclose: allowDisclose,
+		role:          dealerRole,
+
+		stats: &dealerStats{},
 
 		log:   logger,
 		debug: debug,
@@ -146,10 +248,121 @@ func (d *Dealer) SetMetaPeer(metaPeer wamp.Peer) {
 	}
 }
 
+// SetCallTimeoutJitter sets the maximum amount of random time that is added
+// to the timeout of each call that specifies a timeout.  This spreads out the
+// cancellation of calls that have the same timeout, so that calls made at the
+// same time do not all time out at the same instant.  A value of 0, the
+// default, disables jitter.
+func (d *Dealer) SetCallTimeoutJitter(jitter time.Duration) {
+	d.actionChan <- func() {
+		d.timeoutJitter = jitter
+	}
+}
+
+// SetMaxInvocationDuration sets the maximum time that the dealer waits for a
+// callee to respond to an INVOCATION, whether or not the caller gave a
+// timeout.  When the time passes, the callee is sent an INTERRUPT, and the
+// caller is sent a wamp.error.canceled ERROR, as when a call times out.  Each
+// progressive result from the callee restarts the time, so that calls with
+// progressive results are limited by the time between results.  A value of
+// 0, the default, means no limit.
+func (d *Dealer) SetMaxInvocationDuration(max time.Duration) {
+	d.actionChan <- func() {
+		d.maxInvocation = max
+	}
+}
+
+// SetMaxRegistrations sets the maximum number of registrations that the dealer
+// allows.  A REGISTER that would create a registration beyond this limit is
+// answered with a wamp.error.not_authorized ERROR.  Additional callees of a
+// shared registration, and meta procedure registrations, do not count toward
+// the limit.  A value of 0, the default, means no limit.
+func (d *Dealer) SetMaxRegistrations(max int) {
+	d.actionChan <- func() {
+		d.maxRegistrations = max
+	}
+}
+
+// SetMaxSessionRegistrations sets the maximum number of registrations that
+// each callee session may have, including shared registrations that it joins.
+// A REGISTER that would exceed this limit is answered with a
+// wamp.error.not_authorized ERROR.  Sessions internal to the router, and
+// sessions with an authrole given to SetExemptRoles, are not limited.  A value
+// of 0, the default, means no limit.
+func (d *Dealer) SetMaxSessionRegistrations(max int) {
+	d.actionChan <- func() {
+		d.maxSessionRegs = max
+	}
+}
+
+// SetExemptRoles sets the authroles of sessions that are not limited by
+// SetMaxSessionRegistrations, and that may use the features disabled by
+// SetFeatures.  Sessions internal to the router, such as the
+// meta session, are always exempt.  Roles are checked outside of the dealer's
+// goroutine, so this must be called before the dealer is used.
+func (d *Dealer) SetExemptRoles(roles []string) {
+	d.exemptRoles = newRoleSet(roles)
+}
+
+// SetRequestIDGenerator sets the generator of the request IDs of the meta
+// events published by the dealer.  The default generates random IDs.  Some
+// meta events are published outside of the dealer's goroutine, so this must
+// be called before the dealer is used.
+func (d *Dealer) SetRequestIDGenerator(gen wamp.IDGenerator) {
+	d.reqIDGen = gen
+}
+
+// SetRequireDisclosure sets whether the identity of the caller is disclosed in
+// every INVOCATION, even if neither the caller nor the callee requested
+// disclosure.  Callers cannot opt out.  Disclosure is checked outside of the
+// dealer's goroutine, so this must be called before the dealer is used.
+func (d *Dealer) SetRequireDisclosure(require bool) {
+	d.requireDisclose = require
+}
+
+// SetFeatures disables the dealer features that are false in features.  A
+// disabled feature is not advertised in the dealer role, and a REGISTER, CALL,
+// or CANCEL that uses it is answered with a wamp.error.option_not_allowed
+// ERROR, unless it is from a session exempted by SetExemptRoles.  Callees are
+// not sent anything that needs a disabled feature.  An error is returned if
+// features names a feature the dealer does not have.  Requests are checked
+// outside of the dealer's goroutine, so this must be called before the dealer
+// is used.
+func (d *Dealer) SetFeatures(features map[string]bool) error {
+	role, disabled, err := roleFeatures(dealerRole, features)
+	if err != nil {
+		return err
+	}
+	d.role = role
+	d.disabled = disabled
+	return nil
+}
+
+// SetSlowDispatchThreshold sets the amount of time that dispatching a call to
+// its callees may take before a warning is logged.  A value of 0, the default,
+// disables logging of slow dispatch.
+func (d *Dealer) SetSlowDispatchThreshold(threshold time.Duration) {
+	d.actionChan <- func() {
+		d.slowDispatch = threshold
+	}
+}
+
+// SetMetricsRecorder sets the MetricsRecorder that is given the number of
+// calls waiting for a result, for the named realm.  If the recorder is also a
+// CallMetricsRecorder, then it is given the latency of each invocation.  A nil
+// recorder, the default, disables recording.
+func (d *Dealer) SetMetricsRecorder(realm wamp.URI, metrics MetricsRecorder) {
+	d.actionChan <- func() {
+		d.metrics = metrics
+		d.callMetrics, _ = metrics.(CallMetricsRecorder)
+		d.metricsRealm = realm
+	}
+}
+
 // Role returns the role information for the "dealer" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (d *Dealer) Role() wamp.Dict {
-	return dealerRole
+	return d.role
 }
 
 // Register registers a callee to handle calls to a procedure.
@@ -161,6 +374,7 @@ func (d *Dealer) Register(callee *wamp.Session, msg *wamp.Register) {
 	if callee == nil || msg == nil {
 		panic("dealer.Register with nil session or message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
 
 	// Validate procedure URI.  For REGISTER, must be valid URI (either strict
 	// or loose), and all URI components must be non-empty other than for
@@ -198,10 +412,28 @@ func (d *Dealer) Register(callee *wamp.Session, msg *wamp.Register) {
 		}
 	}
 
-	// If callee requests disclosure of caller identity, but dealer does not
-	// allow, then send error as registration response.
+	invoke := wamp.OptionString(msg.Options, wamp.OptInvoke)
 	discloseCaller := wamp.OptionFlag(msg.Options, wamp.OptDiscloseCaller)
-	if !d.allowDisclose && discloseCaller {
+	if len(d.disabled) != 0 && !d.exemptRoles.exempt(callee) {
+		var feature string
+		switch {
+		case match != "" && match != wamp.MatchExact && d.disabled[featurePatternBasedReg]:
+			feature = featurePatternBasedReg
+		case invoke != "" && invoke != wamp.InvokeSingle && d.disabled[featureSharedReg]:
+			feature = featureSharedReg
+		case discloseCaller && d.disabled[featureCallerIdent]:
+			feature = featureCallerIdent
+		}
+		if feature != "" {
+			d.trySend(callee, featureNotAllowed(msg, msg.Request, feature))
+			return
+		}
+	}
+
+	// If callee requests disclosure of caller identity, but dealer does not
+	// allow, then send error as registration response.  Disclosure is always
+	// allowed for the router's own meta procedures.
+	if !d.allowDisclose && discloseCaller && !wampURI {
 		d.trySend(callee, &wamp.Error{
 			Type:    msg.MessageType(),
 			Request: msg.Request,
@@ -211,9 +443,26 @@ func (d *Dealer) Register(callee *wamp.Session, msg *wamp.Register) {
 		return
 	}
 
-	invoke := wamp.OptionString(msg.Options, wamp.OptInvoke)
+	// A fallback registration handles calls to any procedure within its
+	// prefix that no other registration matches, so it must be a prefix
+	// registration.
+	fallback := wamp.OptionFlag(msg.Options, wamp.OptFallback)
+	if fallback && match != wamp.MatchPrefix {
+		errMsg := fmt.Sprintf(
+			"fallback registration for %v must use %s match", msg.Procedure,
+			wamp.MatchPrefix)
+		d.trySend(callee, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{errMsg},
+		})
+		return
+	}
+
 	d.actionChan <- func() {
-		d.register(callee, msg, match, invoke, discloseCaller, wampURI)
+		d.register(callee, msg, match, invoke, discloseCaller, fallback,
+			wampURI)
 	}
 }
 
@@ -222,16 +471,83 @@ func (d *Dealer) Unregister(callee *wamp.Session, msg *wamp.Unregister) {
 	if callee == nil || msg == nil {
 		panic("dealer.Unregister with nil session or message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
 	d.actionChan <- func() {
 		d.unregister(callee, msg)
 	}
 }
 
 // Call invokes a registered remote procedure.
+//
+// If the procedure has a shared registration, then the callee is selected by
+// the registration's invocation policy, unless the CALL has an "rkey" option.
+// Calls with the same rkey are all sent to the same callee, whatever the
+// policy, for as long as that callee stays registered.  If the keyed callee
+// cannot be sent the call, then the other callees are tried in the order of
+// the invocation policy.  A keyed call still advances the position of a
+// "roundrobin" policy, as any other call does.  A CALL with runmode
+// "partition" must have an rkey.
 func (d *Dealer) Call(caller *wamp.Session, msg *wamp.Call) {
 	if caller == nil || msg == nil {
 		panic("dealer.Call with nil session or message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
+	// Validate procedure URI.  For CALL, must be valid URI (either strict or
+	// loose), and all URI components must be non-empty.
+	if !msg.Procedure.ValidURI(d.strictURI, "") {
+		errMsg := fmt.Sprintf(
+			"call to invalid procedure URI %v (URI strict checking %v)",
+			msg.Procedure, d.strictURI)
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidURI,
+			Arguments: wamp.List{errMsg},
+		})
+		return
+	}
+	if len(d.disabled) != 0 && !d.exemptRoles.exempt(caller) {
+		var feature string
+		switch {
+		case wamp.OptionInt64(msg.Options, wamp.OptTimeout) > 0 && d.disabled[featureCallTimeout]:
+			feature = featureCallTimeout
+		case wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) && d.disabled[featureCallerIdent]:
+			feature = featureCallerIdent
+		case wamp.OptionFlag(msg.Options, wamp.OptReceiveProgress) && d.disabled[featureProgCallResults]:
+			feature = featureProgCallResults
+		}
+		if feature != "" {
+			d.trySend(caller, featureNotAllowed(msg, msg.Request, feature))
+			return
+		}
+	}
+	// A Caller MAY request the disclosure of its identity to endpoints of a
+	// routed call.  Dealer MAY deny a Caller's request to disclose its
+	// identity, in which case the call is not made.
+	if !d.allowDisclose && !d.requireDisclose && wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) {
+		d.trySend(caller, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrOptionDisallowedDiscloseMe,
+		})
+		return
+	}
+	// A call in partition run mode must give the routing key that selects
+	// the callee.
+	if _, ok := msg.Options[wamp.OptRKey]; ok ||
+		wamp.OptionString(msg.Options, wamp.OptRunMode) == wamp.RunModePartition {
+		if rkey, _ := msg.Options[wamp.OptRKey].(string); rkey == "" {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{"rkey must be a non-empty string"},
+			})
+			return
+		}
+	}
 	d.actionChan <- func() {
 		d.call(caller, msg)
 	}
@@ -259,8 +575,13 @@ func (d *Dealer) Cancel(caller *wamp.Session, msg *wamp.Cancel) {
 	if caller == nil || msg == nil {
 		panic("dealer.Cancel with nil session or message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
+	if d.disabled[featureCallCanceling] && !d.exemptRoles.exempt(caller) {
+		d.trySend(caller, featureNotAllowed(msg, msg.Request, featureCallCanceling))
+		return
+	}
 	d.actionChan <- func() {
-		d.cancel(caller, msg)
+		d.cancel(caller, msg, nil)
 	}
 }
 
@@ -270,6 +591,7 @@ func (d *Dealer) Yield(callee *wamp.Session, msg *wamp.Yield) {
 	if callee == nil || msg == nil {
 		panic("dealer.Yield with nil session or message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
 	d.actionChan <- func() {
 		d.yield(callee, msg)
 	}
@@ -280,6 +602,7 @@ func (d *Dealer) Error(msg *wamp.Error) {
 	if msg == nil {
 		panic("dealer.Error with nil message")
 	}
+	atomic.AddUint64(&d.stats.routed, 1)
 	d.actionChan <- func() {
 		d.error(msg)
 	}
@@ -299,29 +622,123 @@ func (d *Dealer) RemoveSession(sess *wamp.Session) {
 	}
 }
 
-// Close stops the dealer, letting already queued actions finish.
+// Close stops the dealer, letting already queued actions finish, and waits
+// for the dealer's goroutine to exit.  Any pending call timeouts are stopped.
 func (d *Dealer) Close() {
+	d.closeLock.Lock()
+	defer d.closeLock.Unlock()
+	d.actionChan <- func() {
+		for _, invk := range d.invocations {
+			invk.stopTimeout()
+		}
+	}
+	d.closed = true
 	close(d.actionChan)
+	<-d.stopped
 }
 
 func (d *Dealer) run() {
+	defer close(d.stopped)
 	for action := range d.actionChan {
 		action()
+		if d.metrics != nil {
+			d.recordCallsInFlight()
+		}
 	}
 	if d.debug {
 		d.log.Print("Dealer stopped")
 	}
 }
 
-func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, discloseCaller, wampURI bool) {
-	var reg *registration
-	switch match {
-	default:
-		reg = d.procRegMap[msg.Procedure]
-	case wamp.MatchPrefix:
-		reg = d.pfxProcRegMap[msg.Procedure]
-	case wamp.MatchWildcard:
-		reg = d.wcProcRegMap[msg.Procedure]
+// callFinished gives the call metrics recorder the latency of a finished
+// invocation.  An invocation is only recorded once, by the first outcome.
+func (d *Dealer) callFinished(invk *invocation, outcome string) {
+	if d.callMetrics == nil || invk.sent.IsZero() {
+		return
+	}
+	d.callMetrics.CallFinished(d.metricsRealm, invk.reg.procedure, outcome,
+		time.Since(invk.sent))
+	invk.sent = time.Time{}
+}
+
+// recordCallsInFlight gives the metrics recorder the number of calls, and
+// gather calls, waiting for a result, if that number has changed.
+func (d *Dealer) recordCallsInFlight() {
+	if n := len(d.calls) + len(d.gathers); n != d.inFlight {
+		d.inFlight = n
+		d.metrics.CallsInFlight(d.metricsRealm, n)
+	}
+}
+
+func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, discloseCaller, fallback, wampURI bool) {
+	regMap := d.procRegMapFor(match, fallback)
+	reg := regMap[msg.Procedure]
+
+	// If there is an existing registration(s) for this procedure, then see if
+	// invocation policy allows another.  This is checked before the limit on
+	// the callee's registrations, so that the callee is told the procedure is
+	// already registered, whatever its limit.
+	if reg != nil {
+		// Found an existing registration that has an invocation strategy that
+		// only allows a single callee on a the given registration.
+		if reg.policy == "" || reg.policy == wamp.InvokeSingle {
+			d.log.Println("REGISTER for already registered procedure",
+				msg.Procedure, "from callee", callee)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: errorDetails(d.debug, wamp.Dict{
+					"cause":        "registration only allows single callee",
+					"registration": reg.id,
+					wamp.OptMatch:  match,
+				}),
+				Error:     wamp.ErrProcedureAlreadyExists,
+				Arguments: wamp.List{msg.Procedure},
+			})
+			return
+		}
+
+		// Found an existing registration that has an invocation strategy
+		// different from the one requested by the new callee
+		if reg.policy != invokePolicy {
+			d.log.Println("REGISTER for already registered procedure",
+				msg.Procedure, "with conflicting invocation policy (has",
+				reg.policy, "and", invokePolicy, "was requested")
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: errorDetails(d.debug, wamp.Dict{
+					"cause":        "conflicting invocation policy",
+					"registration": reg.id,
+					wamp.OptMatch:  match,
+					wamp.OptInvoke: reg.policy,
+				}),
+				Error:     wamp.ErrProcedureAlreadyExists,
+				Arguments: wamp.List{msg.Procedure},
+			})
+			return
+		}
+	}
+
+	// Do not allow a callee to have more than the maximum number of
+	// registrations.
+	if d.maxSessionRegs > 0 && len(d.calleeRegIDSet[callee]) >= d.maxSessionRegs &&
+		!d.exemptRoles.exempt(callee) {
+		d.log.Println("REGISTER for", msg.Procedure, "from callee", callee,
+			"exceeds maximum registrations for session")
+		errMsg := fmt.Sprintf("session has maximum number of registrations (%d)",
+			d.maxSessionRegs)
+		d.trySend(callee, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: errorDetails(d.debug, wamp.Dict{
+				"cause":     "maximum registrations for session",
+				"procedure": msg.Procedure,
+			}),
+			Error:     wamp.ErrNotAuthorized,
+			Arguments: wamp.List{errMsg},
+		})
+		return
 	}
 
 	var created string
@@ -329,6 +746,29 @@ func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invok
 	// If no existing registration found for the procedure, then create a new
 	// registration.
 	if reg == nil {
+		// Do not allow a client to create more than the maximum number of
+		// registrations.
+		if !wampURI && d.maxRegistrations > 0 && int(d.stats.registrations) >= d.maxRegistrations {
+			d.log.Println("REGISTER for", msg.Procedure, "from callee", callee,
+				"exceeds maximum registrations")
+			errMsg := fmt.Sprintf("maximum number of registrations (%d) reached",
+				d.maxRegistrations)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: errorDetails(d.debug, wamp.Dict{
+					"cause":     "maximum registrations",
+					"procedure": msg.Procedure,
+				}),
+				Error:     wamp.ErrNotAuthorized,
+				Arguments: wamp.List{errMsg},
+			})
+			return
+		}
+		if !wampURI {
+			atomic.AddInt64(&d.stats.registrations, 1)
+		}
+
 		regID = d.idGen.Next()
 		created = wamp.NowISO8601()
 		reg = &registration{
@@ -338,17 +778,12 @@ func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invok
 			match:     match,
 			policy:    invokePolicy,
 			disclose:  discloseCaller,
+			fallback:  fallback,
+			describe:  msg.Options[wamp.OptDescribe],
 			callees:   []*wamp.Session{callee},
 		}
 		d.registrations[regID] = reg
-		switch match {
-		default:
-			d.procRegMap[msg.Procedure] = reg
-		case wamp.MatchPrefix:
-			d.pfxProcRegMap[msg.Procedure] = reg
-		case wamp.MatchWildcard:
-			d.wcProcRegMap[msg.Procedure] = reg
-		}
+		regMap[msg.Procedure] = reg
 
 		if !wampURI && d.metaPeer != nil {
 			// wamp.registration.on_create is fired when a registration is
@@ -362,48 +797,19 @@ func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invok
 				wamp.OptInvoke: invokePolicy,
 			}
 			d.metaPeer.Send(&wamp.Publish{
-				Request:   wamp.GlobalID(),
+				Request:   d.reqIDGen.Next(),
 				Topic:     wamp.MetaEventRegOnCreate,
 				Arguments: wamp.List{callee.ID, details},
 			})
 		}
 	} else {
-		// There is an existing registration(s) for this procedure.  See if
-		// invocation policy allows another.
-
-		// Found an existing registration that has an invocation strategy that
-		// only allows a single callee on a the given registration.
-		if reg.policy == "" || reg.policy == wamp.InvokeSingle {
-			d.log.Println("REGISTER for already registered procedure",
-				msg.Procedure, "from callee", callee)
-			d.trySend(callee, &wamp.Error{
-				Type:    msg.MessageType(),
-				Request: msg.Request,
-				Details: wamp.Dict{},
-				Error:   wamp.ErrProcedureAlreadyExists,
-			})
-			return
-		}
-
-		// Found an existing registration that has an invocation strategy
-		// different from the one requested by the new callee
-		if reg.policy != invokePolicy {
-			d.log.Println("REGISTER for already registered procedure",
-				msg.Procedure, "with conflicting invocation policy (has",
-				reg.policy, "and", invokePolicy, "was requested")
-			d.trySend(callee, &wamp.Error{
-				Type:    msg.MessageType(),
-				Request: msg.Request,
-				Details: wamp.Dict{},
-				Error:   wamp.ErrProcedureAlreadyExists,
-			})
-			return
-		}
-
 		regID = reg.id
 
 		// Add callee for the registration.
 		reg.callees = append(reg.callees, callee)
+		if reg.describe == nil {
+			reg.describe = msg.Options[wamp.OptDescribe]
+		}
 	}
 
 	// Add the registration ID to the callees set of registrations.
@@ -428,7 +834,7 @@ func (d *Dealer) register(callee *wamp.Session, msg *wamp.Register, match, invok
 		// event, since the first registration results in both the creation of
 		// the registration and the addition of a session.
 		d.metaPeer.Send(&wamp.Publish{
-			Request:   wamp.GlobalID(),
+			Request:   d.reqIDGen.Next(),
 			Topic:     wamp.MetaEventRegOnRegister,
 			Arguments: wamp.List{callee.ID, regID},
 		})
@@ -450,7 +856,7 @@ func (d *Dealer) unregister(callee *wamp.Session, msg *wamp.Unregister) {
 		d.trySend(callee, &wamp.Error{
 			Type:    msg.MessageType(),
 			Request: msg.Request,
-			Details: wamp.Dict{},
+			Details: errorDetails(d.debug, wamp.Dict{"cause": err.Error()}),
 			Error:   wamp.ErrNoSuchRegistration,
 		})
 		return
@@ -458,16 +864,22 @@ func (d *Dealer) unregister(callee *wamp.Session, msg *wamp.Unregister) {
 
 	d.trySend(callee, &wamp.Unregistered{Request: msg.Request})
 
+	d.pubUnregisterMeta(callee.ID, msg.Registration, delReg)
+}
+
+// pubUnregisterMeta publishes the meta events for a callee that is removed
+// from a registration, and for the registration if it was deleted.
+func (d *Dealer) pubUnregisterMeta(calleeID, regID wamp.ID, delReg bool) {
 	if d.metaPeer == nil {
 		return
 	}
 
 	// Publish wamp.registration.on_unregister meta event.  Fired when a
-	// session is removed from a subscription.
+	// callee session is removed from a registration.
 	d.metaPeer.Send(&wamp.Publish{
-		Request:   wamp.GlobalID(),
+		Request:   d.reqIDGen.Next(),
 		Topic:     wamp.MetaEventRegOnUnregister,
-		Arguments: wamp.List{callee.ID, msg.Registration},
+		Arguments: wamp.List{calleeID, regID},
 	})
 
 	if delReg {
@@ -476,24 +888,89 @@ func (d *Dealer) unregister(callee *wamp.Session, msg *wamp.Unregister) {
 		// been removed.  The wamp.registration.on_delete event MUST be
 		// preceded by a wamp.registration.on_unregister event.
 		d.metaPeer.Send(&wamp.Publish{
-			Request:   wamp.GlobalID(),
+			Request:   d.reqIDGen.Next(),
 			Topic:     wamp.MetaEventRegOnDelete,
-			Arguments: wamp.List{callee.ID, msg.Registration},
+			Arguments: wamp.List{calleeID, regID},
 		})
 	}
 }
 
+// revokeReg tells a callee that the router removed it from the registration,
+// by sending it an UNREGISTERED message with the reason, if the callee
+// supports registration revocation.
+func (d *Dealer) revokeReg(callee *wamp.Session, regID wamp.ID, reason string) {
+	if !d.calleeHas(callee, featureRegRevocation) {
+		return
+	}
+	d.trySend(callee, &wamp.Unregistered{
+		Details: wamp.Dict{
+			"registration": regID,
+			"reason":       reason,
+		},
+	})
+}
+
+// revokeSession removes a session that is being killed from all its
+// registrations, telling the session that each is revoked, so that no more
+// calls are sent to it.  This waits for the removal to be done, so that the
+// session is told before it is sent GOODBYE.  Unlike for a session that
+// leaves, the meta events for the registrations come before the session's
+// on_leave event.
+//
+// The meta events are published after the dealer's action is done, since
+// the session may be killed by a meta procedure whose YIELD the meta session
+// is waiting to give to the dealer.
+func (d *Dealer) revokeSession(sess *wamp.Session, reason string) {
+	deleted := make(chan map[wamp.ID]bool)
+	d.actionChan <- func() {
+		regIDs := make(map[wamp.ID]bool, len(d.calleeRegIDSet[sess]))
+		for regID := range d.calleeRegIDSet[sess] {
+			delReg, err := d.delCalleeReg(sess, regID)
+			if err != nil {
+				panic("!!! Callee had ID of nonexistent registration")
+			}
+			d.revokeReg(sess, regID, reason)
+			regIDs[regID] = delReg
+		}
+		delete(d.calleeRegIDSet, sess)
+		deleted <- regIDs
+	}
+	for regID, delReg := range <-deleted {
+		d.pubUnregisterMeta(sess.ID, regID, delReg)
+	}
+}
+
+// procRegMapFor returns the map of procedure URI to registration that holds
+// registrations with the given match policy.
+func (d *Dealer) procRegMapFor(match string, fallback bool) map[wamp.URI]*registration {
+	switch match {
+	case wamp.MatchPrefix:
+		if fallback {
+			return d.fbProcRegMap
+		}
+		return d.pfxProcRegMap
+	case wamp.MatchWildcard:
+		return d.wcProcRegMap
+	}
+	return d.procRegMap
+}
+
 // matchProcedure finds the best matching registration given a procedure URI.
 //
-// If there are both matching prefix and wildcard registrations, then find the
-// one with the more specific match (longest matched pattern).
+// As the WAMP spec requires, an exact match is preferred over a prefix match,
+// and a prefix match over a wildcard match.  Of the matching prefixes, the
+// longest wins; two different prefixes of the same URI cannot have the same
+// length.  Of the matching wildcards, the one whose first non-empty component
+// comes earliest wins, so "a.b." beats "a..c", which beats ".b.c".  Wildcards
+// that tie on this are compared by their next non-empty component, and so on;
+// two different patterns that match the same URI always differ somewhere, so
+// exactly one registration is selected.  Fallback registrations are only
+// considered when no other registration matches.
 func (d *Dealer) matchProcedure(procedure wamp.URI) (*registration, bool) {
 	// Find registered procedures with exact match.
 	reg, ok := d.procRegMap[procedure]
 	if !ok {
-		// No exact match was found.  So, search for a prefix or wildcard
-		// match, and prefer the most specific math (longest matched pattern).
-		// If there is a tie, then prefer the first longest prefix.
+		// No exact match was found, so search for the longest prefix match.
 		var matchCount int
 		for pfxProc, pfxReg := range d.pfxProcRegMap {
 			if procedure.PrefixMatch(pfxProc) {
@@ -504,11 +981,29 @@ func (d *Dealer) matchProcedure(procedure wamp.URI) (*registration, bool) {
 				}
 			}
 		}
+	}
+	if !ok {
+		// No prefix match was found, so search for the most specific
+		// wildcard match.
+		var match wamp.URI
 		for wcProc, wcReg := range d.wcProcRegMap {
 			if procedure.WildcardMatch(wcProc) {
-				if len(wcProc) > matchCount {
+				if !ok || moreSpecificWildcard(wcProc, match) {
 					reg = wcReg
-					matchCount = len(wcProc)
+					match = wcProc
+					ok = true
+				}
+			}
+		}
+	}
+	if !ok {
+		// Nothing else matched, so look for the most specific fallback.
+		var matchCount int
+		for fbProc, fbReg := range d.fbProcRegMap {
+			if procedure.PrefixMatch(fbProc) {
+				if len(fbProc) > matchCount {
+					reg = fbReg
+					matchCount = len(fbProc)
 					ok = true
 				}
 			}
@@ -517,6 +1012,24 @@ func (d *Dealer) matchProcedure(procedure wamp.URI) (*registration, bool) {
 	return reg, ok
 }
 
+// moreSpecificWildcard returns true if wildcard pattern a is more specific
+// than wildcard pattern b, where both patterns match the same URI, and so have
+// the same number of components.  The pattern with a non-empty component where
+// the other has an empty one, at the first such position, is more specific.
+func moreSpecificWildcard(a, b wamp.URI) bool {
+	aParts := strings.Split(string(a), ".")
+	bParts := strings.Split(string(b), ".")
+	for i := range aParts {
+		if i == len(bParts) {
+			break
+		}
+		if (aParts[i] == "") != (bParts[i] == "") {
+			return aParts[i] != ""
+		}
+	}
+	return false
+}
+
 func (d *Dealer) call(caller *wamp.Session, msg *wamp.Call) {
 	reg, ok := d.matchProcedure(msg.Procedure)
 	if !ok || len(reg.callees) == 0 {
@@ -524,40 +1037,38 @@ func (d *Dealer) call(caller *wamp.Session, msg *wamp.Call) {
 		d.trySend(caller, &wamp.Error{
 			Type:    msg.MessageType(),
 			Request: msg.Request,
-			Details: wamp.Dict{},
-			Error:   wamp.ErrNoSuchProcedure,
+			Details: errorDetails(d.debug, wamp.Dict{
+				"cause":     "no registration matches procedure",
+				"procedure": msg.Procedure,
+			}),
+			Error: wamp.ErrNoSuchProcedure,
 		})
 		return
 	}
 
-	var callee *wamp.Session
+	atomic.AddUint64(&d.stats.calls, 1)
 
-	// If there are multiple callees, then select a callee based invocation
-	// policy.
-	if len(reg.callees) > 1 {
-		switch reg.policy {
-		case wamp.InvokeFirst:
-			callee = reg.callees[0]
-		case wamp.InvokeRoundRobin:
-			if reg.nextCallee >= len(reg.callees) {
-				reg.nextCallee = 0
-			}
-			callee = reg.callees[reg.nextCallee]
-			reg.nextCallee++
-		case wamp.InvokeRandom:
-			callee = reg.callees[d.prng.Int63n(int64(len(reg.callees)))]
-		case wamp.InvokeLast:
-			callee = reg.callees[len(reg.callees)-1]
-		default:
-			errMsg := fmt.Sprint("multiple callees registered for ",
-				msg.Procedure, " with '", wamp.InvokeSingle, "' policy")
-			// This is disallowed by the dealer, and is a programming error if
-			// it ever happened, so panic.
-			panic(errMsg)
-		}
-	} else {
-		callee = reg.callees[0]
+	if d.slowDispatch > 0 {
+		defer d.logSlowDispatch(msg.Procedure, len(reg.callees), time.Now())
+	}
+
+	// A Caller may request that all callees of the registration are invoked,
+	// and their results gathered into a single result.
+	if wamp.OptionString(msg.Options, wamp.OptRunMode) == wamp.RunModeGather {
+		d.gather(caller, msg, reg)
+		return
 	}
+
+	// Select a callee based on the invocation policy.  The other callees are
+	// tried, in policy order, if the selected callee cannot be sent to.
+	callees := d.selectCallees(reg)
+	// A Caller may give a routing key to select the callee, so that calls
+	// with the same key go to the same callee.  This overrides the invocation
+	// policy, which only orders the other callees.
+	if rkey := wamp.OptionString(msg.Options, wamp.OptRKey); rkey != "" {
+		callees = keyCallees(rkey, callees)
+	}
+	callee := callees[0]
 	details := wamp.Dict{}
 
 	// A Caller might want to issue a call providing a timeout for the call to
@@ -568,69 +1079,80 @@ func (d *Dealer) call(caller *wamp.Session, msg *wamp.Call) {
 	timeout := wamp.OptionInt64(msg.Options, wamp.OptTimeout)
 	if timeout > 0 {
 		// Check that callee supports call_timeout.
-		if callee.HasFeature(roleCallee, featureCallTimeout) {
+		if d.calleeHas(callee, featureCallTimeout) {
 			details[wamp.OptTimeout] = timeout
 		}
-
-		// TODO: Start a goroutine to cancel the pending call on timeout.
-		// Should be implemented like Cancel with mode=killnowait, and error
-		// message argument should say "call timeout"
 	}
 
 	// TODO: handle trust levels
 
+	// Pass on the marker of a call forwarded by a realm link.
+	if origin, ok := msg.Options[optNexusOrigin]; ok {
+		details[optNexusOrigin] = origin
+	}
+
 	// If the callee has requested disclosure of caller identity when the
-	// registration was created, and this was allowed by the dealer.
-	if reg.disclose {
-		details[roleCaller] = caller.ID
-	} else {
-		// A Caller MAY request the disclosure of its identity (its WAMP
-		// session ID) to endpoints of a routed call.  This is indicated by the
-		// "disclose_me" flag in the message options.
-		if wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) {
-			// Dealer MAY deny a Caller's request to disclose its identity.
-			if !d.allowDisclose {
-				d.trySend(caller, &wamp.Error{
-					Type:    msg.MessageType(),
-					Request: msg.Request,
-					Details: wamp.Dict{},
-					Error:   wamp.ErrOptionDisallowedDiscloseMe,
-				})
-			}
-			if callee.HasFeature(roleCallee, featureCallerIdent) {
-				details[roleCaller] = caller.ID
-			}
+	// registration was created, and this was allowed by the dealer, or if
+	// the dealer requires disclosure.
+	if reg.disclose || d.requireDisclose {
+		discloseCaller(caller, details)
+	} else if wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe) {
+		// A Caller MAY request the disclosure of its identity to endpoints
+		// of a routed call.  This is indicated by the "disclose_me" flag in
+		// the message options, and was already checked to be allowed.
+		if d.calleeHas(callee, featureCallerIdent) {
+			discloseCaller(caller, details)
 		}
 	}
 
 	// A Caller indicates its willingness to receive progressive results by
 	// setting CALL.Options.receive_progress|bool := true
-	if wamp.OptionFlag(msg.Options, wamp.OptReceiveProgress) {
+	receiveProgress := wamp.OptionFlag(msg.Options, wamp.OptReceiveProgress)
+	if receiveProgress {
 		// If the Callee supports progressive calls, the Dealer will
 		// forward the Caller's willingness to receive progressive
 		// results by setting.
-		if callee.HasFeature(roleCallee, featureProgCallResults) {
+		if d.calleeHas(callee, featureProgCallResults) {
 			details[wamp.OptReceiveProgress] = true
 		}
 	}
 
 	d.calls[msg.Request] = caller
 	invocationID := d.idGen.Next()
-	d.invocations[invocationID] = &invocation{
-		callID: msg.Request,
-		callee: callee,
+	invk := &invocation{
+		callID:   msg.Request,
+		callee:   callee,
+		reg:      reg,
+		progress: receiveProgress,
+	}
+	if d.callMetrics != nil {
+		invk.sent = time.Now()
 	}
+	d.invocations[invocationID] = invk
 	d.invocationByCall[msg.Request] = invocationID
 
+	// Cancel the pending call if it does not finish before the timeout.
+	d.startCallTimeout(caller, msg.Request, invocationID, timeout)
+	d.startInvocationLimit(caller, msg.Request, invocationID)
+
 	// Send INVOCATION to the endpoint that has registered the requested
-	// procedure.
-	if !d.trySend(callee, &wamp.Invocation{
+	// procedure.  If the callee is closed or blocked, then skip it and send
+	// to the next callee of a shared registration.
+	invMsg := &wamp.Invocation{
 		Request:      invocationID,
 		Registration: reg.id,
 		Details:      details,
 		Arguments:    msg.Arguments,
 		ArgumentsKw:  msg.ArgumentsKw,
-	}) {
+	}
+	var sent bool
+	for _, callee = range callees {
+		invk.callee = callee
+		if sent = d.trySend(callee, invMsg); sent {
+			break
+		}
+	}
+	if !sent {
 		d.error(&wamp.Error{
 			Type:      wamp.INVOCATION,
 			Request:   invocationID,
@@ -641,7 +1163,232 @@ func (d *Dealer) call(caller *wamp.Session, msg *wamp.Call) {
 	}
 }
 
-func (d *Dealer) cancel(caller *wamp.Session, msg *wamp.Cancel) {
+// logSlowDispatch logs a warning if dispatching a call, which started at the
+// given time, took longer than the slow dispatch threshold.
+func (d *Dealer) logSlowDispatch(procedure wamp.URI, calleeCount int, start time.Time) {
+	if elapsed := time.Since(start); elapsed > d.slowDispatch {
+		d.log.Printf("!!! Slow dispatch of call to %v: %d callees took %v",
+			procedure, calleeCount, elapsed)
+	}
+}
+
+// gather invokes every callee of the registration, and sends the caller a
+// single RESULT whose arguments are a list of one dict per callee.  Each dict
+// contains the callee's session ID and either the "args" and "kwargs" of its
+// YIELD, or the "error", "args", and "kwargs" of its ERROR.
+//
+// The RESULT is sent when the call's timeout, or defaultGatherTimeout if the
+// call has none, expires even if some callees have not responded.  The dict
+// for each non-responding callee has "timed_out" set, and the RESULT details
+// have "partial" set.  A callee that leaves the realm before responding is
+// given a wamp.error.canceled error.
+//
+// Progressive results and cancellation are not supported for gather calls.
+func (d *Dealer) gather(caller *wamp.Session, msg *wamp.Call, reg *registration) {
+	g := &gatherCall{
+		caller:  caller,
+		callID:  msg.Request,
+		results: make(wamp.List, len(reg.callees)),
+		pending: make(map[wamp.ID]int, len(reg.callees)),
+	}
+	forceDisclose := reg.disclose || d.requireDisclose
+	discloseMe := wamp.OptionFlag(msg.Options, wamp.OptDiscloseMe)
+	timeout := defaultGatherTimeout
+	if t := wamp.OptionInt64(msg.Options, wamp.OptTimeout); t > 0 {
+		timeout = d.timeoutDuration(t)
+	}
+	g.timer = time.AfterFunc(timeout, func() {
+		d.gatherTimeout(g)
+	})
+	d.gathers[g] = struct{}{}
+
+	for i, callee := range reg.callees {
+		g.results[i] = wamp.Dict{"callee": callee.ID}
+		// As for other calls, disclose_me only discloses the caller to
+		// callees that support caller identification.
+		details := wamp.Dict{}
+		if forceDisclose || (discloseMe && d.calleeHas(callee, featureCallerIdent)) {
+			discloseCaller(caller, details)
+		}
+		invocationID := d.idGen.Next()
+		if !d.trySend(callee, &wamp.Invocation{
+			Request:      invocationID,
+			Registration: reg.id,
+			Details:      details,
+			Arguments:    msg.Arguments,
+			ArgumentsKw:  msg.ArgumentsKw,
+		}) {
+			g.results[i].(wamp.Dict)[wamp.OptError] = wamp.ErrNetworkFailure
+			continue
+		}
+		g.pending[invocationID] = i
+		invk := &invocation{
+			callID: msg.Request,
+			callee: callee,
+			reg:    reg,
+			timer:  g.timer,
+			gather: g,
+		}
+		if d.callMetrics != nil {
+			invk.sent = time.Now()
+		}
+		d.invocations[invocationID] = invk
+	}
+	if len(g.pending) == 0 {
+		d.finishGather(g)
+	}
+}
+
+// gatherResult records the result from one callee of a gather call, and
+// finishes the call if this was the last result.
+func (d *Dealer) gatherResult(invocationID wamp.ID, g *gatherCall, result wamp.Dict) {
+	delete(d.invocations, invocationID)
+	i, ok := g.pending[invocationID]
+	if !ok {
+		return
+	}
+	delete(g.pending, invocationID)
+	res := g.results[i].(wamp.Dict)
+	for k, v := range result {
+		res[k] = v
+	}
+	if len(g.pending) == 0 {
+		d.finishGather(g)
+	}
+}
+
+// gatherTimeout finishes a gather call, with partial results, when its timeout
+// expires.  This is called by the call's timer, so the work is submitted to
+// the dealer's action goroutine, unless the dealer is already closed.
+func (d *Dealer) gatherTimeout(g *gatherCall) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return
+	}
+	d.actionChan <- func() {
+		d.finishGather(g)
+	}
+}
+
+// finishGather sends the gathered results to the caller.  Any callee that has
+// not responded is marked as timed out, and interrupted if it supports call
+// canceling.
+func (d *Dealer) finishGather(g *gatherCall) {
+	if g.done {
+		return
+	}
+	g.done = true
+	g.timer.Stop()
+	delete(d.gathers, g)
+	details := wamp.Dict{}
+	for invocationID, i := range g.pending {
+		g.results[i].(wamp.Dict)["timed_out"] = true
+		details["partial"] = true
+		invk := d.invocations[invocationID]
+		delete(d.invocations, invocationID)
+		invk.reg.timeouts++
+		d.callFinished(invk, CallTimedOut)
+		if d.calleeHas(invk.callee, featureCallCanceling) {
+			d.trySend(invk.callee, &wamp.Interrupt{
+				Request: invocationID,
+				Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+			})
+		}
+	}
+	g.pending = nil
+	d.trySend(g.caller, &wamp.Result{
+		Request:   g.callID,
+		Details:   details,
+		Arguments: g.results,
+	})
+}
+
+// selectCallees returns the callees of the registration in the order they are
+// to be tried, according to the registration's invocation policy.  The first
+// callee is the one selected by the policy.
+func (d *Dealer) selectCallees(reg *registration) []*wamp.Session {
+	n := len(reg.callees)
+	if n == 1 {
+		return reg.callees
+	}
+	var start int
+	switch reg.policy {
+	case wamp.InvokeFirst:
+		return reg.callees
+	case wamp.InvokeRoundRobin:
+		if reg.nextCallee >= n {
+			reg.nextCallee = 0
+		}
+		start = reg.nextCallee
+		reg.nextCallee++
+	case wamp.InvokeRandom:
+		start = int(d.prng.Int63n(int64(n)))
+	case wamp.InvokeLast:
+		callees := make([]*wamp.Session, n)
+		for i := range reg.callees {
+			callees[i] = reg.callees[n-1-i]
+		}
+		return callees
+	default:
+		errMsg := fmt.Sprint("multiple callees registered for ",
+			reg.procedure, " with '", wamp.InvokeSingle, "' policy")
+		// This is disallowed by the dealer, and is a programming error if it
+		// ever happened, so panic.
+		panic(errMsg)
+	}
+	callees := make([]*wamp.Session, 0, n)
+	callees = append(callees, reg.callees[start:]...)
+	return append(callees, reg.callees[:start]...)
+}
+
+// keyCallees moves the callee selected by the routing key to the front of the
+// callees, keeping the order of the others.
+//
+// The callee is selected by rendezvous hashing: the key is hashed with each
+// callee's session ID, and the callee with the highest hash is selected.  So,
+// a key selects the same callee for as long as that callee is registered, and
+// when a callee is added or removed, only the keys selecting that callee move
+// to another callee.
+func keyCallees(rkey string, callees []*wamp.Session) []*wamp.Session {
+	if len(callees) < 2 {
+		return callees
+	}
+	var sel int
+	var maxHash uint64
+	for i, callee := range callees {
+		h := fnv.New64a()
+		h.Write([]byte(rkey))
+		id := uint64(callee.ID)
+		h.Write([]byte{byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24),
+			byte(id >> 32), byte(id >> 40), byte(id >> 48), byte(id >> 56)})
+		if sum := h.Sum64(); i == 0 || sum > maxHash {
+			sel, maxHash = i, sum
+		}
+	}
+	if sel == 0 {
+		return callees
+	}
+	keyed := make([]*wamp.Session, 0, len(callees))
+	keyed = append(keyed, callees[sel])
+	keyed = append(keyed, callees[:sel]...)
+	return append(keyed, callees[sel+1:]...)
+}
+
+// timeoutDuration returns how long to wait before canceling a call that has
+// the specified timeout in milliseconds.  A random amount of time, up to the
+// dealer's timeout jitter, is added to the timeout.
+func (d *Dealer) timeoutDuration(timeout int64) time.Duration {
+	dur := time.Duration(timeout) * time.Millisecond
+	if d.timeoutJitter > 0 {
+		dur += time.Duration(d.prng.Int63n(int64(d.timeoutJitter)))
+	}
+	return dur
+}
+
+// cancel cancels the pending call.  If errArgs is not nil, then it is used as
+// the arguments of the ERROR sent to the caller.
+func (d *Dealer) cancel(caller *wamp.Session, msg *wamp.Cancel, errArgs wamp.List) {
 	procCaller, ok := d.calls[msg.Request]
 	if !ok {
 		// There is no pending call to cancel.
@@ -680,7 +1427,7 @@ func (d *Dealer) cancel(caller *wamp.Session, msg *wamp.Cancel) {
 	if mode == wamp.CancelModeKillNoWait || mode == wamp.CancelModeKill {
 		// Check that callee supports call canceling to see if it is alright to
 		// send INTERRUPT to callee.
-		if !invk.callee.HasFeature(roleCallee, featureCallCanceling) {
+		if !d.calleeHas(invk.callee, featureCallCanceling) {
 			// Cancel in dealer without sending INTERRUPT to callee.
 			d.log.Println("Callee", invk.callee, "does not support call canceling")
 		} else {
@@ -714,13 +1461,16 @@ func (d *Dealer) cancel(caller *wamp.Session, msg *wamp.Cancel) {
 	delete(d.calls, msg.Request)
 	delete(d.invocationByCall, msg.Request)
 	delete(d.invocations, invocationID)
+	invk.stopTimeout()
+	d.callFinished(invk, CallCanceled)
 
 	// Send error to the caller.
 	d.trySend(caller, &wamp.Error{
-		Type:    wamp.CALL,
-		Request: msg.Request,
-		Error:   wamp.ErrCanceled,
-		Details: wamp.Dict{},
+		Type:      wamp.CALL,
+		Request:   msg.Request,
+		Error:     wamp.ErrCanceled,
+		Details:   wamp.Dict{},
+		Arguments: errArgs,
 	})
 }
 
@@ -733,22 +1483,54 @@ func (d *Dealer) yield(callee *wamp.Session, msg *wamp.Yield) {
 			msg.Request)
 		return
 	}
+	progress := wamp.OptionFlag(msg.Options, wamp.OptProgress)
+	if invk.gather != nil {
+		// Only the final result is gathered.
+		if !progress {
+			invk.reg.yields++
+			d.callFinished(invk, CallSucceeded)
+			d.gatherResult(msg.Request, invk.gather, wamp.Dict{
+				"args":   msg.Arguments,
+				"kwargs": msg.ArgumentsKw,
+			})
+		}
+		return
+	}
+
 	callID := invk.callID
 	// Find caller for this result.
 	caller, ok := d.calls[callID]
 
 	details := wamp.Dict{}
 
-	progress := wamp.OptionFlag(msg.Options, wamp.OptProgress)
 	if !progress {
+		invk.stopTimeout()
 		delete(d.invocations, msg.Request)
 		// Delete callID -> invocation.
 		delete(d.invocationByCall, callID)
 		// Delete pending call since it is finished.
 		delete(d.calls, callID)
 	} else {
+		// A caller that did not request progressive results must only
+		// receive the final result, so drop the progressive result.  Also
+		// drop progressive results for a call that is being canceled.
+		if invk.canceled {
+			if d.debug {
+				d.log.Println("Dropped progressive YIELD for call", callID,
+					"that is being canceled")
+			}
+			return
+		}
+		if !invk.progress {
+			if d.debug {
+				d.log.Println("Dropped progressive YIELD for call", callID,
+					"that did not request progressive results")
+			}
+			return
+		}
 		// If this is a progressive response, then set progress=true.
 		details[wamp.OptProgress] = true
+		invk.lastActive = time.Now()
 	}
 
 	// Did not find caller.
@@ -758,6 +1540,15 @@ func (d *Dealer) yield(callee *wamp.Session, msg *wamp.Yield) {
 			msg.Request)
 		return
 	}
+	if !progress {
+		if invk.canceled {
+			// The callee finished a call canceled with mode "kill".
+			d.callFinished(invk, CallCanceled)
+		} else {
+			invk.reg.yields++
+			d.callFinished(invk, CallSucceeded)
+		}
+	}
 
 	// Send RESULT to the caller.  This forwards the YIELD from the callee.
 	d.trySend(caller, &wamp.Result{
@@ -776,6 +1567,17 @@ func (d *Dealer) error(msg *wamp.Error) {
 			msg.Request, "(response to canceled call)")
 		return
 	}
+	if invk.gather != nil {
+		invk.reg.errors++
+		d.callFinished(invk, CallFailed)
+		d.gatherResult(msg.Request, invk.gather, wamp.Dict{
+			wamp.OptError: msg.Error,
+			"args":        msg.Arguments,
+			"kwargs":      msg.ArgumentsKw,
+		})
+		return
+	}
+	invk.stopTimeout()
 	delete(d.invocations, msg.Request)
 	callID := invk.callID
 
@@ -792,13 +1594,24 @@ func (d *Dealer) error(msg *wamp.Error) {
 		return
 	}
 	delete(d.calls, callID)
+	if invk.canceled {
+		d.callFinished(invk, CallCanceled)
+	} else {
+		invk.reg.errors++
+		d.callFinished(invk, CallFailed)
+	}
 
-	// Send error to the caller.
+	// Send error to the caller.  The details are always a dictionary, even
+	// if the callee did not send any.
+	details := msg.Details
+	if details == nil {
+		details = wamp.Dict{}
+	}
 	d.trySend(caller, &wamp.Error{
 		Type:        wamp.CALL,
 		Request:     callID,
 		Error:       msg.Error,
-		Details:     msg.Details,
+		Details:     details,
 		Arguments:   msg.Arguments,
 		ArgumentsKw: msg.ArgumentsKw,
 	})
@@ -810,33 +1623,89 @@ func (d *Dealer) removeSession(callee *wamp.Session) {
 		if err != nil {
 			panic("!!! Callee had ID of nonexistent registration")
 		}
+		d.pubUnregisterMeta(callee.ID, regID, delReg)
+	}
+	delete(d.calleeRegIDSet, callee)
+	d.removeSessionCalls(callee)
+	d.removeGatherSession(callee)
+}
 
-		if d.metaPeer == nil {
+// removeSessionCalls ends the pending calls of a session that left the realm.
+// Calls made by the session are abandoned, interrupting their callees, since
+// there is no caller to send results to.  Calls that invoked the session, as
+// callee, are answered with a wamp.error.canceled ERROR.  Gather calls are
+// handled by removeGatherSession.
+func (d *Dealer) removeSessionCalls(sess *wamp.Session) {
+	for invocationID, invk := range d.invocations {
+		if invk.gather != nil {
 			continue
 		}
+		caller, ok := d.calls[invk.callID]
+		if !ok {
+			continue
+		}
+		switch {
+		case caller == sess:
+			// A call canceled with mode "kill" was already interrupted.
+			if !invk.canceled && invk.callee != sess && d.calleeHas(invk.callee, featureCallCanceling) {
+				d.trySend(invk.callee, &wamp.Interrupt{
+					Request: invocationID,
+					Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+				})
+			}
+			d.callFinished(invk, CallCanceled)
+		case invk.callee == sess:
+			d.trySend(caller, &wamp.Error{
+				Type:      wamp.CALL,
+				Request:   invk.callID,
+				Error:     wamp.ErrCanceled,
+				Details:   wamp.Dict{},
+				Arguments: wamp.List{"callee left realm"},
+			})
+			d.callFinished(invk, CallFailed)
+		default:
+			continue
+		}
+		invk.stopTimeout()
+		delete(d.invocations, invocationID)
+		delete(d.invocationByCall, invk.callID)
+		delete(d.calls, invk.callID)
+	}
+}
 
-		// Publish wamp.registration.on_unregister meta event.  Fired when a
-		// callee session is removed from a registration.
-		d.metaPeer.Send(&wamp.Publish{
-			Request:   wamp.GlobalID(),
-			Topic:     wamp.MetaEventRegOnUnregister,
-			Arguments: wamp.List{callee.ID, regID},
-		})
-
-		if !delReg {
+// removeGatherSession removes a session that left the realm from the gather
+// calls it is in.  Each pending invocation of the session, as callee, is
+// given an error result.  Gather calls made by the session are abandoned,
+// interrupting their callees, since there is no caller to send results to.
+func (d *Dealer) removeGatherSession(sess *wamp.Session) {
+	for g := range d.gathers {
+		if g.caller == sess {
+			g.done = true
+			g.timer.Stop()
+			delete(d.gathers, g)
+			for invocationID := range g.pending {
+				invk := d.invocations[invocationID]
+				delete(d.invocations, invocationID)
+				d.callFinished(invk, CallCanceled)
+				if invk.callee != sess && d.calleeHas(invk.callee, featureCallCanceling) {
+					d.trySend(invk.callee, &wamp.Interrupt{
+						Request: invocationID,
+						Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+					})
+				}
+			}
 			continue
 		}
-		// Publish wamp.registration.on_delete meta event.  Fired when a
-		// registration is deleted after the last session attached to it
-		// has been removed.  The wamp.registration.on_delete event MUST be
-		// preceded by a wamp.registration.on_unregister event.
-		d.metaPeer.Send(&wamp.Publish{
-			Request:   wamp.GlobalID(),
-			Topic:     wamp.MetaEventRegOnDelete,
-			Arguments: wamp.List{callee.ID, regID},
-		})
+		for invocationID := range g.pending {
+			if invk := d.invocations[invocationID]; invk.callee == sess {
+				d.callFinished(invk, CallFailed)
+				d.gatherResult(invocationID, g, wamp.Dict{
+					wamp.OptError: wamp.ErrCanceled,
+					"args":        wamp.List{"callee left realm"},
+				})
+			}
+		}
 	}
-	delete(d.calleeRegIDSet, callee)
 }
 
 // delCalleeReg deletes the the callee from the specified registration and
@@ -865,6 +1734,11 @@ func (d *Dealer) delCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, error)
 				// Delete preserving order.
 				reg.callees = append(reg.callees[:i], reg.callees[i+1:]...)
 			}
+			// Keep the round-robin position pointing at the same next
+			// callee, so that removing a callee does not skip another.
+			if i < reg.nextCallee {
+				reg.nextCallee--
+			}
 			break
 		}
 	}
@@ -873,14 +1747,10 @@ func (d *Dealer) delCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, error)
 	// according to what match type it is.
 	if len(reg.callees) == 0 {
 		delete(d.registrations, regID)
-		switch reg.match {
-		default:
-			delete(d.procRegMap, reg.procedure)
-		case wamp.MatchPrefix:
-			delete(d.pfxProcRegMap, reg.procedure)
-		case wamp.MatchWildcard:
-			delete(d.wcProcRegMap, reg.procedure)
+		if !strings.HasPrefix(string(reg.procedure), "wamp.") {
+			atomic.AddInt64(&d.stats.registrations, -1)
 		}
+		delete(d.procRegMapFor(reg.match, reg.fallback), reg.procedure)
 		if d.debug {
 			d.log.Printf("Deleted registration %v for procedure %v", regID,
 				reg.procedure)
@@ -903,6 +1773,9 @@ func (d *Dealer) RegList(msg *wamp.Invocation) wamp.Message {
 		for _, reg := range d.pfxProcRegMap {
 			pfxRegs = append(pfxRegs, reg.id)
 		}
+		for _, reg := range d.fbProcRegMap {
+			pfxRegs = append(pfxRegs, reg.id)
+		}
 		for _, reg := range d.wcProcRegMap {
 			wcRegs = append(wcRegs, reg.id)
 		}
@@ -920,29 +1793,39 @@ func (d *Dealer) RegList(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// regCounts returns the number of registrations for each match policy, which
+// are the numbers of registration IDs returned by RegList.
+func (d *Dealer) regCounts() wamp.Dict {
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		dict = wamp.Dict{
+			wamp.MatchExact:    len(d.procRegMap),
+			wamp.MatchPrefix:   len(d.pfxProcRegMap) + len(d.fbProcRegMap),
+			wamp.MatchWildcard: len(d.wcProcRegMap),
+		}
+		close(sync)
+	}
+	<-sync
+	return dict
+}
+
 // RegLookup retrieves registration IDs listed according to match policies.
 func (d *Dealer) RegLookup(msg *wamp.Invocation) wamp.Message {
 	var regID wamp.ID
 	if len(msg.Arguments) != 0 {
 		if procedure, ok := wamp.AsURI(msg.Arguments[0]); ok {
 			var match string
+			var fallback bool
 			if len(msg.Arguments) > 1 {
 				opts := msg.Arguments[1].(wamp.Dict)
 				match = wamp.OptionString(opts, wamp.OptMatch)
+				fallback = wamp.OptionFlag(opts, wamp.OptFallback)
 			}
 			sync := make(chan wamp.ID)
 			d.actionChan <- func() {
 				var r wamp.ID
-				var reg *registration
-				var ok bool
-				switch match {
-				default:
-					reg, ok = d.procRegMap[procedure]
-				case wamp.MatchPrefix:
-					reg, ok = d.pfxProcRegMap[procedure]
-				case wamp.MatchWildcard:
-					reg, ok = d.wcProcRegMap[procedure]
-				}
+				reg, ok := d.procRegMapFor(match, fallback)[procedure]
 				if ok {
 					r = reg.id
 				}
@@ -979,7 +1862,9 @@ func (d *Dealer) RegMatch(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
-// RegGet retrieves information on a particular registration.
+// RegGet retrieves information on a particular registration.  This includes
+// the number of invocations of the registration that finished with a YIELD,
+// with an ERROR, and that timed out, for tracking procedure error rates.
 func (d *Dealer) RegGet(msg *wamp.Invocation) wamp.Message {
 	var dict wamp.Dict
 	if len(msg.Arguments) != 0 {
@@ -995,6 +1880,15 @@ func (d *Dealer) RegGet(msg *wamp.Invocation) wamp.Message {
 						wamp.OptMatch:  reg.match,
 						wamp.OptInvoke: reg.policy,
 					}
+					if reg.fallback {
+						dict[wamp.OptFallback] = true
+					}
+					if reg.describe != nil {
+						dict[wamp.OptDescribe] = reg.describe
+					}
+					dict["yields"] = reg.yields
+					dict["errors"] = reg.errors
+					dict["timeouts"] = reg.timeouts
 				}
 				close(sync)
 			}
@@ -1049,6 +1943,26 @@ func (d *Dealer) RegListCallees(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// RegStats retrieves the number of registrations, not including meta
+// procedure registrations, and the configured maximum number of registrations,
+// where 0 means no limit.
+func (d *Dealer) RegStats(msg *wamp.Invocation) wamp.Message {
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		dict = wamp.Dict{
+			"count":             int(d.stats.registrations),
+			"max_registrations": d.maxRegistrations,
+		}
+		close(sync)
+	}
+	<-sync
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
 // regCountCallees obtains the number of sessions currently attached to the
 // registration.
 func (d *Dealer) RegCountCallees(msg *wamp.Invocation) wamp.Message {
@@ -1086,6 +2000,101 @@ func (d *Dealer) RegCountCallees(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// RegRemoveCallee removes the callee, whose session ID is the second argument,
+// from the registration given as the first argument.  The callee is sent an
+// UNREGISTERED message with the reason given by the "reason" keyword argument,
+// if it supports registration revocation.  Registrations of the router's meta
+// procedures cannot be removed.
+func (d *Dealer) RegRemoveCallee(msg *wamp.Invocation) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+	if len(msg.Arguments) < 2 {
+		return makeErr(wamp.ErrInvalidArgument,
+			"expected registration ID and callee session ID")
+	}
+	regID, ok := wamp.AsID(msg.Arguments[0])
+	if !ok {
+		return makeErr(wamp.ErrNoSuchRegistration)
+	}
+	calleeID, ok := wamp.AsID(msg.Arguments[1])
+	if !ok {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	reason := wamp.OptionString(msg.ArgumentsKw, "reason")
+	if reason == "" {
+		reason = defaultRevokeReason
+	}
+
+	var errMsg *wamp.Error
+	var delReg bool
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		defer close(sync)
+		reg, found := d.registrations[regID]
+		if !found {
+			errMsg = makeErr(wamp.ErrNoSuchRegistration)
+			return
+		}
+		if strings.HasPrefix(string(reg.procedure), "wamp.") {
+			errMsg = makeErr(wamp.ErrInvalidArgument,
+				"cannot remove callee of meta procedure")
+			return
+		}
+		var callee *wamp.Session
+		for _, c := range reg.callees {
+			if c.ID == calleeID {
+				callee = c
+				break
+			}
+		}
+		if callee == nil {
+			errMsg = makeErr(wamp.ErrNoSuchSession)
+			return
+		}
+		if regIDs, ok := d.calleeRegIDSet[callee]; ok {
+			delete(regIDs, regID)
+			if len(regIDs) == 0 {
+				delete(d.calleeRegIDSet, callee)
+			}
+		}
+		delReg, _ = d.delCalleeReg(callee, regID)
+		d.revokeReg(callee, regID, reason)
+	}
+	<-sync
+	if errMsg != nil {
+		return errMsg
+	}
+	// Publish the meta events outside of the dealer's action, as the meta
+	// session may be waiting to give the dealer a YIELD.
+	d.pubUnregisterMeta(calleeID, regID, delReg)
+	return &wamp.Yield{Request: msg.Request}
+}
+
+// discloseCaller adds the caller's session ID, and authid and authrole if the
+// caller has them, to the invocation details.
+func discloseCaller(caller *wamp.Session, details wamp.Dict) {
+	details[roleCaller] = caller.ID
+	if authid := wamp.OptionString(caller.Details, "authid"); authid != "" {
+		details["caller_authid"] = authid
+	}
+	if authrole := wamp.OptionString(caller.Details, "authrole"); authrole != "" {
+		details["caller_authrole"] = authrole
+	}
+}
+
+// calleeHas returns true if the callee supports the feature, and the feature
+// is not disabled for the dealer.
+func (d *Dealer) calleeHas(callee *wamp.Session, feature string) bool {
+	return !d.disabled[feature] && callee.HasFeature(roleCallee, feature)
+}
+
 func (d *Dealer) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	if err := sess.TrySend(msg); err != nil {
 		d.log.Println("!!! dealer dropped", msg.MessageType(), "message:", err)
@@ -1093,3 +2102,52 @@ func (d *Dealer) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	}
 	return true
 }
+
+// ReflectProcedureList retrieves the sorted URIs of all registered
+// procedures, whatever their match policy.
+func (d *Dealer) ReflectProcedureList(msg *wamp.Invocation) wamp.Message {
+	var procs []string
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		for _, regMap := range []map[wamp.URI]*registration{
+			d.procRegMap, d.pfxProcRegMap, d.wcProcRegMap, d.fbProcRegMap} {
+			for uri := range regMap {
+				procs = append(procs, string(uri))
+			}
+		}
+		close(sync)
+	}
+	<-sync
+	sort.Strings(procs)
+	uris := make(wamp.List, len(procs))
+	for i := range procs {
+		uris[i] = wamp.URI(procs[i])
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{uris},
+	}
+}
+
+// describeProcedure returns the URI, match policy, invocation policy, and
+// description of the registration that a call to the procedure would invoke,
+// or nil if there is no such registration.
+func (d *Dealer) describeProcedure(procedure wamp.URI) wamp.Dict {
+	var dict wamp.Dict
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		if reg, ok := d.matchProcedure(procedure); ok {
+			dict = wamp.Dict{
+				"uri":          reg.procedure,
+				wamp.OptMatch:  reg.match,
+				wamp.OptInvoke: reg.policy,
+			}
+			if reg.describe != nil {
+				dict[wamp.OptDescribe] = reg.describe
+			}
+		}
+		close(sync)
+	}
+	<-sync
+	return dict
+}
@@ -42,6 +42,7 @@ func checkMetaReg(metaClient wamp.Peer, sessID wamp.ID) error {
 
 func TestBasicRegister(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register callee
 	callee := newTestPeer()
@@ -97,6 +98,7 @@ func TestBasicRegister(t *testing.T) {
 
 func TestUnregister(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register a procedure.
 	callee := newTestPeer()
@@ -145,8 +147,82 @@ func TestUnregister(t *testing.T) {
 	}
 }
 
+func TestDuplicateRegister(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	// Register a procedure with single invocation policy.
+	callee1 := newTestPeer()
+	sess1 := &wamp.Session{Peer: callee1, ID: wamp.GlobalID()}
+	dealer.Register(sess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeSingle},
+	})
+	rsp := <-callee1.Recv()
+	regID := rsp.(*wamp.Registered).Registration
+	if err := checkMetaReg(metaClient, sess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, sess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Registering the same procedure from another callee must fail.
+	callee2 := newTestPeer()
+	sess2 := &wamp.Session{Peer: callee2, ID: wamp.GlobalID()}
+	dealer.Register(sess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeSingle},
+	})
+	rsp = <-callee2.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+	if errMsg.Request != 124 {
+		t.Fatal("wrong request ID in ERROR")
+	}
+	if len(errMsg.Arguments) == 0 || errMsg.Arguments[0] != testProcedure {
+		t.Fatal("expected conflicting procedure in error args, got:",
+			errMsg.Arguments)
+	}
+
+	// After the first callee unregisters, registering must succeed.
+	dealer.Unregister(sess1, &wamp.Unregister{Request: 125, Registration: regID})
+	rsp = <-callee1.Recv()
+	if _, ok = rsp.(*wamp.Unregistered); !ok {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaReg(metaClient, sess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, sess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	dealer.Register(sess2, &wamp.Register{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeSingle},
+	})
+	rsp = <-callee2.Recv()
+	reg, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if reg.Registration == regID {
+		t.Fatal("expected new registration ID")
+	}
+}
+
 func TestBasicCall(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register a procedure.
 	callee := newTestPeer()
@@ -232,6 +308,7 @@ func TestBasicCall(t *testing.T) {
 
 func TestRemovePeer(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register a procedure.
 	callee := newTestPeer()
@@ -284,6 +361,7 @@ func TestRemovePeer(t *testing.T) {
 
 func TestCancelCallModeKill(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -365,6 +443,7 @@ func TestCancelCallModeKill(t *testing.T) {
 
 func TestCancelCallModeKillNoWait(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -443,6 +522,7 @@ func TestCancelCallModeKillNoWait(t *testing.T) {
 
 func TestCancelCallModeSkip(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register a procedure.
 	callee := newTestPeer()
@@ -505,8 +585,120 @@ func TestCancelCallModeSkip(t *testing.T) {
 	}
 }
 
+func TestCancelYieldRace(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+				},
+			},
+		},
+	}
+
+	// Register a procedure.
+	callee := &testPeer{in: make(chan wamp.Message, 4)}
+	calleeSess := &wamp.Session{Peer: callee, Details: calleeRoles}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// The caller's channel is large enough that, if the dealer sent both a
+	// RESULT and an ERROR, the second response would not be dropped.
+	caller := &testPeer{in: make(chan wamp.Message, 4)}
+	callerSession := &wamp.Session{Peer: caller}
+
+	modes := []string{wamp.CancelModeSkip, wamp.CancelModeKill,
+		wamp.CancelModeKillNoWait}
+	for i := 0; i < 100; i++ {
+		mode := modes[i%len(modes)]
+		callID := wamp.ID(1000 + i)
+		dealer.Call(callerSession,
+			&wamp.Call{Request: callID, Procedure: testProcedure})
+		rsp = <-callee.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+
+		// Send YIELD and CANCEL at nearly the same time.
+		done := make(chan struct{})
+		go func() {
+			dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+			close(done)
+		}()
+		dealer.Cancel(callerSession, &wamp.Cancel{
+			Request: callID,
+			Options: wamp.Dict{wamp.OptMode: mode},
+		})
+		<-done
+
+		// Drain any INTERRUPT.  In "kill" mode the callee answers the
+		// INTERRUPT with ERROR, which must be discarded if the call already
+		// has a result.
+		select {
+		case rsp = <-callee.Recv():
+			if _, ok = rsp.(*wamp.Interrupt); !ok {
+				t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+			}
+			if mode == wamp.CancelModeKill {
+				dealer.Error(&wamp.Error{
+					Type:    wamp.INVOCATION,
+					Request: inv.Request,
+					Error:   wamp.ErrCanceled,
+				})
+			}
+		default:
+		}
+
+		// Sync with the dealer, and check that the call is finished.
+		sync := make(chan int)
+		dealer.actionChan <- func() {
+			sync <- len(dealer.calls) + len(dealer.invocations) +
+				len(dealer.invocationByCall)
+		}
+		if <-sync != 0 {
+			t.Fatal("call still pending after YIELD and CANCEL, mode:", mode)
+		}
+
+		// The caller must receive exactly one response to the call.
+		rsp = <-caller.Recv()
+		switch rsp := rsp.(type) {
+		case *wamp.Result:
+			if rsp.Request != callID {
+				t.Fatal("wrong request ID in RESULT")
+			}
+		case *wamp.Error:
+			if rsp.Request != callID || rsp.Error != wamp.ErrCanceled {
+				t.Fatal("wrong ERROR:", rsp.Error)
+			}
+		default:
+			t.Fatal("expected RESULT or ERROR, got:", rsp.MessageType())
+		}
+		select {
+		case rsp = <-caller.Recv():
+			t.Fatal("caller received second response:", rsp.MessageType(),
+				"mode:", mode)
+		default:
+		}
+	}
+}
+
 func TestSharedRegistrationRoundRobin(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -624,8 +816,99 @@ func TestSharedRegistrationRoundRobin(t *testing.T) {
 	}
 }
 
+func TestSharedRegistrationSkipCallees(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register three callees with roundrobin shared registration.
+	callees := make([]*wamp.Session, 3)
+	for i := range callees {
+		callees[i] = &wamp.Session{Peer: newTestPeer(), Details: calleeRoles}
+		dealer.Register(callees[i], &wamp.Register{
+			Request:   wamp.ID(123 + i),
+			Procedure: testProcedure,
+			Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
+		})
+		if _, ok := (<-callees[i].Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+	}
+
+	// Registering with a conflicting policy must fail.
+	other := &wamp.Session{Peer: newTestPeer(), Details: calleeRoles}
+	dealer.Register(other, &wamp.Register{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "random"),
+	})
+	rsp := <-other.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok ||
+		errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("expected", wamp.ErrProcedureAlreadyExists, "got:", rsp)
+	}
+
+	caller := &wamp.Session{Peer: newTestPeer()}
+	callID := wamp.ID(200)
+	blocked := map[int]bool{}
+	// expectInvocation calls the procedure and checks that the expected
+	// callee, and no other, is invoked.  The invocation is left in the
+	// callee's queue, blocking the callee, if block is true.
+	expectInvocation := func(expect int, block bool) {
+		callID++
+		dealer.Call(caller, &wamp.Call{Request: callID, Procedure: testProcedure})
+		// Sync with the dealer goroutine.
+		sync := make(chan struct{})
+		dealer.actionChan <- func() { close(sync) }
+		<-sync
+		for i, callee := range callees {
+			if callee == nil || blocked[i] {
+				continue
+			}
+			select {
+			case rsp := <-callee.Recv():
+				if i != expect {
+					t.Fatalf("callee%d invoked, expected callee%d", i, expect)
+				}
+				if block {
+					// Put the invocation back to leave the callee blocked.
+					callee.TrySend(rsp)
+					blocked[i] = true
+				}
+			default:
+				if i == expect {
+					t.Fatalf("callee%d not invoked", expect)
+				}
+			}
+		}
+	}
+
+	expectInvocation(0, false)
+	expectInvocation(1, false)
+
+	// Remove callee0, as when its session closes.  Round-robin must continue
+	// with callee2, and not skip it.
+	dealer.RemoveSession(callees[0])
+	callees[0] = nil
+	expectInvocation(2, true)
+	expectInvocation(1, false)
+
+	// callee2 is blocked, so it is skipped and callee1 is invoked instead.
+	expectInvocation(1, false)
+}
+
 func TestSharedRegistrationFirst(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -794,6 +1077,7 @@ func TestSharedRegistrationFirst(t *testing.T) {
 
 func TestSharedRegistrationLast(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -944,6 +1228,7 @@ func TestSharedRegistrationLast(t *testing.T) {
 
 func TestPatternBasedRegistration(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -1005,6 +1290,7 @@ func TestPatternBasedRegistration(t *testing.T) {
 
 func TestRPCBlockedSlowClientCall(t *testing.T) {
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	// Register a procedure.
 	callee, rtr := transport.LinkedPeers()
@@ -1047,6 +1333,7 @@ func TestCallerIdentification(t *testing.T) {
 	// Test disclose_caller
 	// Test disclose_me
 	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
@@ -1081,7 +1368,11 @@ func TestCallerIdentification(t *testing.T) {
 
 	caller := newTestPeer()
 	callerID := wamp.ID(11235813)
-	callerSession := &wamp.Session{Peer: caller, ID: callerID}
+	callerSession := &wamp.Session{
+		Peer:    caller,
+		ID:      callerID,
+		Details: wamp.Dict{"authid": "jdoe", "authrole": "admin"},
+	}
 
 	// Test calling valid procedure with full name.  Widlcard should match.
 	dealer.Call(callerSession,
@@ -1094,9 +1385,1517 @@ func TestCallerIdentification(t *testing.T) {
 		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
 	}
 
-	// Test that invocation contains caller ID.
+	// Test that invocation contains caller ID, authid, and authrole.
 	if wamp.OptionID(inv.Details, "caller") != callerID {
 		fmt.Println("===> details:", inv.Details)
 		t.Fatal("Did not get expected caller ID")
 	}
+	if inv.Details["caller_authid"] != "jdoe" {
+		t.Fatal("incorrect caller authid disclosed")
+	}
+	if inv.Details["caller_authrole"] != "admin" {
+		t.Fatal("incorrect caller authrole disclosed")
+	}
+
+	// Dealer that does not allow disclosure rejects the registration and the
+	// call that request it.
+	dealer2 := NewDealer(logger, false, false, debug)
+	defer dealer2.Close()
+	dealer2.Register(calleeSess, &wamp.Register{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{"disclose_caller": true},
+	})
+	errMsg, ok := (<-callee.Recv()).(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrOptionDisallowedDiscloseMe {
+		t.Fatal("expected", wamp.ErrOptionDisallowedDiscloseMe, "for REGISTER")
+	}
+	dealer2.Register(calleeSess, &wamp.Register{Request: 127, Procedure: testProcedure})
+	if _, ok = (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	dealer2.Call(callerSession, &wamp.Call{
+		Request:   128,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{"disclose_me": true},
+	})
+	errMsg, ok = (<-caller.Recv()).(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrOptionDisallowedDiscloseMe {
+		t.Fatal("expected", wamp.ErrOptionDisallowedDiscloseMe, "for CALL")
+	}
+	select {
+	case rsp = <-callee.Recv():
+		t.Fatal("callee invoked when disclosure disallowed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{
+		Peer: callee,
+		Details: wamp.Dict{
+			"roles": wamp.Dict{
+				"callee": wamp.Dict{
+					"features": wamp.Dict{
+						featureCallCanceling: true,
+						featureCallTimeout:   true,
+					},
+				},
+			},
+		},
+	}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	// Call that times out.  Callee is interrupted and caller gets ERROR.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 10},
+	})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	if wamp.OptionInt64(inv.Details, wamp.OptTimeout) != 10 {
+		t.Fatal("timeout not passed to callee")
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("call did not time out")
+	case rsp := <-caller.Recv():
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrCanceled || errMsg.Request != 124 {
+			t.Fatal("wrong error:", errMsg.Error, "for request", errMsg.Request)
+		}
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("callee not interrupted")
+	case rsp := <-callee.Recv():
+		intr, ok := rsp.(*wamp.Interrupt)
+		if !ok {
+			t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+		}
+		if intr.Request != inv.Request {
+			t.Fatal("INTERRUPT for wrong invocation")
+		}
+	}
+	// The callee's late response is dropped.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+
+	// Call that finishes before the timeout, and call without timeout.  Each
+	// gets only a RESULT, and no error after the timeout would have expired.
+	for _, timeout := range []int{10, 0} {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   125,
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptTimeout: timeout},
+		})
+		inv, ok = (<-callee.Recv()).(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION")
+		}
+		dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		rsp := <-caller.Recv()
+		if _, ok = rsp.(*wamp.Result); !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		select {
+		case rsp = <-caller.Recv():
+			t.Fatal("unexpected message after result:", rsp.MessageType())
+		case rsp = <-callee.Recv():
+			t.Fatal("unexpected message to callee:", rsp.MessageType())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestCallTimeoutJitter(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	getDurations := func() []time.Duration {
+		durations := make([]time.Duration, 20)
+		sync := make(chan struct{})
+		dealer.actionChan <- func() {
+			for i := range durations {
+				durations[i] = dealer.timeoutDuration(1000)
+			}
+			close(sync)
+		}
+		<-sync
+		return durations
+	}
+
+	// Without jitter, all calls with the same timeout time out together.
+	for _, dur := range getDurations() {
+		if dur != time.Second {
+			t.Fatal("expected timeout of 1s without jitter, got", dur)
+		}
+	}
+
+	const jitter = 100 * time.Millisecond
+	dealer.SetCallTimeoutJitter(jitter)
+	durations := getDurations()
+	var spread bool
+	for _, dur := range durations {
+		if dur < time.Second || dur >= time.Second+jitter {
+			t.Fatal("timeout outside of jitter window:", dur)
+		}
+		if dur != durations[0] {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Fatal("all timeouts fire at the same instant")
+	}
+
+	// Check that a call with jittered timeout is canceled.
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 10},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("call did not time out")
+	case rsp := <-caller.Recv():
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrCanceled {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+	}
+}
+
+func TestRegistrationMatchPriority(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	// Register each pattern with its own callee.
+	patterns := []struct {
+		procedure wamp.URI
+		match     string
+	}{
+		{"nexus.test.a.b", wamp.MatchExact},
+		{"nexus.test", wamp.MatchPrefix},
+		{"nexus.test.a", wamp.MatchPrefix},
+		{"nexus.test..b", wamp.MatchWildcard},
+		{"nexus..a.b", wamp.MatchWildcard},
+		{"nexus.other..b", wamp.MatchWildcard},
+		{"nexus.other.a.", wamp.MatchWildcard},
+		{".other.a.b", wamp.MatchWildcard},
+	}
+	callees := map[wamp.URI]*testPeer{}
+	sessions := map[wamp.URI]*wamp.Session{}
+	for i, p := range patterns {
+		callee := newTestPeer()
+		sess := &wamp.Session{Peer: callee, ID: wamp.GlobalID()}
+		dealer.Register(sess, &wamp.Register{
+			Request:   wamp.ID(i + 1),
+			Procedure: p.procedure,
+			Options:   wamp.Dict{wamp.OptMatch: p.match},
+		})
+		rsp := <-callee.Recv()
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+		}
+		// Registration creates the registration and registers the session.
+		if err := checkMetaReg(metaClient, sess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		if err := checkMetaReg(metaClient, sess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		callees[p.procedure] = callee
+		sessions[p.procedure] = sess
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	for i, tc := range []struct {
+		procedure wamp.URI
+		expect    wamp.URI
+	}{
+		// Exact beats prefix and wildcard.
+		{"nexus.test.a.b", "nexus.test.a.b"},
+		// Longest prefix wins.
+		{"nexus.test.a.c", "nexus.test.a"},
+		{"nexus.test.x", "nexus.test"},
+		// Prefix beats wildcard.
+		{"nexus.test.x.b", "nexus.test"},
+		// Earliest non-empty component wins among wildcards.
+		{"nexus.other.a.b", "nexus.other.a."},
+		{"nexus.other.x.b", "nexus.other..b"},
+		{"nexus.x.a.b", "nexus..a.b"},
+		{"x.other.a.b", ".other.a.b"},
+	} {
+		reqID := wamp.ID(100 + i)
+		dealer.Call(callerSession, &wamp.Call{Request: reqID, Procedure: tc.procedure})
+		var rsp wamp.Message
+		select {
+		case rsp = <-callees[tc.expect].Recv():
+		case <-time.After(time.Second):
+			t.Fatal("calling", tc.procedure, "did not invoke", tc.expect)
+		}
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		dealer.Yield(sessions[tc.expect], &wamp.Yield{Request: inv.Request})
+		rsp = <-caller.Recv()
+		if rslt, ok := rsp.(*wamp.Result); !ok || rslt.Request != reqID {
+			t.Fatal("expected RESULT for request", reqID)
+		}
+		for proc, callee := range callees {
+			select {
+			case <-callee.Recv():
+				t.Fatal("calling", tc.procedure, "also invoked", proc)
+			default:
+			}
+		}
+	}
+}
+
+func TestFallbackRegistration(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	// Fallback registration must use prefix match.
+	fbCallee := newTestPeer()
+	fbCalleeSess := &wamp.Session{Peer: fbCallee, ID: wamp.GlobalID()}
+	dealer.Register(fbCalleeSess,
+		&wamp.Register{
+			Request:   123,
+			Procedure: "nexus.test",
+			Options:   wamp.Dict{wamp.OptFallback: true},
+		})
+	rsp := <-fbCallee.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Register a fallback for the prefix.
+	dealer.Register(fbCalleeSess,
+		&wamp.Register{
+			Request:   124,
+			Procedure: "nexus.test",
+			Options: wamp.Dict{
+				wamp.OptMatch:    wamp.MatchPrefix,
+				wamp.OptFallback: true,
+			},
+		})
+	rsp = <-fbCallee.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaReg(metaClient, fbCalleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, fbCalleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register a specific procedure within the fallback's prefix.
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee, ID: wamp.GlobalID()}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 125, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	// Calling the specific procedure must invoke its callee, not fallback.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure})
+	select {
+	case rsp = <-callee.Recv():
+	case rsp = <-fbCallee.Recv():
+		t.Fatal("fallback callee invoked for registered procedure")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+
+	// Calling an unregistered procedure within the prefix must invoke the
+	// fallback callee.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: "nexus.test.unregistered"})
+	select {
+	case rsp = <-fbCallee.Recv():
+	case rsp = <-callee.Recv():
+		t.Fatal("specific callee invoked for unregistered procedure")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	inv, ok = rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.Yield(fbCalleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 127 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+}
+
+func TestErrorDebugDetails(t *testing.T) {
+	callNoSuchProcedure := func(d *Dealer) *wamp.Error {
+		caller := newTestPeer()
+		d.Call(&wamp.Session{Peer: caller},
+			&wamp.Call{Request: 125, Procedure: testProcedure})
+		rsp := <-caller.Recv()
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrNoSuchProcedure {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+		return errMsg
+	}
+
+	// Without debug, no diagnostic info is included.
+	dealer := NewDealer(logger, false, true, false)
+	defer dealer.Close()
+	errMsg := callNoSuchProcedure(dealer)
+	if len(errMsg.Details) != 0 {
+		t.Fatal("expected empty details without debug, got:", errMsg.Details)
+	}
+
+	// With debug, the cause of the error is included.
+	debugDealer := NewDealer(logger, false, true, true)
+	defer debugDealer.Close()
+	errMsg = callNoSuchProcedure(debugDealer)
+	info := wamp.DictChild(errMsg.Details, "debug")
+	if info == nil {
+		t.Fatal("missing debug info in details")
+	}
+	if wamp.OptionString(info, "cause") == "" {
+		t.Fatal("missing cause in debug info")
+	}
+	if info["procedure"] != testProcedure {
+		t.Fatal("wrong procedure in debug info")
+	}
+}
+
+func TestProgressiveCallResults(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"progressive_call_results": true,
+				},
+			},
+		},
+	}
+
+	// Register a procedure.
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee, Details: calleeRoles}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	pendingCalls := func() int {
+		sync := make(chan int)
+		dealer.actionChan <- func() {
+			sync <- len(dealer.calls) + len(dealer.invocations) +
+				len(dealer.invocationByCall)
+		}
+		return <-sync
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	// Call with receive_progress, and check that the callee is told that the
+	// caller accepts progressive results.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptReceiveProgress: true},
+	})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if !wamp.OptionFlag(inv.Details, wamp.OptReceiveProgress) {
+		t.Fatal("expected receive_progress in INVOCATION details")
+	}
+
+	// Each progressive YIELD is forwarded as a progressive RESULT.
+	for i := 0; i < 2; i++ {
+		dealer.Yield(calleeSess, &wamp.Yield{
+			Request:   inv.Request,
+			Options:   wamp.Dict{wamp.OptProgress: true},
+			Arguments: wamp.List{i},
+		})
+		rsp = <-caller.Recv()
+		rslt, ok := rsp.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		if !wamp.OptionFlag(rslt.Details, wamp.OptProgress) {
+			t.Fatal("expected progress flag in progressive RESULT")
+		}
+		if rslt.Arguments[0] != i {
+			t.Fatal("wrong progressive result")
+		}
+		if pendingCalls() == 0 {
+			t.Fatal("call finished before final result")
+		}
+	}
+
+	// The final YIELD finishes the call.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if wamp.OptionFlag(rslt.Details, wamp.OptProgress) {
+		t.Fatal("progress flag should not be set for final result")
+	}
+	if pendingCalls() != 0 {
+		t.Fatal("call still pending after final result")
+	}
+
+	// Call without receive_progress.  Progressive results must not be sent
+	// to the caller, only the final result.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	inv = rsp.(*wamp.Invocation)
+	if wamp.OptionFlag(inv.Details, wamp.OptReceiveProgress) {
+		t.Fatal("unexpected receive_progress in INVOCATION details")
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{
+		Request: inv.Request,
+		Options: wamp.Dict{wamp.OptProgress: true},
+	})
+	dealer.Yield(calleeSess, &wamp.Yield{
+		Request:   inv.Request,
+		Arguments: wamp.List{"final"},
+	})
+	rsp = <-caller.Recv()
+	rslt, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 125 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+	if wamp.OptionFlag(rslt.Details, wamp.OptProgress) ||
+		len(rslt.Arguments) == 0 || rslt.Arguments[0] != "final" {
+		t.Fatal("caller received progressive result it did not request")
+	}
+	if pendingCalls() != 0 {
+		t.Fatal("call still pending after final result")
+	}
+}
+
+func TestMaxRegistrations(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+	const maxRegs = 3
+	dealer.SetMaxRegistrations(maxRegs)
+
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee}
+	register := func(reqID wamp.ID, proc wamp.URI) wamp.Message {
+		dealer.Register(calleeSess,
+			&wamp.Register{Request: reqID, Procedure: proc})
+		return <-callee.Recv()
+	}
+	regCount := func() int {
+		rsp := dealer.RegStats(&wamp.Invocation{Request: 1})
+		stats := rsp.(*wamp.Yield).Arguments[0].(wamp.Dict)
+		if stats["max_registrations"] != maxRegs {
+			t.Fatal("wrong max_registrations:", stats["max_registrations"])
+		}
+		return stats["count"].(int)
+	}
+
+	var regID wamp.ID
+	for i := 0; i < maxRegs; i++ {
+		rsp := register(wamp.ID(100+i), wamp.URI(fmt.Sprint(testProcedure, i)))
+		reg, ok := rsp.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+		}
+		regID = reg.Registration
+	}
+	if n := regCount(); n != maxRegs {
+		t.Fatal("expected", maxRegs, "registrations, got", n)
+	}
+
+	// Registering beyond the maximum fails.
+	rsp := register(200, testProcedure)
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Meta procedures are not limited.
+	if _, ok = register(201, wamp.MetaProcRegStats).(*wamp.Registered); !ok {
+		t.Fatal("meta procedure registration should not be limited")
+	}
+
+	// After unregistering, there is room for another registration.
+	dealer.Unregister(calleeSess,
+		&wamp.Unregister{Request: 202, Registration: regID})
+	if _, ok = (<-callee.Recv()).(*wamp.Unregistered); !ok {
+		t.Fatal("expected UNREGISTERED")
+	}
+	if n := regCount(); n != maxRegs-1 {
+		t.Fatal("expected", maxRegs-1, "registrations, got", n)
+	}
+	if _, ok = register(203, testProcedure).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED after unregister")
+	}
+}
+
+func TestGatherPartialResults(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+					featureCallCanceling:  true,
+				},
+			},
+		},
+	}
+	callees := make([]*wamp.Session, 3)
+	for i := range callees {
+		callees[i] = &wamp.Session{
+			Peer:    newTestPeer(),
+			ID:      wamp.ID(i + 1),
+			Details: calleeRoles,
+		}
+		dealer.Register(callees[i], &wamp.Register{
+			Request:   wamp.ID(123 + i),
+			Procedure: testProcedure,
+			Options:   wamp.SetOption(nil, wamp.OptInvoke, wamp.InvokeRoundRobin),
+		})
+		if _, ok := (<-callees[i].Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+	}
+
+	caller := &wamp.Session{Peer: newTestPeer()}
+	// gatherCall calls the procedure with gather run mode and returns the
+	// invocation received by each callee.
+	gatherCall := func(reqID wamp.ID, opts wamp.Dict) []*wamp.Invocation {
+		opts[wamp.OptRunMode] = wamp.RunModeGather
+		dealer.Call(caller, &wamp.Call{
+			Request:   reqID,
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		invs := make([]*wamp.Invocation, len(callees))
+		for i := range callees {
+			rsp := <-callees[i].Recv()
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			invs[i] = inv
+		}
+		return invs
+	}
+
+	// All callees respond.
+	invs := gatherCall(200, wamp.Dict{})
+	dealer.Yield(callees[0], &wamp.Yield{Request: invs[0].Request,
+		Arguments: wamp.List{"a"}})
+	dealer.Error(&wamp.Error{Type: wamp.INVOCATION, Request: invs[1].Request,
+		Error: wamp.ErrInvalidArgument})
+	dealer.Yield(callees[2], &wamp.Yield{Request: invs[2].Request,
+		Arguments: wamp.List{"c"}})
+	rsp := <-caller.Recv()
+	result, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if result.Request != 200 || len(result.Arguments) != len(callees) {
+		t.Fatal("wrong RESULT:", result)
+	}
+	if _, ok = result.Details["partial"]; ok {
+		t.Fatal("complete results marked partial")
+	}
+	res := result.Arguments[1].(wamp.Dict)
+	if res["callee"] != callees[1].ID || res[wamp.OptError] != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error result:", res)
+	}
+
+	// One callee is slow, so the call returns partial results after the
+	// timeout.
+	invs = gatherCall(201, wamp.Dict{wamp.OptTimeout: 50})
+	dealer.Yield(callees[0], &wamp.Yield{Request: invs[0].Request,
+		Arguments: wamp.List{"a"}})
+	dealer.Yield(callees[2], &wamp.Yield{Request: invs[2].Request,
+		Arguments: wamp.List{"c"}})
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("gather call did not time out")
+	}
+	result, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if result.Details["partial"] != true {
+		t.Fatal("partial results not marked partial")
+	}
+	for i, arg := range result.Arguments {
+		res = arg.(wamp.Dict)
+		if res["callee"] != callees[i].ID {
+			t.Fatal("results not in callee order")
+		}
+		timedOut := res["timed_out"] == true
+		if timedOut != (i == 1) {
+			t.Fatal("wrong timed_out for callee", i, ":", res)
+		}
+		if i != 1 && res["args"].(wamp.List)[0] == nil {
+			t.Fatal("missing result from callee", i)
+		}
+	}
+
+	// The slow callee is interrupted, and its late result is dropped.
+	rsp = <-callees[1].Recv()
+	if intr, ok := rsp.(*wamp.Interrupt); !ok || intr.Request != invs[1].Request {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	dealer.Yield(callees[1], &wamp.Yield{Request: invs[1].Request})
+	select {
+	case rsp = <-caller.Recv():
+		t.Fatal("unexpected message after result:", rsp.MessageType())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A callee that leaves without responding is given an error, so the call
+	// finishes without waiting for a timeout.
+	invs = gatherCall(202, wamp.Dict{})
+	dealer.Yield(callees[0], &wamp.Yield{Request: invs[0].Request})
+	dealer.Yield(callees[2], &wamp.Yield{Request: invs[2].Request})
+	dealer.RemoveSession(callees[1])
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("gather call did not finish when callee left")
+	}
+	result, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	res = result.Arguments[1].(wamp.Dict)
+	if res[wamp.OptError] != wamp.ErrCanceled {
+		t.Fatal("expected error for callee that left, got:", res)
+	}
+	if _, ok = result.Details["partial"]; ok {
+		t.Fatal("results marked partial")
+	}
+
+	// When the caller leaves, the remaining callees are interrupted.
+	callees = []*wamp.Session{callees[0], callees[2]}
+	invs = gatherCall(203, wamp.Dict{})
+	dealer.RemoveSession(caller)
+	for i := range callees {
+		rsp = <-callees[i].Recv()
+		if intr, ok := rsp.(*wamp.Interrupt); !ok || intr.Request != invs[i].Request {
+			t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+		}
+	}
+	sync := make(chan int)
+	dealer.actionChan <- func() { sync <- len(dealer.gathers) + len(dealer.invocations) }
+	if n := <-sync; n != 0 {
+		t.Fatal("gather call not removed when caller left")
+	}
+}
+
+func TestGatherCallerIdentification(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+
+	// Only the first callee supports caller identification.
+	callees := make([]*wamp.Session, 2)
+	for i := range callees {
+		features := wamp.Dict{"shared_registration": true}
+		if i == 0 {
+			features[featureCallerIdent] = true
+		}
+		callees[i] = &wamp.Session{
+			Peer: newTestPeer(),
+			ID:   wamp.ID(i + 1),
+			Details: wamp.Dict{
+				"roles": wamp.Dict{
+					"callee": wamp.Dict{"features": features},
+				},
+			},
+		}
+		dealer.Register(callees[i], &wamp.Register{
+			Request:   wamp.ID(123 + i),
+			Procedure: testProcedure,
+			Options:   wamp.SetOption(nil, wamp.OptInvoke, wamp.InvokeRoundRobin),
+		})
+		if _, ok := (<-callees[i].Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+	}
+
+	caller := &wamp.Session{Peer: newTestPeer(), ID: 11235813}
+	dealer.Call(caller, &wamp.Call{
+		Request:   200,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptRunMode:    wamp.RunModeGather,
+			wamp.OptDiscloseMe: true,
+		},
+	})
+	for i := range callees {
+		rsp := <-callees[i].Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		_, disclosed := inv.Details["caller"]
+		if disclosed != (i == 0) {
+			t.Fatal("wrong caller disclosure for callee", i, ":", inv.Details)
+		}
+		dealer.Yield(callees[i], &wamp.Yield{Request: inv.Request})
+	}
+	if _, ok := (<-caller.Recv()).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+}
+
+func checkMetaEvent(metaClient wamp.Peer, topic wamp.URI, sessID, regID wamp.ID) error {
+	select {
+	case <-time.After(time.Second):
+		return fmt.Errorf("timed out waiting for %s event", topic)
+	case msg := <-metaClient.Recv():
+		event, ok := msg.(*wamp.Publish)
+		if !ok {
+			return fmt.Errorf("expected PUBLISH, got %s", msg.MessageType())
+		}
+		if event.Topic != topic {
+			return fmt.Errorf("expected %s event, got %s", topic, event.Topic)
+		}
+		if len(event.Arguments) != 2 || event.Arguments[0] != sessID {
+			return fmt.Errorf("bad %s event arguments: %v", topic,
+				event.Arguments)
+		}
+		if topic == wamp.MetaEventRegOnCreate {
+			details, ok := event.Arguments[1].(wamp.Dict)
+			if !ok || details["id"] != regID {
+				return fmt.Errorf("bad on_create details: %v",
+					event.Arguments[1])
+			}
+		} else if event.Arguments[1] != regID {
+			return fmt.Errorf("wrong registration ID in %s event", topic)
+		}
+	}
+	return nil
+}
+
+func TestRegistrationMetaEvents(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+	register := func(sess *wamp.Session) wamp.ID {
+		dealer.Register(sess, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+		})
+		rsp := <-sess.Recv()
+		regMsg, ok := rsp.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+		}
+		return regMsg.Registration
+	}
+
+	// First callee creates the registration.
+	sess1 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID(),
+		Details: calleeRoles}
+	regID := register(sess1)
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnCreate, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnRegister, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second callee only joins the registration.
+	sess2 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID(),
+		Details: calleeRoles}
+	if register(sess2) != regID {
+		t.Fatal("expected shared registration")
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnRegister, sess2.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unregistering one callee does not delete the registration.
+	dealer.Unregister(sess1, &wamp.Unregister{Request: wamp.GlobalID(),
+		Registration: regID})
+	if rsp := <-sess1.Recv(); rsp.MessageType() != wamp.UNREGISTERED {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnUnregister, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unregistering the last callee deletes the registration.
+	dealer.Unregister(sess2, &wamp.Unregister{Request: wamp.GlobalID(),
+		Registration: regID})
+	if rsp := <-sess2.Recv(); rsp.MessageType() != wamp.UNREGISTERED {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnUnregister, sess2.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnDelete, sess2.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last callee leaving the realm also deletes the registration.
+	regID = register(sess1)
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnCreate, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnRegister, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+	dealer.RemoveSession(sess1)
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnUnregister, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetaEvent(metaClient, wamp.MetaEventRegOnDelete, sess1.ID, regID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistrationErrorCounts(t *testing.T) {
+	dealer, _ := newTestDealer()
+	defer dealer.Close()
+
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	regMsg, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	// Callee yields for 3 calls and errors for 2 calls.
+	for i := 0; i < 5; i++ {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   wamp.ID(200 + i),
+			Procedure: testProcedure,
+		})
+		inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION")
+		}
+		if i%2 == 0 {
+			dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		} else {
+			dealer.Error(&wamp.Error{
+				Type:    wamp.INVOCATION,
+				Request: inv.Request,
+				Error:   wamp.URI("nexus.test.error"),
+			})
+		}
+		<-caller.Recv()
+	}
+
+	// One call times out.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   300,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 10},
+	})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("call did not time out")
+	case rsp = <-caller.Recv():
+		if _, ok = rsp.(*wamp.Error); !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+	}
+	// Late error from callee is not counted again.
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrCanceled,
+	})
+
+	rsp = dealer.RegGet(&wamp.Invocation{
+		Request:   wamp.GlobalID(),
+		Arguments: wamp.List{regMsg.Registration},
+	})
+	yield, ok := rsp.(*wamp.Yield)
+	if !ok {
+		t.Fatal("expected YIELD, got:", rsp.MessageType())
+	}
+	dict, _ := wamp.AsDict(yield.Arguments[0])
+	for k, expect := range map[string]uint64{"yields": 3, "errors": 2, "timeouts": 1} {
+		if dict[k] != expect {
+			t.Errorf("expected %d %s, got %v", expect, k, dict[k])
+		}
+	}
+}
+
+func TestCallRoutingKey(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register three callees with roundrobin shared registration.
+	callees := make([]*wamp.Session, 3)
+	for i := range callees {
+		callees[i] = &wamp.Session{
+			Peer:    newTestPeer(),
+			ID:      wamp.GlobalID(),
+			Details: calleeRoles,
+		}
+		dealer.Register(callees[i], &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
+		})
+		if _, ok := (<-callees[i].Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+	}
+
+	caller := &wamp.Session{Peer: newTestPeer()}
+	// invoked calls the procedure with the routing key, and returns the index
+	// of the callee that is invoked.
+	invoked := func(rkey string) int {
+		dealer.Call(caller, &wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptRKey: rkey},
+		})
+		sync := make(chan struct{})
+		dealer.actionChan <- func() { close(sync) }
+		<-sync
+		found := -1
+		for i, callee := range callees {
+			if callee == nil {
+				continue
+			}
+			select {
+			case <-callee.Recv():
+				if found != -1 {
+					t.Fatal("more than one callee invoked")
+				}
+				found = i
+			default:
+			}
+		}
+		if found == -1 {
+			t.Fatal("no callee invoked")
+		}
+		return found
+	}
+
+	// Calls with the same key go to the same callee, in spite of the
+	// roundrobin policy.
+	selected := map[string]int{}
+	for i := 0; i < 30; i++ {
+		rkey := fmt.Sprint("key", i)
+		selected[rkey] = invoked(rkey)
+		for j := 0; j < 2; j++ {
+			if c := invoked(rkey); c != selected[rkey] {
+				t.Fatalf("key %s invoked callee%d, then callee%d", rkey,
+					selected[rkey], c)
+			}
+		}
+	}
+
+	// When a callee is removed, only the keys that selected it move.
+	dealer.RemoveSession(callees[0])
+	callees[0] = nil
+	for rkey, sel := range selected {
+		c := invoked(rkey)
+		if sel != 0 && c != sel {
+			t.Fatalf("key %s moved from callee%d to callee%d", rkey, sel, c)
+		}
+	}
+	// The calls left pending on the removed callee were canceled.
+	select {
+	case rsp := <-caller.Recv():
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrCanceled {
+			t.Fatal("expected", wamp.ErrCanceled, "got:", rsp)
+		}
+	default:
+		t.Fatal("pending calls on removed callee not canceled")
+	}
+
+	// A call in partition run mode must have a routing key.
+	dealer.Call(caller, &wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptRunMode: wamp.RunModePartition},
+	})
+	rsp := <-caller.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+}
+
+func TestRequireCallerDisclosure(t *testing.T) {
+	dealer := NewDealer(logger, false, false, debug)
+	dealer.SetRequireDisclosure(true)
+	defer dealer.Close()
+
+	// The callee does not request disclosure, or announce
+	// caller_identification.
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{Peer: callee}
+	dealer.Register(calleeSess, &wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{
+		Peer:    caller,
+		ID:      wamp.ID(11235813),
+		Details: wamp.Dict{"authid": "jdoe", "authrole": "admin"},
+	}
+	// The caller cannot opt out, and requesting disclosure is allowed.
+	for i, opts := range []wamp.Dict{
+		{"disclose_me": false},
+		{"disclose_me": true},
+	} {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   wamp.ID(124 + i),
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		rsp := <-callee.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		if wamp.OptionID(inv.Details, "caller") != callerSession.ID {
+			t.Fatal("caller not disclosed with options", opts)
+		}
+		if inv.Details["caller_authid"] != "jdoe" {
+			t.Fatal("incorrect caller authid disclosed")
+		}
+		dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		if _, ok = (<-caller.Recv()).(*wamp.Result); !ok {
+			t.Fatal("expected RESULT")
+		}
+	}
+}
+
+func TestMaxSessionRegistrations(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+	dealer.SetMaxSessionRegistrations(2)
+	dealer.SetExemptRoles([]string{"admin"})
+
+	sess := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	register := func(s *wamp.Session, proc wamp.URI) wamp.Message {
+		dealer.Register(s, &wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: proc,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+		})
+		return <-s.Recv()
+	}
+
+	// Register up to the maximum number of registrations.
+	var regID wamp.ID
+	for _, proc := range []wamp.URI{"nexus.test.a", "nexus.test.b"} {
+		rsp := register(sess, proc)
+		registered, ok := rsp.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+		}
+		regID = registered.Registration
+	}
+
+	// Registering beyond the maximum must fail.
+	rsp := register(sess, "nexus.test.c")
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+	}
+
+	// Other sessions have their own limit, and joining a shared
+	// registration counts toward it.
+	sess2 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	for _, proc := range []wamp.URI{"nexus.test.a", "nexus.test.c"} {
+		if rsp = register(sess2, proc); rsp.MessageType() != wamp.REGISTERED {
+			t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+		}
+	}
+	if rsp = register(sess2, "nexus.test.b"); rsp.MessageType() != wamp.ERROR {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+
+	// A session at its limit is still told when a procedure already exists.
+	sess3 := &wamp.Session{Peer: newTestPeer(), ID: wamp.GlobalID()}
+	dealer.Register(sess3, &wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: "nexus.test.single",
+		Options:   wamp.Dict{},
+	})
+	if rsp = <-sess3.Recv(); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+	}
+	rsp = register(sess2, "nexus.test.single")
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("expected", wamp.ErrProcedureAlreadyExists, "got:", rsp)
+	}
+
+	// Sessions with an exempt authrole are not limited.
+	admin := &wamp.Session{
+		Peer:    newTestPeer(),
+		ID:      wamp.GlobalID(),
+		Details: wamp.Dict{"authrole": "admin"},
+	}
+	for _, proc := range []wamp.URI{"nexus.test.x", "nexus.test.y", "nexus.test.z"} {
+		if rsp = register(admin, proc); rsp.MessageType() != wamp.REGISTERED {
+			t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+		}
+	}
+
+	// Unregistering makes room for another registration.
+	dealer.Unregister(sess, &wamp.Unregister{Request: wamp.GlobalID(), Registration: regID})
+	if rsp = <-sess.Recv(); rsp.MessageType() != wamp.UNREGISTERED {
+		t.Fatal("expected", wamp.UNREGISTERED, "got:", rsp.MessageType())
+	}
+	if rsp = register(sess, "nexus.test.c"); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+	}
+
+	// Removing the session frees its registrations.
+	dealer.RemoveSession(sess)
+	if rsp = register(sess, "nexus.test.d"); rsp.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected", wamp.REGISTERED, "got:", rsp.MessageType())
+	}
+}
+
+func TestMaxInvocationDuration(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+	dealer.SetMaxInvocationDuration(50 * time.Millisecond)
+
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{
+		Peer: callee,
+		Details: wamp.Dict{
+			"roles": wamp.Dict{
+				"callee": wamp.Dict{
+					"features": wamp.Dict{
+						featureCallCanceling:   true,
+						featureProgCallResults: true,
+					},
+				},
+			},
+		},
+	}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+
+	// Call without a timeout, to a callee that never responds.  Callee is
+	// interrupted and caller gets ERROR.
+	dealer.Call(callerSession, &wamp.Call{Request: 124, Procedure: testProcedure})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("invocation not limited")
+	case rsp := <-caller.Recv():
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrCanceled || errMsg.Request != 124 {
+			t.Fatal("wrong error:", errMsg.Error, "for request", errMsg.Request)
+		}
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("callee not interrupted")
+	case rsp := <-callee.Recv():
+		if intr, ok := rsp.(*wamp.Interrupt); !ok || intr.Request != inv.Request {
+			t.Fatal("expected INTERRUPT for invocation, got:", rsp)
+		}
+	}
+
+	// Call with progressive results, which takes longer than the limit in
+	// total, but not between results.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptReceiveProgress: true},
+	})
+	if inv, ok = (<-callee.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(25 * time.Millisecond)
+		dealer.Yield(calleeSess, &wamp.Yield{
+			Request: inv.Request,
+			Options: wamp.Dict{wamp.OptProgress: true},
+		})
+		rsp := <-caller.Recv()
+		if result, ok := rsp.(*wamp.Result); !ok || !wamp.OptionFlag(result.Details, wamp.OptProgress) {
+			t.Fatal("expected progressive RESULT, got:", rsp)
+		}
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if rsp := <-caller.Recv(); rsp.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	select {
+	case rsp := <-caller.Recv():
+		t.Fatal("unexpected message after RESULT:", rsp)
+	case rsp := <-callee.Recv():
+		t.Fatal("unexpected message to callee:", rsp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// testCallMetrics is a MetricsRecorder that keeps the outcome of each call.
+type testCallMetrics struct {
+	testMetrics
+	outcomes []string
+}
+
+func (m *testCallMetrics) CallFinished(realm, procedure wamp.URI, outcome string, elapsed time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if procedure == testProcedure && elapsed >= 0 {
+		m.outcomes = append(m.outcomes, outcome)
+	}
+}
+
+func TestCallMetrics(t *testing.T) {
+	dealer := NewDealer(logger, false, true, debug)
+	defer dealer.Close()
+	metrics := &testCallMetrics{}
+	dealer.SetMetricsRecorder(testRealm, metrics)
+
+	callee := newTestPeer()
+	calleeSess := &wamp.Session{
+		Peer: callee,
+		Details: wamp.Dict{
+			"roles": wamp.Dict{
+				"callee": wamp.Dict{
+					"features": wamp.Dict{
+						featureCallCanceling: true,
+						featureCallTimeout:   true,
+					},
+				},
+			},
+		},
+	}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := &wamp.Session{Peer: caller}
+	call := func(callID wamp.ID, options wamp.Dict) wamp.ID {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   callID,
+			Procedure: testProcedure,
+			Options:   options,
+		})
+		inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION")
+		}
+		return inv.Request
+	}
+	expect := func(msgType wamp.MessageType) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for", msgType)
+		case rsp := <-caller.Recv():
+			if rsp.MessageType() != msgType {
+				t.Fatal("expected", msgType, "got:", rsp.MessageType())
+			}
+		}
+	}
+
+	invID := call(124, nil)
+	dealer.Yield(calleeSess, &wamp.Yield{Request: invID})
+	expect(wamp.RESULT)
+
+	invID = call(125, nil)
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: invID,
+		Error:   wamp.URI("nexus.test.error"),
+	})
+	expect(wamp.ERROR)
+
+	// A call that times out is not also recorded as canceled, or as failed
+	// when the callee responds to the INTERRUPT.
+	invID = call(126, wamp.Dict{wamp.OptTimeout: 10})
+	expect(wamp.ERROR)
+	if _, ok := (<-callee.Recv()).(*wamp.Interrupt); !ok {
+		t.Fatal("expected INTERRUPT")
+	}
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: invID,
+		Error:   wamp.ErrCanceled,
+	})
+
+	// A call canceled with mode "kill" is recorded as canceled when the
+	// callee responds, even if the callee sends a result.
+	invID = call(127, nil)
+	dealer.Cancel(callerSession, &wamp.Cancel{
+		Request: 127,
+		Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKill},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Interrupt); !ok {
+		t.Fatal("expected INTERRUPT")
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: invID})
+	expect(wamp.RESULT)
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	want := []string{CallSucceeded, CallFailed, CallTimedOut, CallCanceled}
+	if len(metrics.outcomes) != len(want) {
+		t.Fatal("wrong call outcomes:", metrics.outcomes)
+	}
+	for i := range want {
+		if metrics.outcomes[i] != want[i] {
+			t.Fatal("wrong call outcomes:", metrics.outcomes)
+		}
+	}
 }
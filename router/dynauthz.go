@@ -0,0 +1,361 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// defaultDynamicAuthzTimeout is how long to wait for the dynamic authorizer
+// procedure to return, if DynamicAuthorizer.Timeout is not set.
+const defaultDynamicAuthzTimeout = 5 * time.Second
+
+// DynamicAuthorizer configures a realm to authorize requests by calling a
+// procedure that an application registers with the realm.  Before routing a
+// SUBSCRIBE, PUBLISH, REGISTER, or CALL that the realm's Authorizer allows,
+// the router calls the procedure with the arguments:
+//
+//	[session_details, uri, action, options]
+//
+// where action is "subscribe", "publish", "register", or "call", and options
+// are the options of the request.  The "match" item of options is always set
+// to the match policy of the request, which is "exact" unless a SUBSCRIBE or
+// REGISTER asks for "prefix" or "wildcard" matching.  The
+// procedure returns either a boolean, or a dictionary whose "allow" item is a
+// boolean, and whose "cache" item, if false, keeps the decision from being
+// cached.  The request is denied if the procedure is not registered, returns
+// an error or anything else, or does not return within the timeout.
+//
+// The registration of the procedure itself is not authorized by the
+// procedure.  Instead, only sessions with an authrole in CalleeRoles, and
+// sessions internal to the router, may register it, and only with a single
+// callee.  No session may make a pattern based registration that matches the
+// procedure, or join a shared registration of it.  A session waiting for its
+// request to be authorized does not process its other messages, so the callee
+// of the procedure must not need authorization by the procedure to respond.
+//
+// The calls are made by a session of the router, whose authrole is AuthRole.
+// A callee that registers the procedure with the disclose_caller option can
+// check the caller's authrole and session ID.
+type DynamicAuthorizer struct {
+	// URI of the procedure that authorizes requests.  Dynamic authorization
+	// is disabled if this is empty, which is the default.
+	Procedure wamp.URI `json:"procedure"`
+	// How long a decision is remembered for the same session, action, URI,
+	// and match policy, to avoid calling the procedure for every request.  Zero, the
+	// default, disables caching.
+	CacheTTL time.Duration `json:"cache_ttl"`
+	// How long to wait for the procedure to return.  The default is 5
+	// seconds.
+	Timeout time.Duration `json:"timeout"`
+	// Authroles of the sessions that may register the procedure.  When
+	// empty, the default, only sessions internal to the router may register
+	// it.
+	CalleeRoles []string `json:"callee_roles"`
+	// Authrole of the router's session that calls the procedure.  The
+	// default is "trusted".
+	AuthRole string `json:"authrole"`
+}
+
+// defaultDynamicAuthzRole is the authrole of the session that calls the
+// dynamic authorizer procedure, if DynamicAuthorizer.AuthRole is not set.
+const defaultDynamicAuthzRole = "trusted"
+
+// dynamicAuthz authorizes requests by calling the dynamic authorizer
+// procedure.  The calls are made by a session internal to the router, which
+// is never attached to the realm, and whose peer delivers the results of
+// the calls directly to the requests waiting for them.
+type dynamicAuthz struct {
+	procedure   wamp.URI
+	cacheTTL    time.Duration
+	timeout     time.Duration
+	calleeRoles roleSet
+
+	dealer   *Dealer
+	reqIDGen wamp.IDGenerator
+	sess     *wamp.Session
+	peer     *authzPeer
+
+	// Protects cache and nextPrune.
+	lock sync.Mutex
+	// session ID -> action, URI, and match policy -> cached decision
+	cache     map[wamp.ID]map[authzKey]authzDecision
+	nextPrune time.Time
+}
+
+type authzKey struct {
+	action string
+	uri    wamp.URI
+	match  string
+}
+
+type authzDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// newDynamicAuthz returns a dynamicAuthz that calls the procedure through the
+// dealer, from a session with the given ID.
+func newDynamicAuthz(cfg DynamicAuthorizer, dealer *Dealer, sessID wamp.ID, reqIDGen wamp.IDGenerator) *dynamicAuthz {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultDynamicAuthzTimeout
+	}
+	if cfg.AuthRole == "" {
+		cfg.AuthRole = defaultDynamicAuthzRole
+	}
+	peer := &authzPeer{pending: map[wamp.ID]chan wamp.Message{}}
+	return &dynamicAuthz{
+		procedure:   cfg.Procedure,
+		cacheTTL:    cfg.CacheTTL,
+		timeout:     cfg.Timeout,
+		calleeRoles: newRoleSet(cfg.CalleeRoles),
+		dealer:      dealer,
+		reqIDGen:    reqIDGen,
+		sess: &wamp.Session{
+			Peer:    peer,
+			ID:      sessID,
+			Details: markInternal(wamp.Dict{"authrole": cfg.AuthRole}),
+		},
+		peer:  peer,
+		cache: map[wamp.ID]map[authzKey]authzDecision{},
+	}
+}
+
+// authorize returns true if the dynamic authorizer allows the session to
+// send the message.  An error is returned if the dynamic authorizer could not
+// be called, or did not return a decision.
+func (a *dynamicAuthz) authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	var key authzKey
+	var options wamp.Dict
+	switch msg := msg.(type) {
+	case *wamp.Subscribe:
+		key = authzKey{"subscribe", msg.Topic, matchPolicy(msg.Options)}
+		options = msg.Options
+	case *wamp.Publish:
+		key = authzKey{"publish", msg.Topic, wamp.MatchExact}
+		options = msg.Options
+	case *wamp.Register:
+		if a.covers(msg) {
+			return a.mayRegister(sess, msg), nil
+		}
+		key = authzKey{"register", msg.Procedure, matchPolicy(msg.Options)}
+		options = msg.Options
+	case *wamp.Call:
+		key = authzKey{"call", msg.Procedure, wamp.MatchExact}
+		options = msg.Options
+	default:
+		return true, nil
+	}
+	if allow, ok := a.cached(sess.ID, key); ok {
+		return allow, nil
+	}
+
+	// Copy the session details, since the session may be altered while the
+	// call is being sent.
+	details := make(wamp.Dict, len(sess.Details))
+	for k, v := range sess.Details {
+		details[k] = v
+	}
+	// Copy the options, so that the match policy can be set without altering
+	// the request.
+	opts := make(wamp.Dict, len(options)+1)
+	for k, v := range options {
+		opts[k] = v
+	}
+	opts[wamp.OptMatch] = key.match
+	reqID := a.reqIDGen.Next()
+	rspChan := a.peer.expect(reqID)
+	a.dealer.Call(a.sess, &wamp.Call{
+		Request:   reqID,
+		Options:   wamp.Dict{},
+		Procedure: a.procedure,
+		Arguments: wamp.List{details, key.uri, key.action, opts},
+	})
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	var rsp wamp.Message
+	select {
+	case rsp = <-rspChan:
+	case <-timer.C:
+		a.peer.forget(reqID)
+		a.dealer.Cancel(a.sess, &wamp.Cancel{
+			Request: reqID,
+			Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKillNoWait},
+		})
+		return false, errors.New("dynamic authorizer timed out")
+	}
+
+	var result wamp.List
+	switch rsp := rsp.(type) {
+	case *wamp.Error:
+		return false, errors.New("dynamic authorizer failed: " + string(rsp.Error))
+	case *wamp.Result:
+		result = rsp.Arguments
+	}
+	if len(result) == 0 {
+		return false, errors.New("dynamic authorizer returned no decision")
+	}
+	allow, cache := false, true
+	switch decision := result[0].(type) {
+	case bool:
+		allow = decision
+	default:
+		dict, ok := wamp.AsDict(decision)
+		if !ok {
+			return false, errors.New("dynamic authorizer returned invalid decision")
+		}
+		if allow, ok = dict["allow"].(bool); !ok {
+			return false, errors.New("dynamic authorizer returned invalid decision")
+		}
+		if c, ok := dict["cache"].(bool); ok {
+			cache = c
+		}
+	}
+	if cache {
+		a.store(sess.ID, key, allow)
+	}
+	return allow, nil
+}
+
+// matchPolicy returns the match policy of a SUBSCRIBE or REGISTER with the
+// given options.
+func matchPolicy(options wamp.Dict) string {
+	if match := wamp.OptionString(options, wamp.OptMatch); match != "" {
+		return match
+	}
+	return wamp.MatchExact
+}
+
+// covers returns true if the registration would receive calls to the
+// dynamic authorizer procedure.
+func (a *dynamicAuthz) covers(msg *wamp.Register) bool {
+	switch wamp.OptionString(msg.Options, wamp.OptMatch) {
+	case wamp.MatchPrefix:
+		return a.procedure.PrefixMatch(msg.Procedure)
+	case wamp.MatchWildcard:
+		return a.procedure.WildcardMatch(msg.Procedure)
+	}
+	return msg.Procedure == a.procedure
+}
+
+// mayRegister returns true if the session may make a registration that covers
+// the dynamic authorizer procedure.  Only an exact, single callee registration
+// is allowed, from a session internal to the router or with one of the callee
+// roles.  Otherwise, a session could take over authorization for the realm by
+// registering the procedure before the intended callee, or by sharing the
+// registration.
+func (a *dynamicAuthz) mayRegister(sess *wamp.Session, msg *wamp.Register) bool {
+	if msg.Procedure != a.procedure {
+		return false
+	}
+	if invoke := wamp.OptionString(msg.Options, wamp.OptInvoke); invoke != "" && invoke != wamp.InvokeSingle {
+		return false
+	}
+	return a.calleeRoles.exempt(sess)
+}
+
+// cached returns the cached decision for the session, action, URI, and
+// match policy, if there is one that has not expired.
+func (a *dynamicAuthz) cached(sid wamp.ID, key authzKey) (bool, bool) {
+	if a.cacheTTL <= 0 {
+		return false, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	d, ok := a.cache[sid][key]
+	if !ok || time.Now().After(d.expires) {
+		return false, false
+	}
+	return d.allow, true
+}
+
+// store caches the decision for the session, action, URI, and match policy.
+// Expired decisions are removed at most once every cache TTL.
+func (a *dynamicAuthz) store(sid wamp.ID, key authzKey, allow bool) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if now.After(a.nextPrune) {
+		for id, decisions := range a.cache {
+			for k, d := range decisions {
+				if now.After(d.expires) {
+					delete(decisions, k)
+				}
+			}
+			if len(decisions) == 0 {
+				delete(a.cache, id)
+			}
+		}
+		a.nextPrune = now.Add(a.cacheTTL)
+	}
+	decisions, ok := a.cache[sid]
+	if !ok {
+		decisions = map[authzKey]authzDecision{}
+		a.cache[sid] = decisions
+	}
+	decisions[key] = authzDecision{allow, now.Add(a.cacheTTL)}
+}
+
+// removeSession forgets the cached decisions for a session that has left the
+// realm.
+func (a *dynamicAuthz) removeSession(sid wamp.ID) {
+	a.lock.Lock()
+	delete(a.cache, sid)
+	a.lock.Unlock()
+}
+
+// authzPeer is the peer of the session that calls the dynamic authorizer.
+// Instead of being read by a client, the RESULT or ERROR for each call is
+// given to the request waiting for it.
+type authzPeer struct {
+	lock    sync.Mutex
+	pending map[wamp.ID]chan wamp.Message
+}
+
+// expect returns a channel that receives the response to the request.
+func (p *authzPeer) expect(reqID wamp.ID) <-chan wamp.Message {
+	ch := make(chan wamp.Message, 1)
+	p.lock.Lock()
+	p.pending[reqID] = ch
+	p.lock.Unlock()
+	return ch
+}
+
+// forget stops waiting for the response to the request.
+func (p *authzPeer) forget(reqID wamp.ID) {
+	p.lock.Lock()
+	delete(p.pending, reqID)
+	p.lock.Unlock()
+}
+
+func (p *authzPeer) TrySend(msg wamp.Message) error {
+	var reqID wamp.ID
+	switch msg := msg.(type) {
+	case *wamp.Result:
+		reqID = msg.Request
+	case *wamp.Error:
+		reqID = msg.Request
+	default:
+		return nil
+	}
+	p.lock.Lock()
+	ch, ok := p.pending[reqID]
+	delete(p.pending, reqID)
+	p.lock.Unlock()
+	if ok {
+		ch <- msg
+	}
+	return nil
+}
+
+func (p *authzPeer) Send(msg wamp.Message) error { return p.TrySend(msg) }
+
+func (p *authzPeer) Recv() <-chan wamp.Message { return nil }
+
+func (p *authzPeer) Close() {}
@@ -0,0 +1,48 @@
+package router
+
+import "github.com/gammazero/nexus/wamp"
+
+// detailInternal is the session detail that marks a session as internal to
+// the router, such as the realm's meta session, the local sessions of realm
+// links, and the session that calls the dynamic authorizer.  The router
+// removes it from the details of client sessions, so that it cannot be given
+// to a session by a client or an authenticator.
+const detailInternal = "x_nexus_internal"
+
+// markInternal marks the session details as those of a session internal to
+// the router, and returns them.
+func markInternal(details wamp.Dict) wamp.Dict {
+	return wamp.SetOption(details, detailInternal, true)
+}
+
+// isInternal returns true if the session is internal to the router.
+func isInternal(sess *wamp.Session) bool {
+	return wamp.OptionFlag(sess.Details, detailInternal)
+}
+
+// roleSet is the set of authroles whose sessions are exempt from the
+// per-session limits of a realm, and from the features disabled for it.
+type roleSet map[string]struct{}
+
+func newRoleSet(roles []string) roleSet {
+	if len(roles) == 0 {
+		return nil
+	}
+	set := make(roleSet, len(roles))
+	for _, role := range roles {
+		set[role] = struct{}{}
+	}
+	return set
+}
+
+// has returns true if the authrole is in the set.
+func (s roleSet) has(authrole string) bool {
+	_, ok := s[authrole]
+	return ok
+}
+
+// exempt returns true if the session is internal to the router, or has an
+// authrole in the set.
+func (s roleSet) exempt(sess *wamp.Session) bool {
+	return isInternal(sess) || s.has(wamp.OptionString(sess.Details, "authrole"))
+}
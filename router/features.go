@@ -0,0 +1,68 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// RealmFeatures configures which features of the broker and dealer roles a
+// realm supports.  Each map is keyed by feature name, such as
+// "pattern_based_subscription" or "progressive_call_results".  A feature set
+// to false is disabled: it is not advertised in the roles of the WELCOME, and
+// a request from a client that uses it is answered with a
+// wamp.error.option_not_allowed ERROR.  Features that are not in a map stay
+// enabled.  Sessions internal to the router, such as those of realm links,
+// and sessions with an authrole in RealmConfig.ExemptRoles, may use disabled
+// features.
+//
+// Disabling subscription_meta_api or registration_meta_api makes the
+// wamp.subscription.* or wamp.registration.* meta procedures answer callers
+// with wamp.error.no_such_procedure.  The meta events are still published.
+// Disabling subscription_revocation or registration_revocation means clients
+// are not told when the router revokes their subscriptions or registrations.
+type RealmFeatures struct {
+	Broker map[string]bool `json:"broker"`
+	Dealer map[string]bool `json:"dealer"`
+}
+
+// roleFeatures returns a copy of the role information with the features that
+// are false in features removed, and the set of removed features.  An error is
+// returned if features names a feature the role does not have.
+func roleFeatures(role wamp.Dict, features map[string]bool) (wamp.Dict, map[string]bool, error) {
+	all := wamp.DictChild(role, "features")
+	var unknown []string
+	for name := range features {
+		if _, ok := all[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, nil, fmt.Errorf("unknown features: %v", unknown)
+	}
+
+	enabled := make(wamp.Dict, len(all))
+	disabled := map[string]bool{}
+	for name, val := range all {
+		if enable, ok := features[name]; ok && !enable {
+			disabled[name] = true
+			continue
+		}
+		enabled[name] = val
+	}
+	return wamp.Dict{"features": enabled}, disabled, nil
+}
+
+// featureNotAllowed returns the ERROR answering a request that uses a
+// disabled feature.
+func featureNotAllowed(msg wamp.Message, request wamp.ID, feature string) *wamp.Error {
+	return &wamp.Error{
+		Type:      msg.MessageType(),
+		Request:   request,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrOptionNotAllowed,
+		Arguments: wamp.List{"feature " + feature + " is disabled"},
+	}
+}
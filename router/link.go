@@ -0,0 +1,849 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/transport"
+	"github.com/gammazero/nexus/transport/serialize"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// optNexusOrigin marks publications and calls that a realm link forwarded
+// from another router.  The marker is passed on in EVENT and INVOCATION
+// details, and links do not forward anything that carries it.  This prevents
+// events and calls from looping between routers that are linked to each
+// other.  Only sessions internal to the router may set it, so the router
+// removes it from the PUBLISH and CALL options of client sessions.
+const optNexusOrigin = "x_nexus_origin"
+
+// stripLinkOrigin removes the link origin marker from the options of a
+// PUBLISH or CALL.
+func stripLinkOrigin(msg wamp.Message) {
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		msg.Options = withoutLinkOrigin(msg.Options)
+	case *wamp.Call:
+		msg.Options = withoutLinkOrigin(msg.Options)
+	}
+}
+
+// withoutLinkOrigin returns the options without the link origin marker.  The
+// options are copied if they have the marker, since the client may reuse the
+// options and other goroutines may be reading them.
+func withoutLinkOrigin(options wamp.Dict) wamp.Dict {
+	if _, ok := options[optNexusOrigin]; !ok {
+		return options
+	}
+	opts := make(wamp.Dict, len(options)-1)
+	for k, v := range options {
+		if k != optNexusOrigin {
+			opts[k] = v
+		}
+	}
+	return opts
+}
+
+const (
+	defaultLinkResponseTimeout   = 10 * time.Second
+	defaultLinkReconnectDelay    = time.Second
+	defaultLinkMaxReconnectDelay = time.Minute
+)
+
+// LinkAuthFunc answers a CHALLENGE from the upstream router of a realm link.
+type LinkAuthFunc func(challenge *wamp.Challenge) (signature string, details wamp.Dict)
+
+// LinkConfig configures the connection that links a local realm to the same
+// realm on an upstream router.
+type LinkConfig struct {
+	// Details for the HELLO sent to the upstream router, such as authid.
+	HelloDetails wamp.Dict
+	// Map of authmethod to the function that answers a CHALLENGE for that
+	// authmethod.  The keys are sent as the HELLO authmethods.
+	AuthHandlers map[string]LinkAuthFunc
+	// Serialization used to talk to the upstream router.  Default is JSON.
+	Serialization serialize.Serialization
+	// TLS configuration for "wss" and "tcps" URLs.
+	TLSConfig *tls.Config
+	// Time to wait for responses from either router.  Default is 10 seconds.
+	ResponseTimeout time.Duration
+	// Time to wait before reconnecting after the connection to the upstream
+	// router is lost or cannot be made.  The delay doubles after each failed
+	// attempt, up to MaxReconnectDelay.  Defaults are 1 second and 1 minute.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+}
+
+// Roles of the link's sessions.  The local session publishes forwarded events
+// and is the callee for proxied procedures.  Both sessions use the meta API.
+var linkRoles = wamp.Dict{
+	"publisher": wamp.Dict{},
+	"subscriber": wamp.Dict{
+		"features": wamp.Dict{
+			featurePatternSub: true,
+		},
+	},
+	"caller": wamp.Dict{
+		"features": wamp.Dict{
+			featureCallCanceling: true,
+			featureCallTimeout:   true,
+		},
+	},
+	"callee": wamp.Dict{
+		"features": wamp.Dict{
+			featureCallCanceling: true,
+			featureCallTimeout:   true,
+		},
+	},
+}
+
+// errLinkRealmClosed is returned when the local realm of a link is closed.
+var errLinkRealmClosed = errors.New("realm closed")
+
+// realmLink connects a local realm to the same realm on an upstream router.
+// Topics subscribed to in the local realm are subscribed to upstream, and
+// events from upstream are published locally.  Procedures registered
+// upstream are registered locally, and calls to them are forwarded upstream.
+// The link is one-way: local publications and registrations are not
+// forwarded upstream.
+type realmLink struct {
+	realm *realm
+	url   string
+	cfg   LinkConfig
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// LinkRealm links the realm to the same realm on the upstream router at
+// upstreamURL.  The router connects to the upstream router as a WAMP client,
+// using the scheme in the URL to select the transport as the client package
+// does: "ws", "wss", "tcp", "tcps", or "unix".
+//
+// Topics that local sessions subscribe to are subscribed to upstream, and
+// events published upstream are published to the local subscribers.
+// Procedures registered upstream with exact matching are registered locally,
+// and local calls to them are forwarded upstream.  The upstream router must
+// allow the link to use the subscription and registration meta API.
+//
+// The link is one-way.  Events published in the local realm are not
+// forwarded upstream, and procedures registered in the local realm cannot be
+// called from upstream.
+//
+// If the connection is lost, the link reconnects with backoff.  The returned
+// io.Closer removes the link.  Links are also closed when the router closes.
+func (r *router) LinkRealm(realmURI wamp.URI, upstreamURL string, cfg LinkConfig) (io.Closer, error) {
+	if _, err := url.Parse(upstreamURL); err != nil {
+		return nil, err
+	}
+	if cfg.ResponseTimeout == 0 {
+		cfg.ResponseTimeout = defaultLinkResponseTimeout
+	}
+	if cfg.ReconnectDelay == 0 {
+		cfg.ReconnectDelay = defaultLinkReconnectDelay
+	}
+	if cfg.MaxReconnectDelay == 0 {
+		cfg.MaxReconnectDelay = defaultLinkMaxReconnectDelay
+	}
+
+	link := &realmLink{
+		url:  upstreamURL,
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	sync := make(chan error)
+	r.actionChan <- func() {
+		if r.closed {
+			sync <- errors.New("router closed")
+			return
+		}
+		realm, ok := r.realms[realmURI]
+		if !ok {
+			sync <- fmt.Errorf("no realm \"%s\" exists on this router",
+				string(realmURI))
+			return
+		}
+		link.realm = realm
+		r.links = append(r.links, link)
+		sync <- nil
+	}
+	if err := <-sync; err != nil {
+		return nil, err
+	}
+
+	go link.run()
+	return link, nil
+}
+
+// Close stops the link and disconnects from the upstream router.  This is
+// safe to call more than once.
+func (l *realmLink) Close() error {
+	l.closeOnce.Do(func() { close(l.stop) })
+	<-l.done
+	return nil
+}
+
+// run connects to the upstream router, and reconnects with backoff whenever
+// the connection is lost, until the link is closed.
+func (l *realmLink) run() {
+	defer close(l.done)
+	log := l.realm.log
+	delay := l.cfg.ReconnectDelay
+	for {
+		joined, err := l.serve()
+		if err == errLinkRealmClosed {
+			return
+		}
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		if joined {
+			delay = l.cfg.ReconnectDelay
+		}
+		log.Printf("Link from realm %s to %s: %s, reconnecting in %s",
+			l.realm.uri, l.url, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-l.stop:
+			return
+		}
+		if delay *= 2; delay > l.cfg.MaxReconnectDelay {
+			delay = l.cfg.MaxReconnectDelay
+		}
+	}
+}
+
+// serve connects and joins the upstream realm, attaches a session to the
+// local realm, and forwards messages until the link is closed or either
+// session ends.  Returns true if the upstream realm was joined.
+func (l *realmLink) serve() (bool, error) {
+	remote, err := l.connect()
+	if err != nil {
+		return false, err
+	}
+	defer remote.Close()
+	if err = l.join(remote); err != nil {
+		return false, err
+	}
+
+	cli, rtr := transport.LinkedPeers()
+	sess := &wamp.Session{
+		Peer: rtr,
+		ID:   l.realm.sessIDGen.Next(),
+		Details: markInternal(wamp.Dict{
+			"authrole": "trusted",
+			"authid":   "link:" + l.url,
+			"roles":    linkRoles,
+		}),
+	}
+	if err = l.realm.handleSession(sess, nil); err != nil {
+		return true, errLinkRealmClosed
+	}
+	defer cli.Close()
+
+	if l.realm.debug {
+		l.realm.log.Printf("Linked realm %s to %s", l.realm.uri, l.url)
+	}
+	ls := &linkSession{
+		realmLink:   l,
+		remote:      remote,
+		local:       cli,
+		pending:     map[wamp.ID]chan wamp.Message{},
+		localMeta:   map[wamp.ID]struct{}{},
+		remoteMeta:  map[wamp.ID]struct{}{},
+		remoteSubs:  map[linkSubKey]wamp.ID{},
+		subTopics:   map[wamp.ID]wamp.URI{},
+		localRegs:   map[wamp.URI]wamp.ID{},
+		regProcs:    map[wamp.ID]wamp.URI{},
+		calls:       map[wamp.ID]wamp.ID{},
+		invocations: map[wamp.ID]wamp.ID{},
+		subsChanged: make(chan struct{}, 1),
+		regsChanged: make(chan struct{}, 1),
+	}
+	return true, ls.run()
+}
+
+// connect creates a peer connected to the upstream router.
+func (l *realmLink) connect() (wamp.Peer, error) {
+	u, err := url.Parse(l.url)
+	if err != nil {
+		return nil, err
+	}
+	logger := l.realm.log
+	ser := l.cfg.Serialization
+	switch u.Scheme {
+	case "ws", "wss":
+		return transport.ConnectWebsocketPeer(l.url, ser, l.cfg.TLSConfig,
+			nil, logger)
+	case "tcp":
+		return transport.ConnectRawSocketPeer(u.Scheme, u.Host, ser, logger, 0)
+	case "tcps":
+		return transport.ConnectTlsRawSocketPeer("tcp", u.Host, ser,
+			l.cfg.TLSConfig, logger, 0)
+	case "unix":
+		path := strings.TrimRight(u.Host+u.Path, "/")
+		return transport.ConnectRawSocketPeer(u.Scheme, path, ser, logger, 0)
+	}
+	return nil, fmt.Errorf("invalid url: %s", l.url)
+}
+
+// join joins the upstream realm, answering a CHALLENGE if one is sent.
+func (l *realmLink) join(remote wamp.Peer) error {
+	details := wamp.Dict{}
+	for k, v := range l.cfg.HelloDetails {
+		details[k] = v
+	}
+	details["roles"] = linkRoles
+	if len(l.cfg.AuthHandlers) != 0 {
+		authmethods := make(wamp.List, 0, len(l.cfg.AuthHandlers))
+		for am := range l.cfg.AuthHandlers {
+			authmethods = append(authmethods, am)
+		}
+		details["authmethods"] = authmethods
+	}
+	remote.Send(&wamp.Hello{Realm: l.realm.uri, Details: details})
+	msg, err := wamp.RecvTimeout(remote, l.cfg.ResponseTimeout)
+	if err != nil {
+		return err
+	}
+	if challenge, ok := msg.(*wamp.Challenge); ok {
+		authenticate := &wamp.Authenticate{}
+		if authFunc, ok := l.cfg.AuthHandlers[challenge.AuthMethod]; ok {
+			authenticate.Signature, authenticate.Extra = authFunc(challenge)
+		}
+		remote.Send(authenticate)
+		if msg, err = wamp.RecvTimeout(remote, l.cfg.ResponseTimeout); err != nil {
+			return err
+		}
+	}
+	switch msg := msg.(type) {
+	case *wamp.Welcome:
+		return nil
+	case *wamp.Abort:
+		return fmt.Errorf("upstream router aborted join: %s", msg.Reason)
+	}
+	return fmt.Errorf("unexpected %s from upstream router", msg.MessageType())
+}
+
+// linkSubKey identifies a subscription by topic and match policy.
+type linkSubKey struct {
+	topic wamp.URI
+	match string
+}
+
+// linkSession forwards messages between the local and upstream sessions of a
+// realm link, for as long as both sessions exist.
+type linkSession struct {
+	*realmLink
+	remote wamp.Peer
+	local  wamp.Peer
+
+	// Protects the maps shared by the message forwarding goroutine and the
+	// goroutine that synchronizes subscriptions and registrations.
+	lock sync.Mutex
+	// Request ID -> channel waiting for the response.
+	pending map[wamp.ID]chan wamp.Message
+	// IDs of subscriptions to meta events on each router.  Each router
+	// assigns its own subscription IDs, so these are kept separately.
+	localMeta  map[wamp.ID]struct{}
+	remoteMeta map[wamp.ID]struct{}
+	// Upstream subscriptions made for local subscribers.
+	remoteSubs map[linkSubKey]wamp.ID
+	subTopics  map[wamp.ID]wamp.URI
+	// Local registrations made for upstream procedures.
+	localRegs map[wamp.URI]wamp.ID
+	regProcs  map[wamp.ID]wamp.URI
+
+	// Upstream CALL request ID <-> local INVOCATION request ID.  These are
+	// only used by the message forwarding goroutine.
+	calls       map[wamp.ID]wamp.ID
+	invocations map[wamp.ID]wamp.ID
+	// Last publication forwarded, to forward an event that matches more
+	// than one subscription only once.
+	lastPub wamp.ID
+
+	// Signaled by meta events when subscriptions or registrations change.
+	subsChanged chan struct{}
+	regsChanged chan struct{}
+}
+
+// run forwards messages between the upstream and local sessions, while a
+// separate goroutine keeps the subscriptions and registrations in sync.
+func (ls *linkSession) run() error {
+	stopSync := make(chan struct{})
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(syncDone)
+		ls.syncLoop(stopSync)
+	}()
+	defer func() {
+		close(stopSync)
+		<-syncDone
+	}()
+
+	for {
+		select {
+		case msg, open := <-ls.remote.Recv():
+			if !open {
+				return errors.New("upstream connection closed")
+			}
+			if err := ls.handleRemote(msg); err != nil {
+				return err
+			}
+		case msg, open := <-ls.local.Recv():
+			if !open {
+				return errLinkRealmClosed
+			}
+			if err := ls.handleLocal(msg); err != nil {
+				return err
+			}
+		case <-ls.stop:
+			ls.remote.Send(&wamp.Goodbye{
+				Reason:  wamp.ErrCloseRealm,
+				Details: wamp.Dict{},
+			})
+			return nil
+		}
+	}
+}
+
+// handleRemote handles a message from the upstream router.
+func (ls *linkSession) handleRemote(msg wamp.Message) error {
+	switch msg := msg.(type) {
+	case *wamp.Event:
+		if ls.isMetaSub(ls.remoteMeta, msg.Subscription) {
+			signal(ls.regsChanged)
+			return nil
+		}
+		ls.forwardEvent(msg)
+	case *wamp.Result:
+		if ls.respond(msg.Request, msg) {
+			return nil
+		}
+		if invID, ok := ls.calls[msg.Request]; ok {
+			ls.endCall(msg.Request, invID)
+			ls.local.Send(&wamp.Yield{
+				Request:     invID,
+				Arguments:   msg.Arguments,
+				ArgumentsKw: msg.ArgumentsKw,
+			})
+		}
+	case *wamp.Error:
+		if ls.respond(msg.Request, msg) {
+			return nil
+		}
+		if invID, ok := ls.calls[msg.Request]; ok && msg.Type == wamp.CALL {
+			ls.endCall(msg.Request, invID)
+			ls.local.Send(&wamp.Error{
+				Type:        wamp.INVOCATION,
+				Request:     invID,
+				Details:     wamp.Dict{},
+				Error:       msg.Error,
+				Arguments:   msg.Arguments,
+				ArgumentsKw: msg.ArgumentsKw,
+			})
+		}
+	case *wamp.Subscribed:
+		ls.respond(msg.Request, msg)
+	case *wamp.Unsubscribed:
+		ls.respond(msg.Request, msg)
+	case *wamp.Goodbye:
+		ls.remote.Send(&wamp.Goodbye{
+			Reason:  wamp.ErrGoodbyeAndOut,
+			Details: wamp.Dict{},
+		})
+		return fmt.Errorf("upstream router closed session: %s", msg.Reason)
+	case *wamp.Abort:
+		return fmt.Errorf("upstream router aborted session: %s", msg.Reason)
+	}
+	return nil
+}
+
+// handleLocal handles a message from the local realm.
+func (ls *linkSession) handleLocal(msg wamp.Message) error {
+	switch msg := msg.(type) {
+	case *wamp.Event:
+		if ls.isMetaSub(ls.localMeta, msg.Subscription) {
+			signal(ls.subsChanged)
+		}
+	case *wamp.Invocation:
+		ls.forwardCall(msg)
+	case *wamp.Interrupt:
+		if callID, ok := ls.invocations[msg.Request]; ok {
+			ls.remote.Send(&wamp.Cancel{
+				Request: callID,
+				Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKill},
+			})
+		}
+	case *wamp.Result:
+		ls.respond(msg.Request, msg)
+	case *wamp.Error:
+		ls.respond(msg.Request, msg)
+	case *wamp.Subscribed:
+		ls.respond(msg.Request, msg)
+	case *wamp.Registered:
+		ls.respond(msg.Request, msg)
+	case *wamp.Unregistered:
+		ls.respond(msg.Request, msg)
+	case *wamp.Goodbye:
+		return errLinkRealmClosed
+	}
+	return nil
+}
+
+// forwardEvent publishes an event from the upstream router in the local
+// realm.  Events that were already forwarded by a link are not forwarded
+// again.
+func (ls *linkSession) forwardEvent(msg *wamp.Event) {
+	if _, ok := msg.Details[optNexusOrigin]; ok {
+		return
+	}
+	if msg.Publication == ls.lastPub {
+		return
+	}
+	ls.lastPub = msg.Publication
+
+	topic, _ := wamp.AsURI(msg.Details[detailTopic])
+	if topic == "" {
+		ls.lock.Lock()
+		topic = ls.subTopics[msg.Subscription]
+		ls.lock.Unlock()
+		if topic == "" {
+			return
+		}
+	}
+	ls.local.Send(&wamp.Publish{
+		Request:     wamp.GlobalID(),
+		Topic:       topic,
+		Options:     wamp.Dict{optNexusOrigin: ls.url},
+		Arguments:   msg.Arguments,
+		ArgumentsKw: msg.ArgumentsKw,
+	})
+}
+
+// forwardCall calls the upstream procedure for an invocation of a proxied
+// registration.
+func (ls *linkSession) forwardCall(msg *wamp.Invocation) {
+	ls.lock.Lock()
+	procedure, ok := ls.regProcs[msg.Registration]
+	ls.lock.Unlock()
+	if _, forwarded := msg.Details[optNexusOrigin]; forwarded || !ok {
+		// Do not forward a call that another link forwarded, since the
+		// procedure may be proxied back to where the call came from.
+		ls.local.Send(&wamp.Error{
+			Type:    wamp.INVOCATION,
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchProcedure,
+		})
+		return
+	}
+	options := wamp.Dict{optNexusOrigin: ls.url}
+	if timeout := wamp.OptionInt64(msg.Details, wamp.OptTimeout); timeout > 0 {
+		options[wamp.OptTimeout] = timeout
+	}
+	callID := wamp.GlobalID()
+	ls.calls[callID] = msg.Request
+	ls.invocations[msg.Request] = callID
+	ls.remote.Send(&wamp.Call{
+		Request:     callID,
+		Procedure:   procedure,
+		Options:     options,
+		Arguments:   msg.Arguments,
+		ArgumentsKw: msg.ArgumentsKw,
+	})
+}
+
+// endCall forgets a forwarded call that has finished.
+func (ls *linkSession) endCall(callID, invID wamp.ID) {
+	delete(ls.calls, callID)
+	delete(ls.invocations, invID)
+}
+
+// respond delivers a response to the goroutine waiting for it, if any.
+func (ls *linkSession) respond(request wamp.ID, msg wamp.Message) bool {
+	ls.lock.Lock()
+	ch, ok := ls.pending[request]
+	delete(ls.pending, request)
+	ls.lock.Unlock()
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+func (ls *linkSession) isMetaSub(metaSubs map[wamp.ID]struct{}, id wamp.ID) bool {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	_, ok := metaSubs[id]
+	return ok
+}
+
+// signal does a non-blocking send on a channel with a buffer of one.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// request sends a request to the peer and waits for the response.
+func (ls *linkSession) request(peer wamp.Peer, request wamp.ID, msg wamp.Message, stop <-chan struct{}) (wamp.Message, error) {
+	ch := make(chan wamp.Message, 1)
+	ls.lock.Lock()
+	ls.pending[request] = ch
+	ls.lock.Unlock()
+	defer func() {
+		ls.lock.Lock()
+		delete(ls.pending, request)
+		ls.lock.Unlock()
+	}()
+
+	peer.Send(msg)
+	timer := time.NewTimer(ls.cfg.ResponseTimeout)
+	defer timer.Stop()
+	select {
+	case rsp := <-ch:
+		if errMsg, ok := rsp.(*wamp.Error); ok {
+			return nil, fmt.Errorf("%s %s", msg.MessageType(), errMsg.Error)
+		}
+		return rsp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for response to %s",
+			msg.MessageType())
+	case <-stop:
+		return nil, errors.New("link session ended")
+	}
+}
+
+// call calls a meta procedure and returns the first argument of the result.
+func (ls *linkSession) call(peer wamp.Peer, procedure wamp.URI, stop <-chan struct{}, args ...interface{}) (interface{}, error) {
+	req := wamp.GlobalID()
+	rsp, err := ls.request(peer, req, &wamp.Call{
+		Request:   req,
+		Procedure: procedure,
+		Arguments: wamp.List(args),
+	}, stop)
+	if err != nil {
+		return nil, err
+	}
+	result := rsp.(*wamp.Result)
+	if len(result.Arguments) == 0 {
+		return nil, fmt.Errorf("no result from %s", procedure)
+	}
+	return result.Arguments[0], nil
+}
+
+// subscribeMeta subscribes the peer to the meta events for the given topics,
+// and records the subscription IDs in metaSubs.
+func (ls *linkSession) subscribeMeta(peer wamp.Peer, metaSubs map[wamp.ID]struct{}, stop <-chan struct{}, topics ...wamp.URI) error {
+	for _, topic := range topics {
+		req := wamp.GlobalID()
+		rsp, err := ls.request(peer, req, &wamp.Subscribe{
+			Request: req,
+			Topic:   topic,
+			Options: wamp.Dict{},
+		}, stop)
+		if err != nil {
+			return err
+		}
+		ls.lock.Lock()
+		metaSubs[rsp.(*wamp.Subscribed).Subscription] = struct{}{}
+		ls.lock.Unlock()
+	}
+	return nil
+}
+
+// syncLoop watches for changes to local subscriptions and to upstream
+// registrations, and updates the upstream subscriptions and local
+// registrations to match.
+func (ls *linkSession) syncLoop(stop <-chan struct{}) {
+	log := ls.realm.log
+	err := ls.subscribeMeta(ls.local, ls.localMeta, stop,
+		wamp.MetaEventSubOnCreate, wamp.MetaEventSubOnDelete)
+	if err != nil {
+		log.Println("Link cannot watch local subscriptions:", err)
+	}
+	err = ls.subscribeMeta(ls.remote, ls.remoteMeta, stop,
+		wamp.MetaEventRegOnCreate, wamp.MetaEventRegOnDelete)
+	if err != nil {
+		log.Println("Link cannot watch upstream registrations:", err)
+	}
+	ls.syncSubscriptions(stop)
+	ls.syncRegistrations(stop)
+	for {
+		select {
+		case <-ls.subsChanged:
+			ls.syncSubscriptions(stop)
+		case <-ls.regsChanged:
+			ls.syncRegistrations(stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// listMeta calls the list meta procedure, and then the get meta procedure
+// for each listed ID, and returns the details of each.  Details with a meta
+// URI are omitted.
+func (ls *linkSession) listMeta(peer wamp.Peer, listProc, getProc wamp.URI, stop <-chan struct{}) ([]wamp.Dict, error) {
+	arg, err := ls.call(peer, listProc, stop)
+	if err != nil {
+		return nil, err
+	}
+	lists, _ := wamp.AsDict(arg)
+	var all []wamp.Dict
+	for _, match := range []string{wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard} {
+		ids, _ := wamp.AsList(lists[match])
+		for _, v := range ids {
+			id, _ := wamp.AsID(v)
+			arg, err = ls.call(peer, getProc, stop, id)
+			if err != nil {
+				// Removed since listed.
+				continue
+			}
+			details, _ := wamp.AsDict(arg)
+			uri, _ := wamp.AsURI(details["uri"])
+			if strings.HasPrefix(string(uri), "wamp.") {
+				continue
+			}
+			all = append(all, details)
+		}
+	}
+	return all, nil
+}
+
+// syncSubscriptions subscribes upstream to the topics subscribed to locally,
+// and unsubscribes from topics no longer subscribed to locally.
+func (ls *linkSession) syncSubscriptions(stop <-chan struct{}) {
+	subs, err := ls.listMeta(ls.local, wamp.MetaProcSubList,
+		wamp.MetaProcSubGet, stop)
+	if err != nil {
+		ls.realm.log.Println("Link cannot list local subscriptions:", err)
+		return
+	}
+	want := map[linkSubKey]struct{}{}
+	for _, details := range subs {
+		topic, _ := wamp.AsURI(details["uri"])
+		match, _ := wamp.AsString(details[wamp.OptMatch])
+		want[linkSubKey{topic, match}] = struct{}{}
+	}
+
+	ls.lock.Lock()
+	var unsub []linkSubKey
+	for key := range ls.remoteSubs {
+		if _, ok := want[key]; !ok {
+			unsub = append(unsub, key)
+		} else {
+			delete(want, key)
+		}
+	}
+	ls.lock.Unlock()
+
+	for key := range want {
+		req := wamp.GlobalID()
+		rsp, err := ls.request(ls.remote, req, &wamp.Subscribe{
+			Request: req,
+			Topic:   key.topic,
+			Options: wamp.Dict{wamp.OptMatch: key.match},
+		}, stop)
+		if err != nil {
+			ls.realm.log.Println("Link cannot subscribe upstream to",
+				key.topic, err)
+			continue
+		}
+		id := rsp.(*wamp.Subscribed).Subscription
+		ls.lock.Lock()
+		ls.remoteSubs[key] = id
+		ls.subTopics[id] = key.topic
+		ls.lock.Unlock()
+	}
+	for _, key := range unsub {
+		ls.lock.Lock()
+		id := ls.remoteSubs[key]
+		delete(ls.remoteSubs, key)
+		delete(ls.subTopics, id)
+		ls.lock.Unlock()
+		req := wamp.GlobalID()
+		ls.request(ls.remote, req, &wamp.Unsubscribe{
+			Request:      req,
+			Subscription: id,
+		}, stop)
+	}
+}
+
+// syncRegistrations registers locally the procedures registered upstream,
+// and unregisters procedures no longer registered upstream.  Only exact
+// matching registrations are proxied, since an INVOCATION for a pattern
+// based registration does not say what procedure was called.
+func (ls *linkSession) syncRegistrations(stop <-chan struct{}) {
+	regs, err := ls.listMeta(ls.remote, wamp.MetaProcRegList,
+		wamp.MetaProcRegGet, stop)
+	if err != nil {
+		ls.realm.log.Println("Link cannot list upstream registrations:", err)
+		return
+	}
+	want := map[wamp.URI]struct{}{}
+	for _, details := range regs {
+		match, _ := wamp.AsString(details[wamp.OptMatch])
+		if match != "" && match != wamp.MatchExact {
+			continue
+		}
+		procedure, _ := wamp.AsURI(details["uri"])
+		want[procedure] = struct{}{}
+	}
+
+	ls.lock.Lock()
+	var unreg []wamp.URI
+	for procedure := range ls.localRegs {
+		if _, ok := want[procedure]; !ok {
+			unreg = append(unreg, procedure)
+		} else {
+			delete(want, procedure)
+		}
+	}
+	ls.lock.Unlock()
+
+	for procedure := range want {
+		req := wamp.GlobalID()
+		rsp, err := ls.request(ls.local, req, &wamp.Register{
+			Request:   req,
+			Procedure: procedure,
+			Options:   wamp.Dict{},
+		}, stop)
+		if err != nil {
+			// The procedure may already be registered locally.
+			if ls.realm.debug {
+				ls.realm.log.Println("Link cannot register", procedure, err)
+			}
+			continue
+		}
+		id := rsp.(*wamp.Registered).Registration
+		ls.lock.Lock()
+		ls.localRegs[procedure] = id
+		ls.regProcs[id] = procedure
+		ls.lock.Unlock()
+	}
+	for _, procedure := range unreg {
+		ls.lock.Lock()
+		id := ls.localRegs[procedure]
+		delete(ls.localRegs, procedure)
+		delete(ls.regProcs, id)
+		ls.lock.Unlock()
+		req := wamp.GlobalID()
+		ls.request(ls.local, req, &wamp.Unregister{
+			Request:      req,
+			Registration: id,
+		}, stop)
+	}
+}
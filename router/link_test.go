@@ -0,0 +1,219 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestLinkRealm(t *testing.T) {
+	const (
+		testTopic     = wamp.URI("nexus.test.topic")
+		testProcedure = wamp.URI("nexus.test.proc")
+	)
+
+	upstream, err := NewRouter(routerConfig, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closer, err := NewWebsocketServer(upstream).ListenAndServe(wsAddr)
+	if err != nil {
+		upstream.Close()
+		t.Fatal(err)
+	}
+	r, err := newTestRouter()
+	if err != nil {
+		closer.Close()
+		upstream.Close()
+		t.Fatal(err)
+	}
+	// Closing the router also closes its links.
+	defer func() {
+		r.Close()
+		closer.Close()
+		upstream.Close()
+		AssertNoGoroutineLeak(t)
+	}()
+
+	linker, ok := r.(RealmLinker)
+	if !ok {
+		t.Fatal("router does not implement RealmLinker")
+	}
+	if _, err = linker.LinkRealm("nexus.no.such.realm", "ws://"+wsAddr+"/", LinkConfig{}); err == nil {
+		t.Fatal("expected error linking realm that does not exist")
+	}
+	link, err := linker.LinkRealm(testRealm, fmt.Sprintf("ws://%s/", wsAddr),
+		LinkConfig{ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local subscriber receives events published upstream, once the link has
+	// subscribed upstream.
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if _, ok := (<-sub.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	pub, err := testClient(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for event := (*wamp.Event)(nil); event == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("did not receive event from upstream router")
+		}
+		pub.Send(&wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     testTopic,
+			Arguments: wamp.List{"hello"},
+		})
+		select {
+		case msg := <-sub.Recv():
+			var ok bool
+			if event, ok = msg.(*wamp.Event); !ok {
+				t.Fatal("expected EVENT, got", msg.MessageType())
+			}
+		case <-time.After(50 * time.Millisecond):
+			continue
+		}
+		if s, _ := wamp.AsString(event.Arguments[0]); s != "hello" {
+			t.Fatal("wrong event argument:", event.Arguments[0])
+		}
+		// Forwarded events are marked so that links do not forward them
+		// again.
+		if _, ok := event.Details[optNexusOrigin]; !ok {
+			t.Fatal("forwarded event does not have origin marker")
+		}
+	}
+
+	// Local caller can call a procedure registered upstream, once the link
+	// has registered the procedure locally.
+	callee, err := testClient(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+	go func() {
+		for msg := range callee.Recv() {
+			if inv, ok := msg.(*wamp.Invocation); ok {
+				callee.Send(&wamp.Yield{
+					Request:   inv.Request,
+					Arguments: wamp.List{"pong"},
+				})
+			}
+		}
+	}()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+		var msg wamp.Message
+		select {
+		case msg = <-caller.Recv():
+		case <-ctx.Done():
+			t.Fatal("timed out calling procedure registered upstream")
+		}
+		if result, ok := msg.(*wamp.Result); ok {
+			if s, _ := wamp.AsString(result.Arguments[0]); s != "pong" {
+				t.Fatal("wrong result:", result.Arguments[0])
+			}
+			break
+		}
+		if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchProcedure {
+			t.Fatal("unexpected response to CALL:", msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err = link.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkOriginFromClient(t *testing.T) {
+	const (
+		testTopic     = wamp.URI("nexus.test.topic")
+		testProcedure = wamp.URI("nexus.test.proc")
+	)
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if _, ok := (<-sub.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+
+	// A client cannot make its publication or call look like it was
+	// forwarded by a link.
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   testTopic,
+		Options: wamp.Dict{optNexusOrigin: "ws://spoofed/"},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for EVENT")
+	case msg := <-sub.Recv():
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if _, ok = event.Details[optNexusOrigin]; ok {
+			t.Fatal("event has origin marker set by client")
+		}
+	}
+
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{optNexusOrigin: "ws://spoofed/"},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	case msg := <-callee.Recv():
+		inv, ok := msg.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got", msg.MessageType())
+		}
+		if _, ok = inv.Details[optNexusOrigin]; ok {
+			t.Fatal("invocation has origin marker set by client")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// MetricsRecorder is notified of the router's activity, so that it can be
+// exported to a monitoring system.  The router does not depend on any
+// monitoring system; the metrics package provides a MetricsRecorder that is
+// also a Prometheus collector.
+//
+// The methods are called by the goroutines that route messages, so they must
+// be safe to call concurrently and must not block.
+type MetricsRecorder interface {
+	// SessionJoined is called when a client session joins a realm.
+	SessionJoined(realm wamp.URI)
+	// MessageRouted is called for each message received from a client
+	// session, before the message is routed.
+	MessageRouted(realm wamp.URI, msgType wamp.MessageType)
+	// CallsInFlight is called with the number of calls that are waiting for
+	// a result, whenever that number changes.
+	CallsInFlight(realm wamp.URI, count int)
+	// Published is called with the time taken to dispatch a publication to
+	// its subscribers.
+	Published(realm wamp.URI, elapsed time.Duration)
+}
+
+// Outcomes of a call, given to CallMetricsRecorder.CallFinished.
+const (
+	// The callee sent a final YIELD.
+	CallSucceeded = "success"
+	// The callee sent an ERROR, or left the realm before responding.
+	CallFailed = "error"
+	// The call was canceled by the caller.
+	CallCanceled = "canceled"
+	// The call was canceled because its timeout, or the dealer's maximum
+	// invocation duration, expired.
+	CallTimedOut = "timeout"
+)
+
+// CallMetricsRecorder is optionally implemented by a MetricsRecorder that
+// records the latency of calls to each procedure.  If the MetricsRecorder
+// given to the router implements it, then each finished invocation is
+// recorded.
+type CallMetricsRecorder interface {
+	// CallFinished is called when an invocation finishes, with the time
+	// since the INVOCATION was sent to the callee.  The procedure is the URI
+	// of the invoked registration, which is the pattern of a pattern-based
+	// registration.  The outcome is one of CallSucceeded, CallFailed,
+	// CallCanceled, or CallTimedOut.
+	CallFinished(realm, procedure wamp.URI, outcome string, elapsed time.Duration)
+}
@@ -0,0 +1,39 @@
+//go:build prometheus
+// +build prometheus
+
+package metrics_test
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/router/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// This example registers a Collector with the default Prometheus registry,
+// and serves the metrics of a router over HTTP.
+func ExampleCollector() {
+	collector := metrics.NewCollector("")
+	prometheus.MustRegister(collector)
+
+	config := &router.RouterConfig{
+		RealmConfigs: []*router.RealmConfig{
+			{
+				URI:           "nexus.example",
+				AnonymousAuth: true,
+			},
+		},
+		Metrics: collector,
+	}
+	nxr, err := router.NewRouter(config, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nxr.Close()
+
+	http.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(":9090", nil))
+}
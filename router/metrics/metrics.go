@@ -0,0 +1,144 @@
+//go:build prometheus
+// +build prometheus
+
+/*
+Package metrics exports router metrics to Prometheus.
+
+A Collector is a router.MetricsRecorder that records the router's activity in
+Prometheus metrics, and is also a prometheus.Collector that is registered with
+a Prometheus registry.  Give the Collector to the router in the Metrics field
+of the RouterConfig.
+
+This package requires github.com/prometheus/client_golang, which is vendored,
+and is only built with the "prometheus" build tag, so that the router does not
+depend on Prometheus when the metrics are not used.  The vendored client needs
+Go 1.20 or later:
+
+	go build -tags prometheus
+
+The "test-prometheus" make target builds and tests this package.
+
+The metrics, each labeled by realm, are:
+
+	nexus_sessions_total            counter, sessions that joined the realm
+	nexus_messages_routed_total     counter, messages from clients, also
+	                                labeled by message type
+	nexus_calls_in_flight           gauge, calls waiting for a result
+	nexus_publish_latency_seconds   histogram, time to dispatch a publication
+	                                to its subscribers
+	nexus_call_latency_seconds      histogram, time from sending an INVOCATION
+	                                to the callee finishing the call, also
+	                                labeled by procedure and outcome
+
+The procedure of a call is the URI of the invoked registration, and its
+outcome is "success", "error", "canceled", or "timeout".
+*/
+package metrics
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/wamp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace is the namespace of the metrics if none is given to
+// NewCollector.
+const DefaultNamespace = "nexus"
+
+// Collector records the activity of a router in Prometheus metrics.
+type Collector struct {
+	sessions       *prometheus.CounterVec
+	messagesRouted *prometheus.CounterVec
+	callsInFlight  *prometheus.GaugeVec
+	publishLatency *prometheus.HistogramVec
+	callLatency    *prometheus.HistogramVec
+}
+
+// Collector implements all of these interfaces.
+var (
+	_ router.MetricsRecorder     = (*Collector)(nil)
+	_ router.CallMetricsRecorder = (*Collector)(nil)
+	_ prometheus.Collector       = (*Collector)(nil)
+)
+
+// NewCollector creates a Collector whose metric names are prefixed with the
+// given namespace.  If namespace is empty, then DefaultNamespace is used.
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Collector{
+		sessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_total",
+			Help:      "Number of sessions that joined the realm.",
+		}, []string{"realm"}),
+		messagesRouted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_routed_total",
+			Help:      "Number of messages received from clients for routing.",
+		}, []string{"realm", "type"}),
+		callsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "calls_in_flight",
+			Help:      "Number of calls waiting for a result.",
+		}, []string{"realm"}),
+		publishLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_latency_seconds",
+			Help:      "Time taken to dispatch a publication to its subscribers.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"realm"}),
+		callLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "call_latency_seconds",
+			Help:      "Time from sending an invocation to the call finishing.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"realm", "procedure", "outcome"}),
+	}
+}
+
+// Describe sends the descriptors of the Collector's metrics to the channel.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.sessions.Describe(ch)
+	c.messagesRouted.Describe(ch)
+	c.callsInFlight.Describe(ch)
+	c.publishLatency.Describe(ch)
+	c.callLatency.Describe(ch)
+}
+
+// Collect sends the current values of the Collector's metrics to the channel.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.sessions.Collect(ch)
+	c.messagesRouted.Collect(ch)
+	c.callsInFlight.Collect(ch)
+	c.publishLatency.Collect(ch)
+	c.callLatency.Collect(ch)
+}
+
+// SessionJoined counts a session joining the realm.
+func (c *Collector) SessionJoined(realm wamp.URI) {
+	c.sessions.WithLabelValues(string(realm)).Inc()
+}
+
+// MessageRouted counts a message received from a client of the realm.
+func (c *Collector) MessageRouted(realm wamp.URI, msgType wamp.MessageType) {
+	c.messagesRouted.WithLabelValues(string(realm), msgType.String()).Inc()
+}
+
+// CallsInFlight sets the number of calls in the realm waiting for a result.
+func (c *Collector) CallsInFlight(realm wamp.URI, count int) {
+	c.callsInFlight.WithLabelValues(string(realm)).Set(float64(count))
+}
+
+// Published observes the time taken to dispatch a publication in the realm.
+func (c *Collector) Published(realm wamp.URI, elapsed time.Duration) {
+	c.publishLatency.WithLabelValues(string(realm)).Observe(elapsed.Seconds())
+}
+
+// CallFinished observes the latency of a call to the procedure in the realm.
+func (c *Collector) CallFinished(realm, procedure wamp.URI, outcome string, elapsed time.Duration) {
+	c.callLatency.WithLabelValues(string(realm), string(procedure), outcome).Observe(elapsed.Seconds())
+}
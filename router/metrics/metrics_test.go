@@ -0,0 +1,75 @@
+//go:build prometheus
+// +build prometheus
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/router"
+	"github.com/gammazero/nexus/wamp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	realm := wamp.URI("nexus.test.realm")
+	c.SessionJoined(realm)
+	c.SessionJoined(realm)
+	c.MessageRouted(realm, wamp.CALL)
+	c.CallsInFlight(realm, 3)
+	c.Published(realm, time.Millisecond)
+	c.CallFinished(realm, "nexus.test.proc", router.CallFailed, time.Millisecond)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]*dto.Metric{}
+	for _, mf := range families {
+		if len(mf.Metric) != 1 {
+			t.Fatalf("expected 1 %s metric, got %d", mf.GetName(), len(mf.Metric))
+		}
+		metrics[mf.GetName()] = mf.Metric[0]
+	}
+
+	if v := metrics["test_sessions_total"].GetCounter().GetValue(); v != 2 {
+		t.Error("wrong sessions_total:", v)
+	}
+	m := metrics["test_messages_routed_total"]
+	if v := m.GetCounter().GetValue(); v != 1 {
+		t.Error("wrong messages_routed_total:", v)
+	}
+	labels := map[string]string{}
+	for _, lp := range m.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	if labels["realm"] != string(realm) || labels["type"] != "CALL" {
+		t.Error("wrong messages_routed_total labels:", labels)
+	}
+	if v := metrics["test_calls_in_flight"].GetGauge().GetValue(); v != 3 {
+		t.Error("wrong calls_in_flight:", v)
+	}
+	h := metrics["test_publish_latency_seconds"].GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() != time.Millisecond.Seconds() {
+		t.Error("wrong publish_latency_seconds:", h)
+	}
+	m = metrics["test_call_latency_seconds"]
+	labels = map[string]string{}
+	for _, lp := range m.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	if labels["procedure"] != "nexus.test.proc" || labels["outcome"] != "error" {
+		t.Error("wrong call_latency_seconds labels:", labels)
+	}
+	if h = m.GetHistogram(); h.GetSampleCount() != 1 {
+		t.Error("wrong call_latency_seconds:", h)
+	}
+}
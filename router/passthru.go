@@ -0,0 +1,85 @@
+package router
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Options of a PUBLISH in payload passthru mode, which are copied to the
+// details of each EVENT.
+const (
+	optPPTScheme     = "ppt_scheme"
+	optPPTSerializer = "ppt_serializer"
+	optPPTCipher     = "ppt_cipher"
+	optPPTKeyID      = "ppt_keyid"
+
+	// Prefix of the names of custom payload passthru schemes.
+	pptCustomSchemePrefix = "x_"
+)
+
+// pptPayload is the payload of a publication in payload passthru mode.  The
+// payload is a single binary argument that the broker never decodes, so that
+// it is relayed to subscribers as-is.  Serializers that have no binary type,
+// such as JSON, convert binary arguments to and from their own representation,
+// so the broker always sees the payload as a []byte.
+type pptPayload struct {
+	// ppt_* options of the PUBLISH.
+	details wamp.Dict
+}
+
+// newPPTPayload returns the passthru payload of a PUBLISH, or nil if the
+// PUBLISH does not use payload passthru mode.  An error is returned if the
+// PUBLISH has invalid ppt_* options, or a payload that is not a single binary
+// argument.
+func newPPTPayload(msg *wamp.Publish) (*pptPayload, error) {
+	var details wamp.Dict
+	for opt, val := range msg.Options {
+		if !strings.HasPrefix(opt, "ppt_") {
+			continue
+		}
+		switch opt {
+		case optPPTScheme, optPPTSerializer, optPPTCipher, optPPTKeyID:
+		default:
+			return nil, errors.New("unknown payload passthru option " + opt)
+		}
+		if _, ok := val.(string); !ok {
+			return nil, errors.New(opt + " must be a string")
+		}
+		if details == nil {
+			details = wamp.Dict{}
+		}
+		details[opt] = val
+	}
+	if details == nil {
+		return nil, nil
+	}
+
+	scheme, _ := details[optPPTScheme].(string)
+	switch {
+	case scheme == "":
+		return nil, errors.New("payload passthru mode requires " + optPPTScheme)
+	case scheme == "wamp", scheme == "mqtt":
+	case strings.HasPrefix(scheme, pptCustomSchemePrefix):
+	default:
+		return nil, errors.New("unsupported payload passthru scheme " + scheme)
+	}
+
+	if len(msg.Arguments) != 1 || len(msg.ArgumentsKw) != 0 {
+		return nil, errors.New(
+			"payload passthru mode requires a single binary argument")
+	}
+	if _, ok := msg.Arguments[0].([]byte); !ok {
+		return nil, errors.New("payload passthru argument is not binary")
+	}
+	return &pptPayload{details: details}, nil
+}
+
+// addDetails adds the ppt_* options of the publication to the details of an
+// EVENT.
+func (p *pptPayload) addDetails(details wamp.Dict) {
+	for k, v := range p.details {
+		details[k] = v
+	}
+}
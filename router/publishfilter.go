@@ -1,6 +1,8 @@
 package router
 
 import (
+	"fmt"
+	"math"
 	"strings"
 
 	"github.com/gammazero/nexus/wamp"
@@ -16,70 +18,115 @@ type publishFilter struct {
 // newPublishFilter gets any blacklists and whitelists included in a PUBLISH
 // message.  If there are no filters defined by the PUBLISH message, then nil
 // is returned.
-func newPublishFilter(msg *wamp.Publish) *publishFilter {
+//
+// The "exclude" and "eligible" options must be lists of session IDs, and the
+// "exclude_<attribute>" and "eligible_<attribute>" options, such as
+// "eligible_authrole", must be lists of non-empty strings.  An error is
+// returned for an option of any other form, instead of ignoring it, so that a
+// malformed whitelist does not make the event go to every subscriber.
+func newPublishFilter(msg *wamp.Publish) (*publishFilter, error) {
 	const (
 		blacklistPrefix = "exclude_"
 		whitelistPrefix = "eligible_"
 	)
 
 	if len(msg.Options) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	var blIDs []wamp.ID
-	if blacklistFilter, ok := msg.Options[wamp.BlacklistKey]; ok {
-		if blacklist, ok := wamp.AsList(blacklistFilter); ok {
-			for i := range blacklist {
-				if blVal, ok := wamp.AsID(blacklist[i]); ok {
-					blIDs = append(blIDs, blVal)
-				}
+	getIDs := func(key string) ([]wamp.ID, error) {
+		values, ok := msg.Options[key]
+		if !ok {
+			return nil, nil
+		}
+		list, ok := wamp.AsList(values)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of session IDs", key)
+		}
+		ids := make([]wamp.ID, 0, len(list))
+		for i := range list {
+			id, ok := asSessionID(list[i])
+			if !ok {
+				return nil, fmt.Errorf("%s has invalid session ID %v", key,
+					list[i])
 			}
+			ids = append(ids, id)
 		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		return ids, nil
 	}
 
-	var wlIDs []wamp.ID
-	if whitelistFilter, ok := msg.Options[wamp.WhitelistKey]; ok {
-		if whitelist, ok := wamp.AsList(whitelistFilter); ok {
-			for i := range whitelist {
-				if wlID, ok := wamp.AsID(whitelist[i]); ok {
-					wlIDs = append(wlIDs, wlID)
-				}
-			}
-		}
+	blIDs, err := getIDs(wamp.BlacklistKey)
+	if err != nil {
+		return nil, err
+	}
+	wlIDs, err := getIDs(wamp.WhitelistKey)
+	if err != nil {
+		return nil, err
 	}
 
-	getAttrMap := func(prefix string) map[string][]string {
+	getAttrMap := func(prefix string) (map[string][]string, error) {
 		var attrMap map[string][]string
 		for k, values := range msg.Options {
-			if !strings.HasPrefix(k, prefix) {
+			if !strings.HasPrefix(k, prefix) || k == wamp.OptExcludeMe {
 				continue
 			}
-			if vals, ok := wamp.AsList(values); ok {
-				vallist := make([]string, 0, len(vals))
-				for i := range vals {
-					if val, ok := wamp.AsString(vals[i]); ok && val != "" {
-						vallist = append(vallist, val)
-					}
+			vals, ok := wamp.AsList(values)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings", k)
+			}
+			vallist := make([]string, 0, len(vals))
+			for i := range vals {
+				val, ok := wamp.AsString(vals[i])
+				if !ok || val == "" {
+					return nil, fmt.Errorf("%s has invalid value %v", k,
+						vals[i])
 				}
-				if len(vallist) != 0 {
-					attrName := k[len(prefix):]
-					if attrMap == nil {
-						attrMap = map[string][]string{}
-					}
-					attrMap[attrName] = vallist
+				vallist = append(vallist, val)
+			}
+			if len(vallist) != 0 {
+				attrName := k[len(prefix):]
+				if attrMap == nil {
+					attrMap = map[string][]string{}
 				}
+				attrMap[attrName] = vallist
 			}
 		}
-		return attrMap
+		return attrMap, nil
 	}
 
-	blMap := getAttrMap(blacklistPrefix)
-	wlMap := getAttrMap(whitelistPrefix)
+	blMap, err := getAttrMap(blacklistPrefix)
+	if err != nil {
+		return nil, err
+	}
+	wlMap, err := getAttrMap(whitelistPrefix)
+	if err != nil {
+		return nil, err
+	}
 
 	if blIDs == nil && wlIDs == nil && blMap == nil && wlMap == nil {
-		return nil
+		return nil, nil
+	}
+	return &publishFilter{blIDs, wlIDs, blMap, wlMap}, nil
+}
+
+// asSessionID returns the value as a session ID, if it is an integer.  JSON
+// decodes numbers as float64, so a float without a fractional part is also a
+// session ID.
+func asSessionID(v interface{}) (wamp.ID, bool) {
+	switch f := v.(type) {
+	case float64:
+		if f != math.Trunc(f) {
+			return 0, false
+		}
+	case float32:
+		if float64(f) != math.Trunc(float64(f)) {
+			return 0, false
+		}
 	}
-	return &publishFilter{blIDs, wlIDs, blMap, wlMap}
+	return wamp.AsID(v)
 }
 
 // publishAllowed determines if a message is allowed to be published to a
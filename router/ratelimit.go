@@ -0,0 +1,85 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Policies for handling a message from a session that has exceeded its rate
+// limit, set by RateLimit.Policy.
+const (
+	// Stop reading messages from the session until the message is within
+	// the rate limit.  This pushes back on the client through its transport.
+	RateLimitDelay = "delay"
+	// End the session.  Since the session has already joined the realm, it
+	// is sent a GOODBYE, not an ABORT, with the reason
+	// wamp.error.protocol_violation.
+	RateLimitAbort = "abort"
+)
+
+// RateLimit limits the rate at which the router processes messages from each
+// session in a realm.  Each session has its own token bucket, which holds up
+// to Burst tokens and is refilled at Rate tokens per second.  Each message
+// from the session, other than GOODBYE, takes a token.  A message that
+// arrives when the bucket is empty is handled according to Policy.
+type RateLimit struct {
+	// Average number of messages per second allowed from each session.
+	// Zero, the default, means no limit.
+	Rate float64 `json:"rate"`
+	// Number of messages that a session may send at once, after sending
+	// nothing for a while.  The default is 1.
+	Burst int `json:"burst"`
+	// What to do with a message that exceeds the rate limit: RateLimitDelay
+	// or RateLimitAbort.  The default is RateLimitDelay.
+	Policy string `json:"policy"`
+}
+
+// tokenBucket is the rate limiter of a single session.  It is only used by
+// the goroutine handling the session's inbound messages, so it needs no
+// locking.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // capacity of the bucket
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+// newTokenBucket returns a full token bucket for the rate limit.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take takes a token for the message.  If there is no token, then nothing is
+// taken, and the time to wait until there is one is returned.  A GOODBYE
+// never waits, so that a session can always leave.
+func (b *tokenBucket) take(msg wamp.Message) time.Duration {
+	if _, ok := msg.(*wamp.Goodbye); ok {
+		return 0
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait <= 0 {
+		// Round up, so that waiting always gets the token.
+		wait = time.Nanosecond
+	}
+	return wait
+}
@@ -2,7 +2,6 @@ package router
 
 import (
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
 	"time"
@@ -65,22 +64,15 @@ func (s *RawSocketServer) ListenAndServe(network, address string) (io.Closer, er
 // goroutine that accepts new TLS client connections until the returned
 // io.closer is closed.  If tls.Config does not already contain a certificate,
 // then certFile and keyFile, if specified, are used to load an X509
-// certificate.
+// certificate.  An error is returned if there is no certificate.
+//
+// To have clients present certificates, set ClientAuth in tls.Config.  The
+// subject of a client's certificate is included in the transport details
+// given to authenticators, and in the session details.
 func (s *RawSocketServer) ListenAndServeTLS(network, address string, tlscfg *tls.Config, certFile, keyFile string) (io.Closer, error) {
-	var hasCert bool
-	if tlscfg == nil {
-		tlscfg = &tls.Config{}
-	} else if len(tlscfg.Certificates) > 0 || tlscfg.GetCertificate != nil {
-		hasCert = true
-	}
-
-	if !hasCert || certFile != "" || keyFile != "" {
-		var err error
-		tlscfg.Certificates = make([]tls.Certificate, 1)
-		tlscfg.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return nil, fmt.Errorf("error loading X509 key pair: %s", err)
-		}
+	tlscfg, err := serverTLSConfig(tlscfg, certFile, keyFile)
+	if err != nil {
+		return nil, err
 	}
 
 	l, err := tls.Listen(network, address, tlscfg)
@@ -1,7 +1,21 @@
 package router
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
 	"github.com/gammazero/nexus/transport"
@@ -74,3 +88,321 @@ func TestRSHandshakeMsgpack(t *testing.T) {
 	}
 	client.Close()
 }
+
+func TestRSMaxMessageSize(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				MaxMessageSize: 1024,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	clsr, err := NewRawSocketServer(r, 0, 0).ListenAndServe("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	client, err := transport.ConnectRawSocketPeer("tcp", tcpAddr,
+		serialize.JSON, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	checkMaxMessageSize(t, client)
+}
+
+// checkMaxMessageSize checks that a client of a realm with a maximum message
+// size of 1024 bytes is aborted when it sends a larger message.
+func checkMaxMessageSize(t *testing.T, client wamp.Peer) {
+	recv := func() (wamp.Message, bool) {
+		select {
+		case msg, ok := <-client.Recv():
+			return msg, ok
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+		return nil, false
+	}
+
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if msg, _ := recv(); msg == nil || msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg)
+	}
+
+	// A message within the limit is routed.
+	client.Send(&wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Options:   wamp.Dict{wamp.OptAcknowledge: true},
+		Topic:     "nexus.test.topic",
+		Arguments: wamp.List{strings.Repeat("x", 512)},
+	})
+	if msg, _ := recv(); msg == nil || msg.MessageType() != wamp.PUBLISHED {
+		t.Fatal("expected PUBLISHED, got", msg)
+	}
+
+	// A message over the limit aborts the session.
+	client.Send(&wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Options:   wamp.Dict{wamp.OptAcknowledge: true},
+		Topic:     "nexus.test.topic",
+		Arguments: wamp.List{strings.Repeat("x", 2048)},
+	})
+	msg, _ := recv()
+	abort, ok := msg.(*wamp.Abort)
+	if !ok {
+		t.Fatal("expected ABORT, got", msg)
+	}
+	if abort.Reason != wamp.ErrProtocolViolation {
+		t.Fatal("wrong abort reason:", abort.Reason)
+	}
+	if _, ok = recv(); ok {
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+func TestRSUnixSocket(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "nexus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "nexus.sock")
+
+	clsr, err := NewRawSocketServer(r, 0, 0).ListenAndServe("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	client, err := transport.ConnectRawSocketPeer("unix", sockPath,
+		serialize.JSON, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, ok := <-client.Recv()
+	if !ok {
+		t.Fatal("recv chan closed")
+	}
+	if _, ok = msg.(*wamp.Welcome); !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+	client.Close()
+}
+
+func TestRSHandshakeErrors(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	clsr, err := NewRawSocketServer(r, 0, 0).ListenAndServe("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	for _, tc := range []struct {
+		name      string
+		handshake []byte
+		errByte   byte
+	}{
+		{"unsupported serializer", []byte{0x7f, 0xf5, 0, 0}, 0x1},
+		{"reserved bits", []byte{0x7f, 0xf1, 0, 1}, 0x3},
+	} {
+		conn, err := net.Dial("tcp", tcpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Write(tc.handshake); err != nil {
+			t.Fatal(err)
+		}
+		var rsp [4]byte
+		if _, err = io.ReadFull(conn, rsp[:]); err != nil {
+			t.Fatal(tc.name, "error reading handshake response:", err)
+		}
+		if rsp[0] != 0x7f || rsp[1] != tc.errByte<<4 {
+			t.Fatalf("%s: wrong handshake response: %x", tc.name, rsp)
+		}
+		conn.Close()
+	}
+}
+
+func TestRSMessageTooLarge(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Limit messages received by the router to 512 bytes.
+	clsr, err := NewRawSocketServer(r, 512, 0).ListenAndServe("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Handshake requesting JSON serialization.
+	if _, err = conn.Write([]byte{0x7f, 0xf1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var rsp [4]byte
+	if _, err = io.ReadFull(conn, rsp[:]); err != nil {
+		t.Fatal(err)
+	}
+	// Server announces receive limit of 2^9 = 512 bytes.
+	if rsp[0] != 0x7f || rsp[1] != 0x01 {
+		t.Fatalf("wrong handshake response: %x", rsp)
+	}
+
+	// Send a message larger than the negotiated limit.  The router must
+	// close the connection.
+	msg := make([]byte, 1024)
+	if _, err = conn.Write([]byte{0, 0, 0x04, 0}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(msg)
+	if _, err = conn.Read(rsp[:]); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed after oversized message")
+	}
+}
+
+// testCertificate creates a self-signed certificate, for 127.0.0.1, that can
+// be used by both servers and clients, and a pool containing it.
+func testCertificate(commonName string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, nil
+}
+
+func TestRSTLSClientCert(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cert, pool, err := testCertificate("nexus-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewRawSocketServer(r, 0, 0)
+
+	// TLS without a certificate fails when starting the server.
+	if _, err = s.ListenAndServeTLS("tcp", tcpAddr, &tls.Config{}, "", ""); err != errNoCertificate {
+		t.Fatal("expected error for TLS without certificate, got:", err)
+	}
+
+	clsr, err := s.ListenAndServeTLS("tcp", tcpAddr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	client, err := transport.ConnectTlsRawSocketPeer("tcp", tcpAddr,
+		serialize.JSON, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		}, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, ok := <-client.Recv()
+	if !ok {
+		t.Fatal("recv chan closed")
+	}
+	welcome, ok := msg.(*wamp.Welcome)
+	if !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+
+	// Session details include the subject of the client certificate.
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{welcome.ID},
+	})
+	msg, ok = <-client.Recv()
+	if !ok {
+		t.Fatal("recv chan closed")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	details := wamp.NormalizeDict(result.Arguments[0])
+	cn, err := wamp.DictValue(details,
+		[]string{"transport", "tls", "peer_cert", "common_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn != "nexus-client" {
+		t.Fatal("wrong client certificate common name:", cn)
+	}
+}
@@ -3,7 +3,10 @@ package router
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
@@ -18,49 +21,356 @@ type RealmConfig struct {
 	URI wamp.URI
 	// Enforce strict URI format validation.
 	StrictURI bool `json:"strict_uri"`
+	// Reject PUBLISH, CALL, and SUBSCRIBE messages that have options the
+	// router does not recognize, with a wamp.error.invalid_options error.
+	// When false, the default, unrecognized options are ignored.
+	StrictOptions bool `json:"strict_options"`
 	// Allow anonymous authentication.  Does not require any Authenticators.
 	AnonymousAuth bool `json:"anonymous_auth"`
 	// Allow publisher and caller identity disclosure when requested.
 	AllowDisclose bool `json:"allow_disclose"`
-	// Slice of Authenticator interfaces.
+	// Disclose the identity of the caller in every INVOCATION, whether or
+	// not the caller or callee requested it.  Callers cannot opt out.
+	RequireCallerDisclosure bool `json:"require_caller_disclosure"`
+	// Disclose the identity of the publisher in every EVENT, whether or not
+	// the publisher requested it.  Publishers cannot opt out.
+	RequirePublisherDisclosure bool `json:"require_publisher_disclosure"`
+	// Features of the broker and dealer roles to disable for the realm.  The
+	// default is to enable all features.
+	Features RealmFeatures `json:"features"`
+	// Slice of Authenticator interfaces, in order of priority.  When a client
+	// offers multiple authmethods, the first Authenticator in this slice for
+	// any of the offered authmethods is used.  If AnonymousAuth is set, and no
+	// anonymous Authenticator is supplied, anonymous auth has lowest priority.
 	Authenticators []auth.Authenticator
 	// Authorizer called for each message.
 	Authorizer Authorizer
+	// Authorizes the requests that the Authorizer allows by calling a
+	// procedure registered by an application, if its Procedure is set.
+	DynamicAuthorizer DynamicAuthorizer `json:"dynamic_authorizer"`
+	// Authroles allowed to make catch-all subscriptions, which are prefix
+	// subscriptions to the empty URI that receive every publication in the
+	// realm.  When set, sessions with any other authrole are not authorized to
+	// make catch-all subscriptions.  When empty, the default, any session that
+	// the Authorizer allows may make them.
+	CatchAllRoles []string `json:"catch_all_roles"`
+	// URICanonicalizer, if set, converts the topic and procedure URIs of
+	// messages from clients into a canonical form, before the messages are
+	// authorized and routed.  For example, a canonicalizer that lowercases
+	// URIs causes "Foo.Bar" and "foo.bar" to be treated identically.  The
+	// default is no canonicalization.
+	URICanonicalizer func(wamp.URI) wamp.URI
+	// Maximum random time added to the timeout of calls that specify a
+	// timeout.  This spreads out the cancellation of calls that have the same
+	// timeout.  Zero, the default, disables jitter.
+	CallTimeoutJitter time.Duration `json:"call_timeout_jitter"`
+	// Maximum time to wait for a callee to respond to an INVOCATION, even if
+	// the caller did not give a timeout.  When it passes, the callee is sent
+	// an INTERRUPT and the caller a wamp.error.canceled ERROR.  Progressive
+	// results restart the time.  Zero, the default, means no limit.
+	MaxInvocationDuration time.Duration `json:"max_invocation_duration"`
+	// Maximum number of sessions that may subscribe to any one topic.  This
+	// guards against a single hot topic consuming all dispatch capacity.
+	// Zero, the default, means no limit.
+	MaxTopicSubscribers int `json:"max_topic_subscribers"`
+	// Maximum number of topics for which the realm keeps a retained event.  A
+	// PUBLISH with the "retain" option replaces the retained event for its
+	// topic, or clears it if the publication has no arguments.  A SUBSCRIBE
+	// with the "get_retained" option is sent the retained events for the
+	// topics it matches, with the "retained" detail set.  When the limit is
+	// reached, the event for the topic retained longest ago is discarded.
+	// Zero, the default, means events are not retained.
+	MaxRetainedEvents int `json:"max_retained_events"`
+	// Number of recent events kept for each subscription, which are retrieved
+	// using the wamp.subscription.get_events meta procedure.  Once the history
+	// is full, the oldest event is discarded for each new event.  Zero, the
+	// default, means no history is kept.
+	EventHistorySize int `json:"event_history_size"`
+	// Maximum number of registrations in the realm.  This guards against a
+	// client registering an unbounded number of procedures.  Zero, the
+	// default, means no limit.
+	MaxRegistrations int `json:"max_registrations"`
+	// Maximum number of subscriptions and registrations that each session in
+	// the realm may have.  A SUBSCRIBE or REGISTER that would exceed the
+	// limit is answered with a wamp.error.not_authorized ERROR.  Sessions
+	// internal to the router, and sessions with an authrole in ExemptRoles,
+	// are not limited.  Zero, the default, means no limit.
+	MaxSessionSubscriptions int `json:"max_session_subscriptions"`
+	MaxSessionRegistrations int `json:"max_session_registrations"`
+	// Authroles of sessions that are not limited by MaxSessionSubscriptions
+	// and MaxSessionRegistrations, and that may use the features disabled by
+	// Features.  Sessions internal to the router, such as the meta session
+	// and the local sessions of realm links, are always exempt.  Empty, the
+	// default, means no other sessions are exempt.
+	ExemptRoles []string `json:"exempt_roles"`
+	// Maximum size, in bytes, of a serialized message received from a
+	// session in this realm.  A session that sends a larger message is
+	// aborted with a wamp.error.protocol_violation ABORT, and the message is
+	// not processed.  This applies to websocket and rawsocket transports,
+	// once the session has joined the realm, and is in addition to any limit
+	// negotiated by the rawsocket handshake.  Zero, the default, means no
+	// limit.
+	MaxMessageSize int `json:"max_message_size"`
+	// Time a session may go without sending any message before the router
+	// closes it, sending GOODBYE with reason wamp.close.idle_timeout.  Any
+	// message from the session, and any keepalive message handled by its
+	// transport, such as a rawsocket PING, resets the timer.  Zero, the
+	// default, means sessions are never closed for being idle.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	// Maximum time a session may stay attached to the realm.  When it
+	// expires, the router closes the session, regardless of its activity, by
+	// sending GOODBYE with reason wamp.close.lifetime_expired.  A client that
+	// reconnects, such as a client.ReconnectingClient, then joins the realm
+	// again as a new session.  Zero, the default, means no limit.
+	MaxSessionLifetime time.Duration `json:"max_session_lifetime"`
+	// Limit on the rate of messages from each session.  The default is no
+	// limit.
+	RateLimit RateLimit `json:"rate_limit"`
+	// Maximum time allowed for the entire authentication exchange, from HELLO
+	// to WELCOME, including all CHALLENGE and AUTHENTICATE messages.  This is
+	// in addition to any per-message timeout of the authenticator.  A client
+	// that does not finish in time is sent ABORT with
+	// wamp.error.authentication_timeout, and its transport is closed.  Zero,
+	// the default, means use the router's AuthTimeout.  A negative value
+	// means no overall limit.
+	AuthTimeout time.Duration `json:"auth_timeout"`
+	// Maximum number of CHALLENGE messages sent to a client authenticated by
+	// an auth.MultiChallengeAuthenticator.  A client that is not
+	// authenticated after this many challenges is sent ABORT with
+	// wamp.error.authentication_failed.  Zero, the default, means
+	// auth.DefaultMaxChallenges.
+	MaxAuthChallenges int `json:"max_auth_challenges"`
+	// When true, only one session at a time may be attached to the realm for
+	// any authid.  What happens when a new session has the same authid as an
+	// existing session is determined by AuthIDConflictPolicy.
+	SingleSessionPerAuthID bool `json:"single_session_per_authid"`
+	// What to do when SingleSessionPerAuthID is set and a new session has the
+	// same authid as an existing session.  AuthIDConflictReject, the default,
+	// aborts the new session.  AuthIDConflictReplace kills the existing
+	// session and lets the new session join.
+	AuthIDConflictPolicy string `json:"authid_conflict_policy"`
+	// Dispatching a publication to its subscribers, or a call to its callees,
+	// that takes longer than this is logged as a warning, along with the
+	// topic or procedure and the number of subscribers or callees.  Zero, the
+	// default, disables logging of slow dispatch.
+	SlowDispatchThreshold time.Duration `json:"slow_dispatch_threshold"`
+	// Maximum number of CALL and PUBLISH messages from a single session that
+	// are processed concurrently.  This improves throughput for clients that
+	// make independent requests, particularly when the Authorizer is slow,
+	// but calls are no longer routed in the order they were sent.
+	// Publications are authorized concurrently, but still routed in order,
+	// and a CANCEL is always routed after the CALL it cancels.  Other
+	// messages, such as SUBSCRIBE and UNSUBSCRIBE, are always processed in
+	// order.  The Authorizer must be safe to call concurrently for the same
+	// session.  Zero or one, the default, processes all messages in order.
+	InboundConcurrency int `json:"inbound_concurrency"`
+	// Number of times to retry sending an EVENT to a subscriber whose
+	// outbound queue is full, and the delay before the first retry, which
+	// doubles for each subsequent retry.  Other publications are routed while
+	// waiting to retry, but later EVENTs for the same subscriber are held so
+	// that they are delivered in order.  If EventRetryDelay is
+	// zero, then it defaults to 1 millisecond.  Zero retries, the default,
+	// means an EVENT is dropped if the subscriber is blocked.
+	EventRetries    int           `json:"event_retries"`
+	EventRetryDelay time.Duration `json:"event_retry_delay"`
+	// When true, a subscriber that cannot be sent an EVENT, after any
+	// retries, is disconnected from the realm.
+	DisconnectBlockedSubscribers bool `json:"disconnect_blocked_subscribers"`
+	// Size of the outbound message queue the router keeps for each session,
+	// in addition to any buffering done by the session's transport.  Zero,
+	// the default, means no queue: a message that the transport cannot
+	// accept immediately is handled as a blocked send.
+	SendQueueSize int `json:"send_queue_size"`
+	// What to do with a message for a session whose send queue is full:
+	// SendQueueBlock, SendQueueDropOldest, or SendQueueDisconnect.  The
+	// default is SendQueueDropOldest, so that a slow session never stalls
+	// delivery to other sessions.  Only EVENT messages are dropped; a session
+	// whose queue is full of other messages is disconnected.
+	SendQueuePolicy string `json:"send_queue_policy"`
+	// Extra details added to the WELCOME and ABORT messages sent to clients
+	// of this realm, for example a support contact or documentation URL.
+	// These never replace details set by the router.
+	WelcomeDetails wamp.Dict `json:"welcome_details"`
+	AbortDetails   wamp.Dict `json:"abort_details"`
+	// When true, messages sent to sessions in this realm are not compressed,
+	// even if the client negotiated compression with the websocket server.
+	// Compressed messages from clients are still accepted.
+	DisableCompression bool `json:"disable_compression"`
+	// OnDetach, if set, is called with the statistics for a session when the
+	// session leaves the realm.  This is called from the session's goroutine
+	// and must not block for long.
+	OnDetach func(sess *wamp.Session, stats SessionStats)
+	// OnSessionAttach, if set, is called when a session is added to the
+	// realm, before the session is sent WELCOME and before the realm publishes
+	// the wamp.session.on_join meta event.  OnSessionLeave, if set, is called
+	// when a session is removed from the realm.  Both are called by the
+	// realm's goroutine, so no other session joins or leaves the realm while
+	// the callback runs, but they must not block for long since they hold up
+	// all other sessions joining and leaving the realm.  When the realm is
+	// closed, OnSessionLeave is called for each remaining session as the
+	// session is closed, instead of by the realm's goroutine.
+	OnSessionAttach func(sess *wamp.Session)
+	OnSessionLeave  func(sess *wamp.Session)
 }
 
+// Policies for handling a new session with the same authid as an existing
+// session, when RealmConfig.SingleSessionPerAuthID is set.
+const (
+	AuthIDConflictReject  = "reject"
+	AuthIDConflictReplace = "replace"
+)
+
+// When a realm is closed, its sessions are sent GOODBYE in batches of
+// closeBatchSize sessions, by closeWorkers goroutines.
+const (
+	closeBatchSize = 1000
+	closeWorkers   = 16
+)
+
+// errRealmDraining is returned when a session tries to join a realm that is
+// waiting for its sessions to leave before shutting down.
+var errRealmDraining = errors.New("realm is shutting down")
+
+// errAuthTimeout is returned when the authentication exchange does not finish
+// within the realm's authentication timeout.
+var errAuthTimeout = errors.New("authentication timed out")
+
+// errAuthIDInUse is returned when a session is rejected because another
+// session with the same authid is attached to the realm.
+var errAuthIDInUse = errors.New("session with same authid already attached")
+
+// errSessionIDInUse is returned when a session is rejected because no session
+// ID that is not already in use could be generated for it.
+var errSessionIDInUse = errors.New("no unused session ID available")
+
+// maxSessionIDAttempts is the number of times a new session ID is generated
+// for a joining session whose ID is already in use, before the session is
+// rejected.
+const maxSessionIDAttempts = 10
+
 // A Realm is a WAMP routing and administrative domain, optionally protected by
 // authentication and authorization.  WAMP messages are only routed within a
 // Realm.
 type realm struct {
+	uri wamp.URI
+
 	broker *Broker
 	dealer *Dealer
 
 	authorizer Authorizer
 
-	// authmethod -> Authenticator
-	authenticators map[string]auth.Authenticator
+	canonURI func(wamp.URI) wamp.URI
+
+	// Authenticators in order of priority.
+	authenticators []auth.Authenticator
+	// Remembers the authentication of clients with tracking cookies, if the
+	// realm accepts cookie authentication.
+	cookieAuth *auth.CookieAuthenticator
 
 	// session ID -> Session
 	clients    map[wamp.ID]*wamp.Session
 	clientStop chan struct{}
+	// Closed when the realm has sent GOODBYE to all sessions at shutdown.
+	clientStopped chan struct{}
+	// session ID -> channel to kill session
+	clientKill map[wamp.ID]chan *wamp.Goodbye
+	// session ID -> scope -> testaments
+	testaments map[wamp.ID]map[string][]testament
+
+	// Maximum time for entire authentication exchange.
+	authTimeout time.Duration
+	// Maximum number of challenges from a multi-challenge authenticator.
+	maxAuthChallenges int
+
+	// Close sessions that send nothing for this long.
+	idleTimeout time.Duration
+	// Close sessions that have been attached for this long.
+	maxLifetime time.Duration
+
+	// Time the router was started, reported by wamp.router.info.
+	routerStarted time.Time
+	// Lists the realms on the router, if this is the router's admin realm.
+	listRealms func() []wamp.URI
+
+	// Limit sessions to one per authid, and policy for a conflicting session.
+	singleAuthID  bool
+	replaceAuthID bool
+
+	// Reject requests that have unrecognized options.
+	strictOptions bool
+
+	// Authroles that may use the features disabled for the realm.
+	exemptRoles roleSet
+
+	// Maximum concurrent CALL and PUBLISH messages per session.
+	inboundConcurrency int
+
+	// Extra details for WELCOME and ABORT messages.
+	welcomeDetails wamp.Dict
+	abortDetails   wamp.Dict
+
+	// Do not compress messages sent to clients.
+	disableCompression bool
+
+	// Maximum size of messages received from clients.
+	maxMessageSize int
+
+	// Size of, and overflow policy for, each session's send queue.
+	sendQueueSize   int
+	sendQueuePolicy string
+
+	// Limit on the rate of messages from each session, if Rate is not zero.
+	rateLimit RateLimit
+
+	// Calls the dynamic authorizer procedure, if the realm has one.
+	dynAuthzConfig DynamicAuthorizer
+	dynAuthz       *dynamicAuthz
 
 	metaPeer  wamp.Peer
 	metaSess  *wamp.Session
 	metaIDGen *wamp.IDGen
 
+	// Generate the IDs of the realm's own sessions, and the request IDs of
+	// messages that the realm sends on its own behalf.
+	sessIDGen wamp.IDGenerator
+	reqIDGen  wamp.IDGenerator
+
 	actionChan chan func()
 
 	// Used by close() to wait for sessions to exit.
 	waitHandlers sync.WaitGroup
+	// Used to wait for session transports to be closed, after the session
+	// has left the realm.
+	waitSessions sync.WaitGroup
 
 	// Session meta-procedure registration ID -> handler map.
 	metaProcMap map[wamp.ID]func(*wamp.Invocation) wamp.Message
 	metaStop    chan struct{}
 	metaDone    chan struct{}
+	// Responses of meta procedures that run in their own goroutine, and the
+	// wait group for those goroutines.
+	metaAsyncRsp chan wamp.Message
+	metaAsync    sync.WaitGroup
 
 	closed    bool
 	closeLock sync.Mutex
 
+	// Set when the realm is draining sessions at shutdown, and closed when
+	// the last session leaves.
+	drained chan struct{}
+
+	onDetach func(*wamp.Session, SessionStats)
+
+	// Called when a session is added to, or removed from, the realm.
+	onSessionAttach func(*wamp.Session)
+	onSessionLeave  func(*wamp.Session)
+
+	// Statistics, updated atomically.
+	counters *realmStats
+
+	// Notified of sessions joining and of messages routed, if not nil.
+	metrics MetricsRecorder
+
 	log   stdlog.StdLog
 	debug bool
 }
@@ -72,42 +382,140 @@ func newRealm(config *RealmConfig, broker *Broker, dealer *Dealer, logger stdlog
 			"invalid realm URI %v (URI strict checking %v)", config.URI, config.StrictURI)
 	}
 
+	var replaceAuthID bool
+	switch config.AuthIDConflictPolicy {
+	case "", AuthIDConflictReject:
+	case AuthIDConflictReplace:
+		replaceAuthID = true
+	default:
+		return nil, fmt.Errorf("invalid authid conflict policy: %q",
+			config.AuthIDConflictPolicy)
+	}
+
+	sendQueuePolicy := config.SendQueuePolicy
+	switch sendQueuePolicy {
+	case "":
+		sendQueuePolicy = SendQueueDropOldest
+	case SendQueueBlock, SendQueueDropOldest, SendQueueDisconnect:
+	default:
+		return nil, fmt.Errorf("invalid send queue policy: %q",
+			config.SendQueuePolicy)
+	}
+
+	rateLimit := config.RateLimit
+	if rateLimit.Rate < 0 {
+		return nil, fmt.Errorf("invalid rate limit: %v", rateLimit.Rate)
+	}
+	switch rateLimit.Policy {
+	case "":
+		rateLimit.Policy = RateLimitDelay
+	case RateLimitDelay, RateLimitAbort:
+	default:
+		return nil, fmt.Errorf("invalid rate limit policy: %q",
+			config.RateLimit.Policy)
+	}
+
 	r := &realm{
+		uri:         config.URI,
 		broker:      broker,
 		dealer:      dealer,
 		authorizer:  config.Authorizer,
+		canonURI:    config.URICanonicalizer,
 		clients:     map[wamp.ID]*wamp.Session{},
 		clientStop:  make(chan struct{}),
+		clientKill:  map[wamp.ID]chan *wamp.Goodbye{},
+		testaments:  map[wamp.ID]map[string][]testament{},
 		actionChan:  make(chan func()),
 		metaIDGen:   wamp.NewIDGen(),
+		sessIDGen:   wamp.RandomIDGen{},
+		reqIDGen:    wamp.RandomIDGen{},
 		metaStop:    make(chan struct{}),
 		metaDone:    make(chan struct{}),
 		metaProcMap: make(map[wamp.ID]func(*wamp.Invocation) wamp.Message, 9),
-		log:         logger,
-		debug:       debug,
+
+		metaAsyncRsp: make(chan wamp.Message),
+		onDetach:     config.OnDetach,
+		log:          logger,
+		debug:        debug,
+	}
+
+	r.onSessionAttach = config.OnSessionAttach
+	r.onSessionLeave = config.OnSessionLeave
+	r.authTimeout = config.AuthTimeout
+	r.maxAuthChallenges = config.MaxAuthChallenges
+	r.idleTimeout = config.IdleTimeout
+	r.maxLifetime = config.MaxSessionLifetime
+	r.singleAuthID = config.SingleSessionPerAuthID
+	r.replaceAuthID = replaceAuthID
+	r.strictOptions = config.StrictOptions
+	r.exemptRoles = newRoleSet(config.ExemptRoles)
+	r.inboundConcurrency = config.InboundConcurrency
+	r.welcomeDetails = config.WelcomeDetails
+	r.abortDetails = config.AbortDetails
+	r.disableCompression = config.DisableCompression
+	r.maxMessageSize = config.MaxMessageSize
+	r.sendQueueSize = config.SendQueueSize
+	r.clientStopped = make(chan struct{})
+	r.counters = &realmStats{}
+	r.sendQueuePolicy = sendQueuePolicy
+	r.rateLimit = rateLimit
+
+	if config.DynamicAuthorizer.CacheTTL < 0 || config.DynamicAuthorizer.Timeout < 0 {
+		return nil, errors.New("invalid dynamic authorizer cache TTL or timeout")
 	}
+	r.dynAuthzConfig = config.DynamicAuthorizer
 
 	if r.authorizer == nil {
 		r.authorizer = NewAuthorizer()
 	}
+	if len(config.CatchAllRoles) != 0 {
+		r.authorizer = newCatchAllAuthorizer(r.authorizer, config.CatchAllRoles)
+	}
 
-	r.authenticators = map[string]auth.Authenticator{}
-	for _, auth := range config.Authenticators {
-		r.authenticators[auth.AuthMethod()] = auth
+	// authmethod -> index of authenticator in priority order
+	authIndex := map[string]int{}
+	for _, authr := range config.Authenticators {
+		method := authr.AuthMethod()
+		if i, ok := authIndex[method]; ok {
+			// A later authenticator for the same method replaces the
+			// earlier one, keeping the earlier one's priority.
+			r.authenticators[i] = authr
+			continue
+		}
+		authIndex[method] = len(r.authenticators)
+		r.authenticators = append(r.authenticators, authr)
+	}
+	if i, ok := authIndex["cookie"]; ok {
+		if ca, ok := r.authenticators[i].(*auth.CookieAuthenticator); ok {
+			// Cookies remembered in this realm only authenticate clients
+			// joining this realm.
+			r.cookieAuth = ca.ForRealm(r.uri)
+			r.authenticators[i] = r.cookieAuth
+		}
 	}
 
 	// If allowing anonymous authentication, then install the anonymous
-	// authenticator.  Install this first so that it is replaced in case a
-	// custom anonymous authenticator is supplied.
+	// authenticator, with the lowest priority, unless a custom anonymous
+	// authenticator is supplied.
 	if config.AnonymousAuth {
-		if _, ok := r.authenticators["anonymous"]; !ok {
-			r.authenticators["anonymous"] = auth.AnonymousAuth
+		if _, ok := authIndex["anonymous"]; !ok {
+			r.authenticators = append(r.authenticators, auth.AnonymousAuth)
 		}
 	}
 
 	return r, nil
 }
 
+// addDetails copies the realm's extra details into the details of a WELCOME
+// or ABORT message, without replacing any details already present.
+func addDetails(details, extra wamp.Dict) {
+	for k, v := range extra {
+		if _, ok := details[k]; !ok {
+			details[k] = v
+		}
+	}
+}
+
 // waitReady waits for the realm to be fully initialized and running.
 func (r *realm) waitReady() {
 	sync := make(chan struct{})
@@ -123,10 +531,15 @@ func (r *realm) waitReady() {
 // realm and makes sure any clients already in the process of joining finish
 // joining.
 //
-// Next, each client session is killed, removing it from the broker and dealer,
-// triggering a GOODBYE message to the client, and causing the session's
-// message handler to exit.  This ensures there are no messages remaining to be
-// sent to the router.
+// Next, each client session's message handler is stopped, and close waits for
+// all handlers to exit.  This ensures there are no messages remaining to be
+// sent to the router.  The sessions are not removed from the broker and dealer
+// individually, since the broker and dealer are discarded as a whole.
+//
+// The sessions are then removed from the realm in batches of closeBatchSize,
+// and a pool of closeWorkers goroutines sends each one a GOODBYE.  This keeps
+// the memory used by close bounded however many sessions the realm has.  Once
+// all GOODBYEs are sent, each session's goroutine closes its transport.
 //
 // After that, the meta client session is killed.  This ensures there are no
 // more meta messages to sent to the router.
@@ -160,12 +573,32 @@ func (r *realm) close() {
 	// messages can be generated once sessions are closed.
 	r.waitHandlers.Wait()
 
+	// Tell subscribers that their subscriptions are gone, before they are
+	// sent GOODBYE.
+	r.broker.revokeAll(string(wamp.ErrSystemShutdown))
+
+	// Sessions that left because of the shutdown did not remove themselves,
+	// so remove them now and send them GOODBYE.
+	r.stopSessions()
+
+	// Sessions that left before the shutdown may have removals still queued
+	// in the broker and dealer, which publish meta events.  Wait for these to
+	// finish while the meta session is still reading them.
+	for _, actionChan := range []chan func(){r.dealer.actionChan, r.broker.actionChan} {
+		sync := make(chan struct{})
+		actionChan <- func() { close(sync) }
+		<-sync
+	}
+
 	// All normal handlers have exited, so now stop the meta session.  When
 	// the meta client receives GOODBYE from the meta session, the meta
 	// session is done and will not try to publish anything more to the
 	// broker, and it is finally safe to exit and close the broker.
 	close(r.metaStop)
 	<-r.metaDone
+	// Meta procedures still running in their own goroutines may call the
+	// dealer, so wait for them before closing it.
+	r.metaAsync.Wait()
 
 	// handleInboundMessages() and metaProcedureHandler() are the only things
 	// than can submit request to the broker and dealer, so now that these are
@@ -180,24 +613,175 @@ func (r *realm) close() {
 	close(r.actionChan)
 }
 
+// stopSessions removes all sessions from the realm, in batches, and sends
+// each a GOODBYE using a pool of worker goroutines.  Sending GOODBYE does not
+// block, so the sessions are closed by their own goroutines when this is done.
+func (r *realm) stopSessions() {
+	goodbye := &wamp.Goodbye{
+		Reason:  wamp.ErrSystemShutdown,
+		Details: wamp.Dict{},
+	}
+	work := make(chan *wamp.Session, closeBatchSize)
+	var workers sync.WaitGroup
+	workers.Add(closeWorkers)
+	for i := 0; i < closeWorkers; i++ {
+		go func() {
+			defer workers.Done()
+			for sess := range work {
+				sess.TrySend(goodbye)
+			}
+		}()
+	}
+
+	batch := make([]*wamp.Session, 0, closeBatchSize)
+	for {
+		sync := make(chan struct{})
+		r.actionChan <- func() {
+			for id, sess := range r.clients {
+				delete(r.clients, id)
+				atomic.AddInt64(&r.counters.sessions, -1)
+				delete(r.clientKill, id)
+				delete(r.testaments, id)
+				batch = append(batch, sess)
+				if len(batch) == closeBatchSize {
+					break
+				}
+			}
+			close(sync)
+		}
+		<-sync
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			work <- batch[i]
+			batch[i] = nil
+		}
+		batch = batch[:0]
+	}
+	close(work)
+	workers.Wait()
+	close(r.clientStopped)
+}
+
+// drain sends a GOODBYE to every session in the realm, and stops any more
+// sessions from joining.  Each session leaves the realm when it replies with
+// its own GOODBYE, or otherwise detaches.  The returned channel is closed once
+// no sessions remain in the realm.
+func (r *realm) drain() <-chan struct{} {
+	retChan := make(chan chan struct{})
+	r.actionChan <- func() {
+		if r.drained == nil {
+			r.drained = make(chan struct{})
+			goodbye := &wamp.Goodbye{
+				Reason:  wamp.ErrSystemShutdown,
+				Details: wamp.Dict{},
+			}
+			for _, sess := range r.clients {
+				sess.TrySend(goodbye)
+			}
+			if len(r.clients) == 0 {
+				close(r.drained)
+			}
+		}
+		retChan <- r.drained
+	}
+	return <-retChan
+}
+
+// clientCount returns the number of client sessions in the realm.
+func (r *realm) clientCount() int {
+	retChan := make(chan int)
+	r.actionChan <- func() {
+		retChan <- len(r.clients)
+	}
+	return <-retChan
+}
+
+// session returns a read-only view of the attached session with the ID.
+func (r *realm) session(id wamp.ID) (*SessionDetails, bool) {
+	retChan := make(chan *SessionDetails)
+	r.actionChan <- func() {
+		sess, ok := r.clients[id]
+		if !ok {
+			retChan <- nil
+			return
+		}
+		retChan <- newSessionDetails(sess, r.uri)
+	}
+	sd := <-retChan
+	return sd, sd != nil
+}
+
 // run must be called to start the Realm.
 // It blocks so should be executed in a separate goroutine
 func (r *realm) run() {
 	// Create a local client for publishing meta events.
 	r.createMetaSession()
 
+	if r.dynAuthzConfig.Procedure != "" {
+		r.dynAuthz = newDynamicAuthz(r.dynAuthzConfig, r.dealer,
+			r.sessIDGen.Next(), r.reqIDGen)
+	}
+
 	// Register to handle session meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionCount, r.sessionCount)
 	r.registerMetaProcedure(wamp.MetaProcSessionList, r.sessionList)
 	r.registerMetaProcedure(wamp.MetaProcSessionGet, r.sessionGet)
+	r.registerMetaProcedure(wamp.MetaProcSessionKill, r.sessionKill)
+	r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthid, r.sessionKillByAuthid)
+	r.registerMetaProcedure(wamp.MetaProcSessionKillByAuthrole, r.sessionKillByAuthrole)
+
+	// Register to handle testament meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcSessionAddTestament, r.addTestament)
+	r.registerMetaProcedure(wamp.MetaProcSessionFlushTestaments, r.flushTestaments)
 
 	// Register to handle registration meta procedures.
-	r.registerMetaProcedure(wamp.MetaProcRegList, r.dealer.RegList)
-	r.registerMetaProcedure(wamp.MetaProcRegLookup, r.dealer.RegLookup)
-	r.registerMetaProcedure(wamp.MetaProcRegMatch, r.dealer.RegMatch)
-	r.registerMetaProcedure(wamp.MetaProcRegGet, r.dealer.RegGet)
-	r.registerMetaProcedure(wamp.MetaProcRegListCallees, r.dealer.RegListCallees)
-	r.registerMetaProcedure(wamp.MetaProcRegCountCallees, r.dealer.RegCountCallees)
+	regAPI := func(f func(*wamp.Invocation) wamp.Message) func(*wamp.Invocation) wamp.Message {
+		return r.metaAPI(featureRegMetaAPI, r.dealer.disabled, f)
+	}
+	r.registerMetaProcedure(wamp.MetaProcRegList, regAPI(r.dealer.RegList))
+	r.registerMetaProcedure(wamp.MetaProcRegLookup, regAPI(r.dealer.RegLookup))
+	r.registerMetaProcedure(wamp.MetaProcRegMatch, regAPI(r.dealer.RegMatch))
+	r.registerMetaProcedure(wamp.MetaProcRegGet, regAPI(r.dealer.RegGet))
+	r.registerMetaProcedure(wamp.MetaProcRegListCallees, regAPI(r.dealer.RegListCallees))
+	r.registerMetaProcedure(wamp.MetaProcRegCountCallees, regAPI(r.dealer.RegCountCallees))
+	r.registerMetaProcedure(wamp.MetaProcRegStats, regAPI(r.dealer.RegStats))
+	r.registerMetaProcedure(wamp.MetaProcRegRemoveCallee, regAPI(r.dealer.RegRemoveCallee))
+
+	// Register to handle subscription meta procedures.
+	subAPI := func(f func(*wamp.Invocation) wamp.Message) func(*wamp.Invocation) wamp.Message {
+		return r.metaAPI(featureSubMetaAPI, r.broker.disabled, f)
+	}
+	r.registerMetaProcedure(wamp.MetaProcSubList, subAPI(r.broker.SubList))
+	r.registerMetaProcedure(wamp.MetaProcSubLookup, subAPI(r.broker.SubLookup))
+	r.registerMetaProcedure(wamp.MetaProcSubMatch, subAPI(r.broker.SubMatch))
+	r.registerMetaProcedure(wamp.MetaProcSubGet, subAPI(r.broker.SubGet))
+	r.registerMetaProcedure(wamp.MetaProcSubListCallees, subAPI(r.broker.SubListSubscribers))
+	r.registerMetaProcedure(wamp.MetaProcSubCountCallees, subAPI(r.broker.SubCountSubscribers))
+	r.registerMetaProcedure(wamp.MetaProcSubGetEvents, subAPI(r.broker.SubGetEvents))
+	r.registerMetaProcedure(wamp.MetaProcSubRemoveSubscriber, subAPI(r.broker.SubRemoveSubscriber))
+
+	// Register to handle topic meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcTopicStats, r.broker.TopicStats)
+
+	// Register to handle router meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcRouterPing, r.routerPing)
+	r.registerMetaProcedure(wamp.MetaProcRouterInfo, r.routerInfo)
+	r.registerMetaProcedure(wamp.MetaProcRealmCount, r.realmCount)
+	if r.listRealms != nil {
+		r.registerMetaProcedure(wamp.MetaProcRouterRealmList, r.routerRealmList)
+	}
+
+	// Register to handle reflection meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcReflectProcedureList, r.dealer.ReflectProcedureList)
+	r.registerMetaProcedure(wamp.MetaProcReflectTopicList, r.broker.ReflectTopicList)
+	r.registerMetaProcedure(wamp.MetaProcReflectDescribe, r.reflectDescribe)
+
+	// Register to handle authorization meta procedures.  The check may call
+	// the dynamic authorizer, so it runs in its own goroutine, to not hold up
+	// other meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcAuthzCheck, r.metaAsyncProc(r.authzCheck))
 
 	go r.metaProcedureHandler()
 
@@ -217,35 +801,85 @@ func (r *realm) createMetaSession() {
 	r.metaPeer = cli
 	r.dealer.SetMetaPeer(cli)
 
-	details := wamp.SetOption(nil, "authrole", "trusted")
+	details := markInternal(wamp.Dict{"authrole": "trusted"})
 
 	// This session is the local leg of the router uplink.
 	r.metaSess = &wamp.Session{
 		Peer:    rtr,
-		ID:      wamp.GlobalID(),
+		ID:      r.sessIDGen.Next(),
 		Details: details,
 	}
 
 	// Run the handler for messages from the meta session.
-	go r.handleInboundMessages(r.metaSess)
+	go r.handleInboundMessages(r.metaSess, nil, nil, nil)
 	if r.debug {
 		r.log.Println("Started meta-session", r.metaSess)
 	}
 }
 
 // onJoin is called when a non-meta session joins this realm.  The session is
-// stored in the realm's clients and a meta event is published.
+// stored in the realm's clients and a meta event is published.  The kill
+// channel is used to make the session leave the realm.
+//
+// If the realm allows only a single session per authid, and another session
+// has the same authid, then either that session is killed or errAuthIDInUse
+// is returned, depending on the realm's authid conflict policy.
 //
 // Note: onJoin() is called from handleSession, not handleInboundMessages, so
 // that it is not called for the meta client.
-func (r *realm) onJoin(sess *wamp.Session) {
+func (r *realm) onJoin(sess *wamp.Session, kill chan *wamp.Goodbye) error {
 	r.waitHandlers.Add(1)
-	sync := make(chan struct{})
+	sync := make(chan error)
 	r.actionChan <- func() {
+		if r.drained != nil {
+			sync <- errRealmDraining
+			return
+		}
+		if r.singleAuthID {
+			authid := wamp.OptionString(sess.Details, "authid")
+			for id, other := range r.clients {
+				if authid == "" || wamp.OptionString(other.Details, "authid") != authid {
+					continue
+				}
+				if !r.replaceAuthID {
+					sync <- errAuthIDInUse
+					return
+				}
+				r.log.Println("Session", other, "replaced by session", sess,
+					"with same authid:", authid)
+				r.killSession(id, &wamp.Goodbye{
+					Reason:  wamp.ErrSessionKilled,
+					Details: wamp.Dict{"message": "replaced by new session"},
+				})
+			}
+		}
+		// Generate another ID for a session whose ID is already in use, since
+		// routing to either session would otherwise go wrong.
+		for attempt := 1; r.sessionIDInUse(sess.ID); attempt++ {
+			if attempt > maxSessionIDAttempts {
+				sync <- errSessionIDInUse
+				return
+			}
+			newID := r.sessIDGen.Next()
+			r.log.Println("Session ID", sess.ID, "already in use, using", newID)
+			sess.ID = newID
+			sess.Details = wamp.SetOption(sess.Details, "session", newID)
+		}
 		r.clients[sess.ID] = sess
-		close(sync)
+		atomic.AddInt64(&r.counters.sessions, 1)
+		if r.metrics != nil {
+			r.metrics.SessionJoined(r.uri)
+		}
+		r.clientKill[sess.ID] = kill
+		if r.onSessionAttach != nil {
+			r.onSessionAttach(sess)
+		}
+		sync <- nil
+	}
+	if err := <-sync; err != nil {
+		r.waitHandlers.Done()
+		return err
 	}
-	<-sync
 
 	// Session Meta Events MUST be dispatched by the Router to the same realm
 	// as the WAMP session which triggered the event.
@@ -253,14 +887,25 @@ func (r *realm) onJoin(sess *wamp.Session) {
 	// WAMP spec only specifies publishing "authid", "authrole", "authmethod",
 	// "authprovider", "transport".  This implementation publishes all details.
 	r.metaPeer.Send(&wamp.Publish{
-		Request:   wamp.GlobalID(),
+		Request:   r.reqIDGen.Next(),
 		Topic:     wamp.MetaEventSessionOnJoin,
 		Arguments: wamp.List{sess.Details},
 	})
+	return nil
+}
+
+// sessionIDInUse returns true if a session attached to the realm has the ID.
+// This must be called from the realm's goroutine.
+func (r *realm) sessionIDInUse(id wamp.ID) bool {
+	if _, ok := r.clients[id]; ok {
+		return true
+	}
+	return r.metaSess != nil && r.metaSess.ID == id
 }
 
-// onLeave is called when a non-meta session leaves this realm.  The session is
-// removed from the realm's clients and a meta event is published.
+// onLeave is called when a non-meta session leaves this realm.  A meta event,
+// with the session's ID, authid, and authrole, is published and the session is
+// removed from the realm's clients.
 //
 // If the session handler exited due to realm shutdown, then remove the session
 // from broker, dealer, and realm without generating meta events.  If not
@@ -270,28 +915,65 @@ func (r *realm) onJoin(sess *wamp.Session) {
 // events would only be received by meta event subscribers that had not been
 // removed yet, and clients are removed in any order.
 //
+// If the realm has an OnSessionLeave callback, then it is called as the session
+// is removed.  If the realm has an OnDetach callback, then it is called with
+// the session's statistics after the session is removed.
+//
 // Note: onLeave() must be called from outside handleInboundMessages so that it
 // is not called for the meta client.
-func (r *realm) onLeave(sess *wamp.Session, shutdown bool) {
-	sync := make(chan struct{})
-	r.actionChan <- func() {
-		delete(r.clients, sess.ID)
-		// If realm is shutdown, do not bother to remove session from broker
-		// and dealer.  They will be closed after sessions are closed.
-		if !shutdown {
+func (r *realm) onLeave(sess *wamp.Session, shutdown bool, stats *SessionStats) {
+	// Publish the session's testaments, and then the on_leave event, before
+	// the session is removed from the broker and dealer, so that its meta
+	// events come after this one and subscribers can correlate them with the
+	// departed session.
+	if !shutdown {
+		// Stop counting the session as a subscriber now, since it may take a
+		// while for the broker to get to removing it.
+		r.broker.sessionLeaving(sess)
+		r.publishTestaments(sess)
+		r.metaPeer.Send(&wamp.Publish{
+			Request: r.reqIDGen.Next(),
+			Topic:   wamp.MetaEventSessionOnLeave,
+			Arguments: wamp.List{
+				sess.ID,
+				wamp.OptionString(sess.Details, "authid"),
+				wamp.OptionString(sess.Details, "authrole"),
+			},
+		})
+	}
+
+	// If realm is shutdown, do not bother to remove the session from the
+	// realm, broker, and dealer.  The realm drops all sessions at once, and
+	// the broker and dealer are closed, after all sessions are closed.  This
+	// avoids queuing an action for each session when closing a realm with
+	// many sessions.
+	if !shutdown {
+		sync := make(chan struct{})
+		r.actionChan <- func() {
+			delete(r.clients, sess.ID)
+			atomic.AddInt64(&r.counters.sessions, -1)
+			delete(r.clientKill, sess.ID)
+			delete(r.testaments, sess.ID)
+			if r.dynAuthz != nil {
+				r.dynAuthz.removeSession(sess.ID)
+			}
 			r.dealer.RemoveSession(sess)
 			r.broker.RemoveSession(sess)
+			if r.onSessionLeave != nil {
+				r.onSessionLeave(sess)
+			}
+			if r.drained != nil && len(r.clients) == 0 {
+				close(r.drained)
+			}
+			close(sync)
 		}
-		close(sync)
+		<-sync
+	} else if r.onSessionLeave != nil {
+		r.onSessionLeave(sess)
 	}
-	<-sync
 
-	if !shutdown {
-		r.metaPeer.Send(&wamp.Publish{
-			Request:   wamp.GlobalID(),
-			Topic:     wamp.MetaEventSessionOnLeave,
-			Arguments: wamp.List{sess.ID},
-		})
+	if r.onDetach != nil {
+		r.onDetach(sess, *stats)
 	}
 
 	r.waitHandlers.Done()
@@ -299,8 +981,13 @@ func (r *realm) onLeave(sess *wamp.Session, shutdown bool) {
 
 // HandleSession starts a session attached to this realm.
 //
+// If welcome is not nil, then it is sent to the session before the session's
+// handler starts.  This ensures the handler, which closes the session's peer
+// when the session ends, cannot close the peer while it is being sent the
+// WELCOME.
+//
 // Routing occurs only between WAMP Sessions that have joined the same Realm.
-func (r *realm) handleSession(sess *wamp.Session) error {
+func (r *realm) handleSession(sess *wamp.Session, welcome *wamp.Welcome) error {
 	// The lock is held in mutual exclusion with the closing of the realm.
 	// This ensures that no new session handler can start once the realm is
 	// closing, during which the realm waits for all existing session handlers
@@ -312,16 +999,58 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 		return err
 	}
 
+	// Keepalive messages handled by the transport count as activity when
+	// checking whether the session is idle.
+	keepalive, _ := sess.Peer.(transport.ActivityReporter)
+	client := sess.Peer
+
+	// Count the messages sent to the session.  This wraps the session's own
+	// peer, so that messages are counted when delivered to the transport,
+	// rather than when added to the send queue.
+	peer := &statsPeer{Peer: sess.Peer}
+	sess.Peer = peer
+	stats := &SessionStats{Joined: time.Now()}
+
+	// Queue messages sent to the session, if the realm has a send queue.
+	// Delivery of queued messages starts once the session has joined.
+	var queue *queuePeer
+	if r.sendQueueSize > 0 {
+		queue = newQueuePeer(sess.Peer, r.sendQueueSize, r.sendQueuePolicy,
+			func() { r.dropSession(sess, "send queue full") })
+		sess.Peer = queue
+	}
+
 	// Ensure session is capable of receiving exit signal before releasing lock
-	r.onJoin(sess)
+	kill := make(chan *wamp.Goodbye, 1)
+	if err := r.onJoin(sess, kill); err != nil {
+		r.closeLock.Unlock()
+		return err
+	}
+	if queue != nil {
+		queue.start()
+	}
+	r.waitSessions.Add(1)
 	r.closeLock.Unlock()
 
+	if welcome != nil {
+		// The session ID is only known to be unique once the session has
+		// joined.
+		welcome.ID = sess.ID
+		client.Send(welcome) // Blocking OK; this is session goroutine.
+	}
 	if r.debug {
 		r.log.Println("Started session", sess)
 	}
 	go func() {
-		shutdown := r.handleInboundMessages(sess)
-		r.onLeave(sess, shutdown)
+		defer r.waitSessions.Done()
+		shutdown := r.handleInboundMessages(sess, stats, kill, keepalive)
+		peer.updateStats(stats)
+		stats.Duration = time.Since(stats.Joined)
+		r.onLeave(sess, shutdown, stats)
+		if shutdown {
+			// Wait for the realm to send GOODBYE before closing.
+			<-r.clientStopped
+		}
 		sess.Close()
 	}()
 
@@ -329,8 +1058,28 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 }
 
 // handleInboundMessages handles the messages sent from a client session to
-// the router.
-func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
+// the router.  If stats is not nil, then it is updated with each message
+// received from the session.  A GOODBYE received on the kill channel is sent
+// to the session, ending the session.
+//
+// If the realm has an idle timeout, then a client session that sends no
+// message within the timeout is sent GOODBYE, ending the session.  If
+// keepalive is not nil, then the keepalive messages it reports also count as
+// activity of the session.  If the realm has a maximum session lifetime, then
+// a client session is sent GOODBYE when it expires.
+//
+// If the realm has a rate limit, then a client session that exceeds it is
+// either aborted, or has its message held, and no more messages read, until
+// the message is within the limit.
+//
+// If the realm allows concurrent inbound processing, then CALL and PUBLISH
+// messages are processed in separate goroutines.  PUBLISH messages are still
+// passed to the broker in the order they were received, so that their events
+// are delivered in order, and a CANCEL is passed to the dealer after the CALL
+// it cancels.  All of these goroutines finish before this function returns,
+// so that no requests are submitted for the session after it has left the
+// realm.
+func (r *realm) handleInboundMessages(sess *wamp.Session, stats *SessionStats, kill <-chan *wamp.Goodbye, keepalive transport.ActivityReporter) bool {
 	if r.debug {
 		defer r.log.Println("Ended session", sess)
 	}
@@ -338,6 +1087,47 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
 	if sess == r.metaSess {
 		stopChan = r.metaStop
 	}
+
+	var concurrent chan struct{}
+	// Closed when the last PUBLISH processed concurrently has been passed to
+	// the broker.
+	var lastPub chan struct{}
+	// Closed when a CALL processed concurrently has been passed to the
+	// dealer, by request ID.
+	var callsMu sync.Mutex
+	var calls map[wamp.ID]chan struct{}
+	if r.inboundConcurrency > 1 && sess != r.metaSess {
+		concurrent = make(chan struct{}, r.inboundConcurrency)
+		lastPub = make(chan struct{})
+		close(lastPub)
+		calls = map[wamp.ID]chan struct{}{}
+	}
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if r.idleTimeout > 0 && sess != r.metaSess {
+		idleTimer = time.NewTimer(r.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	var expired <-chan time.Time
+	if r.maxLifetime > 0 && sess != r.metaSess {
+		lifetimeTimer := time.NewTimer(r.maxLifetime)
+		defer lifetimeTimer.Stop()
+		expired = lifetimeTimer.C
+	}
+
+	// While a message is delayed by the rate limit, no more messages are
+	// read from the session.
+	var limiter *tokenBucket
+	if r.rateLimit.Rate > 0 && sess != r.metaSess {
+		limiter = newTokenBucket(r.rateLimit)
+	}
+	var delayed wamp.Message
+	var throttle <-chan time.Time
+
 	recvChan := sess.Recv()
 	for {
 		var msg wamp.Message
@@ -348,15 +1138,82 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
 				r.log.Println("Lost", sess)
 				return false
 			}
+		case <-throttle:
+			msg, delayed, throttle = delayed, nil, nil
+			recvChan = sess.Recv()
 		case <-stopChan:
 			if r.debug {
 				r.log.Printf("Stop session %s: system shutdown", sess)
 			}
+			if sess != r.metaSess {
+				// The realm sends GOODBYE to client sessions.
+				return true
+			}
 			sess.TrySend(&wamp.Goodbye{
 				Reason:  wamp.ErrSystemShutdown,
 				Details: wamp.Dict{},
 			})
 			return true
+		case goodbye := <-kill:
+			if r.debug {
+				r.log.Printf("Kill session %s: %s", sess, goodbye.Reason)
+			}
+			r.dealer.revokeSession(sess, string(goodbye.Reason))
+			sess.TrySend(goodbye)
+			return false
+		case <-idle:
+			if keepalive != nil {
+				since := time.Since(keepalive.LastActivity())
+				if since < r.idleTimeout {
+					idleTimer.Reset(r.idleTimeout - since)
+					continue
+				}
+			}
+			r.log.Printf("Closing session %s: idle for %v", sess,
+				r.idleTimeout)
+			sess.TrySend(&wamp.Goodbye{
+				Reason:  wamp.ErrSessionIdle,
+				Details: wamp.Dict{},
+			})
+			return false
+		case <-expired:
+			r.log.Printf("Closing session %s: reached lifetime of %v", sess,
+				r.maxLifetime)
+			sess.TrySend(&wamp.Goodbye{
+				Reason:  wamp.ErrSessionExpired,
+				Details: wamp.Dict{},
+			})
+			return false
+		}
+
+		if limiter != nil {
+			if wait := limiter.take(msg); wait > 0 {
+				if r.rateLimit.Policy == RateLimitAbort {
+					r.log.Printf("Closing session %s: exceeded rate limit",
+						sess)
+					sess.TrySend(&wamp.Goodbye{
+						Reason: wamp.ErrProtocolViolation,
+						Details: wamp.Dict{
+							"message": "rate limit exceeded",
+						},
+					})
+					return false
+				}
+				delayed, throttle = msg, time.After(wait)
+				recvChan = nil
+				continue
+			}
+		}
+
+		if idleTimer != nil {
+			// The session is active, so restart the idle timeout.
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(r.idleTimeout)
 		}
 
 		if r.debug {
@@ -364,9 +1221,81 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
 				msg.MessageType(), msg)
 		}
 
-		// N.B. meta session is always authorized
-		if sess != r.metaSess && !r.authzMessage(sess, msg) {
-			// Not authorized; error response send; do not process message.
+		if stats != nil {
+			stats.countRecvd(msg)
+		}
+		if r.metrics != nil && sess != r.metaSess {
+			r.metrics.MessageRouted(r.uri, msg.MessageType())
+		}
+
+		if concurrent != nil {
+			switch m := msg.(type) {
+			case *wamp.Publish, *wamp.Call:
+				// Wait for room if too many requests are in progress.
+				concurrent <- struct{}{}
+				inflight.Add(1)
+				var prevPub, pubDone, callDone chan struct{}
+				switch m := m.(type) {
+				case *wamp.Publish:
+					prevPub, pubDone = lastPub, make(chan struct{})
+					lastPub = pubDone
+				case *wamp.Call:
+					callDone = make(chan struct{})
+					callsMu.Lock()
+					calls[m.Request] = callDone
+					callsMu.Unlock()
+				}
+				go func(msg wamp.Message) {
+					defer func() {
+						<-concurrent
+						inflight.Done()
+					}()
+					admitted := r.admitMessage(sess, msg)
+					switch msg := msg.(type) {
+					case *wamp.Publish:
+						// Authorization is concurrent, but publications
+						// are routed in order.
+						<-prevPub
+						if admitted {
+							r.broker.Publish(sess, msg)
+						}
+						close(pubDone)
+					case *wamp.Call:
+						if admitted {
+							r.dealer.Call(sess, msg)
+						}
+						callsMu.Lock()
+						if calls[msg.Request] == callDone {
+							delete(calls, msg.Request)
+						}
+						callsMu.Unlock()
+						close(callDone)
+					}
+				}(msg)
+				continue
+			case *wamp.Cancel:
+				// A CANCEL is passed to the dealer after the CALL it
+				// cancels, if that CALL is still being processed.
+				callsMu.Lock()
+				callDone := calls[m.Request]
+				callsMu.Unlock()
+				if callDone == nil {
+					break
+				}
+				inflight.Add(1)
+				go func() {
+					defer inflight.Done()
+					<-callDone
+					if r.admitMessage(sess, m) {
+						r.dealer.Cancel(sess, m)
+					}
+				}()
+				continue
+			}
+		}
+
+		if !r.admitMessage(sess, msg) {
+			// Error response sent; do not process message.
 			continue
 		}
 
@@ -400,11 +1329,14 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
 			}
 
 		case *wamp.Goodbye:
-			// Handle client leaving realm.
-			sess.TrySend(&wamp.Goodbye{
-				Reason:  wamp.ErrGoodbyeAndOut,
-				Details: wamp.Dict{},
-			})
+			// Handle client leaving realm.  A GOODBYE that is itself a reply,
+			// to a GOODBYE sent by the router, is not answered.
+			if msg.Reason != wamp.ErrGoodbyeAndOut {
+				sess.TrySend(&wamp.Goodbye{
+					Reason:  wamp.ErrGoodbyeAndOut,
+					Details: wamp.Dict{},
+				})
+			}
 			if r.debug {
 				r.log.Println("GOODBYE from session", sess, "reason:",
 					msg.Reason)
@@ -418,13 +1350,108 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) bool {
 	}
 }
 
+// admitMessage removes options reserved for the router from a message from a
+// client session, canonicalizes the URI in the message, and checks that the
+// message is authorized and has valid options.  If not, then an error
+// response is sent to the session and false is returned.
+func (r *realm) admitMessage(sess *wamp.Session, msg wamp.Message) bool {
+	// N.B. meta session is always authorized
+	if sess == r.metaSess {
+		return true
+	}
+	// Only a realm link may mark a request as forwarded from another router.
+	if !isInternal(sess) {
+		stripLinkOrigin(msg)
+	}
+	if r.canonURI != nil {
+		r.canonicalizeURI(msg)
+	}
+	if !r.authzMessage(sess, msg) {
+		return false
+	}
+	if r.strictOptions && !r.checkOptions(sess, msg) {
+		return false
+	}
+	return true
+}
+
+// dropSubscriber kills a session that could not be sent an EVENT.  This is
+// called from the broker's goroutine, so the session is killed by another
+// goroutine, unless the realm is already closed.
+func (r *realm) dropSubscriber(sess *wamp.Session) {
+	r.dropSession(sess, "could not deliver event")
+}
+
+// dropSession asynchronously kills a session that is not keeping up with the
+// messages sent to it.  This is safe to call from any goroutine.
+func (r *realm) dropSession(sess *wamp.Session, message string) {
+	go func() {
+		r.closeLock.Lock()
+		defer r.closeLock.Unlock()
+		if r.closed {
+			return
+		}
+		r.actionChan <- func() {
+			if r.killSession(sess.ID, &wamp.Goodbye{
+				Reason:  wamp.ErrSessionKilled,
+				Details: wamp.Dict{"message": message},
+			}) {
+				r.log.Println("Disconnected slow session", sess, "-", message)
+			}
+		}
+	}()
+}
+
+// killSession makes the session with the given ID leave the realm, after
+// sending it the GOODBYE message.  This must be called from the realm's
+// action goroutine.
+func (r *realm) killSession(id wamp.ID, goodbye *wamp.Goodbye) bool {
+	kill, ok := r.clientKill[id]
+	if !ok {
+		return false
+	}
+	// The session may already be killed and not yet removed.
+	select {
+	case kill <- goodbye:
+	default:
+	}
+	return true
+}
+
+// canonicalizeURI replaces the topic or procedure URI of the message with its
+// canonical form, so that it is matched the same way when subscribing and
+// publishing, or registering and calling.
+func (r *realm) canonicalizeURI(msg wamp.Message) {
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		msg.Topic = r.canonURI(msg.Topic)
+	case *wamp.Subscribe:
+		msg.Topic = r.canonURI(msg.Topic)
+	case *wamp.Register:
+		msg.Procedure = r.canonURI(msg.Procedure)
+	case *wamp.Call:
+		msg.Procedure = r.canonURI(msg.Procedure)
+	}
+}
+
+// authorize returns true if the session is authorized to send the message by
+// the realm's Authorizer and, if the realm has one, its dynamic authorizer.
+func (r *realm) authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	isAuthz, err := r.authorizer.Authorize(sess, msg)
+	if !isAuthz || r.dynAuthz == nil {
+		return isAuthz, err
+	}
+	return r.dynAuthz.authorize(sess, msg)
+}
+
 // authzMessage checks if the session is authroized to send the message.  If
 // authorization fails or if the session is not authorized, then an error
 // response is returned to the client, and this method returns false.
 func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
-	isAuthz, err := r.authorizer.Authorize(sess, msg)
+	isAuthz, err := r.authorize(sess, msg)
 	if !isAuthz {
 		errRsp := &wamp.Error{Type: msg.MessageType()}
+		var cause string
 		// Get the Request from request types of messages.
 		switch msg := msg.(type) {
 		case *wamp.Publish:
@@ -448,14 +1475,20 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 			// Error trying to authorize.  Include error message.
 			errRsp.Error = wamp.ErrAuthorizationFailed
 			errRsp.Arguments = wamp.List{err.Error()}
+			cause = err.Error()
 			r.log.Println("Client", sess, "authorization failed:", err)
 		} else {
 			// Session not authorized.  The inability to return a message is
 			// intentional, so as not to encourage returning information that
 			// could disclose any clues about authorization to an attacker.
 			errRsp.Error = wamp.ErrNotAuthorized
+			cause = "not authorized by authorizer"
 			r.log.Println("Client", sess, msg.MessageType(), "not authorized")
 		}
+		errRsp.Details = errorDetails(r.debug, wamp.Dict{
+			"realm": r.uri,
+			"cause": cause,
+		})
 		err = sess.TrySend(errRsp)
 		if err != nil {
 			r.log.Println("!!! client blocked, could not send authz error")
@@ -465,6 +1498,173 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 	return true
 }
 
+// Options recognized by the router for each type of request.  Options that
+// begin with a prefix in pubOptionPrefixes are also recognized for PUBLISH.
+var (
+	pubOptions = map[string]struct{}{
+		wamp.OptAcknowledge: {},
+		wamp.OptDiscloseMe:  {},
+		wamp.OptExcludeMe:   {},
+		wamp.OptRetain:      {},
+		wamp.BlacklistKey:   {},
+		wamp.WhitelistKey:   {},
+		optNexusOrigin:      {},
+	}
+	pubOptionPrefixes = []string{"exclude_", "eligible_", "ppt_"}
+
+	subOptions = map[string]struct{}{
+		wamp.OptDescribe:    {},
+		wamp.OptGetRetained: {},
+		wamp.OptMatch:       {},
+		wamp.OptTopicSuffix: {},
+	}
+
+	callOptions = map[string]struct{}{
+		wamp.OptDiscloseMe:      {},
+		wamp.OptReceiveProgress: {},
+		wamp.OptRKey:            {},
+		wamp.OptRunMode:         {},
+		wamp.OptTimeout:         {},
+		optNexusOrigin:          {},
+	}
+)
+
+// checkOptions checks that a PUBLISH, SUBSCRIBE, or CALL message has only
+// options that the router recognizes.  If the message has an unrecognized
+// option, then an error is sent to the session and false is returned.
+func (r *realm) checkOptions(sess *wamp.Session, msg wamp.Message) bool {
+	var request wamp.ID
+	var options wamp.Dict
+	var known map[string]struct{}
+	var prefixes []string
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		request, options, known, prefixes = msg.Request, msg.Options, pubOptions, pubOptionPrefixes
+	case *wamp.Subscribe:
+		request, options, known = msg.Request, msg.Options, subOptions
+	case *wamp.Call:
+		request, options, known = msg.Request, msg.Options, callOptions
+	default:
+		return true
+	}
+
+nextOption:
+	for opt := range options {
+		if _, ok := known[opt]; ok {
+			continue
+		}
+		for _, pfx := range prefixes {
+			if strings.HasPrefix(opt, pfx) {
+				continue nextOption
+			}
+		}
+		r.log.Println("Client", sess, msg.MessageType(), "has unknown option:",
+			opt)
+		err := sess.TrySend(&wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   request,
+			Details:   errorDetails(r.debug, wamp.Dict{"option": opt}),
+			Error:     wamp.ErrInvalidOptions,
+			Arguments: wamp.List{"unknown option: " + opt},
+		})
+		if err != nil {
+			r.log.Println("!!! client blocked, could not send options error")
+		}
+		return false
+	}
+	return true
+}
+
+// authzCheck runs the realm's authorizer, for the calling session, on a
+// request message for the action and URI given as arguments.  The action is
+// one of "publish", "subscribe", "call", or "register".  An optional third
+// argument is a dictionary of options for the request, such as "match".  The
+// URI may only be empty if a "match" option is given, as for a catch-all
+// prefix subscription.  The request is not performed.
+//
+// The result is a dictionary with "allowed" set to true or false.  If not
+// allowed, the dictionary also contains the "error" URI that would be
+// returned for the actual request, and the "reason".
+func (r *realm) authzCheck(msg *wamp.Invocation) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+
+	if len(msg.Arguments) < 2 {
+		return makeErr(wamp.ErrInvalidArgument, "expected action and uri")
+	}
+	action, _ := wamp.AsString(msg.Arguments[0])
+	uri, _ := wamp.AsURI(msg.Arguments[1])
+	options := wamp.Dict{}
+	if len(msg.Arguments) > 2 {
+		opts, ok := wamp.AsDict(msg.Arguments[2])
+		if !ok {
+			return makeErr(wamp.ErrInvalidArgument, "options must be a dictionary")
+		}
+		// Copy the options, since the authorizer may alter them.
+		for k, v := range opts {
+			options[k] = v
+		}
+	}
+	if uri == "" && wamp.OptionString(options, wamp.OptMatch) == "" {
+		return makeErr(wamp.ErrInvalidArgument, "missing uri")
+	}
+
+	var req wamp.Message
+	switch action {
+	case "publish":
+		req = &wamp.Publish{Request: r.reqIDGen.Next(), Topic: uri, Options: options}
+	case "subscribe":
+		req = &wamp.Subscribe{Request: r.reqIDGen.Next(), Topic: uri, Options: options}
+	case "call":
+		req = &wamp.Call{Request: r.reqIDGen.Next(), Procedure: uri, Options: options}
+	case "register":
+		req = &wamp.Register{Request: r.reqIDGen.Next(), Procedure: uri, Options: options}
+	default:
+		return makeErr(wamp.ErrInvalidArgument, "invalid action: "+action)
+	}
+
+	caller, _ := wamp.AsID(msg.Details[roleCaller])
+	retChan := make(chan *wamp.Session)
+	r.actionChan <- func() {
+		retChan <- r.clients[caller]
+	}
+	sess := <-retChan
+	if sess == nil {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+
+	// The authorizer may alter the session, so give it a copy.
+	details := make(wamp.Dict, len(sess.Details))
+	for k, v := range sess.Details {
+		details[k] = v
+	}
+	sess = &wamp.Session{Peer: sess.Peer, ID: sess.ID, Details: details}
+
+	if r.canonURI != nil {
+		r.canonicalizeURI(req)
+	}
+	// Report the same outcome as authzMessage.
+	isAuthz, err := r.authorize(sess, req)
+	result := wamp.Dict{"allowed": isAuthz}
+	if !isAuthz {
+		if err != nil {
+			result["error"] = wamp.ErrAuthorizationFailed
+			result["reason"] = err.Error()
+		} else {
+			result["error"] = wamp.ErrNotAuthorized
+			result["reason"] = "not authorized by authorizer"
+		}
+	}
+	return &wamp.Yield{Request: msg.Request, Arguments: wamp.List{result}}
+}
+
 // authClient authenticates the client according to the authmethods in the
 // HELLO message details and the authenticators available for this realm.
 func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*wamp.Welcome, error) {
@@ -490,11 +1690,33 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 	}
 
 	// Return welcome message or error.
-	welcome, err := authr.Authenticate(sid, details, client)
+	welcome, err := r.authenticate(authr, sid, details, client)
+	if err != nil && err != errAuthTimeout && method == "cookie" {
+		// The client's cookie is not valid, so authenticate the client using
+		// the other methods it offered.
+		others := make([]string, 0, len(authmethods)-1)
+		for _, am := range authmethods {
+			if am != "cookie" {
+				others = append(others, am)
+			}
+		}
+		if authr, method = r.getAuthenticator(others); authr != nil {
+			welcome, err = r.authenticate(authr, sid, details, client)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	if r.cookieAuth != nil && method != "cookie" && method != "anonymous" {
+		r.cookieAuth.Remember(details, welcome.Details)
+	}
+	// The authenticator provides the authid, authrole, and authprovider, and
+	// any authextra, such as the router's key for mutual authentication.
 	welcome.Details["authmethod"] = method
+	if _, ok := welcome.Details["authprovider"]; !ok {
+		welcome.Details["authprovider"] = "static"
+	}
+	welcome.Details["realm"] = r.uri
 	welcome.Details["roles"] = wamp.Dict{
 		"broker": r.broker.Role(),
 		"dealer": r.dealer.Role(),
@@ -502,31 +1724,179 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 	return welcome, nil
 }
 
-// getAuthenticator finds the first authenticator registered for the methods.
+// authenticate runs the authenticator, limiting the time for the entire
+// authentication exchange to the realm's authentication timeout.
+//
+// If the timeout expires, errAuthTimeout is returned and the authenticator is
+// left to exit when it fails to receive from the client, which is closed when
+// the router aborts the session.  The authenticator is not allowed to send to
+// the client after the timeout, since the client may be closed.
+func (r *realm) authenticate(authr auth.Authenticator, sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	if r.authTimeout <= 0 {
+		return r.runAuthenticator(authr, sid, details, client)
+	}
+
+	type authResult struct {
+		welcome *wamp.Welcome
+		err     error
+	}
+	done := make(chan authResult, 1)
+	authClient := &authPeer{Peer: client}
+	go func() {
+		welcome, err := r.runAuthenticator(authr, sid, details, authClient)
+		done <- authResult{welcome, err}
+	}()
+
+	timer := time.NewTimer(r.authTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.welcome, res.err
+	case <-timer.C:
+		authClient.expire()
+		return nil, errAuthTimeout
+	}
+}
+
+// runAuthenticator authenticates the client with the authenticator.  The
+// challenges of a MultiChallengeAuthenticator are exchanged with the client
+// by the router, which sends no more than the realm's maximum number of
+// challenges.
+func (r *realm) runAuthenticator(authr auth.Authenticator, sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	multi, ok := authr.(auth.MultiChallengeAuthenticator)
+	if !ok {
+		return authr.Authenticate(sid, details, client)
+	}
+	challenges, err := multi.Challenges(sid, details)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ExchangeChallenges(challenges, client, 0, r.maxAuthChallenges)
+}
+
+// authPeer is the client peer given to an authenticator that has a time
+// limit.  Once expired, messages from the authenticator are not sent.
+type authPeer struct {
+	wamp.Peer
+	lock    sync.Mutex
+	expired bool
+}
+
+// expire stops any more messages from being sent to the client.  This waits
+// for any send in progress to finish, which does not block since sends to the
+// client are non-blocking.
+func (p *authPeer) expire() {
+	p.lock.Lock()
+	p.expired = true
+	p.lock.Unlock()
+}
+
+// Send sends a message to the client, retrying with backoff while the client
+// is blocked, until the message is sent or the authPeer expires.
+func (p *authPeer) Send(msg wamp.Message) error {
+	delay := time.Millisecond
+	for {
+		err := p.TrySend(msg)
+		if err != wamp.ErrBlocked {
+			return err
+		}
+		time.Sleep(delay)
+		if delay < maxSendQueueRetryDelay {
+			delay *= 2
+		}
+	}
+}
+
+func (p *authPeer) TrySend(msg wamp.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.expired {
+		return errAuthTimeout
+	}
+	return p.Peer.TrySend(msg)
+}
+
+// getAuthenticator finds the highest priority authenticator, configured for
+// the realm, for any of the methods offered by the client.
+//
+// The authenticators are not changed once the realm is created, so this does
+// not run in the realm's goroutine, which may have exited if the realm was
+// removed while the client was joining.
 func (r *realm) getAuthenticator(methods []string) (auth auth.Authenticator, authMethod string) {
-	sync := make(chan struct{})
-	r.actionChan <- func() {
-		// Iterate through the methods and see if there is an Authenticator for
-		// the method.
-		if len(r.authenticators) != 0 {
-			for _, method := range methods {
-				if a, ok := r.authenticators[method]; ok {
-					auth = a
-					authMethod = method
-					break
-				}
+	// Iterate through the authenticators in priority order and see if the
+	// client offered the method of the Authenticator.
+	for _, a := range r.authenticators {
+		for _, method := range methods {
+			if a.AuthMethod() == method {
+				return a, method
 			}
 		}
-		close(sync)
 	}
-	<-sync
-	return
+	return nil, ""
+}
+
+// metaAPI returns the handler of a meta procedure of a meta API feature.  If
+// the feature is disabled, then the handler answers callers that are not
+// exempt, as decided by exemptCaller, with wamp.error.no_such_procedure.
+func (r *realm) metaAPI(feature string, disabled map[string]bool, f func(*wamp.Invocation) wamp.Message) func(*wamp.Invocation) wamp.Message {
+	if !disabled[feature] {
+		return f
+	}
+	return func(msg *wamp.Invocation) wamp.Message {
+		if !r.exemptCaller(msg) {
+			return &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrNoSuchProcedure,
+			}
+		}
+		return f(msg)
+	}
+}
+
+// metaAsyncProc returns the handler of a meta procedure that may take a long
+// time.  The handler runs f in a new goroutine, which gives the response to
+// metaProcedureHandler to send, and returns nil so that metaProcedureHandler
+// does not wait for the response.
+func (r *realm) metaAsyncProc(f func(*wamp.Invocation) wamp.Message) func(*wamp.Invocation) wamp.Message {
+	return func(msg *wamp.Invocation) wamp.Message {
+		r.metaAsync.Add(1)
+		go func() {
+			defer r.metaAsync.Done()
+			rsp := f(msg)
+			select {
+			case r.metaAsyncRsp <- rsp:
+			case <-r.metaDone:
+			}
+		}()
+		return nil
+	}
+}
+
+// exemptCaller returns true if the caller of a meta procedure may use the
+// features disabled for the realm: if the caller has an exempt authrole, or
+// is a session internal to the router, such as that of a realm link.
+func (r *realm) exemptCaller(msg *wamp.Invocation) bool {
+	if r.exemptRoles.has(wamp.OptionString(msg.Details, "caller_authrole")) {
+		return true
+	}
+	caller := wamp.OptionID(msg.Details, roleCaller)
+	retChan := make(chan bool)
+	r.actionChan <- func() {
+		sess, ok := r.clients[caller]
+		retChan <- ok && isInternal(sess)
+	}
+	return <-retChan
 }
 
 func (r *realm) registerMetaProcedure(procedure wamp.URI, f func(*wamp.Invocation) wamp.Message) {
+	// Caller identity is disclosed to meta procedures, so that handlers can
+	// tell which session made the call.
 	r.metaPeer.Send(&wamp.Register{
 		Request:   r.metaIDGen.Next(),
 		Procedure: procedure,
+		Options:   wamp.Dict{wamp.OptDiscloseCaller: true},
 	})
 	msg := <-r.metaPeer.Recv()
 	if msg == nil {
@@ -559,7 +1929,19 @@ func (r *realm) registerMetaProcedure(procedure wamp.URI, f func(*wamp.Invocatio
 func (r *realm) metaProcedureHandler() {
 	defer close(r.metaDone)
 	var rsp wamp.Message
-	for msg := range r.metaPeer.Recv() {
+	for {
+		var msg wamp.Message
+		var open bool
+		select {
+		case rsp = <-r.metaAsyncRsp:
+			// Response of a meta procedure run by metaAsyncProc.
+			r.metaPeer.Send(rsp)
+			continue
+		case msg, open = <-r.metaPeer.Recv():
+			if !open {
+				return
+			}
+		}
 		switch msg := msg.(type) {
 		case *wamp.Invocation:
 			metaProcHandler, ok := r.metaProcMap[msg.Registration]
@@ -572,7 +1954,10 @@ func (r *realm) metaProcedureHandler() {
 				})
 				continue
 			}
-			rsp = metaProcHandler(msg)
+			if rsp = metaProcHandler(msg); rsp == nil {
+				// Response is sent when the procedure finishes.
+				continue
+			}
 		case *wamp.Goodbye:
 			if r.debug {
 				r.log.Print("Session meta procedure handler exiting GOODBYE")
@@ -676,6 +2061,9 @@ func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
 	retChan := make(chan *wamp.Session)
 	r.actionChan <- func() {
 		sess, _ := r.clients[wamp.ID(sessID)]
+		if sess == nil && wamp.ID(sessID) == r.metaSess.ID {
+			sess = r.metaSess
+		}
 		retChan <- sess
 	}
 	sess := <-retChan
@@ -688,6 +2076,423 @@ func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
 	// implementation.
 	return &wamp.Yield{
 		Request:   msg.Request,
-		Arguments: wamp.List{sess.Details},
+		Arguments: wamp.List{sessionInfo(sess)},
+	}
+}
+
+// sessionInfo returns the details of a session, as returned by
+// wamp.session.get.  The details the WAMP spec requires, and the roles, are
+// always present, so that sessions attached within the router, such as the
+// meta session and realm links, are described like other sessions.  These
+// have "internal" as their transport type.
+func sessionInfo(sess *wamp.Session) wamp.Dict {
+	info := make(wamp.Dict, len(sess.Details)+7)
+	for k, v := range sess.Details {
+		info[k] = v
+	}
+	info["session"] = sess.ID
+	for _, k := range []string{"authid", "authrole", "authmethod", "authprovider"} {
+		if _, ok := info[k]; !ok {
+			info[k] = ""
+		}
+	}
+	if _, ok := info["transport"]; !ok {
+		info["transport"] = wamp.Dict{"type": transportTypeInternal}
+	}
+	if _, ok := info["roles"]; !ok {
+		info["roles"] = wamp.Dict{}
+	}
+	return info
+}
+
+// sessionKill kills the session identified by the session ID argument.  The
+// session is sent a GOODBYE message, and its transport is closed.
+//
+// The optional keyword arguments "reason" and "message" specify the GOODBYE
+// reason URI and message.  The calling session cannot kill itself unless the
+// keyword argument "self" is true.
+func (r *realm) sessionKill(msg *wamp.Invocation) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+
+	if len(msg.Arguments) == 0 {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	sessID, ok := wamp.AsID(msg.Arguments[0])
+	if !ok {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+
+	caller, _ := wamp.AsID(msg.Details[roleCaller])
+	if sessID == caller && !wamp.OptionFlag(msg.ArgumentsKw, "self") {
+		return makeErr(wamp.ErrInvalidArgument, "cannot kill own session")
+	}
+
+	goodbye := killGoodbye(msg.ArgumentsKw)
+	if goodbye == nil {
+		return makeErr(wamp.ErrInvalidURI, "invalid reason URI")
+	}
+
+	killed := make(chan bool)
+	r.actionChan <- func() {
+		killed <- r.killSession(sessID, goodbye)
+	}
+	if !<-killed {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	r.log.Println("Killed session", sessID, "reason:", goodbye.Reason)
+	return &wamp.Yield{Request: msg.Request}
+}
+
+// sessionKillByAuthid kills all sessions with the authid given as the
+// argument, and returns the number of sessions killed.  The keyword arguments
+// are the same as for sessionKill, and the calling session is not killed
+// unless "self" is true.
+func (r *realm) sessionKillByAuthid(msg *wamp.Invocation) wamp.Message {
+	return r.killSessionsByDetail(msg, "authid")
+}
+
+// sessionKillByAuthrole kills all sessions with the authrole given as the
+// argument, and returns the number of sessions killed.  The keyword arguments
+// are the same as for sessionKill, and the calling session is not killed
+// unless "self" is true.
+func (r *realm) sessionKillByAuthrole(msg *wamp.Invocation) wamp.Message {
+	return r.killSessionsByDetail(msg, "authrole")
+}
+
+// killSessionsByDetail kills all sessions whose session details have the
+// value, given as the first argument of msg, for the specified detail.
+func (r *realm) killSessionsByDetail(msg *wamp.Invocation, detail string) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+
+	var value string
+	if len(msg.Arguments) != 0 {
+		value, _ = wamp.AsString(msg.Arguments[0])
+	}
+	if value == "" {
+		return makeErr(wamp.ErrInvalidArgument, "missing "+detail)
+	}
+
+	goodbye := killGoodbye(msg.ArgumentsKw)
+	if goodbye == nil {
+		return makeErr(wamp.ErrInvalidURI, "invalid reason URI")
+	}
+	caller, _ := wamp.AsID(msg.Details[roleCaller])
+	killSelf := wamp.OptionFlag(msg.ArgumentsKw, "self")
+
+	countChan := make(chan int)
+	r.actionChan <- func() {
+		var count int
+		for id, sess := range r.clients {
+			if id == caller && !killSelf {
+				continue
+			}
+			if wamp.OptionString(sess.Details, detail) != value {
+				continue
+			}
+			if r.killSession(id, goodbye) {
+				count++
+			}
+		}
+		countChan <- count
+	}
+	count := <-countChan
+	r.log.Println("Killed", count, "sessions with", detail, value, "reason:",
+		goodbye.Reason)
+	return &wamp.Yield{Request: msg.Request, Arguments: wamp.List{count}}
+}
+
+// killGoodbye returns the GOODBYE message to send to a killed session, using
+// the "reason" and "message" keyword arguments given to a kill meta
+// procedure.  Returns nil if the reason is not a valid URI.
+func killGoodbye(kwargs wamp.Dict) *wamp.Goodbye {
+	reason := wamp.ErrSessionKilled
+	if s := wamp.OptionURI(kwargs, "reason"); s != "" {
+		if !s.ValidURI(false, "") {
+			return nil
+		}
+		reason = s
+	}
+	details := wamp.Dict{}
+	if message := wamp.OptionString(kwargs, "message"); message != "" {
+		details["message"] = message
+	}
+	return &wamp.Goodbye{Reason: reason, Details: details}
+}
+
+// Testament scopes.  This router does not support session resumption, so a
+// session is detached and destroyed at the same time, when it leaves the
+// realm.  Testaments for the detached scope are published first.
+const (
+	scopeDetached  = "detached"
+	scopeDestroyed = "destroyed"
+)
+
+// testament is an event that is published when a session leaves the realm.
+type testament struct {
+	topic   wamp.URI
+	args    wamp.List
+	kwargs  wamp.Dict
+	options wamp.Dict
+}
+
+// testamentScope returns the scope given by the "scope" keyword argument,
+// which defaults to "destroyed".  An empty string is returned if the scope is
+// not valid.
+func testamentScope(kwargs wamp.Dict) string {
+	scope, ok := kwargs["scope"]
+	if !ok {
+		return scopeDestroyed
+	}
+	s, _ := wamp.AsString(scope)
+	if s != scopeDetached && s != scopeDestroyed {
+		return ""
+	}
+	return s
+}
+
+// addTestament stores a testament for the calling session.  The arguments are
+// the topic, and the positional and keyword arguments of the event.  The
+// keyword arguments "publish_options" and "scope" specify the options of the
+// PUBLISH and when it is published.
+//
+// The session must be authorized to publish the testament when it is added,
+// since it is published on the session's behalf without further checks.
+func (r *realm) addTestament(msg *wamp.Invocation) wamp.Message {
+	makeErr := func(errURI wamp.URI, args ...interface{}) *wamp.Error {
+		return &wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     errURI,
+			Arguments: args,
+		}
+	}
+
+	if len(msg.Arguments) == 0 {
+		return makeErr(wamp.ErrInvalidArgument, "missing topic")
+	}
+	topic, _ := wamp.AsURI(msg.Arguments[0])
+	if !topic.ValidURI(false, "") {
+		return makeErr(wamp.ErrInvalidURI, "invalid topic")
+	}
+	var t testament
+	t.topic = topic
+	if len(msg.Arguments) > 1 {
+		t.args, _ = wamp.AsList(msg.Arguments[1])
+	}
+	if len(msg.Arguments) > 2 {
+		t.kwargs, _ = wamp.AsDict(msg.Arguments[2])
+	}
+	if opts, ok := msg.ArgumentsKw["publish_options"]; ok {
+		t.options, _ = wamp.AsDict(opts)
+	}
+	scope := testamentScope(msg.ArgumentsKw)
+	if scope == "" {
+		return makeErr(wamp.ErrInvalidArgument, "invalid scope")
+	}
+
+	caller, _ := wamp.AsID(msg.Details[roleCaller])
+	retChan := make(chan *wamp.Session)
+	r.actionChan <- func() {
+		retChan <- r.clients[caller]
+	}
+	sess := <-retChan
+	if sess == nil {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	pub := &wamp.Publish{
+		Request:     r.reqIDGen.Next(),
+		Options:     wamp.Dict{},
+		Topic:       t.topic,
+		Arguments:   t.args,
+		ArgumentsKw: t.kwargs,
+	}
+	for k, v := range t.options {
+		pub.Options[k] = v
+	}
+	if r.canonURI != nil {
+		r.canonicalizeURI(pub)
+		t.topic = pub.Topic
+	}
+	if isAuthz, err := r.authorize(sess, pub); !isAuthz {
+		if err != nil {
+			return makeErr(wamp.ErrAuthorizationFailed, err.Error())
+		}
+		return makeErr(wamp.ErrNotAuthorized)
+	}
+
+	added := make(chan bool)
+	r.actionChan <- func() {
+		if _, ok := r.clients[caller]; !ok {
+			added <- false
+			return
+		}
+		scopes, ok := r.testaments[caller]
+		if !ok {
+			scopes = map[string][]testament{}
+			r.testaments[caller] = scopes
+		}
+		scopes[scope] = append(scopes[scope], t)
+		added <- true
+	}
+	if !<-added {
+		return makeErr(wamp.ErrNoSuchSession)
+	}
+	return &wamp.Yield{Request: msg.Request}
+}
+
+// flushTestaments removes the calling session's testaments for the scope
+// given by the "scope" keyword argument, and returns the number removed.
+func (r *realm) flushTestaments(msg *wamp.Invocation) wamp.Message {
+	scope := testamentScope(msg.ArgumentsKw)
+	if scope == "" {
+		return &wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{"invalid scope"},
+		}
+	}
+
+	caller, _ := wamp.AsID(msg.Details[roleCaller])
+	countChan := make(chan int)
+	r.actionChan <- func() {
+		count := len(r.testaments[caller][scope])
+		delete(r.testaments[caller], scope)
+		countChan <- count
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{<-countChan},
+	}
+}
+
+// publishTestaments publishes the testaments of a session that is leaving the
+// realm.  They are published by the broker as if sent by the session.
+func (r *realm) publishTestaments(sess *wamp.Session) {
+	scopesChan := make(chan map[string][]testament)
+	r.actionChan <- func() {
+		scopesChan <- r.testaments[sess.ID]
+	}
+	scopes := <-scopesChan
+	for _, scope := range []string{scopeDetached, scopeDestroyed} {
+		for _, t := range scopes[scope] {
+			opts := wamp.Dict{}
+			for k, v := range t.options {
+				opts[k] = v
+			}
+			// No one is left to receive the acknowledgement.
+			delete(opts, wamp.OptAcknowledge)
+			r.broker.Publish(sess, &wamp.Publish{
+				Request:     r.reqIDGen.Next(),
+				Options:     opts,
+				Topic:       t.topic,
+				Arguments:   t.args,
+				ArgumentsKw: t.kwargs,
+			})
+		}
+	}
+}
+
+// routerPing returns the router's current time as the number of microseconds
+// since the Unix epoch.  This does not access any realm state, so that it is
+// as cheap as possible and measures only the round trip time.
+func (r *realm) routerPing(msg *wamp.Invocation) wamp.Message {
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{time.Now().UnixNano() / int64(time.Microsecond)},
+	}
+}
+
+// routerInfo returns a dictionary containing the router's software version,
+// the number of seconds the router has been running, and the broker and
+// dealer features enabled for the realm.
+func (r *realm) routerInfo(msg *wamp.Invocation) wamp.Message {
+	return &wamp.Yield{
+		Request: msg.Request,
+		Arguments: wamp.List{wamp.Dict{
+			"version": Version,
+			"uptime":  int64(time.Since(r.routerStarted) / time.Second),
+			"features": wamp.Dict{
+				"broker": r.broker.Role()["features"],
+				"dealer": r.dealer.Role()["features"],
+			},
+		}},
+	}
+}
+
+// realmCount returns a dictionary with the number of sessions in the realm, as
+// "sessions", and the numbers of registrations and subscriptions for each
+// match policy, as "registrations" and "subscriptions".  This gives the same
+// counts as calling wamp.session.count, wamp.registration.list, and
+// wamp.subscription.list, in a single call.
+func (r *realm) realmCount(msg *wamp.Invocation) wamp.Message {
+	return &wamp.Yield{
+		Request: msg.Request,
+		Arguments: wamp.List{wamp.Dict{
+			"sessions":      r.clientCount(),
+			"registrations": r.dealer.regCounts(),
+			"subscriptions": r.broker.subCounts(),
+		}},
+	}
+}
+
+// routerRealmList returns the URIs of the realms on the router.  Only the
+// router's admin realm has this meta procedure.
+func (r *realm) routerRealmList(msg *wamp.Invocation) wamp.Message {
+	uris := r.listRealms()
+	list := make(wamp.List, len(uris))
+	for i := range uris {
+		list[i] = uris[i]
+	}
+	return &wamp.Yield{Request: msg.Request, Arguments: wamp.List{list}}
+}
+
+// reflectDescribe returns a dictionary describing the registered procedure
+// that a call to the URI would invoke, as "procedure", and the subscribed
+// topic with the URI, as "topic".  Either is left out if there is no such
+// procedure or topic.
+func (r *realm) reflectDescribe(msg *wamp.Invocation) wamp.Message {
+	var uri wamp.URI
+	var ok bool
+	if len(msg.Arguments) != 0 {
+		uri, ok = wamp.AsURI(msg.Arguments[0])
+	}
+	if !ok || uri == "" {
+		return &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{"missing URI argument"},
+		}
+	}
+	dict := wamp.Dict{}
+	if proc := r.dealer.describeProcedure(uri); proc != nil {
+		dict["procedure"] = proc
+	}
+	if topic := r.broker.describeTopic(uri); topic != nil {
+		dict["topic"] = topic
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
 	}
 }
@@ -7,18 +7,45 @@ publication filtering functionality.
 package router
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/wamp"
 )
 
-const helloTimeout = 5 * time.Second
+// defaultHelloTimeout is the time allowed for a new client to send HELLO, if
+// not configured by the router.
+const defaultHelloTimeout = 5 * time.Second
+
+// defaultAuthTimeout is the time allowed for the authentication exchange, if
+// not configured by the realm or the router.
+const defaultAuthTimeout = 10 * time.Second
+
+// Version is the version of the nexus router software.
+const Version = "1.0.0"
+
+// WELCOME details that identify the router software.  These are prefixed to
+// avoid clashing with any details defined by the WAMP specification.
+const (
+	detailNexusVersion = "x_nexus_version"
+	detailNexusPeer    = "x_nexus_peer"
+
+	nexusPeer = "nexus"
+)
+
+// Transport type of a session whose peer is in the same process as the
+// router, and so has no transport details.
+const transportTypeInternal = "internal"
 
 // RouterConfig configures the router with realms, and optionally a template
 // for creating new realms.
@@ -37,6 +64,38 @@ type RouterConfig struct {
 
 	// Enable debug logging for router, realm, broker, dealer
 	Debug bool
+
+	// Maximum time allowed for a new client to send HELLO, after the
+	// transport is established.  Attach closes the transport of a client that
+	// does not send HELLO in time.  Zero, the default, means 5 seconds.  A
+	// negative value means no limit.
+	HelloTimeout time.Duration `json:"hello_timeout"`
+
+	// Maximum time allowed for the authentication exchange in realms whose
+	// AuthTimeout is zero.  Zero, the default, means 10 seconds.  A negative
+	// value means no limit.
+	AuthTimeout time.Duration `json:"auth_timeout"`
+
+	// Metrics, if set, is notified of the activity of every realm, for
+	// exporting to a monitoring system.
+	Metrics MetricsRecorder `json:"-"`
+
+	// SessionIDGenerator, if set, generates the IDs of sessions, including
+	// the router's own meta and link sessions.  It must not generate the ID
+	// of a session that is still attached.  RequestIDGenerator, if set,
+	// generates publication IDs, and the request IDs of messages that the
+	// router sends on its own behalf, such as meta events.  These may be the
+	// same generator.  Both default to wamp.RandomIDGen, which generates
+	// random IDs.  A sequential generator, such as wamp.SyncIDGen, makes IDs
+	// predictable for testing, and a cluster of routers can give each router
+	// a generator of a distinct range of IDs.
+	SessionIDGenerator wamp.IDGenerator `json:"-"`
+	RequestIDGenerator wamp.IDGenerator `json:"-"`
+
+	// AdminRealm, if set, is the URI of a realm in which sessions can call
+	// the wamp.router.realm.list meta procedure to list the realms on the
+	// router.  The realm may be configured, or created from the template.
+	AdminRealm wamp.URI `json:"admin_realm"`
 }
 
 // A Router handles new Peers and routes requests to the requested Realm.
@@ -51,6 +110,60 @@ type Router interface {
 	Logger() stdlog.StdLog
 }
 
+// GracefulCloser is implemented by a Router that can wait for its sessions to
+// finish when it is closed.  The Router returned by NewRouter implements it.
+type GracefulCloser interface {
+	// CloseTimeout stops the router, like Close, and additionally waits for
+	// all sessions to be detached and their transports closed.  An error is
+	// returned if teardown is not complete within the timeout.
+	CloseTimeout(time.Duration) error
+
+	// Shutdown stops accepting new sessions, sends GOODBYE to all sessions,
+	// and waits for them to reply before closing the router.  If the context
+	// is done first, then the router is closed anyway.  Returns the number of
+	// sessions that did not reply with GOODBYE in time.
+	Shutdown(context.Context) int
+}
+
+// RealmLinker is implemented by a Router that can link its realms to realms
+// on other routers.  The Router returned by NewRouter implements it.
+type RealmLinker interface {
+	// LinkRealm links a realm to the same realm on an upstream router, so
+	// that local sessions receive events published upstream and can call
+	// procedures registered upstream.  The returned io.Closer removes the
+	// link.
+	LinkRealm(realm wamp.URI, upstreamURL string, cfg LinkConfig) (io.Closer, error)
+}
+
+// RealmLister is implemented by a Router that reports which realms it has.
+// The Router returned by NewRouter implements it.
+type RealmLister interface {
+	// Realms returns the URIs of the realms on the router, in sorted order.
+	Realms() []wamp.URI
+	// RealmExists returns true if the router has the realm.
+	RealmExists(realm wamp.URI) bool
+}
+
+// RealmRemover is implemented by a Router that can remove realms while it is
+// running.  The Router returned by NewRouter implements it.
+type RealmRemover interface {
+	// RemoveRealm closes a realm, sending GOODBYE to all of its sessions, and
+	// removes the realm from the router.  Returns an error if the router has
+	// no such realm.
+	RemoveRealm(realm wamp.URI) error
+}
+
+// SessionGetter is implemented by a Router that gives applications embedding
+// the router access to the sessions attached to its realms, without calling
+// the session meta procedures.  The Router returned by NewRouter implements
+// it.
+type SessionGetter interface {
+	// Session returns a read-only view of the session with the ID in the
+	// realm.  Returns false if the router has no such realm, or the realm
+	// has no such session.
+	Session(realm wamp.URI, id wamp.ID) (*SessionDetails, bool)
+}
+
 // DefaultRouter is the default WAMP router implementation.
 type router struct {
 	realms map[wamp.URI]*realm
@@ -61,6 +174,32 @@ type router struct {
 	realmTemplate *RealmConfig
 	closed        bool
 
+	// Links from local realms to upstream routers.
+	links []*realmLink
+
+	// URIs of the realms, for reporting without waiting for the router's
+	// goroutine.  Only changed by the router's goroutine, along with realms.
+	realmURIs  map[wamp.URI]struct{}
+	realmsLock sync.Mutex
+
+	// Realm in which the realms can be listed.
+	adminRealm wamp.URI
+
+	// Time the router was started, for reporting uptime.
+	started time.Time
+
+	// Notified of the activity of every realm, if not nil.
+	metrics MetricsRecorder
+
+	// Time allowed for a new client to send HELLO.
+	helloTimeout time.Duration
+	// Authentication timeout of realms that do not set their own.
+	authTimeout time.Duration
+
+	// Generate session IDs, and router request IDs.
+	sessIDGen wamp.IDGenerator
+	reqIDGen  wamp.IDGenerator
+
 	log   stdlog.StdLog
 	debug bool
 }
@@ -79,10 +218,30 @@ func NewRouter(config *RouterConfig, logger stdlog.StdLog) (Router, error) {
 
 	r := &router{
 		realms:        map[wamp.URI]*realm{},
+		realmURIs:     map[wamp.URI]struct{}{},
+		adminRealm:    config.AdminRealm,
 		actionChan:    make(chan func()),
 		realmTemplate: config.RealmTemplate,
+		started:       time.Now(),
 		log:           logger,
 		debug:         config.Debug,
+		metrics:       config.Metrics,
+		helloTimeout:  config.HelloTimeout,
+		authTimeout:   config.AuthTimeout,
+		sessIDGen:     config.SessionIDGenerator,
+		reqIDGen:      config.RequestIDGenerator,
+	}
+	if r.helloTimeout == 0 {
+		r.helloTimeout = defaultHelloTimeout
+	}
+	if r.authTimeout == 0 {
+		r.authTimeout = defaultAuthTimeout
+	}
+	if r.sessIDGen == nil {
+		r.sessIDGen = wamp.RandomIDGen{}
+	}
+	if r.reqIDGen == nil {
+		r.reqIDGen = wamp.RandomIDGen{}
 	}
 
 	for _, realmConfig := range config.RealmConfigs {
@@ -110,6 +269,9 @@ func (r *router) Logger() stdlog.StdLog { return r.log }
 // Attach connects a client to the router and to the requested realm.  If
 // successful, Attach returns after sending a WELCOME message to the client.
 func (r *router) Attach(client wamp.Peer) error {
+	// Realm the client is attaching to, once known.
+	var realm *realm
+
 	sendAbort := func(reason wamp.URI, abortErr error) {
 		abortMsg := wamp.Abort{Reason: reason}
 		abortMsg.Details = wamp.Dict{}
@@ -117,13 +279,18 @@ func (r *router) Attach(client wamp.Peer) error {
 			abortMsg.Details["error"] = abortErr.Error()
 			r.log.Println("Aborting client connection:", abortErr)
 		}
+		if realm != nil {
+			addDetails(abortMsg.Details, realm.abortDetails)
+		}
 		client.Send(&abortMsg) // Blocking OK; this is session goroutine.
 		client.Close()
 	}
 
-	// Receive HELLO message from the client.
-	msg, err := wamp.RecvTimeout(client, helloTimeout)
+	// Receive HELLO message from the client.  Close the transport of a
+	// client that does not send one, so that it does not stay open.
+	msg, err := r.recvHello(client)
 	if err != nil {
+		client.Close()
 		return errors.New("did not receive HELLO: " + err.Error())
 	}
 	if r.debug {
@@ -151,7 +318,6 @@ func (r *router) Attach(client wamp.Peer) error {
 		return err
 	}
 	// Lookup or create realm to attach to.
-	var realm *realm
 	sync := make(chan error)
 	r.actionChan <- func() {
 		if r.closed {
@@ -192,6 +358,17 @@ func (r *router) Attach(client wamp.Peer) error {
 		return err
 	}
 
+	if realm.disableCompression {
+		if c, ok := client.(transport.Compressor); ok {
+			c.SetCompression(false, 0)
+		}
+	}
+	if realm.maxMessageSize > 0 {
+		if l, ok := client.(transport.RecvLimiter); ok {
+			l.SetRecvLimit(realm.maxMessageSize)
+		}
+	}
+
 	hello.Details = wamp.NormalizeDict(hello.Details)
 
 	// A Client must announce the roles it supports via
@@ -230,13 +407,25 @@ func (r *router) Attach(client wamp.Peer) error {
 		hello.Details["authmethods"] = []string{"anonymous"}
 	}
 
+	// Give the authenticator the details of the client's transport, such as
+	// the client's TLS certificate.  These replace any transport details in
+	// the HELLO from the client.
+	delete(hello.Details, "transport")
+	if td, ok := client.(transport.TransportDetailer); ok {
+		hello.Details["transport"] = td.TransportDetails()
+	}
+
 	// Handle any necessary client auth.  This results in either a WELCOME
 	// message or an error.
 	//
 	// Authentication may take some some.
-	sid := wamp.GlobalID()
+	sid := r.sessIDGen.Next()
 	welcome, err := realm.authClient(sid, client, hello.Details)
 	if err != nil {
+		if err == errAuthTimeout {
+			sendAbort(wamp.ErrAuthenticationTimeout, err)
+			return err
+		}
 		sendAbort(wamp.ErrAuthenticationFailed, err)
 		return errors.New("authentication error: " + err.Error())
 	}
@@ -257,6 +446,23 @@ func (r *router) Attach(client wamp.Peer) error {
 		sessDetails[k] = v
 	}
 	sessDetails["session"] = welcome.ID
+	if td, ok := wamp.AsDict(hello.Details["transport"]); ok {
+		// The tracking cookie authenticates the client, so keep it out of
+		// the session details, which other sessions can get.
+		if _, ok = td[auth.CookieTransportDetail]; ok {
+			sessTD := make(wamp.Dict, len(td)-1)
+			for k, v := range td {
+				if k != auth.CookieTransportDetail {
+					sessTD[k] = v
+				}
+			}
+			td = sessTD
+		}
+		sessDetails["transport"] = td
+	}
+
+	// Only the router marks its own sessions as internal.
+	delete(sessDetails, detailInternal)
 
 	// Create new session.
 	sess := &wamp.Session{
@@ -265,39 +471,232 @@ func (r *router) Attach(client wamp.Peer) error {
 		Details: sessDetails,
 	}
 
-	if err := realm.handleSession(sess); err != nil {
-		// N.B. assume, for now, that any error is a shutdown error
+	// Identify the router software to the client.  This is not part of the
+	// session details.
+	welcome.Details[detailNexusVersion] = Version
+	welcome.Details[detailNexusPeer] = nexusPeer
+	addDetails(welcome.Details, realm.welcomeDetails)
+
+	// The realm sends the WELCOME once the session has joined.
+	if err := realm.handleSession(sess, welcome); err != nil {
+		if err == errAuthIDInUse || err == errSessionIDInUse {
+			sendAbort(wamp.ErrNotAuthorized, err)
+			return err
+		}
+		// N.B. assume, for now, that any other error is a shutdown error
 		sendAbort(wamp.ErrSystemShutdown, nil)
 		return err
 	}
 
-	client.Send(welcome) // Blocking OK; this is session goroutine.
 	if r.debug {
-		r.log.Println("Created session:", welcome.ID)
+		r.log.Println("Created session:", sess.ID)
+	}
+	return nil
+}
+
+// recvHello receives the first message from a new client, waiting no longer
+// than the router's HELLO timeout, if it has one.
+func (r *router) recvHello(client wamp.Peer) (wamp.Message, error) {
+	if r.helloTimeout > 0 {
+		return wamp.RecvTimeout(client, r.helloTimeout)
+	}
+	msg, open := <-client.Recv()
+	if !open {
+		return nil, errors.New("receive channel closed")
+	}
+	return msg, nil
+}
+
+// Realms returns the URIs of the realms on the router, in sorted order.
+func (r *router) Realms() []wamp.URI {
+	r.realmsLock.Lock()
+	names := make([]string, 0, len(r.realmURIs))
+	for uri := range r.realmURIs {
+		names = append(names, string(uri))
+	}
+	r.realmsLock.Unlock()
+	sort.Strings(names)
+	uris := make([]wamp.URI, len(names))
+	for i := range names {
+		uris[i] = wamp.URI(names[i])
+	}
+	return uris
+}
+
+// RealmExists returns true if the router has the realm.
+func (r *router) RealmExists(uri wamp.URI) bool {
+	r.realmsLock.Lock()
+	defer r.realmsLock.Unlock()
+	_, ok := r.realmURIs[uri]
+	return ok
+}
+
+// Session returns a read-only view of the session with the ID in the realm.
+func (r *router) Session(uri wamp.URI, id wamp.ID) (*SessionDetails, bool) {
+	var realm *realm
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		if !r.closed {
+			realm = r.realms[uri]
+		}
+		close(sync)
+	}
+	<-sync
+	if realm == nil {
+		return nil, false
+	}
+	return realm.session(id)
+}
+
+// RemoveRealm removes the realm from the router, so that clients can no longer
+// join it, and then closes the realm.  Each session in the realm is sent a
+// GOODBYE with the reason wamp.close.system_shutdown, its subscriptions and
+// registrations are removed, and the realm's broker and dealer are stopped.
+// Any links from the realm to upstream routers are closed.  RemoveRealm
+// returns when the realm is closed.
+//
+// If the router has a realm template, then a client that later joins the
+// realm creates a new realm from the template.
+func (r *router) RemoveRealm(uri wamp.URI) error {
+	var realm *realm
+	var links []*realmLink
+	sync := make(chan error)
+	r.actionChan <- func() {
+		if r.closed {
+			sync <- errors.New("router closed")
+			return
+		}
+		var ok bool
+		if realm, ok = r.realms[uri]; !ok {
+			sync <- fmt.Errorf("no realm \"%s\" exists on this router",
+				string(uri))
+			return
+		}
+		delete(r.realms, uri)
+		r.realmsLock.Lock()
+		delete(r.realmURIs, uri)
+		r.realmsLock.Unlock()
+		remaining := r.links[:0]
+		for _, link := range r.links {
+			if link.realm == realm {
+				links = append(links, link)
+			} else {
+				remaining = append(remaining, link)
+			}
+		}
+		r.links = remaining
+		sync <- nil
 	}
+	if err := <-sync; err != nil {
+		return err
+	}
+	for _, link := range links {
+		link.Close()
+	}
+	realm.close()
+	r.log.Println("Removed realm:", uri)
 	return nil
 }
 
 // Close stops the router and waits message processing to stop.
 func (r *router) Close() {
+	r.close()
+}
+
+// CloseTimeout stops the router and waits until it is quiescent: all realms
+// closed, all sessions detached, the transport of every session closed, and
+// all router goroutines exited.  If this does not happen within the given
+// timeout, then an error is returned and teardown continues in the
+// background.
+func (r *router) CloseTimeout(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		for _, realm := range r.close() {
+			realm.waitSessions.Wait()
+		}
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		return fmt.Errorf("router teardown not complete after %s", timeout)
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the router.  New sessions are no longer accepted,
+// and every session is sent a GOODBYE with the reason
+// wamp.error.system_shutdown.  Sessions continue to be served, so that any
+// requests in progress can finish, until each session replies with GOODBYE
+// and leaves its realm.  When no sessions remain, or when the context is done,
+// the router is closed as with Close.
+//
+// Returns the number of sessions that had not left when the router was
+// closed.
+func (r *router) Shutdown(ctx context.Context) int {
+	var realms []*realm
 	sync := make(chan struct{})
 	r.actionChan <- func() {
 		// Prevent new or attachment to existing realms.
 		r.closed = true
+		for _, realm := range r.realms {
+			realms = append(realms, realm)
+		}
+		close(sync)
+	}
+	<-sync
+
+	var remaining int
+	for _, realm := range realms {
+		select {
+		case <-realm.drain():
+		case <-ctx.Done():
+		}
+	}
+	for _, realm := range realms {
+		remaining += realm.clientCount()
+	}
+	r.close()
+	return remaining
+}
+
+// close closes all realms and stops the router.  The closed realms are
+// returned so that the caller can wait for their sessions to finish.
+func (r *router) close() []*realm {
+	var closed []*realm
+	var links []*realmLink
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		// Prevent new or attachment to existing realms.
+		r.closed = true
+		links = r.links
+		r.links = nil
 		// Close all existing realms.
 		for uri, realm := range r.realms {
 			realm.close()
+			closed = append(closed, realm)
 			// Delete the realm
 			delete(r.realms, uri)
 			r.log.Println("Realm", uri, "completed shutdown")
 		}
+		r.realmsLock.Lock()
+		r.realmURIs = map[wamp.URI]struct{}{}
+		r.realmsLock.Unlock()
 		close(sync)
 	}
 	<-sync
+	// Stop any links that are waiting to reconnect.
+	for _, link := range links {
+		link.Close()
+	}
 	// Wait for all existing realms to close.
 	r.waitRealms.Wait()
 	close(r.actionChan)
 	r.log.Println("Router stopped")
+	return closed
 }
 
 // addRealm creates a new Realm and adds that to the router.  At least one
@@ -307,15 +706,86 @@ func (r *router) addRealm(config *RealmConfig) (*realm, error) {
 		return nil, errors.New("realm already exists: " + string(config.URI))
 	}
 
-	realm, err := newRealm(
-		config,
-		NewBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug),
-		NewDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug),
-		r.log, r.debug)
+	dealer := NewDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug)
+	if config.CallTimeoutJitter != 0 {
+		dealer.SetCallTimeoutJitter(config.CallTimeoutJitter)
+	}
+	if config.MaxInvocationDuration != 0 {
+		dealer.SetMaxInvocationDuration(config.MaxInvocationDuration)
+	}
+	if config.MaxRegistrations != 0 {
+		dealer.SetMaxRegistrations(config.MaxRegistrations)
+	}
+	if config.MaxSessionRegistrations != 0 {
+		dealer.SetMaxSessionRegistrations(config.MaxSessionRegistrations)
+	}
+	dealer.SetRequestIDGenerator(r.reqIDGen)
+	dealer.SetRequireDisclosure(config.RequireCallerDisclosure)
+	dealer.SetExemptRoles(config.ExemptRoles)
+	broker := NewBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug)
+	broker.SetExemptRoles(config.ExemptRoles)
+	broker.SetRequestIDGenerator(r.reqIDGen)
+	broker.SetRequireDisclosure(config.RequirePublisherDisclosure)
+	if config.MaxTopicSubscribers != 0 {
+		broker.SetMaxTopicSubscribers(config.MaxTopicSubscribers)
+	}
+	if config.MaxSessionSubscriptions != 0 {
+		broker.SetMaxSessionSubscriptions(config.MaxSessionSubscriptions)
+	}
+	if config.MaxRetainedEvents != 0 {
+		broker.SetMaxRetainedEvents(config.MaxRetainedEvents)
+	}
+	if config.EventHistorySize != 0 {
+		broker.SetEventHistorySize(config.EventHistorySize)
+	}
+	if config.SlowDispatchThreshold != 0 {
+		dealer.SetSlowDispatchThreshold(config.SlowDispatchThreshold)
+		broker.SetSlowDispatchThreshold(config.SlowDispatchThreshold)
+	}
+	if config.EventRetries != 0 {
+		delay := config.EventRetryDelay
+		if delay == 0 {
+			delay = time.Millisecond
+		}
+		broker.SetEventRetries(config.EventRetries, delay)
+	}
+	if err := broker.SetFeatures(config.Features.Broker); err != nil {
+		broker.Close()
+		dealer.Close()
+		return nil, err
+	}
+	if err := dealer.SetFeatures(config.Features.Dealer); err != nil {
+		broker.Close()
+		dealer.Close()
+		return nil, err
+	}
+	realm, err := newRealm(config, broker, dealer, r.log, r.debug)
 	if err != nil {
+		broker.Close()
+		dealer.Close()
 		return nil, err
 	}
+	if config.DisconnectBlockedSubscribers {
+		broker.SetEventDropHandler(realm.dropSubscriber)
+	}
+	realm.routerStarted = r.started
+	if realm.authTimeout == 0 {
+		realm.authTimeout = r.authTimeout
+	}
+	realm.sessIDGen = r.sessIDGen
+	realm.reqIDGen = r.reqIDGen
+	if config.URI == r.adminRealm {
+		realm.listRealms = r.Realms
+	}
+	if r.metrics != nil {
+		realm.metrics = r.metrics
+		broker.SetMetricsRecorder(config.URI, r.metrics)
+		dealer.SetMetricsRecorder(config.URI, r.metrics)
+	}
 	r.realms[config.URI] = realm
+	r.realmsLock.Lock()
+	r.realmURIs[config.URI] = struct{}{}
+	r.realmsLock.Unlock()
 
 	r.waitRealms.Add(1)
 	go func() {
@@ -334,3 +804,15 @@ func (r *router) run() {
 		action()
 	}
 }
+
+// errorDetails returns the details for an ERROR message generated by the
+// router.  When debug is enabled, the details contain a "debug" dictionary
+// holding the supplied diagnostic info, such as the cause of the error, to
+// speed up troubleshooting.  Otherwise, the details are empty so that router
+// internals are not exposed to clients.
+func errorDetails(debug bool, info wamp.Dict) wamp.Dict {
+	if !debug {
+		return wamp.Dict{}
+	}
+	return wamp.Dict{"debug": info}
+}
@@ -1,17 +1,25 @@
 package router
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/wamp"
+	"github.com/gammazero/nexus/wamp/crsign"
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -68,10 +76,14 @@ func newTestRouter() (Router, error) {
 }
 
 func testClient(r Router) (*wamp.Session, error) {
+	return testClientInRealm(r, testRealm)
+}
+
+func testClientInRealm(r Router, realm wamp.URI) (*wamp.Session, error) {
 	client, server := transport.LinkedPeers()
 	// Run as goroutine since Send will block until message read by router, if
 	// client uses unbuffered channel.
-	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	go client.Send(&wamp.Hello{Realm: realm, Details: clientRoles})
 	err := r.Attach(server)
 	if err != nil {
 		return nil, err
@@ -94,6 +106,44 @@ func testClient(r Router) (*wamp.Session, error) {
 	}, nil
 }
 
+// AssertNoGoroutineLeak fails the test if any goroutines running router code,
+// other than the test's own goroutine, are still running.  Call this after
+// Router.Close() to verify that all goroutines started by the router have
+// exited.  Goroutines are given a short time to finish exiting.
+func AssertNoGoroutineLeak(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		leaked := nexusGoroutines()
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, g := range leaked {
+				t.Error("leaked goroutine:", g)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nexusGoroutines returns the stacks of goroutines that are running nexus
+// code, excluding goroutines running tests.
+func nexusGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "testing.tRunner") {
+			continue
+		}
+		if strings.Contains(g, "github.com/gammazero/nexus/") {
+			stacks = append(stacks, g)
+		}
+	}
+	return stacks
+}
+
 func TestHandshake(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
@@ -142,573 +192,1003 @@ func TestHandshakeBadRealm(t *testing.T) {
 	}
 }
 
-func TestRouterSubscribe(t *testing.T) {
+func TestHandshakeBadCRAuth(t *testing.T) {
 	defer leaktest.Check(t)()
-	const testTopic = wamp.URI("some.uri")
-	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			if authid != "jdoe" {
+				return "", errors.New("no such user: " + authid)
+			}
+			return "squeemishosafradge", nil
+		},
 	}
-	defer r.Close()
-
-	sub, err := testClient(r)
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				Authenticators: []auth.Authenticator{
+					auth.NewCRAuthenticator(keyStore, time.Second),
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	subscribeID := wamp.GlobalID()
-	sub.Send(&wamp.Subscribe{Request: subscribeID, Topic: testTopic})
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid":      "jdoe",
+			"authmethods": wamp.List{"wampcra"},
+			"roles":       clientRoles["roles"],
+		},
+	})
+	errChan := make(chan error)
+	go func() { errChan <- r.Attach(server) }()
 
-	var subscriptionID wamp.ID
+	// Respond to CHALLENGE with a signature made using the wrong secret.
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for SUBSCRIBED")
-	case msg := <-sub.Recv():
-		subMsg, ok := msg.(*wamp.Subscribed)
+		t.Fatal("timed out waiting for CHALLENGE")
+	case msg := <-client.Recv():
+		ch, ok := msg.(*wamp.Challenge)
 		if !ok {
-			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+			t.Fatal("expected CHALLENGE, received:", msg.MessageType())
 		}
-		if subMsg.Request != subscribeID {
-			t.Fatal("wrong request ID")
+		if ch.AuthMethod != "wampcra" {
+			t.Fatal("wrong authmethod in CHALLENGE:", ch.AuthMethod)
 		}
-		subscriptionID = subMsg.Subscription
-	}
-
-	pub, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+		if wamp.OptionString(ch.Extra, "challenge") == "" {
+			t.Fatal("missing challenge in CHALLENGE extra")
+		}
+		chStr := wamp.OptionString(ch.Extra, "challenge")
+		go client.Send(&wamp.Authenticate{
+			Signature: crsign.SignChallenge(chStr, []byte("wrong")),
+			Extra:     wamp.Dict{},
+		})
 	}
-	pubID := wamp.GlobalID()
-	pub.Send(&wamp.Publish{Request: pubID, Topic: testTopic})
 
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for EVENT")
-	case msg := <-sub.Recv():
-		event, ok := msg.(*wamp.Event)
+		t.Fatal("timed out waiting for ABORT")
+	case msg := <-client.Recv():
+		abort, ok := msg.(*wamp.Abort)
 		if !ok {
-			t.Fatal("Expected EVENT, got:", msg.MessageType())
+			t.Fatal("expected ABORT, received:", msg.MessageType())
 		}
-		if event.Subscription != subscriptionID {
-			t.Fatal("wrong subscription ID")
+		if abort.Reason != wamp.ErrAuthenticationFailed {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
 		}
 	}
+	if err = <-errChan; err == nil {
+		t.Fatal("expected error from Attach")
+	}
 }
 
-func TestPublishAcknowledge(t *testing.T) {
+func TestAuthTimeout(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
 	}
-	defer r.Close()
-	client, err := testClient(r)
+	const authTimeout = 100 * time.Millisecond
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				Authenticators: []auth.Authenticator{
+					// Per-message timeout is longer than overall timeout.
+					auth.NewCRAuthenticator(keyStore, 5*time.Second),
+				},
+				AuthTimeout: authTimeout,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{
-		Request: id,
-		Options: wamp.Dict{"acknowledge": true},
-		Topic:   "some.uri"})
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid":      "jdoe",
+			"authmethods": wamp.List{"wampcra"},
+			"roles":       clientRoles["roles"],
+		},
+	})
+	attachErr := make(chan error, 1)
+	start := time.Now()
+	go func() { attachErr <- r.Attach(server) }()
 
+	// Stall after receiving the CHALLENGE.
+	if _, ok := (<-client.Recv()).(*wamp.Challenge); !ok {
+		t.Fatal("expected CHALLENGE")
+	}
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("sent acknowledge=true, timed out waiting for PUBLISHED")
+		t.Fatal("authentication did not time out")
 	case msg := <-client.Recv():
-		pub, ok := msg.(*wamp.Published)
+		abort, ok := msg.(*wamp.Abort)
 		if !ok {
-			t.Fatal("sent acknowledge=true, expected PUBLISHED, got:",
-				msg.MessageType())
+			t.Fatal("expected ABORT, got:", msg.MessageType())
 		}
-		if pub.Request != id {
-			t.Fatal("wrong request id")
+		if abort.Reason != wamp.ErrAuthenticationTimeout {
+			t.Fatal("wrong abort reason:", abort.Reason)
 		}
 	}
+	if elapsed := time.Since(start); elapsed < authTimeout {
+		t.Fatal("authentication timed out too soon:", elapsed)
+	}
+	if err = <-attachErr; err == nil {
+		t.Fatal("expected error from Attach")
+	}
 }
 
-func TestPublishFalseAcknowledge(t *testing.T) {
-	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
+func TestRouterAuthTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
 	}
-	defer r.Close()
-	client, err := testClient(r)
+	// The realm does not set a timeout, so the router's is used.
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				Authenticators: []auth.Authenticator{
+					auth.NewTicketAuthenticator(keyStore, 5*time.Second),
+				},
+			},
+		},
+		AuthTimeout: 100 * time.Millisecond,
+		Debug:       debug,
+	}
+	r, err := NewRouter(config, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{
-		Request: id,
-		Options: wamp.Dict{"acknowledge": false},
-		Topic:   "some.uri"})
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authid":      "jdoe",
+			"authmethods": wamp.List{"ticket"},
+			"roles":       clientRoles["roles"],
+		},
+	})
+	attachErr := make(chan error, 1)
+	go func() { attachErr <- r.Attach(server) }()
 
+	if _, ok := (<-client.Recv()).(*wamp.Challenge); !ok {
+		t.Fatal("expected CHALLENGE")
+	}
 	select {
-	case <-time.After(200 * time.Millisecond):
+	case <-time.After(time.Second):
+		t.Fatal("authentication did not time out")
 	case msg := <-client.Recv():
-		if _, ok := msg.(*wamp.Published); ok {
-			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
-				msg.MessageType())
+		abort, ok := msg.(*wamp.Abort)
+		if !ok || abort.Reason != wamp.ErrAuthenticationTimeout {
+			t.Fatal("expected authentication timeout ABORT, got:", msg)
 		}
 	}
-}
-
-func TestPublishNoAcknowledge(t *testing.T) {
-	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
-	}
-	defer r.Close()
-	client, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+	if err = <-attachErr; err == nil {
+		t.Fatal("expected error from Attach")
 	}
-
-	id := wamp.GlobalID()
-	client.Send(&wamp.Publish{Request: id, Topic: "some.uri"})
+	// The transport is closed.
 	select {
-	case <-time.After(200 * time.Millisecond):
-	case msg := <-client.Recv():
-		if _, ok := msg.(*wamp.Published); ok {
-			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
-				msg.MessageType())
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	case _, open := <-client.Recv():
+		if open {
+			t.Fatal("unexpected message after ABORT")
 		}
 	}
 }
 
-func TestRouterCall(t *testing.T) {
+func TestHelloTimeout(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
-	if err != nil {
-		t.Error(err)
-	}
-	defer r.Close()
-	callee, err := testClient(r)
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		HelloTimeout: 100 * time.Millisecond,
+		Debug:        debug,
+	}, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer r.Close()
 
-	registerID := wamp.GlobalID()
-	// Register remote procedure
-	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+	// The client never sends HELLO.
+	client, server := transport.LinkedPeers()
+	defer client.Close()
+	attachErr := make(chan error, 1)
+	go func() { attachErr <- r.Attach(server) }()
 
-	var registrationID wamp.ID
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for REGISTERED")
-	case msg := <-callee.Recv():
-		registered, ok := msg.(*wamp.Registered)
-		if !ok {
-			t.Fatal("expected REGISTERED,got:", msg.MessageType())
+		t.Fatal("Attach did not time out")
+	case err = <-attachErr:
+		if err == nil {
+			t.Fatal("expected error from Attach")
 		}
-		if registered.Request != registerID {
-			t.Fatal("wrong request ID")
+	}
+	// The transport is closed.
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	case _, open := <-client.Recv():
+		if open {
+			t.Fatal("unexpected message before HELLO")
 		}
-		registrationID = registered.Registration
 	}
+}
 
-	caller, err := testClient(r)
+// twoFactorAuth is a MultiChallengeAuthenticator that requires a password, and
+// then a one-time code, before welcoming a client.
+type twoFactorAuth struct{}
+
+func (twoFactorAuth) AuthMethod() string { return "twofactor" }
+
+func (a twoFactorAuth) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	challenges, err := a.Challenges(sid, details)
 	if err != nil {
-		t.Fatal("Error connecting caller:", err)
+		return nil, err
 	}
-	callID := wamp.GlobalID()
-	// Call remote procedure
-	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	return auth.ExchangeChallenges(challenges, client, time.Second, 0)
+}
 
-	var invocationID wamp.ID
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
-	case msg := <-callee.Recv():
-		invocation, ok := msg.(*wamp.Invocation)
-		if !ok {
-			t.Fatal("expected INVOCATION, got:", msg.MessageType())
-		}
-		if invocation.Registration != registrationID {
-			t.Fatal("wrong registration id")
-		}
-		invocationID = invocation.Request
-	}
+func (twoFactorAuth) Challenges(sid wamp.ID, details wamp.Dict) (auth.Challenges, error) {
+	return &twoFactorChallenges{authid: wamp.OptionString(details, "authid")}, nil
+}
 
-	// Returns result of remove procedure
-	callee.Send(&wamp.Yield{Request: invocationID})
+type twoFactorChallenges struct {
+	authid string
+	step   int
+}
 
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok := msg.(*wamp.Result)
-		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
+func (c *twoFactorChallenges) Next(rsp *wamp.Authenticate) (*wamp.Challenge, *wamp.Welcome, error) {
+	switch c.step {
+	case 1:
+		if rsp.Signature != "password" {
+			return nil, nil, errors.New("wrong password")
 		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+	case 2:
+		if rsp.Signature != "123456" {
+			return nil, nil, errors.New("wrong code")
 		}
+		return nil, &wamp.Welcome{Details: wamp.Dict{
+			"authid":   c.authid,
+			"authrole": "user",
+		}}, nil
 	}
+	c.step++
+	return &wamp.Challenge{
+		AuthMethod: "twofactor",
+		Extra:      wamp.Dict{"step": c.step},
+	}, nil, nil
 }
 
-func TestSessionMetaProcedures(t *testing.T) {
+func TestMultipleChallenges(t *testing.T) {
 	defer leaktest.Check(t)()
-	r, err := newTestRouter()
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				Authenticators: []auth.Authenticator{twoFactorAuth{}},
+			},
+			{
+				URI:               "nexus.test.onechallenge",
+				Authenticators:    []auth.Authenticator{twoFactorAuth{}},
+				MaxAuthChallenges: 1,
+			},
+		},
+		Debug: debug,
+	}, logger)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
-	if err != nil {
-		t.Fatal(err)
+	// join answers each CHALLENGE with the next signature, and returns the
+	// first message that is not a CHALLENGE.
+	join := func(realm wamp.URI, signatures ...string) wamp.Message {
+		client, server := transport.LinkedPeers()
+		defer client.Close()
+		go client.Send(&wamp.Hello{
+			Realm: realm,
+			Details: wamp.Dict{
+				"authid":      "jdoe",
+				"authmethods": wamp.List{"twofactor"},
+				"roles":       clientRoles["roles"],
+			},
+		})
+		go r.Attach(server)
+		for {
+			var msg wamp.Message
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for message")
+			case msg = <-client.Recv():
+			}
+			if _, ok := msg.(*wamp.Challenge); !ok || len(signatures) == 0 {
+				return msg
+			}
+			client.Send(&wamp.Authenticate{Signature: signatures[0], Extra: wamp.Dict{}})
+			signatures = signatures[1:]
+		}
 	}
-	sessID := caller.ID
-	var result *wamp.Result
-	var ok bool
 
-	// Call session meta-procedure to get session count.
-	callID := wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSessionCount})
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
-		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
-		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
-		}
+	welcome, ok := join(testRealm, "password", "123456").(*wamp.Welcome)
+	if !ok {
+		t.Fatal("expected WELCOME after two challenges")
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	if wamp.OptionString(welcome.Details, "authmethod") != "twofactor" {
+		t.Fatal("wrong authmethod:", welcome.Details)
 	}
-	count, ok := result.Arguments[0].(int)
-	if !ok {
-		t.Fatal("expected int arguemnt")
+
+	abort, ok := join(testRealm, "password", "654321").(*wamp.Abort)
+	if !ok || abort.Reason != wamp.ErrAuthenticationFailed {
+		t.Fatal("expected ABORT for wrong code")
 	}
-	if count != 1 {
-		t.Fatal("wrong session count")
+
+	// The second challenge is not sent in a realm that allows only one.
+	abort, ok = join("nexus.test.onechallenge", "password", "123456").(*wamp.Abort)
+	if !ok || abort.Reason != wamp.ErrAuthenticationFailed {
+		t.Fatal("expected ABORT after too many challenges")
 	}
+}
 
-	// Call session meta-procedure to get session list.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSessionList})
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
-		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
+func TestSingleSessionPerAuthID(t *testing.T) {
+	defer leaktest.Check(t)()
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
+	}
+	for _, policy := range []string{AuthIDConflictReject, AuthIDConflictReplace} {
+		config := &RouterConfig{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI: testRealm,
+					Authenticators: []auth.Authenticator{
+						auth.NewTicketAuthenticator(keyStore, time.Second),
+					},
+					SingleSessionPerAuthID: true,
+					AuthIDConflictPolicy:   policy,
+				},
+			},
+			Debug: debug,
 		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+		r, err := NewRouter(config, logger)
+		if err != nil {
+			t.Fatal(err)
 		}
+
+		// join authenticates a session with the given authid, and returns
+		// the client and the router's response to the authentication.
+		join := func(authid string) (wamp.Peer, wamp.Message) {
+			client, server := transport.LinkedPeers()
+			go client.Send(&wamp.Hello{
+				Realm: testRealm,
+				Details: wamp.Dict{
+					"authid":      authid,
+					"authmethods": wamp.List{"ticket"},
+					"roles":       clientRoles["roles"],
+				},
+			})
+			go r.Attach(server)
+			if _, ok := (<-client.Recv()).(*wamp.Challenge); !ok {
+				t.Fatal("expected CHALLENGE")
+			}
+			client.Send(&wamp.Authenticate{Signature: "squeemishosafradge"})
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for response to AUTHENTICATE")
+			case msg := <-client.Recv():
+				return client, msg
+			}
+			return nil, nil
+		}
+
+		client1, msg := join("jdoe")
+		if _, ok := msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, got:", msg.MessageType())
+		}
+		// A different authid is not affected.
+		client2, msg := join("alice")
+		if _, ok := msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, got:", msg.MessageType())
+		}
+
+		client3, msg := join("jdoe")
+		switch policy {
+		case AuthIDConflictReject:
+			abort, ok := msg.(*wamp.Abort)
+			if !ok {
+				t.Fatal("expected ABORT, got:", msg.MessageType())
+			}
+			if abort.Reason != wamp.ErrNotAuthorized {
+				t.Fatal("wrong abort reason:", abort.Reason)
+			}
+			client3.Close()
+			// The existing session is still attached.
+			select {
+			case msg = <-client1.Recv():
+				t.Fatal("existing session got unexpected", msg.MessageType())
+			default:
+			}
+			client1.Send(&wamp.Goodbye{})
+			if _, ok = (<-client1.Recv()).(*wamp.Goodbye); !ok {
+				t.Fatal("expected GOODBYE")
+			}
+		case AuthIDConflictReplace:
+			if _, ok := msg.(*wamp.Welcome); !ok {
+				t.Fatal("expected WELCOME, got:", msg.MessageType())
+			}
+			// The existing session is killed.
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("existing session not killed")
+			case msg = <-client1.Recv():
+				goodbye, ok := msg.(*wamp.Goodbye)
+				if !ok {
+					t.Fatal("expected GOODBYE, got:", msg.MessageType())
+				}
+				if goodbye.Reason != wamp.ErrSessionKilled {
+					t.Fatal("wrong goodbye reason:", goodbye.Reason)
+				}
+			}
+			client3.Close()
+		}
+		client1.Close()
+		client2.Close()
+		r.Close()
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
-	}
-	ids, ok := result.Arguments[0].([]wamp.ID)
-	if !ok {
-		t.Fatal("wrong arg type")
+}
+
+func TestAuthenticatorPriority(t *testing.T) {
+	defer leaktest.Check(t)()
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
 	}
-	if len(ids) != count {
-		t.Fatal("wrong number of session IDs")
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authenticators: []auth.Authenticator{
+					auth.NewTicketAuthenticator(keyStore, time.Second),
+					auth.NewCRAuthenticator(keyStore, time.Second),
+				},
+			},
+		},
+		Debug: debug,
 	}
-	if sessID != ids[0] {
-		t.Fatal("wrong session ID")
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer r.Close()
 
-	// Call session meta-procedure with bad session ID
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSessionGet,
-		Arguments: wamp.List{wamp.ID(123456789)},
-	})
-	var errRsp *wamp.Error
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		errRsp, ok = msg.(*wamp.Error)
-		if !ok {
-			t.Fatal("expected ERROR, got", msg.MessageType())
-		}
-		if errRsp.Error != wamp.ErrNoSuchSession {
-			t.Fatal("wrong error value")
+	// helloRsp sends HELLO offering the given authmethods, and returns the
+	// router's first response.
+	helloRsp := func(authmethods ...interface{}) wamp.Message {
+		client, server := transport.LinkedPeers()
+		defer client.Close()
+		go client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authid":      "jdoe",
+				"authmethods": wamp.List(authmethods),
+				"roles":       clientRoles["roles"],
+			},
+		})
+		go r.Attach(server)
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for response to HELLO")
+		case msg := <-client.Recv():
+			if ch, ok := msg.(*wamp.Challenge); ok {
+				// Fail the authentication so that Attach returns.
+				client.Send(&wamp.Authenticate{Signature: "bad"})
+				<-client.Recv()
+				return ch
+			}
+			return msg
 		}
+		return nil
 	}
 
-	// Call session meta-procedure to get session get.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcSessionGet,
-		Arguments: wamp.List{sessID},
-	})
-	select {
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
-		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
-		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
-		}
+	// The realm's order is used, not the order offered by the client.
+	msg := helloRsp("anonymous", "wampcra", "ticket")
+	if ch, ok := msg.(*wamp.Challenge); !ok || ch.AuthMethod != "ticket" {
+		t.Fatal("expected ticket CHALLENGE, got:", msg)
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+	msg = helloRsp("anonymous", "wampcra")
+	if ch, ok := msg.(*wamp.Challenge); !ok || ch.AuthMethod != "wampcra" {
+		t.Fatal("expected wampcra CHALLENGE, got:", msg)
 	}
-	dict, ok := result.Arguments[0].(wamp.Dict)
+	// Anonymous auth is the lowest priority default.
+	msg = helloRsp("anonymous")
+	welcome, ok := msg.(*wamp.Welcome)
 	if !ok {
-		t.Fatal("expected dict type arg")
+		t.Fatal("expected WELCOME, got:", msg.MessageType())
 	}
-	sid := wamp.ID(wamp.OptionInt64(dict, "session"))
-	if sid != sessID {
-		t.Fatal("wrong session ID")
+	if wamp.OptionString(welcome.Details, "authmethod") != "anonymous" {
+		t.Fatal("wrong authmethod in WELCOME")
 	}
 }
 
-func TestRegistrationMetaProcedures(t *testing.T) {
+func TestRouterSubscribe(t *testing.T) {
 	defer leaktest.Check(t)()
+	const testTopic = wamp.URI("some.uri")
 	r, err := newTestRouter()
 	if err != nil {
 		t.Error(err)
 	}
 	defer r.Close()
 
-	caller, err := testClient(r)
+	sub, err := testClient(r)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sessID := caller.ID
-	var result *wamp.Result
-	var ok bool
 
-	// ----- Test wamp.registration.list meta procedure -----
-	callID := wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	subscribeID := wamp.GlobalID()
+	sub.Send(&wamp.Subscribe{Request: subscribeID, Topic: testTopic})
+
+	var subscriptionID wamp.ID
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	case msg := <-sub.Recv():
+		subMsg, ok := msg.(*wamp.Subscribed)
 		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
 		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+		if subMsg.Request != subscribeID {
+			t.Fatal("wrong request ID")
 		}
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
-	}
-	dict, ok := result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
-	}
-	exactPrev, ok := dict["exact"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
-	}
-	prefixPrev, ok := dict["prefix"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
-	}
-	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
-	if !ok {
-		t.Fatal("expected []wamp.ID")
+		subscriptionID = subMsg.Subscription
 	}
 
-	callee, err := testClient(r)
+	pub, err := testClient(r)
 	if err != nil {
-		t.Fatal("Error connecting client:", err)
+		t.Fatal(err)
 	}
-	sessID = callee.ID
-	// Register remote procedure
-	registerID := wamp.GlobalID()
-	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+	pubID := wamp.GlobalID()
+	pub.Send(&wamp.Publish{Request: pubID, Topic: testTopic})
 
-	var registrationID wamp.ID
-	var registered *wamp.Registered
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for REGISTERED")
-	case msg := <-callee.Recv():
-		registered, ok = msg.(*wamp.Registered)
+		t.Fatal("Timed out waiting for EVENT")
+	case msg := <-sub.Recv():
+		event, ok := msg.(*wamp.Event)
 		if !ok {
-			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+			t.Fatal("Expected EVENT, got:", msg.MessageType())
 		}
-		if registered.Request != registerID {
-			t.Fatal("wrong request ID")
+		if event.Subscription != subscriptionID {
+			t.Fatal("wrong subscription ID")
 		}
-		registrationID = registered.Registration
 	}
+}
 
-	// Register remote procedure
-	callee.Send(&wamp.Register{
-		Request:   wamp.GlobalID(),
-		Procedure: testProcedureWC,
-		Options:   wamp.Dict{"match": "wildcard"},
-	})
-	msg := <-callee.Recv()
-	if _, ok = msg.(*wamp.Registered); !ok {
-		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+func TestURICanonicalizer(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				URICanonicalizer: func(uri wamp.URI) wamp.URI {
+					return wamp.URI(strings.ToLower(string(uri)))
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer r.Close()
 
-	// Call session meta-procedure to get session count.
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribeID := wamp.GlobalID()
+	sub.Send(&wamp.Subscribe{Request: subscribeID, Topic: "Nexus.Test.Topic"})
+	var subscriptionID wamp.ID
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	case msg := <-sub.Recv():
+		subMsg, ok := msg.(*wamp.Subscribed)
 		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
-		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
 		}
-	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
-	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
-	}
-	exact := dict["exact"].([]wamp.ID)
-	prefix := dict["prefix"].([]wamp.ID)
-	wildcard := dict["wildcard"].([]wamp.ID)
-
-	if len(exact) != len(exactPrev)+1 {
-		t.Fatal("expected additional exact match")
-	}
-	if len(prefix) != len(prefixPrev) {
-		t.Fatal("prefix matches should not have changed")
-	}
-	if len(wildcard) != len(wildcardPrev)+1 {
-		t.Fatal("wildcard matches should not have changed")
+		subscriptionID = subMsg.Subscription
 	}
 
-	var found bool
-	for i := range exact {
-		if exact[i] == registrationID {
-			found = true
-			break
-		}
-	}
-	if !found {
-		t.Fatal("missing expected registration ID")
+	// Publish to the same topic with different case.
+	pub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// ----- Test wamp.registration.lookup meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegLookup,
-		Arguments: wamp.List{testProcedure},
-	})
+	pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: "nexus.TEST.topic"})
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
+		t.Fatal("Timed out waiting for EVENT")
+	case msg := <-sub.Recv():
+		event, ok := msg.(*wamp.Event)
 		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
+			t.Fatal("Expected EVENT, got:", msg.MessageType())
 		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+		if event.Subscription != subscriptionID {
+			t.Fatal("wrong subscription ID")
 		}
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+}
+
+func TestStrictURI(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ack := wamp.Dict{wamp.OptAcknowledge: true}
+	wildcard := wamp.Dict{wamp.OptMatch: wamp.MatchWildcard}
+	prefix := wamp.Dict{wamp.OptMatch: wamp.MatchPrefix}
+	tests := []struct {
+		msg         wamp.Message
+		strictValid bool
+		looseValid  bool
+	}{
+		{&wamp.Subscribe{Topic: "nexus.test.topic"}, true, true},
+		{&wamp.Subscribe{Topic: "Nexus.Test.Topic"}, false, true},
+		{&wamp.Subscribe{Topic: "nexus..topic"}, false, false},
+		{&wamp.Subscribe{Topic: "nexus..topic", Options: wildcard}, true, true},
+		{&wamp.Subscribe{Topic: "nexus.test.", Options: prefix}, true, true},
+		{&wamp.Subscribe{Topic: "nexus..test", Options: prefix}, false, false},
+		{&wamp.Subscribe{Topic: "nexus.te st.", Options: wildcard}, false, false},
+		{&wamp.Publish{Topic: "nexus.test.topic", Options: ack}, true, true},
+		{&wamp.Publish{Topic: "nexus.Test", Options: ack}, false, true},
+		{&wamp.Publish{Topic: "nexus..topic", Options: ack}, false, false},
+		{&wamp.Register{Procedure: "nexus.test.proc"}, true, true},
+		{&wamp.Register{Procedure: "nexus.test.Proc"}, false, true},
+		{&wamp.Register{Procedure: "nexus..proc"}, false, false},
+		{&wamp.Register{Procedure: "nexus..proc", Options: wildcard}, true, true},
+		{&wamp.Register{Procedure: "nexus#proc.", Options: prefix}, false, false},
+		{&wamp.Call{Procedure: "nexus.test.call"}, true, true},
+		{&wamp.Call{Procedure: "nexus.test.Call"}, false, true},
+		{&wamp.Call{Procedure: "nexus.test..call"}, false, false},
+		{&wamp.Call{Procedure: ""}, false, false},
 	}
-	regID, ok := result.Arguments[0].(wamp.ID)
-	if !ok {
-		t.Fatal("expected wamp.ID")
+
+	for _, strict := range []bool{true, false} {
+		config := &RouterConfig{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:           testRealm,
+					StrictURI:     strict,
+					AnonymousAuth: true,
+				},
+			},
+			Debug: debug,
+		}
+		r, err := NewRouter(config, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, tc := range tests {
+			reqID := wamp.ID(i + 1)
+			switch msg := tc.msg.(type) {
+			case *wamp.Subscribe:
+				msg.Request = reqID
+			case *wamp.Publish:
+				msg.Request = reqID
+			case *wamp.Register:
+				msg.Request = reqID
+			case *wamp.Call:
+				msg.Request = reqID
+			}
+			valid := tc.looseValid
+			if strict {
+				valid = tc.strictValid
+			}
+			client.Send(tc.msg)
+			var rsp wamp.Message
+			select {
+			case rsp = <-client.Recv():
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for response")
+			}
+			errMsg, isErr := rsp.(*wamp.Error)
+			invalid := isErr && errMsg.Error == wamp.ErrInvalidURI
+			if invalid == valid {
+				t.Errorf("strict=%v: %v got %v, expected valid=%v",
+					strict, tc.msg, rsp.MessageType(), valid)
+			}
+		}
+		r.Close()
 	}
-	if regID != registrationID {
-		t.Fatal("received wrong registration ID")
+}
+
+func TestPublishAcknowledge(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// ----- Test wamp.registration.match meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegMatch,
-		Arguments: wamp.List{testProcedure},
-	})
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{
+		Request: id,
+		Options: wamp.Dict{"acknowledge": true},
+		Topic:   "some.uri"})
+
 	select {
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
+		t.Fatal("sent acknowledge=true, timed out waiting for PUBLISHED")
+	case msg := <-client.Recv():
+		pub, ok := msg.(*wamp.Published)
 		if !ok {
-			t.Fatal("expected RESULT, got", msg.MessageType())
+			t.Fatal("sent acknowledge=true, expected PUBLISHED, got:",
+				msg.MessageType())
 		}
-		if result.Request != callID {
-			t.Fatal("wrong result ID")
+		if pub.Request != id {
+			t.Fatal("wrong request id")
 		}
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+}
+
+func TestPublishFalseAcknowledge(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
 	}
-	regID, ok = wamp.AsID(result.Arguments[0])
-	if !ok {
-		t.Fatal("expected wamp.ID")
+	defer r.Close()
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if regID != registrationID {
-		t.Fatal("received wrong registration ID")
+
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{
+		Request: id,
+		Options: wamp.Dict{"acknowledge": false},
+		Topic:   "some.uri"})
+
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case msg := <-client.Recv():
+		if _, ok := msg.(*wamp.Published); ok {
+			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
+				msg.MessageType())
+		}
 	}
+}
+
+func TestPublishNoAcknowledge(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := wamp.GlobalID()
+	client.Send(&wamp.Publish{Request: id, Topic: "some.uri"})
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case msg := <-client.Recv():
+		if _, ok := msg.(*wamp.Published); ok {
+			t.Fatal("Sent acknowledge=false, but received PUBLISHED:",
+				msg.MessageType())
+		}
+	}
+}
+
+func TestRouterCall(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registerID := wamp.GlobalID()
+	// Register remote procedure
+	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+
+	var registrationID wamp.ID
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		registered, ok := msg.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED,got:", msg.MessageType())
+		}
+		if registered.Request != registerID {
+			t.Fatal("wrong request ID")
+		}
+		registrationID = registered.Registration
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting caller:", err)
+	}
+	callID := wamp.GlobalID()
+	// Call remote procedure
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+
+	var invocationID wamp.ID
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	case msg := <-callee.Recv():
+		invocation, ok := msg.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", msg.MessageType())
+		}
+		if invocation.Registration != registrationID {
+			t.Fatal("wrong registration id")
+		}
+		invocationID = invocation.Request
+	}
+
+	// Returns result of remove procedure
+	callee.Send(&wamp.Yield{Request: invocationID})
 
-	// ----- Test wamp.registration.get meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegGet,
-		Arguments: wamp.List{registrationID},
-	})
 	select {
 	case <-time.After(time.Second):
 		t.Fatal("Timed out waiting for RESULT")
 	case msg := <-caller.Recv():
-		result, ok = msg.(*wamp.Result)
+		result, ok := msg.(*wamp.Result)
 		if !ok {
-			t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
+			t.Fatal("expected RESULT, got", msg.MessageType())
 		}
 		if result.Request != callID {
 			t.Fatal("wrong result ID")
 		}
 	}
-	if len(result.Arguments) == 0 {
-		t.Fatal("missing expected arguemnt")
+}
+
+func TestRouterCallError(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
 	}
-	dict, ok = result.Arguments[0].(wamp.Dict)
-	if !ok {
-		t.Fatal("expected wamp.Dict")
+	defer r.Close()
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	regID = wamp.OptionID(dict, "id")
-	if regID != registrationID {
-		t.Fatal("received wrong registration")
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
 	}
-	uri := wamp.OptionURI(dict, "uri")
-	if uri != testProcedure {
-		t.Fatal("registration has wrong uri:", uri)
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting caller:", err)
 	}
 
-	// ----- Test wamp.registration.list_callees meta procedure -----
-	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegListCallees,
-		Arguments: wamp.List{registrationID},
-	})
+	const errURI = wamp.URI("com.example.error.out_of_stock")
+	for _, details := range []wamp.Dict{{"retry_after": 30}, nil} {
+		callID := wamp.GlobalID()
+		caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+
+		var invocationID wamp.ID
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for INVOCATION")
+		case msg := <-callee.Recv():
+			invocation, ok := msg.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", msg.MessageType())
+			}
+			invocationID = invocation.Request
+		}
+
+		// Callee returns an error with arguments.
+		callee.Send(&wamp.Error{
+			Type:        wamp.INVOCATION,
+			Request:     invocationID,
+			Details:     details,
+			Error:       errURI,
+			Arguments:   wamp.List{"widget", 0},
+			ArgumentsKw: wamp.Dict{"sku": "w-100", "backorder": true},
+		})
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for ERROR")
+		case msg := <-caller.Recv():
+			errMsg, ok := msg.(*wamp.Error)
+			if !ok {
+				t.Fatal("expected ERROR, got", msg.MessageType())
+			}
+			if errMsg.Type != wamp.CALL {
+				t.Fatal("wrong ERROR type:", errMsg.Type)
+			}
+			if errMsg.Request != callID {
+				t.Fatal("wrong request ID")
+			}
+			if errMsg.Error != errURI {
+				t.Fatal("wrong error URI:", errMsg.Error)
+			}
+			if len(errMsg.Arguments) != 2 || errMsg.Arguments[0] != "widget" || errMsg.Arguments[1] != 0 {
+				t.Fatal("wrong error arguments:", errMsg.Arguments)
+			}
+			if len(errMsg.ArgumentsKw) != 2 || errMsg.ArgumentsKw["sku"] != "w-100" || errMsg.ArgumentsKw["backorder"] != true {
+				t.Fatal("wrong error keyword arguments:", errMsg.ArgumentsKw)
+			}
+			if errMsg.Details == nil {
+				t.Fatal("ERROR has nil details")
+			}
+			if len(errMsg.Details) != len(details) || (details != nil && errMsg.Details["retry_after"] != 30) {
+				t.Fatal("wrong error details:", errMsg.Details)
+			}
+		}
+	}
+}
+
+func TestSessionMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+	var result *wamp.Result
+	var ok bool
+
+	// Call session meta-procedure to get session count.
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSessionCount})
 	select {
 	case <-time.After(time.Second):
 		t.Fatal("Timed out waiting for RESULT")
@@ -724,24 +1204,17 @@ func TestRegistrationMetaProcedures(t *testing.T) {
 	if len(result.Arguments) == 0 {
 		t.Fatal("missing expected arguemnt")
 	}
-	idList, ok := result.Arguments[0].([]wamp.ID)
+	count, ok := result.Arguments[0].(int)
 	if !ok {
-		t.Fatal("Expected []wamp.ID")
-	}
-	if len(idList) != 1 {
-		t.Fatal("Expected 1 callee in list")
+		t.Fatal("expected int arguemnt")
 	}
-	if idList[0] != sessID {
-		t.Fatal("Wrong callee session ID")
+	if count != 1 {
+		t.Fatal("wrong session count")
 	}
 
-	// ----- Test wamp.registration.list_callees meta procedure -----
+	// Call session meta-procedure to get session list.
 	callID = wamp.GlobalID()
-	caller.Send(&wamp.Call{
-		Request:   callID,
-		Procedure: wamp.MetaProcRegCountCallees,
-		Arguments: wamp.List{registrationID},
-	})
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcSessionList})
 	select {
 	case <-time.After(time.Second):
 		t.Fatal("Timed out waiting for RESULT")
@@ -757,11 +1230,4263 @@ func TestRegistrationMetaProcedures(t *testing.T) {
 	if len(result.Arguments) == 0 {
 		t.Fatal("missing expected arguemnt")
 	}
-	count, ok := wamp.AsInt64(result.Arguments[0])
+	ids, ok := result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("wrong arg type")
+	}
+	if len(ids) != count {
+		t.Fatal("wrong number of session IDs")
+	}
+	if sessID != ids[0] {
+		t.Fatal("wrong session ID")
+	}
+
+	// Call session meta-procedure with bad session ID
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{wamp.ID(123456789)},
+	})
+	var errRsp *wamp.Error
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		errRsp, ok = msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got", msg.MessageType())
+		}
+		if errRsp.Error != wamp.ErrNoSuchSession {
+			t.Fatal("wrong error value")
+		}
+	}
+
+	// Call session meta-procedure to get session get.
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{sessID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected dict type arg")
+	}
+	sid := wamp.ID(wamp.OptionInt64(dict, "session"))
+	if sid != sessID {
+		t.Fatal("wrong session ID")
+	}
+	if _, ok = dict["authid"].(string); !ok {
+		t.Fatal("missing authid")
+	}
+	for k, v := range map[string]string{
+		"authrole":     "anonymous",
+		"authmethod":   "anonymous",
+		"authprovider": "static",
+	} {
+		if s, ok := dict[k].(string); !ok || s != v {
+			t.Fatalf("wrong %s: %v", k, dict[k])
+		}
+	}
+	// The session is attached within the process.
+	if tt, _ := wamp.DictValue(dict, []string{"transport", "type"}); tt != "internal" {
+		t.Fatal("expected internal transport, got", tt)
+	}
+	if _, err = wamp.DictValue(dict, []string{"roles", "caller"}); err != nil {
+		t.Fatal("missing caller role:", err)
+	}
+}
+
+func TestSessionKill(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callKill := func(args wamp.List, kwargs wamp.Dict) wamp.Message {
+		caller.Send(&wamp.Call{
+			Request:     wamp.GlobalID(),
+			Procedure:   wamp.MetaProcSessionKill,
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-caller.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	// Killing a nonexistent session is an error.
+	msg := callKill(wamp.List{wamp.GlobalID()}, nil)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSession {
+		t.Fatal("expected", wamp.ErrNoSuchSession, "got:", msg)
+	}
+
+	// Caller cannot kill itself without "self" flag.
+	msg = callKill(wamp.List{caller.ID}, nil)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", msg)
+	}
+
+	// Kill other session, with reason and message.
+	const reason = wamp.URI("test.kill.reason")
+	msg = callKill(wamp.List{victim.ID},
+		wamp.Dict{"reason": reason, "message": "go away"})
+	if _, ok := msg.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", msg.MessageType())
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for GOODBYE")
+	case msg = <-victim.Recv():
+		goodbye, ok := msg.(*wamp.Goodbye)
+		if !ok {
+			t.Fatal("expected GOODBYE, got:", msg.MessageType())
+		}
+		if goodbye.Reason != reason {
+			t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+		}
+		if wamp.OptionString(goodbye.Details, "message") != "go away" {
+			t.Fatal("wrong GOODBYE message")
+		}
+	}
+	// Killed session's transport is closed.
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for transport to close")
+	case _, open := <-victim.Recv():
+		if open {
+			t.Fatal("expected killed session transport to be closed")
+		}
+	}
+
+	// Caller can kill itself with "self" flag.
+	msg = callKill(wamp.List{caller.ID}, wamp.Dict{"self": true})
+	for msg.MessageType() != wamp.GOODBYE {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for GOODBYE")
+		case msg = <-caller.Recv():
+		}
+	}
+	if msg.(*wamp.Goodbye).Reason != wamp.ErrSessionKilled {
+		t.Fatal("wrong GOODBYE reason")
+	}
+}
+
+func TestSessionKillByAuth(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(proc wamp.URI, args wamp.List, kwargs wamp.Dict) *wamp.Result {
+		caller.Send(&wamp.Call{
+			Request:     wamp.GlobalID(),
+			Procedure:   proc,
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for RESULT")
+		case msg := <-caller.Recv():
+			result, ok := msg.(*wamp.Result)
+			if !ok {
+				t.Fatal("expected RESULT, got:", msg.MessageType())
+			}
+			return result
+		}
+		return nil
+	}
+	checkKilled := func(sess *wamp.Session, reason wamp.URI) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for GOODBYE")
+		case msg := <-sess.Recv():
+			goodbye, ok := msg.(*wamp.Goodbye)
+			if !ok {
+				t.Fatal("expected GOODBYE, got:", msg.MessageType())
+			}
+			if goodbye.Reason != reason {
+				t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+			}
+		}
+	}
+
+	// Kill session by authid.
+	victim, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := call(wamp.MetaProcSessionGet, wamp.List{victim.ID}, nil)
+	details, _ := wamp.AsDict(result.Arguments[0])
+	authid := wamp.OptionString(details, "authid")
+	authrole := wamp.OptionString(details, "authrole")
+	result = call(wamp.MetaProcSessionKillByAuthid, wamp.List{authid}, nil)
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != 1 {
+		t.Fatal("expected 1 session killed, got", n)
+	}
+	checkKilled(victim, wamp.ErrSessionKilled)
+
+	// Kill all sessions with the same authrole, except the caller.
+	const reason = wamp.URI("test.kill.reason")
+	victims := make([]*wamp.Session, 3)
+	for i := range victims {
+		if victims[i], err = testClient(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result = call(wamp.MetaProcSessionKillByAuthrole, wamp.List{authrole},
+		wamp.Dict{"reason": reason})
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != int64(len(victims)) {
+		t.Fatal("expected", len(victims), "sessions killed, got", n)
+	}
+	for _, sess := range victims {
+		checkKilled(sess, reason)
+	}
+
+	// Only the caller remains, once killed sessions have left.
+	for i := 0; ; i++ {
+		result = call(wamp.MetaProcSessionCount, nil, nil)
+		n, _ := wamp.AsInt64(result.Arguments[0])
+		if n == 1 {
+			break
+		}
+		if i == 20 {
+			t.Fatal("expected 1 remaining session, got", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTestaments(t *testing.T) {
+	defer leaktest.Check(t)()
+	const willTopic = wamp.URI("nexus.test.will")
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscriber, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: willTopic})
+	if msg := <-subscriber.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	call := func(sess *wamp.Session, proc wamp.URI, args wamp.List, kwargs wamp.Dict) *wamp.Result {
+		sess.Send(&wamp.Call{
+			Request:     wamp.GlobalID(),
+			Procedure:   proc,
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for RESULT")
+		case msg := <-sess.Recv():
+			result, ok := msg.(*wamp.Result)
+			if !ok {
+				t.Fatal("expected RESULT, got:", msg.MessageType())
+			}
+			return result
+		}
+		return nil
+	}
+
+	// Testaments are published when the session is lost.
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(client, wamp.MetaProcSessionAddTestament,
+		wamp.List{willTopic, wamp.List{"destroyed"}, wamp.Dict{"who": "client"}},
+		nil)
+	call(client, wamp.MetaProcSessionAddTestament,
+		wamp.List{willTopic, wamp.List{"detached"}},
+		wamp.Dict{"scope": "detached"})
+	client.Close()
+
+	for _, expect := range []string{"detached", "destroyed"} {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for testament EVENT")
+		case msg := <-subscriber.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got:", msg.MessageType())
+			}
+			if len(event.Arguments) != 1 || event.Arguments[0] != expect {
+				t.Fatal("expected", expect, "testament, got", event.Arguments)
+			}
+			if expect == "destroyed" && event.ArgumentsKw["who"] != "client" {
+				t.Fatal("testament missing kwargs")
+			}
+		}
+	}
+
+	// Flushed testaments are not published.
+	client, err = testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(client, wamp.MetaProcSessionAddTestament, wamp.List{willTopic}, nil)
+	result := call(client, wamp.MetaProcSessionFlushTestaments, nil, nil)
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != 1 {
+		t.Fatal("expected 1 testament flushed, got", n)
+	}
+	client.Send(&wamp.Goodbye{Reason: wamp.ErrCloseRealm, Details: wamp.Dict{}})
+	select {
+	case msg := <-subscriber.Recv():
+		t.Fatal("unexpected", msg.MessageType(), "after testament flushed")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// callMeta calls the meta procedure and returns the response.
+	callMeta := func(procedure wamp.URI, args ...interface{}) wamp.Message {
+		callID := wamp.GlobalID()
+		caller.Send(&wamp.Call{
+			Request:   callID,
+			Procedure: procedure,
+			Arguments: wamp.List(args),
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response to", procedure)
+		case msg := <-caller.Recv():
+			return msg
+		}
+		return nil
+	}
+	// callMetaResult calls the meta procedure and returns its result.
+	callMetaResult := func(procedure wamp.URI, args ...interface{}) interface{} {
+		msg := callMeta(procedure, args...)
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if len(result.Arguments) == 0 {
+			t.Fatal("missing expected arguemnt")
+		}
+		return result.Arguments[0]
+	}
+
+	// Observe subscription meta events.
+	observer, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   "wamp.subscription.on_",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	if _, ok := (<-observer.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	// checkMetaEvent checks that the observer received the meta event.
+	checkMetaEvent := func(metaTopic wamp.URI, sessID, subID wamp.ID) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", metaTopic)
+		case msg := <-observer.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got", msg.MessageType())
+			}
+			if event.Details[detailTopic] != metaTopic {
+				t.Fatal("expected", metaTopic, "got", event.Details[detailTopic])
+			}
+			if id, _ := wamp.AsID(event.Arguments[0]); id != sessID {
+				t.Fatal(metaTopic, "has wrong session ID")
+			}
+			var id wamp.ID
+			if metaTopic == wamp.MetaEventSubOnCreate {
+				id = wamp.OptionID(event.Arguments[1].(wamp.Dict), "id")
+			} else {
+				id, _ = wamp.AsID(event.Arguments[1])
+			}
+			if id != subID {
+				t.Fatal(metaTopic, "has wrong subscription ID")
+			}
+		}
+	}
+
+	// Two sessions subscribe to the same topic.
+	const testTopic = wamp.URI("nexus.test.topic")
+	subscribe := func(sess *wamp.Session) wamp.ID {
+		sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		msg := <-sess.Recv()
+		subscribed, ok := msg.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+		}
+		return subscribed.Subscription
+	}
+	subscriber1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subID1 := subscribe(subscriber1)
+	checkMetaEvent(wamp.MetaEventSubOnCreate, subscriber1.ID, subID1)
+	checkMetaEvent(wamp.MetaEventSubOnSubscribe, subscriber1.ID, subID1)
+	subscriber2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subID2 := subscribe(subscriber2)
+	checkMetaEvent(wamp.MetaEventSubOnSubscribe, subscriber2.ID, subID2)
+
+	// ----- Test wamp.subscription.list meta procedure -----
+	dict := callMetaResult(wamp.MetaProcSubList).(wamp.Dict)
+	var found bool
+	for _, id := range dict[wamp.MatchExact].([]wamp.ID) {
+		if id == subID2 {
+			t.Fatal("subscription listed more than once")
+		}
+		if id == subID1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("missing expected subscription ID")
+	}
+	if len(dict[wamp.MatchWildcard].([]wamp.ID)) != 0 {
+		t.Fatal("unexpected wildcard subscriptions")
+	}
+
+	// ----- Test wamp.subscription.lookup meta procedure -----
+	if id := callMetaResult(wamp.MetaProcSubLookup, testTopic); id != subID1 {
+		t.Fatal("received wrong subscription ID")
+	}
+	id := callMetaResult(wamp.MetaProcSubLookup, testTopic,
+		wamp.Dict{wamp.OptMatch: wamp.MatchPrefix})
+	if id != wamp.ID(0) {
+		t.Fatal("should not find prefix subscription")
+	}
+
+	// ----- Test wamp.subscription.match meta procedure -----
+	ids := callMetaResult(wamp.MetaProcSubMatch, testTopic).([]wamp.ID)
+	if len(ids) != 1 || ids[0] != subID1 {
+		t.Fatal("received wrong subscription IDs:", ids)
+	}
+
+	// ----- Test wamp.subscription.get meta procedure -----
+	dict = callMetaResult(wamp.MetaProcSubGet, subID2).(wamp.Dict)
+	if dict["id"] != subID1 || dict["uri"] != testTopic ||
+		dict[wamp.OptMatch] != wamp.MatchExact || dict["created"] == "" {
+		t.Fatal("wrong subscription info:", dict)
+	}
+
+	// ----- Test wamp.subscription.list_subscribers meta procedure -----
+	sessIDs := callMetaResult(wamp.MetaProcSubListCallees, subID1).([]wamp.ID)
+	if len(sessIDs) != 2 {
+		t.Fatal("expected 2 subscribers, got", len(sessIDs))
+	}
+	for _, sid := range sessIDs {
+		if sid != subscriber1.ID && sid != subscriber2.ID {
+			t.Fatal("wrong subscriber session ID")
+		}
+	}
+
+	// ----- Test wamp.subscription.count_subscribers meta procedure -----
+	if n := callMetaResult(wamp.MetaProcSubCountCallees, subID1); n != 2 {
+		t.Fatal("expected 2 subscribers, got", n)
+	}
+
+	// Unsubscribe one session, and the other session leaves.
+	subscriber1.Send(&wamp.Unsubscribe{Request: wamp.GlobalID(), Subscription: subID1})
+	if _, ok := (<-subscriber1.Recv()).(*wamp.Unsubscribed); !ok {
+		t.Fatal("expected UNSUBSCRIBED")
+	}
+	checkMetaEvent(wamp.MetaEventSubOnUnsubscribe, subscriber1.ID, subID1)
+	if n := callMetaResult(wamp.MetaProcSubCountCallees, subID2); n != 1 {
+		t.Fatal("expected 1 subscriber, got", n)
+	}
+	subscriber2.Send(&wamp.Goodbye{})
+	<-subscriber2.Recv()
+	checkMetaEvent(wamp.MetaEventSubOnUnsubscribe, subscriber2.ID, subID2)
+	checkMetaEvent(wamp.MetaEventSubOnDelete, subscriber2.ID, subID2)
+
+	// The subscription no longer exists.
+	msg := callMeta(wamp.MetaProcSubGet, subID2)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription, "got:", msg)
+	}
+
+	subscriber1.Close()
+	subscriber2.Close()
+	observer.Close()
+	caller.Close()
+}
+
+func TestRegistrationMetaProcedures(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Error(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessID := caller.ID
+	var result *wamp.Result
+	var ok bool
+
+	// ----- Test wamp.registration.list meta procedure -----
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exactPrev, ok := dict["exact"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	prefixPrev, ok := dict["prefix"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	wildcardPrev, ok := dict["wildcard"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal("Error connecting client:", err)
+	}
+	sessID = callee.ID
+	// Register remote procedure
+	registerID := wamp.GlobalID()
+	callee.Send(&wamp.Register{Request: registerID, Procedure: testProcedure})
+
+	var registrationID wamp.ID
+	var registered *wamp.Registered
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		registered, ok = msg.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+		}
+		if registered.Request != registerID {
+			t.Fatal("wrong request ID")
+		}
+		registrationID = registered.Registration
+	}
+
+	// Register remote procedure
+	callee.Send(&wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedureWC,
+		Options:   wamp.Dict{"match": "wildcard"},
+	})
+	msg := <-callee.Recv()
+	if _, ok = msg.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	}
+
+	// Call session meta-procedure to get session count.
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRegList})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	exact := dict["exact"].([]wamp.ID)
+	prefix := dict["prefix"].([]wamp.ID)
+	wildcard := dict["wildcard"].([]wamp.ID)
+
+	if len(exact) != len(exactPrev)+1 {
+		t.Fatal("expected additional exact match")
+	}
+	if len(prefix) != len(prefixPrev) {
+		t.Fatal("prefix matches should not have changed")
+	}
+	if len(wildcard) != len(wildcardPrev)+1 {
+		t.Fatal("wildcard matches should not have changed")
+	}
+
+	var found bool
+	for i := range exact {
+		if exact[i] == registrationID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("missing expected registration ID")
+	}
+
+	// ----- Test wamp.registration.lookup meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegLookup,
+		Arguments: wamp.List{testProcedure},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	regID, ok := result.Arguments[0].(wamp.ID)
+	if !ok {
+		t.Fatal("expected wamp.ID")
+	}
+	if regID != registrationID {
+		t.Fatal("received wrong registration ID")
+	}
+
+	// ----- Test wamp.registration.match meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegMatch,
+		Arguments: wamp.List{testProcedure},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	regID, ok = wamp.AsID(result.Arguments[0])
+	if !ok {
+		t.Fatal("expected wamp.ID")
+	}
+	if regID != registrationID {
+		t.Fatal("received wrong registration ID")
+	}
+
+	// ----- Test wamp.registration.get meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegGet,
+		Arguments: wamp.List{registrationID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatalf("expected RESULT, got %s %+v", msg.MessageType(), msg)
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok = result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	regID = wamp.OptionID(dict, "id")
+	if regID != registrationID {
+		t.Fatal("received wrong registration")
+	}
+	uri := wamp.OptionURI(dict, "uri")
+	if uri != testProcedure {
+		t.Fatal("registration has wrong uri:", uri)
+	}
+
+	// ----- Test wamp.registration.list_callees meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegListCallees,
+		Arguments: wamp.List{registrationID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	idList, ok := result.Arguments[0].([]wamp.ID)
+	if !ok {
+		t.Fatal("Expected []wamp.ID")
+	}
+	if len(idList) != 1 {
+		t.Fatal("Expected 1 callee in list")
+	}
+	if idList[0] != sessID {
+		t.Fatal("Wrong callee session ID")
+	}
+
+	// ----- Test wamp.registration.list_callees meta procedure -----
+	callID = wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegCountCallees,
+		Arguments: wamp.List{registrationID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok = msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	count, ok := wamp.AsInt64(result.Arguments[0])
+	if !ok {
+		t.Fatal("Argument is not an int")
+	}
+	if count != 1 {
+		t.Fatal("Wring number of callees")
+	}
+}
+
+func TestRealmFeatures(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Features: RealmFeatures{
+					Broker: map[string]bool{
+						"pattern_based_subscription": false,
+						"publisher_exclusion":        true,
+					},
+					Dealer: map[string]bool{
+						"progressive_call_results": false,
+						"registration_meta_api":    false,
+					},
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err != nil {
+		t.Fatal(err)
+	}
+	var welcome *wamp.Welcome
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for welcome")
+	case msg := <-client.Recv():
+		var ok bool
+		if welcome, ok = msg.(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+	}
+	roles := wamp.DictChild(welcome.Details, "roles")
+	brokerFeatures := wamp.DictChild(wamp.DictChild(roles, "broker"), "features")
+	dealerFeatures := wamp.DictChild(wamp.DictChild(roles, "dealer"), "features")
+	if _, ok := brokerFeatures[featurePatternSub]; ok {
+		t.Error("disabled broker feature advertised")
+	}
+	if _, ok := brokerFeatures[featurePubExclusion]; !ok {
+		t.Error("enabled broker feature not advertised")
+	}
+	if _, ok := dealerFeatures[featureProgCallResults]; ok {
+		t.Error("disabled dealer feature advertised")
+	}
+	if _, ok := dealerFeatures[featureCallCanceling]; !ok {
+		t.Error("enabled dealer feature not advertised")
+	}
+
+	expectError := func(errURI wamp.URI) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for ERROR")
+		case msg := <-client.Recv():
+			errMsg, ok := msg.(*wamp.Error)
+			if !ok {
+				t.Fatal("expected ERROR, got", msg.MessageType())
+			}
+			if errMsg.Error != errURI {
+				t.Fatal("expected", errURI, "got", errMsg.Error)
+			}
+		}
+	}
+
+	// Using a disabled feature is not allowed.
+	client.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   "nexus.test",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	expectError(wamp.ErrOptionNotAllowed)
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionCount,
+		Options:   wamp.Dict{wamp.OptReceiveProgress: true},
+	})
+	expectError(wamp.ErrOptionNotAllowed)
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcRegList,
+	})
+	expectError(wamp.ErrNoSuchProcedure)
+
+	// Enabled features still work.
+	client.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test"})
+	if msg := <-client.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSubList,
+	})
+	if msg := <-client.Recv(); msg.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	client.Close()
+
+	// Disabling a feature that does not exist is an error.
+	config.RealmConfigs[0].Features.Dealer["no_such_feature"] = false
+	if r, err = NewRouter(config, logger); err == nil {
+		r.Close()
+		t.Fatal("expected error for unknown feature")
+	}
+}
+
+func TestRealmFeaturesExemptRoles(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Features: RealmFeatures{
+					Broker: map[string]bool{"pattern_based_subscription": false},
+					Dealer: map[string]bool{"registration_meta_api": false},
+				},
+			},
+			{
+				URI:           "nexus.test.exempt",
+				AnonymousAuth: true,
+				Features: RealmFeatures{
+					Broker: map[string]bool{"pattern_based_subscription": false},
+					Dealer: map[string]bool{"registration_meta_api": false},
+				},
+				ExemptRoles: []string{"anonymous"},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	join := func(realm wamp.URI, details wamp.Dict) wamp.Peer {
+		for k, v := range clientRoles {
+			details[k] = v
+		}
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{Realm: realm, Details: details})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		if msg := <-client.Recv(); msg.MessageType() != wamp.WELCOME {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return client
+	}
+	request := func(client wamp.Peer) (wamp.Message, wamp.Message) {
+		client.Send(&wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   "nexus.test",
+			Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+		})
+		subRsp := <-client.Recv()
+		client.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcRegList,
+		})
+		return subRsp, <-client.Recv()
+	}
+
+	// A client cannot make itself internal to the router.
+	client := join(testRealm, wamp.Dict{detailInternal: true, "authrole": "trusted"})
+	subRsp, callRsp := request(client)
+	if errMsg, ok := subRsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrOptionNotAllowed {
+		t.Fatal("expected", wamp.ErrOptionNotAllowed, "got", subRsp)
+	}
+	if errMsg, ok := callRsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected", wamp.ErrNoSuchProcedure, "got", callRsp)
+	}
+	client.Close()
+
+	// A session with an exempt authrole may use disabled features.
+	client = join("nexus.test.exempt", wamp.Dict{})
+	subRsp, callRsp = request(client)
+	if subRsp.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED, got", subRsp)
+	}
+	if callRsp.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got", callRsp)
+	}
+	client.Close()
+}
+
+func TestRealmCount(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCounts := func() wamp.Dict {
+		callID := wamp.GlobalID()
+		caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRealmCount})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for RESULT")
+		case msg := <-caller.Recv():
+			result, ok := msg.(*wamp.Result)
+			if !ok {
+				t.Fatal("expected RESULT, got", msg.MessageType())
+			}
+			if result.Request != callID {
+				t.Fatal("wrong result ID")
+			}
+			if len(result.Arguments) == 0 {
+				t.Fatal("missing expected argument")
+			}
+			dict, ok := result.Arguments[0].(wamp.Dict)
+			if !ok {
+				t.Fatal("expected wamp.Dict")
+			}
+			return dict
+		}
+		return nil
+	}
+	count := func(dict wamp.Dict, key, policy string) int64 {
+		n, ok := wamp.AsInt64(wamp.DictChild(dict, key)[policy])
+		if !ok {
+			t.Fatalf("missing %s count for %s", policy, key)
+		}
+		return n
+	}
+
+	prev := getCounts()
+	if n, _ := wamp.AsInt64(prev["sessions"]); n != 1 {
+		t.Fatal("expected 1 session, got", n)
+	}
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	client.Send(&wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedureWC,
+		Options:   wamp.Dict{"match": "wildcard"},
+	})
+	client.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   "nexus.test",
+		Options: wamp.Dict{"match": "prefix"},
+	})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			switch msg.(type) {
+			case *wamp.Registered, *wamp.Subscribed:
+			default:
+				t.Fatal("expected REGISTERED or SUBSCRIBED, got", msg.MessageType())
+			}
+		}
+	}
+
+	counts := getCounts()
+	if n, _ := wamp.AsInt64(counts["sessions"]); n != 2 {
+		t.Fatal("expected 2 sessions, got", n)
+	}
+	expect := []struct {
+		key, policy string
+		added       int64
+	}{
+		{"registrations", wamp.MatchExact, 1},
+		{"registrations", wamp.MatchPrefix, 0},
+		{"registrations", wamp.MatchWildcard, 1},
+		{"subscriptions", wamp.MatchExact, 0},
+		{"subscriptions", wamp.MatchPrefix, 1},
+		{"subscriptions", wamp.MatchWildcard, 0},
+	}
+	for _, e := range expect {
+		got := count(counts, e.key, e.policy)
+		want := count(prev, e.key, e.policy) + e.added
+		if got != want {
+			t.Errorf("expected %d %s %s, got %d", want, e.policy, e.key, got)
+		}
+	}
+}
+
+func TestRealmStats(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	reporter, ok := r.(StatsReporter)
+	if !ok {
+		t.Fatal("router does not implement StatsReporter")
+	}
+	recv := func(sess *wamp.Session) wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		case msg := <-sess.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	// One client subscribes and registers, the other publishes and calls.
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test.topic"})
+	if _, ok = recv(sub).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	sub.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok = recv(sub).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+	pub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	before, _ := reporter.RealmStats(testRealm)
+	pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: "nexus.test.topic"})
+	if _, ok = recv(sub).(*wamp.Event); !ok {
+		t.Fatal("expected EVENT")
+	}
+	pub.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	inv, ok := recv(sub).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	sub.Send(&wamp.Yield{Request: inv.Request})
+	if _, ok = recv(pub).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+
+	stats, ok := reporter.RealmStats(testRealm)
+	if !ok {
+		t.Fatal("no stats for realm")
+	}
+	if stats.Sessions != 2 || stats.Subscriptions != 1 || stats.Registrations != 1 {
+		t.Fatalf("wrong counts: %+v", stats)
+	}
+	// Meta events published by the router are also counted as publications.
+	if stats.Publications < before.Publications+1 || stats.Events != 1 || stats.Calls != 1 {
+		t.Fatalf("wrong activity counts: %+v", stats)
+	}
+	// SUBSCRIBE, REGISTER, PUBLISH, CALL, YIELD, and any meta messages.
+	if stats.MessagesRouted < 5 {
+		t.Fatalf("wrong number of messages routed: %+v", stats)
+	}
+	if all := reporter.Stats(); len(all) != 1 || all[testRealm] != stats {
+		t.Fatal("Stats does not match RealmStats:", all)
+	}
+	if _, ok = reporter.RealmStats("no.such.realm"); ok {
+		t.Fatal("expected no stats for unknown realm")
+	}
+
+	// Subscriptions and registrations are removed with the session.
+	sub.Send(&wamp.Goodbye{Reason: wamp.ErrCloseRealm, Details: wamp.Dict{}})
+	recv(sub)
+	sub.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, _ = reporter.RealmStats(testRealm)
+		if stats.Sessions == 1 && stats.Subscriptions == 0 && stats.Registrations == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong counts after session left: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testMetrics is a MetricsRecorder that keeps what it is given.
+type testMetrics struct {
+	sync.Mutex
+	joined    int
+	routed    map[wamp.MessageType]int
+	inFlight  []int
+	published int
+}
+
+func (m *testMetrics) SessionJoined(realm wamp.URI) {
+	m.Lock()
+	defer m.Unlock()
+	m.joined++
+}
+
+func (m *testMetrics) MessageRouted(realm wamp.URI, msgType wamp.MessageType) {
+	m.Lock()
+	defer m.Unlock()
+	m.routed[msgType]++
+}
+
+func (m *testMetrics) CallsInFlight(realm wamp.URI, count int) {
+	m.Lock()
+	defer m.Unlock()
+	m.inFlight = append(m.inFlight, count)
+}
+
+func (m *testMetrics) Published(realm wamp.URI, elapsed time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.published++
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	defer leaktest.Check(t)()
+	metrics := &testMetrics{routed: map[wamp.MessageType]int{}}
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		Debug:   debug,
+		Metrics: metrics,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	recv := func(sess *wamp.Session) wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		case msg := <-sess.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok := recv(callee).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	caller.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   "nexus.test.topic",
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	if _, ok := recv(caller).(*wamp.Published); !ok {
+		t.Fatal("expected PUBLISHED")
+	}
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	inv, ok := recv(callee).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	callee.Send(&wamp.Yield{Request: inv.Request})
+	if _, ok = recv(caller).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+
+	// The number of calls in flight is recorded after the RESULT is sent.
+	deadline := time.Now().Add(time.Second)
+	for {
+		metrics.Lock()
+		n := len(metrics.inFlight)
+		metrics.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("calls in flight not recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.joined != 2 {
+		t.Error("wrong number of sessions joined:", metrics.joined)
+	}
+	for _, mt := range []wamp.MessageType{wamp.REGISTER, wamp.PUBLISH, wamp.CALL, wamp.YIELD} {
+		if metrics.routed[mt] != 1 {
+			t.Errorf("wrong number of %s messages routed: %d", mt, metrics.routed[mt])
+		}
+	}
+	if metrics.inFlight[0] != 1 || metrics.inFlight[1] != 0 {
+		t.Error("wrong calls in flight:", metrics.inFlight)
+	}
+	// Meta events published by the router are also dispatched.
+	if metrics.published == 0 {
+		t.Error("publication dispatch time not recorded")
+	}
+}
+
+// keepalivePeer is a Peer whose transport reports keepalive activity.
+type keepalivePeer struct {
+	wamp.Peer
+}
+
+func (p keepalivePeer) LastActivity() time.Time { return time.Now() }
+
+func TestIdleTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	const idleTimeout = 200 * time.Millisecond
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				IdleTimeout:   idleTimeout,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// A session that has only keepalive activity is not idle.
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(keepalivePeer{server}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if msg := <-client.Recv(); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+
+	// Each message resets the idle timeout.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		time.Sleep(idleTimeout / 2)
+		sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test.topic"})
+		select {
+		case msg := <-sess.Recv():
+			if _, ok := msg.(*wamp.Subscribed); !ok {
+				t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for SUBSCRIBED")
+		}
+	}
+
+	select {
+	case msg := <-sess.Recv():
+		g, ok := msg.(*wamp.Goodbye)
+		if !ok || g.Reason != wamp.ErrSessionIdle {
+			t.Fatal("expected GOODBYE with idle timeout, got", msg)
+		}
+	case <-time.After(2 * idleTimeout):
+		t.Fatal("idle session was not closed")
+	}
+	if elapsed := time.Since(start); elapsed < 3*idleTimeout/2+idleTimeout {
+		t.Fatal("idle session closed too soon:", elapsed)
+	}
+
+	select {
+	case msg := <-client.Recv():
+		t.Fatal("session with keepalive activity was sent", msg.MessageType())
+	default:
+	}
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	defer leaktest.Check(t)()
+	const lifetime = 200 * time.Millisecond
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:                testRealm,
+				AnonymousAuth:      true,
+				MaxSessionLifetime: lifetime,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	start := time.Now()
+
+	// Activity does not extend the session's lifetime.  TrySend is used
+	// because the router stops reading once the session has expired.
+	var expired *wamp.Goodbye
+	for expired == nil {
+		sess.TrySend(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test.topic"})
+		select {
+		case msg := <-sess.Recv():
+			switch msg := msg.(type) {
+			case *wamp.Subscribed:
+			case *wamp.Goodbye:
+				expired = msg
+			default:
+				t.Fatal("expected SUBSCRIBED or GOODBYE, got", msg.MessageType())
+			}
+		case <-time.After(lifetime * 2):
+			t.Fatal("session was not closed at end of lifetime")
+		}
+		time.Sleep(lifetime / 10)
+	}
+	if expired.Reason != wamp.ErrSessionExpired {
+		t.Fatal("wrong GOODBYE reason:", expired.Reason)
+	}
+	if elapsed := time.Since(start); elapsed < lifetime {
+		t.Fatal("session closed too soon:", elapsed)
+	}
+
+	// A new session can join after the old one expired.
+	sess2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess2.Close()
+}
+
+func TestRateLimit(t *testing.T) {
+	defer leaktest.Check(t)()
+	const (
+		rate  = 20
+		burst = 2
+		count = 6
+	)
+	for _, policy := range []string{RateLimitDelay, RateLimitAbort} {
+		r, err := NewRouter(&RouterConfig{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:           testRealm,
+					AnonymousAuth: true,
+					RateLimit: RateLimit{
+						Rate:   rate,
+						Burst:  burst,
+						Policy: policy,
+					},
+				},
+			},
+			Debug: debug,
+		}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Send messages faster than the rate limit allows.  The router stops
+		// reading them when delayed or closed, so send from another
+		// goroutine until done.
+		start := time.Now()
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < count; i++ {
+				msg := &wamp.Subscribe{
+					Request: wamp.GlobalID(),
+					Topic:   "nexus.test.topic",
+				}
+				for sess.TrySend(msg) != nil {
+					select {
+					case <-time.After(time.Millisecond):
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+
+		var subscribed int
+	recvLoop:
+		for subscribed < count {
+			select {
+			case msg := <-sess.Recv():
+				switch msg := msg.(type) {
+				case *wamp.Subscribed:
+					subscribed++
+				case *wamp.Goodbye:
+					// An established session is closed with GOODBYE,
+					// since ABORT is only allowed before WELCOME.
+					if policy != RateLimitAbort {
+						t.Fatal("session closed with delay policy")
+					}
+					if msg.Reason != wamp.ErrProtocolViolation {
+						t.Fatal("wrong GOODBYE reason:", msg.Reason)
+					}
+					break recvLoop
+				default:
+					t.Fatal("unexpected", msg.MessageType())
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for response")
+			}
+		}
+
+		close(done)
+
+		switch policy {
+		case RateLimitDelay:
+			// The messages after the burst are delayed to the rate limit.
+			minElapsed := time.Second * (count - burst) / rate
+			if elapsed := time.Since(start); elapsed < minElapsed*9/10 {
+				t.Fatal("messages not delayed by rate limit:", elapsed)
+			}
+		case RateLimitAbort:
+			// Only the burst is allowed before the session is closed.
+			if subscribed != burst {
+				t.Fatal("expected", burst, "messages before GOODBYE, got",
+					subscribed)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestSessionAttachLeave(t *testing.T) {
+	defer leaktest.Check(t)()
+	attached := make(chan wamp.ID, 2)
+	left := make(chan wamp.ID, 2)
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				OnSessionAttach: func(sess *wamp.Session) {
+					attached <- sess.ID
+				},
+				OnSessionLeave: func(sess *wamp.Session) {
+					left <- sess.ID
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OnSessionAttach is called before the session is welcomed.
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-attached:
+		if id != cli1.ID {
+			t.Fatal("OnSessionAttach called with wrong session ID")
+		}
+	default:
+		t.Fatal("OnSessionAttach not called before WELCOME")
+	}
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-attached; id != cli2.ID {
+		t.Fatal("OnSessionAttach called with wrong session ID")
+	}
+
+	// A session leaving by GOODBYE is removed.
+	cli1.Send(&wamp.Goodbye{})
+	<-cli1.Recv()
+	select {
+	case id := <-left:
+		if id != cli1.ID {
+			t.Fatal("OnSessionLeave called with wrong session ID")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnSessionLeave not called")
+	}
+
+	// A session still attached when the router closes is removed.
+	r.Close()
+	select {
+	case id := <-left:
+		if id != cli2.ID {
+			t.Fatal("OnSessionLeave called with wrong session ID")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnSessionLeave not called at shutdown")
+	}
+}
+
+func TestSessionStatsOnDetach(t *testing.T) {
+	defer leaktest.Check(t)()
+	statsChan := make(chan SessionStats, 1)
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				OnDetach: func(sess *wamp.Session, stats SessionStats) {
+					statsChan <- stats
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "some.uri"})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	case msg := <-cli.Recv():
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+		}
+	}
+
+	// A failed subscription is not counted.
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "bad uri"})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ERROR")
+	case msg := <-cli.Recv():
+		if _, ok := msg.(*wamp.Error); !ok {
+			t.Fatal("Expected ERROR, got:", msg.MessageType())
+		}
+	}
+
+	cli.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   "some.uri",
+		Options: wamp.Dict{"acknowledge": true},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for PUBLISHED")
+	case msg := <-cli.Recv():
+		if _, ok := msg.(*wamp.Published); !ok {
+			t.Fatal("Expected PUBLISHED, got:", msg.MessageType())
+		}
+	}
+
+	cli.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-cli.Recv():
+		if _, ok := msg.(*wamp.Result); !ok {
+			t.Fatal("Expected RESULT, got:", msg.MessageType())
+		}
+	}
+
+	cli.Send(&wamp.Goodbye{})
+	<-cli.Recv()
+
+	var stats SessionStats
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("OnDetach not called")
+	case stats = <-statsChan:
+	}
+
+	// SUBSCRIBE, SUBSCRIBE, PUBLISH, CALL, GOODBYE
+	if stats.MessagesRecvd != 5 {
+		t.Fatal("wrong number of messages received:", stats.MessagesRecvd)
+	}
+	// SUBSCRIBED, ERROR, PUBLISHED, RESULT, GOODBYE
+	if stats.MessagesSent != 5 {
+		t.Fatal("wrong number of messages sent:", stats.MessagesSent)
+	}
+	if stats.Subscribes != 1 || stats.Publications != 1 || stats.Calls != 1 {
+		t.Fatalf("wrong request counts: %+v", stats)
+	}
+	if stats.Registrations != 0 {
+		t.Fatal("should not have counted any registrations")
+	}
+	if stats.Joined.IsZero() || stats.Duration <= 0 {
+		t.Fatal("session duration not recorded")
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		if _, ok := msg.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+		}
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make a call that times out, and another call that is still waiting to
+	// time out when the router is closed.
+	timeoutCallID := wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   timeoutCallID,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 50},
+	})
+	caller.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 60000},
+	})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for INVOCATION")
+		case msg := <-callee.Recv():
+			if _, ok := msg.(*wamp.Invocation); !ok {
+				t.Fatal("expected INVOCATION, got:", msg.MessageType())
+			}
+		}
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for call timeout")
+	case msg := <-caller.Recv():
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", msg.MessageType())
+		}
+		if errMsg.Request != timeoutCallID {
+			t.Fatal("wrong request ID in ERROR")
+		}
+	}
+
+	r.Close()
+	AssertNoGoroutineLeak(t)
+}
+
+func TestRouterPing(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().UnixNano() / int64(time.Microsecond)
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRouterPing})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-caller.Recv():
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+		if len(result.Arguments) == 0 {
+			t.Fatal("missing timestamp in RESULT")
+		}
+		ts, ok := wamp.AsInt64(result.Arguments[0])
+		if !ok {
+			t.Fatal("timestamp has wrong type")
+		}
+		after := time.Now().UnixNano() / int64(time.Microsecond)
+		if ts < before || ts > after {
+			t.Fatal("timestamp not between call and result")
+		}
+	}
+}
+
+func TestRouterInfo(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err != nil {
+		t.Fatal(err)
+	}
+	var sessID wamp.ID
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for WELCOME")
+	case msg := <-client.Recv():
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		if welcome.Details["x_nexus_version"] != Version {
+			t.Fatal("WELCOME missing router version")
+		}
+		if welcome.Details["x_nexus_peer"] == nil {
+			t.Fatal("WELCOME missing router identity")
+		}
+		sessID = welcome.ID
+	}
+
+	// Router identity is not part of the session details.
+	callID := wamp.GlobalID()
+	client.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{sessID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-client.Recv():
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		details, _ := wamp.AsDict(result.Arguments[0])
+		if _, ok = details["x_nexus_version"]; ok {
+			t.Fatal("session details should not have router version")
+		}
+	}
+
+	callID = wamp.GlobalID()
+	client.Send(&wamp.Call{Request: callID, Procedure: wamp.MetaProcRouterInfo})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-client.Recv():
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+		info, ok := wamp.AsDict(result.Arguments[0])
+		if !ok {
+			t.Fatal("router info is not a dictionary")
+		}
+		if info["version"] != Version {
+			t.Fatal("wrong version in router info:", info["version"])
+		}
+		if uptime, ok := wamp.AsInt64(info["uptime"]); !ok || uptime < 0 {
+			t.Fatal("bad uptime in router info:", info["uptime"])
+		}
+		features, _ := wamp.AsDict(info["features"])
+		brokerFeatures, _ := wamp.AsDict(features["broker"])
+		if !wamp.OptionFlag(brokerFeatures, featurePatternSub) {
+			t.Fatal("router info missing broker features")
+		}
+		if _, ok = features["dealer"]; !ok {
+			t.Fatal("router info missing dealer features")
+		}
+	}
+}
+
+func TestRealmBrandingDetails(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				WelcomeDetails: wamp.Dict{
+					"x_support": "support@example.com",
+					"authrole":  "admin",
+				},
+				AbortDetails: wamp.Dict{
+					"x_docs": "https://example.com/docs",
+					"error":  "replaced",
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for WELCOME")
+	case msg := <-client.Recv():
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		if welcome.Details["x_support"] != "support@example.com" {
+			t.Fatal("WELCOME missing branding details")
+		}
+		if welcome.Details["authrole"] != "anonymous" {
+			t.Fatal("branding details replaced authrole")
+		}
+	}
+	client.Close()
+
+	// Request an authmethod the realm does not support.
+	client, server = transport.LinkedPeers()
+	go client.Send(&wamp.Hello{
+		Realm: testRealm,
+		Details: wamp.Dict{
+			"authmethods": wamp.List{"wampcra"},
+			"roles":       clientRoles["roles"],
+		},
+	})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error from Attach")
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ABORT")
+	case msg := <-client.Recv():
+		abort, ok := msg.(*wamp.Abort)
+		if !ok {
+			t.Fatal("expected ABORT, got", msg.MessageType())
+		}
+		if abort.Reason != wamp.ErrAuthenticationFailed {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
+		}
+		if abort.Details["x_docs"] != "https://example.com/docs" {
+			t.Fatal("ABORT missing branding details")
+		}
+		if abort.Details["error"] == "replaced" {
+			t.Fatal("branding details replaced error")
+		}
+	}
+}
+
+// slowClosePeer is a peer that takes some time to close its transport.
+type slowClosePeer struct {
+	wamp.Peer
+	delay time.Duration
+}
+
+func (p *slowClosePeer) Close() {
+	time.Sleep(p.delay)
+	p.Peer.Close()
+}
+
+func slowCloseClient(r Router, delay time.Duration) (*wamp.Session, error) {
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err := r.Attach(&slowClosePeer{server, delay}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(time.Second):
+		return nil, errors.New("timed out waiting for welcome")
+	case msg := <-client.Recv():
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			return nil, fmt.Errorf("expected %v, got %v", wamp.WELCOME,
+				msg.MessageType())
+		}
+		return &wamp.Session{Peer: client, ID: welcome.ID}, nil
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const closeDelay = 200 * time.Millisecond
+	callee, err := slowCloseClient(r, closeDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		if _, ok := msg.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+		}
+	}
+	caller, err := slowCloseClient(r, closeDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave a call pending when the router is closed.
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	case msg := <-callee.Recv():
+		if _, ok := msg.(*wamp.Invocation); !ok {
+			t.Fatal("expected INVOCATION, got:", msg.MessageType())
+		}
+	}
+
+	start := time.Now()
+	if err = r.(GracefulCloser).CloseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < closeDelay {
+		t.Fatal("CloseTimeout returned before sessions were closed")
+	}
+
+	// Both sessions must be told goodbye and have their transports closed,
+	// without waiting, by the time CloseTimeout returns.
+	for _, sess := range []*wamp.Session{callee, caller} {
+		var gotGoodbye bool
+	drain:
+		for {
+			select {
+			case msg, open := <-sess.Recv():
+				if !open {
+					break drain
+				}
+				if _, ok := msg.(*wamp.Goodbye); ok {
+					gotGoodbye = true
+				}
+			default:
+				t.Fatal("session transport not closed after CloseTimeout")
+			}
+		}
+		if !gotGoodbye {
+			t.Fatal("session did not receive GOODBYE")
+		}
+	}
+	AssertNoGoroutineLeak(t)
+}
+
+func TestCloseTimeoutExpired(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const closeDelay = 500 * time.Millisecond
+	if _, err = slowCloseClient(r, closeDelay); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.(GracefulCloser).CloseTimeout(50 * time.Millisecond); err == nil {
+		t.Fatal("expected error when teardown incomplete")
+	}
+	// Let the teardown finish in the background.
+	time.Sleep(closeDelay)
+	AssertNoGoroutineLeak(t)
+}
+
+func TestShutdown(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(sess *wamp.Session) wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		case msg := <-sess.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if msg, ok := recv(callee).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", msg.MessageType())
+	}
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	// Leave a call in progress when the shutdown starts.
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	inv, ok := recv(callee).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result := make(chan int)
+	go func() { result <- r.(GracefulCloser).Shutdown(ctx) }()
+
+	for _, sess := range []*wamp.Session{callee, caller} {
+		msg := recv(sess)
+		if g, ok := msg.(*wamp.Goodbye); !ok || g.Reason != wamp.ErrSystemShutdown {
+			t.Fatal("expected GOODBYE with system shutdown, got:", msg)
+		}
+	}
+
+	// New sessions are not accepted.
+	if _, err = testClient(r); err == nil {
+		t.Fatal("expected new session to be refused during shutdown")
+	}
+
+	// The call in progress can still finish.
+	callee.Send(&wamp.Yield{Request: inv.Request})
+	if msg, ok := recv(caller).(*wamp.Result); !ok || msg.Request != callID {
+		t.Fatal("expected RESULT for call in progress")
+	}
+
+	// Only the caller replies to GOODBYE, so the callee is not counted as
+	// having left.
+	caller.Send(&wamp.Goodbye{Reason: wamp.ErrGoodbyeAndOut, Details: wamp.Dict{}})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after context expired")
+	case n := <-result:
+		if n != 1 {
+			t.Fatal("expected 1 session to not reply to GOODBYE, got", n)
+		}
+	}
+	// The caller must not get a reply to its GOODBYE.
+	if msg, open := <-caller.Recv(); open {
+		t.Fatal("unexpected message after GOODBYE:", msg.MessageType())
+	}
+}
+
+func TestSessionMetaEvents(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscriber, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subIDs := map[wamp.URI]wamp.ID{}
+	for _, topic := range []wamp.URI{wamp.MetaEventSessionOnJoin, wamp.MetaEventSessionOnLeave} {
+		subscriber.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+	subscribed:
+		for {
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for SUBSCRIBED")
+			case msg := <-subscriber.Recv():
+				switch msg := msg.(type) {
+				case *wamp.Subscribed:
+					subIDs[topic] = msg.Subscription
+					break subscribed
+				case *wamp.Event:
+					// Skip on_join event for subscriber's own session.
+				default:
+					t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+				}
+			}
+		}
+	}
+	nextEvent := func(topic wamp.URI) *wamp.Event {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", topic)
+		case msg := <-subscriber.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got:", msg.MessageType())
+			}
+			if event.Subscription != subIDs[topic] {
+				t.Fatal("expected", topic, "event")
+			}
+			return event
+		}
+		return nil
+	}
+
+	// Joining session publishes its session details.
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details wamp.Dict
+	for {
+		event := nextEvent(wamp.MetaEventSessionOnJoin)
+		if len(event.Arguments) != 1 {
+			t.Fatal("expected 1 argument in on_join event")
+		}
+		var ok bool
+		if details, ok = event.Arguments[0].(wamp.Dict); !ok {
+			t.Fatal("on_join argument is not session details")
+		}
+		// Skip any on_join event for the subscriber's own session.
+		if id, _ := wamp.AsID(details["session"]); id == sess.ID {
+			break
+		}
+	}
+	authid := wamp.OptionString(details, "authid")
+	authrole := wamp.OptionString(details, "authrole")
+	if authrole == "" {
+		t.Fatal("on_join missing authrole")
+	}
+
+	// Leaving session publishes its ID, authid, and authrole.
+	sess.Send(&wamp.Goodbye{Reason: wamp.ErrCloseRealm, Details: wamp.Dict{}})
+	event := nextEvent(wamp.MetaEventSessionOnLeave)
+	if len(event.Arguments) != 3 {
+		t.Fatal("expected 3 arguments in on_leave event, got",
+			len(event.Arguments))
+	}
+	if id, _ := wamp.AsID(event.Arguments[0]); id != sess.ID {
+		t.Fatal("on_leave has wrong session ID")
+	}
+	if event.Arguments[1] != authid || event.Arguments[2] != authrole {
+		t.Fatal("on_leave has wrong authid or authrole:", event.Arguments)
+	}
+}
+
+func TestUnknownOptions(t *testing.T) {
+	defer leaktest.Check(t)()
+	const testTopic = wamp.URI("nexus.test.topic")
+	for _, strict := range []bool{false, true} {
+		r, err := NewRouter(&RouterConfig{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:           testRealm,
+					AnonymousAuth: true,
+					StrictOptions: strict,
+				},
+			},
+			Debug: debug,
+		}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Known options, including publish filter attributes, are accepted.
+		client.Send(&wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptMatch: wamp.MatchExact},
+		})
+		if msg := <-client.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+		}
+		client.Send(&wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{
+				wamp.OptAcknowledge: true,
+				wamp.OptExcludeMe:   true,
+				"exclude_authrole":  wamp.List{"nobody"},
+			},
+		})
+		if msg := <-client.Recv(); msg.MessageType() != wamp.PUBLISHED {
+			t.Fatal("expected PUBLISHED, got:", msg.MessageType())
+		}
+
+		reqs := []wamp.Message{
+			&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic,
+				Options: wamp.Dict{"x_unknown": true}},
+			&wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic,
+				Options: wamp.Dict{wamp.OptAcknowledge: true, "x_unknown": true}},
+			&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount,
+				Options: wamp.Dict{"x_unknown": true}},
+		}
+		expect := []wamp.MessageType{wamp.SUBSCRIBED, wamp.PUBLISHED, wamp.RESULT}
+		for i, req := range reqs {
+			client.Send(req)
+			var msg wamp.Message
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for response to", req.MessageType())
+			case msg = <-client.Recv():
+			}
+			if !strict {
+				// Lenient mode ignores the unknown option.
+				if msg.MessageType() != expect[i] {
+					t.Fatal("expected", expect[i], "got:", msg.MessageType())
+				}
+				continue
+			}
+			errMsg, ok := msg.(*wamp.Error)
+			if !ok {
+				t.Fatal("expected ERROR, got:", msg.MessageType())
+			}
+			if errMsg.Type != req.MessageType() {
+				t.Fatal("wrong request type in ERROR")
+			}
+			if errMsg.Error != wamp.ErrInvalidOptions {
+				t.Fatal("wrong error URI:", errMsg.Error)
+			}
+		}
+		r.Close()
+	}
+}
+
+// slowCallAuthorizer takes some time to authorize each CALL.
+type slowCallAuthorizer struct {
+	delay time.Duration
+}
+
+func (a *slowCallAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if _, ok := msg.(*wamp.Call); ok {
+		time.Sleep(a.delay)
+	}
+	return true, nil
+}
+
+func TestInboundConcurrency(t *testing.T) {
+	defer leaktest.Check(t)()
+	const (
+		authzDelay = 200 * time.Millisecond
+		callCount  = 4
+	)
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:                testRealm,
+				AnonymousAuth:      true,
+				Authorizer:         &slowCallAuthorizer{authzDelay},
+				InboundConcurrency: callCount,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		if _, ok := msg.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+		}
+	}
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send independent calls from one session.  If they are processed
+	// concurrently, all are authorized in about the time it takes to
+	// authorize one.
+	start := time.Now()
+	for i := 0; i < callCount; i++ {
+		caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	}
+	for i := 0; i < callCount; i++ {
+		select {
+		case <-time.After(callCount * authzDelay):
+			t.Fatal("Timed out waiting for INVOCATION")
+		case msg := <-callee.Recv():
+			inv, ok := msg.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", msg.MessageType())
+			}
+			callee.Send(&wamp.Yield{Request: inv.Request})
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 2*authzDelay {
+		t.Fatal("calls were not processed concurrently, took", elapsed)
+	}
+	for i := 0; i < callCount; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for RESULT")
+		case msg := <-caller.Recv():
+			if _, ok := msg.(*wamp.Result); !ok {
+				t.Fatal("expected RESULT, got:", msg.MessageType())
+			}
+		}
+	}
+}
+
+// pubDelayAuthorizer takes longer to authorize a PUBLISH the smaller its
+// first argument is, so that later publications are authorized first.
+type pubDelayAuthorizer struct {
+	count int
+	delay time.Duration
+}
+
+func (a *pubDelayAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if pub, ok := msg.(*wamp.Publish); ok && len(pub.Arguments) != 0 {
+		seq, _ := wamp.AsInt64(pub.Arguments[0])
+		time.Sleep(time.Duration(int64(a.count)-seq) * a.delay)
+	}
+	return true, nil
+}
+
+func TestInboundConcurrencyPublishOrder(t *testing.T) {
+	defer leaktest.Check(t)()
+	const (
+		pubCount  = 8
+		testTopic = wamp.URI("nexus.test.topic")
+	)
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:                testRealm,
+				AnonymousAuth:      true,
+				Authorizer:         &pubDelayAuthorizer{pubCount, 10 * time.Millisecond},
+				InboundConcurrency: pubCount,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscriber, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg := <-subscriber.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+	publisher, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Publications are authorized concurrently, and later ones first, but
+	// the events must arrive in the order published.
+	for i := 0; i < pubCount; i++ {
+		publisher.Send(&wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     testTopic,
+			Arguments: wamp.List{i},
+		})
+	}
+	for i := 0; i < pubCount; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for EVENT")
+		case msg := <-subscriber.Recv():
+			evt, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got:", msg.MessageType())
+			}
+			if seq, _ := wamp.AsInt64(evt.Arguments[0]); seq != int64(i) {
+				t.Fatalf("expected event %d, got %d", i, seq)
+			}
+		}
+	}
+}
+
+func TestInboundConcurrencyCancelOrder(t *testing.T) {
+	defer leaktest.Check(t)()
+	const authzDelay = 200 * time.Millisecond
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:                testRealm,
+				AnonymousAuth:      true,
+				Authorizer:         &slowCallAuthorizer{authzDelay},
+				InboundConcurrency: 2,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	case msg := <-callee.Recv():
+		if _, ok := msg.(*wamp.Registered); !ok {
+			t.Fatal("expected REGISTERED, got:", msg.MessageType())
+		}
+	}
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The CANCEL arrives while the CALL is still being authorized, and must
+	// not be processed before it.
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: callID, Procedure: testProcedure})
+	caller.Send(&wamp.Cancel{
+		Request: callID,
+		Options: wamp.Dict{wamp.OptMode: wamp.CancelModeSkip},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ERROR")
+	case msg := <-caller.Recv():
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", msg.MessageType())
+		}
+		if errMsg.Request != callID || errMsg.Error != wamp.ErrCanceled {
+			t.Fatal("expected", wamp.ErrCanceled, "for call, got:", errMsg.Error)
+		}
+	}
+}
+
+// uriAuthorizer denies requests for URIs with a "denied" prefix, and fails
+// to authorize requests for URIs with a "broken" prefix.
+type uriAuthorizer struct{}
+
+func (a *uriAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	var uri wamp.URI
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		uri = msg.Topic
+	case *wamp.Subscribe:
+		uri = msg.Topic
+	case *wamp.Call:
+		uri = msg.Procedure
+	case *wamp.Register:
+		uri = msg.Procedure
+	}
+	switch {
+	case strings.HasPrefix(string(uri), "denied."):
+		return false, nil
+	case strings.HasPrefix(string(uri), "broken."):
+		return false, errors.New("authorizer unavailable")
+	}
+	return true, nil
+}
+
+func TestAuthorizerDenial(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authorizer:    &uriAuthorizer{},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each denied request is answered with an ERROR for the request.
+	const uri = wamp.URI("denied.uri")
+	reqID := wamp.GlobalID()
+	for _, req := range []wamp.Message{
+		&wamp.Subscribe{Request: reqID, Topic: uri},
+		&wamp.Publish{Request: reqID, Topic: uri,
+			Options: wamp.Dict{wamp.OptAcknowledge: true}},
+		&wamp.Register{Request: reqID, Procedure: uri},
+		&wamp.Call{Request: reqID, Procedure: uri},
+	} {
+		client.Send(req)
+		var msg wamp.Message
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response to", req.MessageType())
+		case msg = <-client.Recv():
+		}
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR for", req.MessageType(), "got:",
+				msg.MessageType())
+		}
+		if errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("wrong error for", req.MessageType(), errMsg.Error)
+		}
+		if errMsg.Type != req.MessageType() || errMsg.Request != reqID {
+			t.Fatal("ERROR does not identify request", req.MessageType())
+		}
+	}
+}
+
+func TestAuthzCheck(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authorizer:    &uriAuthorizer{},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	for _, uri := range []wamp.URI{"allowed.uri", "denied.uri", "broken.uri"} {
+		for _, action := range []string{"publish", "subscribe", "call", "register"} {
+			client.Send(&wamp.Call{
+				Request:   wamp.GlobalID(),
+				Procedure: wamp.MetaProcAuthzCheck,
+				Arguments: wamp.List{action, uri},
+			})
+			msg := recv()
+			result, ok := msg.(*wamp.Result)
+			if !ok {
+				t.Fatal("expected RESULT, got:", msg.MessageType())
+			}
+			check, _ := wamp.AsDict(result.Arguments[0])
+			allowed := wamp.OptionFlag(check, "allowed")
+			errURI := wamp.OptionURI(check, "error")
+
+			// Perform the action and check that enforcement matches.
+			var req wamp.Message
+			switch action {
+			case "publish":
+				req = &wamp.Publish{Request: wamp.GlobalID(), Topic: uri,
+					Options: wamp.Dict{wamp.OptAcknowledge: true}}
+			case "subscribe":
+				req = &wamp.Subscribe{Request: wamp.GlobalID(), Topic: uri}
+			case "call":
+				req = &wamp.Call{Request: wamp.GlobalID(), Procedure: uri}
+			case "register":
+				req = &wamp.Register{Request: wamp.GlobalID(), Procedure: uri}
+			}
+			client.Send(req)
+			msg = recv()
+			var enforcedErr wamp.URI
+			if errMsg, ok := msg.(*wamp.Error); ok {
+				enforcedErr = errMsg.Error
+			}
+			denied := enforcedErr == wamp.ErrNotAuthorized ||
+				enforcedErr == wamp.ErrAuthorizationFailed
+			if allowed == denied {
+				t.Fatalf("dry-run allowed=%v for %s %s, but got %v", allowed,
+					action, uri, msg.MessageType())
+			}
+			if !allowed && errURI != enforcedErr {
+				t.Fatalf("dry-run error %s for %s %s, enforced %s", errURI,
+					action, uri, enforcedErr)
+			}
+		}
+	}
+
+	// Invalid action is an error.
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcAuthzCheck,
+		Arguments: wamp.List{"fly", "allowed.uri"},
+	})
+	if errMsg, ok := recv().(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument)
+	}
+
+	// Empty URI is an error without a match option.
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcAuthzCheck,
+		Arguments: wamp.List{"subscribe", ""},
+	})
+	if errMsg, ok := recv().(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument)
+	}
+}
+
+// slowAuthorizer blocks authorization of URIs with a "slow" prefix until
+// release is closed.
+type slowAuthorizer struct {
+	release chan struct{}
+}
+
+func (a *slowAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if m, ok := msg.(*wamp.Subscribe); ok && strings.HasPrefix(string(m.Topic), "slow.") {
+		<-a.release
+	}
+	return true, nil
+}
+
+func TestAuthzCheckNotBlocking(t *testing.T) {
+	defer leaktest.Check(t)()
+	authz := &slowAuthorizer{release: make(chan struct{})}
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authorizer:    authz,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+
+	checkID := wamp.GlobalID()
+	client.Send(&wamp.Call{
+		Request:   checkID,
+		Procedure: wamp.MetaProcAuthzCheck,
+		Arguments: wamp.List{"subscribe", "slow.topic"},
+	})
+
+	// Other meta procedures must not wait for the slow authorizer.
+	countID := wamp.GlobalID()
+	client.Send(&wamp.Call{Request: countID, Procedure: wamp.MetaProcSessionCount})
+	result, ok := recv().(*wamp.Result)
+	if !ok || result.Request != countID {
+		t.Fatal("expected RESULT for session count before authz check")
+	}
+
+	close(authz.release)
+	result, ok = recv().(*wamp.Result)
+	if !ok || result.Request != checkID {
+		t.Fatal("expected RESULT for authz check")
+	}
+	check, _ := wamp.AsDict(result.Arguments[0])
+	if !wamp.OptionFlag(check, "allowed") {
+		t.Fatal("expected slow.topic to be allowed")
+	}
+}
+
+func TestTestamentAuthorization(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authorizer:    &uriAuthorizer{},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uri, expect := range map[wamp.URI]wamp.URI{
+		"denied.will":  wamp.ErrNotAuthorized,
+		"broken.will":  wamp.ErrAuthorizationFailed,
+		"allowed.will": "",
+	} {
+		client.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcSessionAddTestament,
+			Arguments: wamp.List{uri},
+		})
+		var msg wamp.Message
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg = <-client.Recv():
+		}
+		if expect == "" {
+			if _, ok := msg.(*wamp.Result); !ok {
+				t.Fatal("expected RESULT adding testament for", uri)
+			}
+			continue
+		}
+		if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != expect {
+			t.Fatal("expected", expect, "adding testament for", uri)
+		}
+	}
+}
+
+func TestCloseManySessions(t *testing.T) {
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sessCount = 5000
+	clients := make([]*wamp.Session, sessCount)
+	for i := range clients {
+		if clients[i], err = testClient(r); err != nil {
+			r.Close()
+			t.Fatal(err)
+		}
+		// Each client subscribes to a shared topic and to its own topic.
+		for _, topic := range []string{"nexus.test.shared", fmt.Sprint("nexus.test.topic", i)} {
+			clients[i].Send(&wamp.Subscribe{
+				Request: wamp.GlobalID(),
+				Topic:   wamp.URI(topic),
+			})
+			if _, ok := (<-clients[i].Recv()).(*wamp.Subscribed); !ok {
+				r.Close()
+				t.Fatal("expected SUBSCRIBED")
+			}
+		}
+	}
+
+	start := time.Now()
+	r.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("closing realm with", sessCount, "sessions took", elapsed)
+	}
+	for _, client := range clients {
+		if _, ok := (<-client.Recv()).(*wamp.Goodbye); !ok {
+			t.Fatal("expected GOODBYE")
+		}
+	}
+}
+
+// roleAuthenticator is an anonymous authenticator that gives the session the
+// authrole requested in HELLO.
+type roleAuthenticator struct{}
+
+func (a roleAuthenticator) AuthMethod() string { return "anonymous" }
+
+func (a roleAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	return &wamp.Welcome{Details: wamp.Dict{
+		"authid":     fmt.Sprint(sid),
+		"authmethod": a.AuthMethod(),
+		"authrole":   wamp.OptionString(details, "authrole"),
+	}}, nil
+}
+
+func TestCatchAllRoles(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				Authenticators: []auth.Authenticator{roleAuthenticator{}},
+				CatchAllRoles:  []string{"admin"},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	join := func(authrole string) wamp.Peer {
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authrole": authrole,
+				"roles":    clientRoles["roles"],
+			},
+		})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := (<-client.Recv()).(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME")
+		}
+		return client
+	}
+	recv := func(client wamp.Peer) wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+	subscribe := func(authrole string, topic wamp.URI, match string) wamp.Message {
+		client := join(authrole)
+		defer client.Close()
+		client.Send(&wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Options: wamp.Dict{wamp.OptMatch: match},
+			Topic:   topic,
+		})
+		return recv(client)
+	}
+	// check asks wamp.authz.check whether the role may make the catch-all
+	// subscription.
+	check := func(authrole string) bool {
+		client := join(authrole)
+		defer client.Close()
+		client.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcAuthzCheck,
+			Arguments: wamp.List{"subscribe", "",
+				wamp.Dict{wamp.OptMatch: wamp.MatchPrefix}},
+		})
+		msg := recv(client)
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", msg.MessageType())
+		}
+		dict, _ := wamp.AsDict(result.Arguments[0])
+		return wamp.OptionFlag(dict, "allowed")
+	}
+
+	// Admin role is allowed the catch-all subscription.
+	msg := subscribe("admin", "", wamp.MatchPrefix)
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED for admin, got:", msg.MessageType())
+	}
+
+	// Regular role is denied the catch-all subscription.
+	msg = subscribe("user", "", wamp.MatchPrefix)
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR for user, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Regular role is allowed other prefix subscriptions.
+	msg = subscribe("user", "nexus.test.", wamp.MatchPrefix)
+	if _, ok = msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED for user, got:", msg.MessageType())
+	}
+
+	// Dry-run check of the catch-all subscription matches enforcement.
+	if !check("admin") {
+		t.Fatal("authz check denied catch-all subscription for admin")
+	}
+	if check("user") {
+		t.Fatal("authz check allowed catch-all subscription for user")
+	}
+}
+
+func TestSendQueuePolicy(t *testing.T) {
+	defer leaktest.Check(t)()
+	const (
+		testTopic = wamp.URI("nexus.test.topic")
+		numEvents = 40
+	)
+
+	// Subscribe a client that does not read its messages, publish more
+	// events than it can buffer, and then return the client.
+	slowSubscriber := func(r Router) *wamp.Session {
+		sub, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		if _, ok := (<-sub.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED")
+		}
+		pub, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < numEvents; i++ {
+			pub.Send(&wamp.Publish{
+				Request:   wamp.GlobalID(),
+				Topic:     testTopic,
+				Arguments: wamp.List{i},
+			})
+		}
+		pub.Send(&wamp.Goodbye{})
+		<-pub.Recv()
+		pub.Close()
+		return sub
+	}
+
+	newRouter := func(policy string) Router {
+		r, err := NewRouter(&RouterConfig{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:             testRealm,
+					AnonymousAuth:   true,
+					SendQueueSize:   2,
+					SendQueuePolicy: policy,
+				},
+			},
+			Debug: debug,
+		}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Oldest events are dropped, and the newest are delivered.
+	r := newRouter(SendQueueDropOldest)
+	sub := slowSubscriber(r)
+	var count int
+	var last int64
+	for done := false; !done; {
+		select {
+		case msg := <-sub.Recv():
+			event, ok := msg.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected EVENT, got", msg.MessageType())
+			}
+			last, _ = wamp.AsInt64(event.Arguments[0])
+			count++
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if count == 0 || count >= numEvents {
+		t.Fatal("expected some events to be dropped, received", count)
+	}
+	if last != numEvents-1 {
+		t.Fatal("expected last event to be delivered, got", last)
+	}
+	r.Close()
+
+	// Session is disconnected with a GOODBYE.
+	r = newRouter(SendQueueDisconnect)
+	defer r.Close()
+	sub = slowSubscriber(r)
+	timeout := time.After(time.Second)
+	for {
+		var msg wamp.Message
+		select {
+		case msg = <-sub.Recv():
+		case <-timeout:
+			t.Fatal("timed out waiting for GOODBYE")
+		}
+		if goodbye, ok := msg.(*wamp.Goodbye); ok {
+			if goodbye.Reason != wamp.ErrSessionKilled {
+				t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+			}
+			break
+		}
+		if _, ok := msg.(*wamp.Event); !ok {
+			t.Fatal("expected EVENT or GOODBYE, got", msg.MessageType())
+		}
+	}
+
+	_, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{URI: testRealm, SendQueuePolicy: "bogus"},
+		},
+	}, logger)
+	if err == nil {
+		t.Fatal("expected error for invalid send queue policy")
+	}
+}
+
+func TestSendQueueDropsOnlyEvents(t *testing.T) {
+	var overflowed bool
+	// Queue messages without delivering them, so that the queue fills.
+	p := newQueuePeer(nil, 2, SendQueueDropOldest, func() { overflowed = true })
+	result := &wamp.Result{Request: 1}
+	p.TrySend(result)
+	p.TrySend(&wamp.Event{Subscription: 1})
+	newest := &wamp.Event{Subscription: 2}
+	if err := p.TrySend(newest); err != nil {
+		t.Fatal("expected oldest event to be dropped, got", err)
+	}
+	if p.queue[0] != result || p.queue[1] != newest {
+		t.Fatal("wrong messages queued:", p.queue)
+	}
+
+	// A RESULT replaces the queued EVENT.
+	if err := p.TrySend(&wamp.Result{Request: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// With no EVENT left to drop, a new EVENT is dropped.
+	if err := p.TrySend(&wamp.Event{Subscription: 3}); err != wamp.ErrBlocked {
+		t.Fatal("expected new event to be dropped")
+	}
+	for _, msg := range p.queue {
+		if msg.MessageType() != wamp.RESULT {
+			t.Fatal("expected only RESULT queued, got", msg.MessageType())
+		}
+	}
+	if overflowed {
+		t.Fatal("session should not be disconnected for dropped event")
+	}
+	// Anything else disconnects the session.
+	if err := p.TrySend(&wamp.Result{Request: 3}); err != wamp.ErrBlocked {
+		t.Fatal("expected RESULT to be discarded")
+	}
+	if !overflowed {
+		t.Fatal("expected session to be disconnected")
+	}
+}
+
+func TestRegistrationRevocation(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(sess *wamp.Session) wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		case msg := <-sess.Recv():
+			return msg
+		}
+		return nil
+	}
+	call := func(proc wamp.URI, args wamp.List, kwargs wamp.Dict) wamp.Message {
+		caller.Send(&wamp.Call{
+			Request:     wamp.GlobalID(),
+			Procedure:   proc,
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+		return recv(caller)
+	}
+
+	// Two callees that support registration revocation share a registration.
+	calleeDetails := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration":     true,
+					"registration_revocation": true,
+				},
+			},
+		},
+	}
+	callees := make([]*wamp.Session, 2)
+	var regID wamp.ID
+	for i := range callees {
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{Realm: testRealm, Details: calleeDetails})
+		if err = r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		welcome, ok := (<-client.Recv()).(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME")
+		}
+		callees[i] = &wamp.Session{Peer: client, ID: welcome.ID}
+		callees[i].Send(&wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+		})
+		registered, ok := recv(callees[i]).(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED")
+		}
+		regID = registered.Registration
+	}
+	checkRevoked := func(sess *wamp.Session, reason string) {
+		msg := recv(sess)
+		unreg, ok := msg.(*wamp.Unregistered)
+		if !ok {
+			t.Fatal("expected UNREGISTERED, got:", msg.MessageType())
+		}
+		if unreg.Request != 0 {
+			t.Fatal("revocation has non-zero request ID")
+		}
+		if id, _ := wamp.AsID(unreg.Details["registration"]); id != regID {
+			t.Fatal("wrong registration revoked:", unreg.Details)
+		}
+		if r := wamp.OptionString(unreg.Details, "reason"); r != reason {
+			t.Fatal("wrong revocation reason:", r)
+		}
+	}
+
+	// A killed callee is told its registration is revoked, before GOODBYE.
+	if msg := call(wamp.MetaProcSessionKill, wamp.List{callees[0].ID}, nil); msg.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got:", msg.MessageType())
+	}
+	checkRevoked(callees[0], string(wamp.ErrSessionKilled))
+	if msg := recv(callees[0]); msg.MessageType() != wamp.GOODBYE {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+
+	// The other callee keeps the registration, and gets the calls.
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	inv, ok := recv(callees[1]).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	callees[1].Send(&wamp.Yield{Request: inv.Request})
+	if msg := recv(caller); msg.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got:", msg.MessageType())
+	}
+
+	// Removing the callee from the registration revokes it, with the reason
+	// given, and deletes the registration.
+	msg := call(wamp.MetaProcRegRemoveCallee, wamp.List{regID, callees[1].ID},
+		wamp.Dict{"reason": "maintenance"})
+	if msg.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got:", msg)
+	}
+	checkRevoked(callees[1], "maintenance")
+	msg = call(testProcedure, nil, nil)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected", wamp.ErrNoSuchProcedure, "got:", msg)
+	}
+	msg = call(wamp.MetaProcRegRemoveCallee, wamp.List{regID, callees[1].ID}, nil)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchRegistration {
+		t.Fatal("expected", wamp.ErrNoSuchRegistration, "got:", msg)
+	}
+	callees[1].Close()
+	caller.Close()
+}
+
+func TestReflection(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() wamp.Message {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+	call := func(proc wamp.URI, args ...interface{}) wamp.Message {
+		client.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: proc,
+			Arguments: args,
+		})
+		return recv()
+	}
+
+	procDesc := wamp.Dict{
+		"args":   wamp.List{"name"},
+		"result": "greeting",
+	}
+	client.Send(&wamp.Register{
+		Request:   wamp.GlobalID(),
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptDescribe: procDesc},
+	})
+	registered, ok := recv().(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED")
+	}
+	const testTopic = wamp.URI("nexus.test.topic")
+	client.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptDescribe: "test events"},
+	})
+	if _, ok = recv().(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+
+	// The description is returned by wamp.registration.get.
+	result, ok := call(wamp.MetaProcRegGet, registered.Registration).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	dict, _ := wamp.AsDict(result.Arguments[0])
+	desc, _ := wamp.AsDict(dict[wamp.OptDescribe])
+	if desc["result"] != "greeting" {
+		t.Fatal("wrong description from registration get:", dict)
+	}
+
+	result, ok = call(wamp.MetaProcReflectProcedureList).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	procs, _ := wamp.AsList(result.Arguments[0])
+	var found bool
+	for _, p := range procs {
+		if p == testProcedure {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("procedure list missing", testProcedure, procs)
+	}
+
+	result, ok = call(wamp.MetaProcReflectTopicList).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	topics, _ := wamp.AsList(result.Arguments[0])
+	if len(topics) != 1 || topics[0] != testTopic {
+		t.Fatal("wrong topic list:", topics)
+	}
+
+	result, ok = call(wamp.MetaProcReflectDescribe, testProcedure).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	dict, _ = wamp.AsDict(result.Arguments[0])
+	proc, _ := wamp.AsDict(dict["procedure"])
+	desc, _ = wamp.AsDict(proc[wamp.OptDescribe])
+	if proc["uri"] != testProcedure || desc["result"] != "greeting" {
+		t.Fatal("wrong procedure description:", dict)
+	}
+	if _, ok = dict["topic"]; ok {
+		t.Fatal("procedure should not be described as a topic")
+	}
+
+	result, ok = call(wamp.MetaProcReflectDescribe, testTopic).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	dict, _ = wamp.AsDict(result.Arguments[0])
+	topic, _ := wamp.AsDict(dict["topic"])
+	if topic[wamp.OptMatch] != wamp.MatchExact || topic[wamp.OptDescribe] != "test events" {
+		t.Fatal("wrong topic description:", dict)
+	}
+	if _, ok = dict["procedure"]; ok {
+		t.Fatal("topic should not be described as a procedure")
+	}
+
+	if _, ok = call(wamp.MetaProcReflectDescribe).(*wamp.Error); !ok {
+		t.Fatal("expected ERROR without URI argument")
+	}
+}
+
+// rangeIDGen generates sequential IDs starting after base.
+type rangeIDGen struct {
+	base wamp.ID
+	gen  *wamp.SyncIDGen
+}
+
+func (g rangeIDGen) Next() wamp.ID { return g.base + g.gen.Next() }
+
+func TestIDGenerators(t *testing.T) {
+	defer leaktest.Check(t)()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		SessionIDGenerator: rangeIDGen{1000, wamp.NewSyncIDGen()},
+		RequestIDGenerator: rangeIDGen{2000, wamp.NewSyncIDGen()},
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The meta session is the first session of the realm.
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ID != 1002 {
+		t.Fatal("wrong session ID:", client.ID)
+	}
+
+	client.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   "nexus.test.topic",
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for PUBLISHED")
+	case msg := <-client.Recv():
+		published, ok := msg.(*wamp.Published)
+		if !ok {
+			t.Fatal("expected PUBLISHED, got", msg.MessageType())
+		}
+		if published.Publication <= 2000 || published.Publication > 2100 {
+			t.Fatal("publication ID not from generator:", published.Publication)
+		}
+	}
+}
+
+// scriptedIDGen generates the given IDs in order, and then repeats the last.
+type scriptedIDGen struct {
+	lock sync.Mutex
+	ids  []wamp.ID
+}
+
+func (g *scriptedIDGen) Next() wamp.ID {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	id := g.ids[0]
+	if len(g.ids) > 1 {
+		g.ids = g.ids[1:]
+	}
+	return id
+}
+
+func TestSessionIDCollision(t *testing.T) {
+	defer leaktest.Check(t)()
+	// The meta session gets ID 1, and the first client ID 2.  The second
+	// client is first given the IDs of the other two sessions.
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		SessionIDGenerator: &scriptedIDGen{ids: []wamp.ID{1, 2, 2, 1, 3, 3}},
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	client1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client1.ID != 2 || client2.ID != 3 {
+		t.Fatal("expected session IDs 2 and 3, got", client1.ID, client2.ID)
+	}
+
+	// The session details have the new ID.
+	client1.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{client2.ID},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	case msg := <-client1.Recv():
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		details, _ := wamp.AsDict(result.Arguments[0])
+		if id, _ := wamp.AsID(details["session"]); id != client2.ID {
+			t.Fatal("wrong session ID in details:", details["session"])
+		}
+	}
+
+	// A session is rejected if no unused ID can be generated for it.
+	if _, err = testClient(r); err == nil {
+		t.Fatal("expected session with ID in use to be rejected")
+	}
+}
+
+func TestDynamicAuthorizer(t *testing.T) {
+	defer leaktest.Check(t)()
+	const authzProc = wamp.URI("nexus.test.authorize")
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				DynamicAuthorizer: DynamicAuthorizer{
+					Procedure:   authzProc,
+					CacheTTL:    time.Minute,
+					Timeout:     200 * time.Millisecond,
+					CalleeRoles: []string{"anonymous"},
+				},
+			},
+		},
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	authz, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: authzProc})
+	if _, ok := (<-authz.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+
+	// Allow exact matches of topics beginning with "allowed.", deny others,
+	// and never answer for procedures beginning with "slow.".
+	invocations := make(chan wamp.List, 10)
+	go func() {
+		for msg := range authz.Recv() {
+			inv, ok := msg.(*wamp.Invocation)
+			if !ok {
+				continue
+			}
+			invocations <- inv.Arguments
+			uri, _ := wamp.AsURI(inv.Arguments[1])
+			if strings.HasPrefix(string(uri), "slow.") {
+				continue
+			}
+			options, _ := wamp.AsDict(inv.Arguments[3])
+			var decision interface{} = strings.HasPrefix(string(uri), "allowed.") &&
+				options[wamp.OptMatch] == wamp.MatchExact
+			if uri == "allowed.nocache" {
+				decision = wamp.Dict{"allow": true, "cache": false}
+			}
+			authz.Send(&wamp.Yield{
+				Request:   inv.Request,
+				Arguments: wamp.List{decision},
+			})
+		}
+	}()
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe := func(topic wamp.URI, options wamp.Dict) wamp.Message {
+		client.Send(&wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   topic,
+			Options: options,
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+	checkInvocation := func(uri wamp.URI, action, match string) {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("dynamic authorizer not called")
+		case args := <-invocations:
+			details, _ := wamp.AsDict(args[0])
+			if id, _ := wamp.AsID(details["session"]); id != client.ID {
+				t.Fatal("wrong session details:", details)
+			}
+			options, _ := wamp.AsDict(args[3])
+			if args[1] != uri || args[2] != action || options[wamp.OptMatch] != match {
+				t.Fatal("wrong authorizer arguments:", args)
+			}
+		}
+	}
+
+	if _, ok := subscribe("allowed.topic", nil).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	checkInvocation("allowed.topic", "subscribe", wamp.MatchExact)
+
+	errMsg, ok := subscribe("denied.topic", nil).(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected not_authorized ERROR")
+	}
+	checkInvocation("denied.topic", "subscribe", wamp.MatchExact)
+
+	// The decision is cached, unless the authorizer says not to.
+	if _, ok = subscribe("allowed.topic", nil).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok = subscribe("allowed.nocache", nil).(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED")
+		}
+		checkInvocation("allowed.nocache", "subscribe", wamp.MatchExact)
+	}
+
+	// The cached decision for an exact subscription does not allow a prefix
+	// subscription to the same URI.
+	errMsg, ok = subscribe("allowed.topic",
+		wamp.Dict{wamp.OptMatch: wamp.MatchPrefix}).(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected not_authorized ERROR")
+	}
+	checkInvocation("allowed.topic", "subscribe", wamp.MatchPrefix)
+	select {
+	case args := <-invocations:
+		t.Fatal("unexpected authorizer call:", args)
+	default:
+	}
+
+	// The request is denied if the authorizer does not answer in time.
+	client.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: "slow.proc"})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ERROR")
+	case msg := <-client.Recv():
+		errMsg, ok = msg.(*wamp.Error)
+		if !ok || errMsg.Error != wamp.ErrAuthorizationFailed {
+			t.Fatal("expected authorization_failed ERROR, got", msg)
+		}
+	}
+	checkInvocation("slow.proc", "call", wamp.MatchExact)
+}
+
+func TestDynamicAuthorizerRegistration(t *testing.T) {
+	defer leaktest.Check(t)()
+	const authzProc = wamp.URI("nexus.test.authorize")
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				AllowDisclose:  true,
+				Authenticators: []auth.Authenticator{extraAuthenticator{}},
+				DynamicAuthorizer: DynamicAuthorizer{
+					Procedure:   authzProc,
+					CalleeRoles: []string{"extra"},
+					AuthRole:    "router",
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	join := func(authmethod string) wamp.Peer {
+		details := wamp.Dict{}
+		for k, v := range clientRoles {
+			details[k] = v
+		}
+		details["authmethods"] = wamp.List{authmethod}
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{Realm: testRealm, Details: details})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		if msg := <-client.Recv(); msg.MessageType() != wamp.WELCOME {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		return client
+	}
+	register := func(client wamp.Peer, procedure wamp.URI, options wamp.Dict) wamp.Message {
+		client.Send(&wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: procedure,
+			Options:   options,
+		})
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for response")
+		case msg := <-client.Recv():
+			return msg
+		}
+		return nil
+	}
+	expectNotAuthorized := func(msg wamp.Message) {
+		if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("expected not_authorized ERROR, got", msg)
+		}
+	}
+
+	// A session without a callee role cannot register the procedure, or
+	// cover it with a pattern based registration.
+	anon := join("anonymous")
+	expectNotAuthorized(register(anon, authzProc, wamp.Dict{}))
+	expectNotAuthorized(register(anon, "nexus.test",
+		wamp.Dict{wamp.OptMatch: wamp.MatchPrefix}))
+	expectNotAuthorized(register(anon, "nexus..authorize",
+		wamp.Dict{wamp.OptMatch: wamp.MatchWildcard}))
+
+	// A session with a callee role can only register it with a single
+	// callee.
+	callee := join("x-extra")
+	expectNotAuthorized(register(callee, authzProc,
+		wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin}))
+	if msg := register(callee, authzProc, wamp.Dict{wamp.OptDiscloseCaller: true}); msg.MessageType() != wamp.REGISTERED {
+		t.Fatal("expected REGISTERED, got", msg)
+	}
+
+	// The procedure is called by a router session with the configured
+	// authrole and a generated session ID.
+	anon.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test.topic"})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("dynamic authorizer not called")
+	case msg := <-callee.Recv():
+		inv, ok := msg.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got", msg)
+		}
+		if wamp.OptionString(inv.Details, "caller_authrole") != "router" {
+			t.Fatal("wrong caller authrole:", inv.Details)
+		}
+		if wamp.OptionID(inv.Details, "caller") == 0 {
+			t.Fatal("caller session has no ID")
+		}
+		callee.Send(&wamp.Yield{Request: inv.Request, Arguments: wamp.List{true}})
+	}
+	if msg := <-anon.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("expected SUBSCRIBED, got", msg)
+	}
+	anon.Close()
+	callee.Close()
+}
+
+// extraAuthenticator is a custom authenticator that provides authextra, but
+// no authprovider.
+type extraAuthenticator struct{}
+
+func (a extraAuthenticator) AuthMethod() string { return "x-extra" }
+
+func (a extraAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	return &wamp.Welcome{Details: wamp.Dict{
+		"authid":    "extra-user",
+		"authrole":  "extra",
+		"authextra": wamp.Dict{"server_key": "abc"},
+	}}, nil
+}
+
+func TestWelcomeAuthDetails(t *testing.T) {
+	defer leaktest.Check(t)()
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
+		Role: func(authid string) (string, error) {
+			return "admin", nil
+		},
+		Name: "testkeys",
+	}
+	pubkey, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkeyHex := hex.EncodeToString(pubkey)
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Authenticators: []auth.Authenticator{
+					auth.NewTicketAuthenticator(keyStore, time.Second),
+					auth.NewCRAuthenticator(keyStore, time.Second),
+					auth.NewCryptoSignAuthenticator(func(authid, pubkey string) (string, error) {
+						return "device", nil
+					}, time.Second),
+					extraAuthenticator{},
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// welcome joins the realm using the authmethod, and returns the details
+	// of the WELCOME.
+	welcome := func(authmethod string, authextra wamp.Dict, respond func(*wamp.Challenge) string) wamp.Dict {
+		client, server := transport.LinkedPeers()
+		defer client.Close()
+		go client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authid":      "jdoe",
+				"authmethods": wamp.List{authmethod},
+				"authextra":   authextra,
+				"roles":       clientRoles["roles"],
+			},
+		})
+		go r.Attach(server)
+		for {
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for WELCOME")
+			case msg := <-client.Recv():
+				switch msg := msg.(type) {
+				case *wamp.Challenge:
+					go client.Send(&wamp.Authenticate{
+						Signature: respond(msg),
+						Extra:     wamp.Dict{},
+					})
+					continue
+				case *wamp.Welcome:
+					client.Send(&wamp.Goodbye{Reason: wamp.ErrCloseRealm, Details: wamp.Dict{}})
+					return msg.Details
+				}
+				t.Fatal("expected WELCOME, got:", msg.MessageType())
+			}
+		}
+	}
+	check := func(details wamp.Dict, authid, authrole, authmethod, authprovider string) {
+		for k, v := range map[string]string{
+			"authid":       authid,
+			"authrole":     authrole,
+			"authmethod":   authmethod,
+			"authprovider": authprovider,
+			"realm":        string(testRealm),
+		} {
+			if got := wamp.OptionString(details, k); v != "" && got != v {
+				t.Errorf("wrong %s in %s WELCOME: %q", k, authmethod, got)
+			}
+		}
+	}
+
+	details := welcome("anonymous", nil, nil)
+	check(details, "", "anonymous", "anonymous", "static")
+	if wamp.OptionString(details, "authid") == "" {
+		t.Error("missing authid in anonymous WELCOME")
+	}
+
+	details = welcome("wampcra", nil, func(ch *wamp.Challenge) string {
+		return crsign.SignChallenge(wamp.OptionString(ch.Extra, "challenge"),
+			[]byte("squeemishosafradge"))
+	})
+	check(details, "jdoe", "admin", "wampcra", "testkeys")
+
+	details = welcome("ticket", nil, func(ch *wamp.Challenge) string {
+		return "squeemishosafradge"
+	})
+	check(details, "jdoe", "admin", "ticket", "testkeys")
+
+	details = welcome("cryptosign", wamp.Dict{"pubkey": pubkeyHex},
+		func(ch *wamp.Challenge) string {
+			challenge, _ := hex.DecodeString(wamp.OptionString(ch.Extra, "challenge"))
+			return hex.EncodeToString(ed25519.Sign(privkey, challenge))
+		})
+	check(details, "jdoe", "device", "cryptosign", "static")
+	extra, _ := wamp.AsDict(details["authextra"])
+	if wamp.OptionString(extra, "pubkey") != pubkeyHex {
+		t.Error("missing pubkey in cryptosign WELCOME authextra")
+	}
+
+	// The router fills in the authprovider, and keeps the authextra, of a
+	// custom authenticator.
+	details = welcome("x-extra", nil, nil)
+	check(details, "extra-user", "extra", "x-extra", "static")
+	extra, _ = wamp.AsDict(details["authextra"])
+	if wamp.OptionString(extra, "server_key") != "abc" {
+		t.Error("missing authextra in custom WELCOME")
+	}
+}
+
+func TestSessionGetter(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	getter := r.(SessionGetter)
+
+	client, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, ok := getter.Session(testRealm, client.ID)
 	if !ok {
-		t.Fatal("Argument is not an int")
+		t.Fatal("session not found")
 	}
-	if count != 1 {
-		t.Fatal("Wring number of callees")
+	if sess.ID() != client.ID {
+		t.Fatal("wrong session ID:", sess.ID())
+	}
+	if sess.Realm() != testRealm {
+		t.Fatal("wrong realm:", sess.Realm())
+	}
+	if sess.AuthRole() != "anonymous" {
+		t.Fatal("wrong authrole:", sess.AuthRole())
+	}
+	if sess.AuthID() == "" {
+		t.Fatal("missing authid")
+	}
+	roles := sess.Roles()
+	expectRoles := []string{"callee", "caller", "publisher", "subscriber"}
+	if len(roles) != len(expectRoles) {
+		t.Fatal("wrong roles:", roles)
+	}
+	for i := range roles {
+		if roles[i] != expectRoles[i] {
+			t.Fatal("wrong roles:", roles)
+		}
+	}
+	if !sess.HasFeature("caller", "call_timeout") {
+		t.Fatal("missing caller feature")
+	}
+	if sess.HasRole("dealer") {
+		t.Fatal("session has role it did not announce")
+	}
+
+	// Changing the returned details does not change the session.
+	details := sess.Details()
+	wamp.DictChild(details, "roles")["dealer"] = wamp.Dict{}
+	details["authrole"] = "trusted"
+	if sess, _ = getter.Session(testRealm, client.ID); sess.HasRole("dealer") ||
+		sess.AuthRole() != "anonymous" {
+		t.Fatal("session changed by changing its details")
+	}
+
+	if _, ok = getter.Session(testRealm, client.ID+1); ok {
+		t.Fatal("found session that does not exist")
+	}
+	if _, ok = getter.Session("nexus.no.such.realm", client.ID); ok {
+		t.Fatal("found session in realm that does not exist")
+	}
+
+	client.Close()
+}
+
+func TestRealmList(t *testing.T) {
+	defer leaktest.Check(t)()
+	const adminRealm = wamp.URI("nexus.admin")
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{URI: testRealm, AnonymousAuth: true},
+		},
+		RealmTemplate: &RealmConfig{AnonymousAuth: true},
+		AdminRealm:    adminRealm,
+		Debug:         debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lister := r.(RealmLister)
+
+	if !lister.RealmExists(testRealm) {
+		t.Fatal("configured realm does not exist")
+	}
+	if lister.RealmExists(adminRealm) {
+		t.Fatal("admin realm exists before being created")
+	}
+	if realms := lister.Realms(); len(realms) != 1 || realms[0] != testRealm {
+		t.Fatal("wrong realms:", realms)
+	}
+
+	// Joining the admin realm creates it from the template.
+	admin, err := testClientInRealm(r, adminRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lister.RealmExists(adminRealm) {
+		t.Fatal("created realm does not exist")
+	}
+	want := []wamp.URI{adminRealm, testRealm}
+	if realms := lister.Realms(); len(realms) != len(want) || realms[0] != want[0] || realms[1] != want[1] {
+		t.Fatal("wrong realms:", realms)
+	}
+
+	admin.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcRouterRealmList})
+	msg := <-admin.Recv()
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", msg)
+	}
+	list, _ := wamp.AsList(result.Arguments[0])
+	if len(list) != len(want) || list[0] != want[0] || list[1] != want[1] {
+		t.Fatal("wrong realm list:", list)
+	}
+
+	// The procedure is only in the admin realm.
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcRouterRealmList})
+	if e, ok := (<-cli.Recv()).(*wamp.Error); !ok || e.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected", wamp.ErrNoSuchProcedure)
+	}
+}
+
+func TestRemoveRealm(t *testing.T) {
+	defer leaktest.Check(t)()
+	const otherRealm = wamp.URI("nexus.test.other")
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{URI: testRealm, AnonymousAuth: true},
+			{URI: otherRealm, AnonymousAuth: true},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	remover := r.(RealmRemover)
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := testClientInRealm(r, otherRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: wamp.URI("nexus.test.topic")})
+	if _, ok := (<-cli.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+
+	if err = remover.RemoveRealm(testRealm); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GOODBYE")
+	case msg := <-cli.Recv():
+		goodbye, ok := msg.(*wamp.Goodbye)
+		if !ok {
+			t.Fatal("expected GOODBYE, got:", msg)
+		}
+		if goodbye.Reason != wamp.ErrSystemShutdown {
+			t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+		}
+	}
+	if r.(RealmLister).RealmExists(testRealm) {
+		t.Fatal("removed realm still exists")
+	}
+	if err = remover.RemoveRealm(testRealm); err == nil {
+		t.Fatal("expected error removing realm that does not exist")
+	}
+
+	// New clients cannot join the removed realm.
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error joining removed realm")
+	}
+	if abort, ok := (<-client.Recv()).(*wamp.Abort); !ok || abort.Reason != wamp.ErrNoSuchRealm {
+		t.Fatal("expected", wamp.ErrNoSuchRealm)
+	}
+
+	// The other realm is not affected.
+	other.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionCount})
+	if _, ok := (<-other.Recv()).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT from other realm")
+	}
+}
+
+func TestGoodbyeWithPendingCall(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{"call_canceling": true},
+			},
+		},
+	}
+	join := func(details wamp.Dict) wamp.Peer {
+		client, server := transport.LinkedPeers()
+		go client.Send(&wamp.Hello{Realm: testRealm, Details: details})
+		if err := r.Attach(server); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := (<-client.Recv()).(*wamp.Welcome); !ok {
+			t.Fatal("expected WELCOME")
+		}
+		return client
+	}
+	callee := join(calleeRoles)
+	defer callee.Close()
+	caller := join(clientRoles)
+
+	// The caller also registers and subscribes, so that it has everything
+	// to clean up when it leaves.
+	for _, msg := range []wamp.Message{
+		&wamp.Register{Request: wamp.GlobalID(), Procedure: "nexus.test.caller.proc"},
+		&wamp.Subscribe{Request: wamp.GlobalID(), Topic: "nexus.test.topic"},
+	} {
+		caller.Send(msg)
+		rsp := <-caller.Recv()
+		if rsp.MessageType() != wamp.REGISTERED && rsp.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("unexpected response:", rsp)
+		}
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED")
+	}
+
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	// The caller leaves in the middle of the call.
+	caller.Send(&wamp.Goodbye{Reason: wamp.ErrCloseRealm, Details: wamp.Dict{}})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GOODBYE")
+	case msg := <-caller.Recv():
+		if _, ok = msg.(*wamp.Goodbye); !ok {
+			t.Fatal("expected GOODBYE, got:", msg)
+		}
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("callee not interrupted")
+	case msg := <-callee.Recv():
+		intr, ok := msg.(*wamp.Interrupt)
+		if !ok || intr.Request != inv.Request {
+			t.Fatal("expected INTERRUPT for invocation, got:", msg)
+		}
+	}
+	// The callee's late response is dropped.
+	callee.Send(&wamp.Yield{Request: inv.Request})
+
+	// The caller's registration and subscription are gone.
+	callee.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcRegLookup,
+		Arguments: wamp.List{"nexus.test.caller.proc"}})
+	if result, ok := (<-callee.Recv()).(*wamp.Result); !ok || result.Arguments[0] != wamp.ID(0) {
+		t.Fatal("registration of caller not removed")
+	}
+	callee.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSubLookup,
+		Arguments: wamp.List{"nexus.test.topic"}})
+	if result, ok := (<-callee.Recv()).(*wamp.Result); !ok || result.Arguments[0] != wamp.ID(0) {
+		t.Fatal("subscription of caller not removed")
 	}
 }
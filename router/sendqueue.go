@@ -0,0 +1,252 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Policies for handling a message sent to a session whose send queue is full,
+// set by RealmConfig.SendQueuePolicy.
+const (
+	// Wait for room in the queue.  This stalls the router goroutine sending
+	// the message, such as the broker delivering events to other
+	// subscribers, until the session catches up.
+	SendQueueBlock = "block"
+	// Discard the oldest EVENT in the queue to make room for the new message.
+	// If the queue has no EVENT to discard, then a new EVENT is discarded,
+	// and any other new message is handled as for SendQueueDisconnect.  Only
+	// EVENT messages are ever dropped, since losing a RESULT, ERROR, or
+	// INVOCATION would leave a call unanswered.
+	SendQueueDropOldest = "drop_oldest"
+	// Discard the queued messages and close the session with a GOODBYE.
+	SendQueueDisconnect = "disconnect"
+)
+
+const (
+	// Longest time to wait between attempts to deliver a queued message to a
+	// blocked peer.
+	maxSendQueueRetryDelay = 100 * time.Millisecond
+	// Time allowed, when the session is closed, to deliver the messages still
+	// in the queue, such as the final GOODBYE.
+	sendQueueFlushTimeout = time.Second
+)
+
+// queuePeer wraps the Peer of a session to give it a bounded outbound queue.
+// Messages sent to the peer go into the queue, and a separate goroutine
+// delivers them to the session's transport.  When the queue is full, the
+// queue's policy determines what happens to a new message.
+type queuePeer struct {
+	wamp.Peer
+	size   int
+	policy string
+
+	// Called, once, when the queue overflows and the session must be
+	// disconnected.
+	overflow func()
+
+	// Protects queue and overflowed.
+	lock       sync.Mutex
+	queue      []wamp.Message
+	overflowed bool
+
+	// Signaled when a message is added to, or removed from, the queue.
+	ready chan struct{}
+	space chan struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newQueuePeer wraps the peer with a queue of the given size and overflow
+// policy.  Queued messages are not delivered to the peer until start is
+// called.
+func newQueuePeer(peer wamp.Peer, size int, policy string, overflow func()) *queuePeer {
+	return &queuePeer{
+		Peer:     peer,
+		size:     size,
+		policy:   policy,
+		overflow: overflow,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start starts delivering queued messages to the peer.  This must be called
+// exactly once before the queue peer is closed.
+func (p *queuePeer) start() {
+	go p.deliverQueued()
+}
+
+// TrySend adds a message to the queue, applying the queue's policy if the
+// queue is full.  A GOODBYE is always queued, so that closing a session never
+// waits for room in its queue.  wamp.ErrBlocked is returned if the message is
+// discarded.
+func (p *queuePeer) TrySend(msg wamp.Message) error {
+	p.lock.Lock()
+	if _, ok := msg.(*wamp.Goodbye); ok || p.overflowed || len(p.queue) < p.size {
+		defer p.lock.Unlock()
+		return p.push(msg)
+	}
+	if p.policy == SendQueueBlock {
+		p.lock.Unlock()
+		return p.Send(msg)
+	}
+	defer p.lock.Unlock()
+	if p.policy == SendQueueDropOldest {
+		if p.dropOldestEvent() {
+			return p.push(msg)
+		}
+		if _, ok := msg.(*wamp.Event); ok {
+			return wamp.ErrBlocked
+		}
+	}
+	return p.disconnect(msg)
+}
+
+// Send adds a message to the queue, waiting for room if the queue is full.
+// This is only for use by goroutines that are allowed to block.
+func (p *queuePeer) Send(msg wamp.Message) error {
+	for {
+		p.lock.Lock()
+		if p.overflowed || len(p.queue) < p.size {
+			err := p.push(msg)
+			if len(p.queue) < p.size {
+				// Let any other waiting sender use the remaining room.
+				signal(p.space)
+			}
+			p.lock.Unlock()
+			return err
+		}
+		p.lock.Unlock()
+		select {
+		case <-p.space:
+		case <-p.closing:
+			return wamp.ErrBlocked
+		}
+	}
+}
+
+// push adds a message to the queue.  Once the queue has overflowed, only the
+// GOODBYE to the session is queued.  The caller must hold the lock.
+func (p *queuePeer) push(msg wamp.Message) error {
+	if p.overflowed {
+		if _, ok := msg.(*wamp.Goodbye); !ok {
+			return wamp.ErrBlocked
+		}
+	}
+	p.queue = append(p.queue, msg)
+	signal(p.ready)
+	return nil
+}
+
+// dropOldestEvent removes the oldest EVENT from the queue.  Returns false if
+// the queue has no EVENT.  The caller must hold the lock.
+func (p *queuePeer) dropOldestEvent() bool {
+	for i, msg := range p.queue {
+		if _, ok := msg.(*wamp.Event); ok {
+			copy(p.queue[i:], p.queue[i+1:])
+			p.queue[len(p.queue)-1] = nil
+			p.queue = p.queue[:len(p.queue)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// disconnect handles a full queue that requires the session to be closed.
+// The queued messages are discarded and the overflow function is called to
+// close the session.  After that, only the GOODBYE to the session is queued.
+// The caller must hold the lock.
+func (p *queuePeer) disconnect(msg wamp.Message) error {
+	p.queue = nil
+	p.overflowed = true
+	p.overflow()
+	return p.push(msg)
+}
+
+// pop removes and returns the oldest message in the queue.  Returns false if
+// the queue is empty.
+func (p *queuePeer) pop() (wamp.Message, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.queue) == 0 {
+		return nil, false
+	}
+	msg := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	signal(p.space)
+	return msg, true
+}
+
+// Close delivers any queued messages, unless the peer stays blocked for too
+// long, and then closes the peer.  This is safe to call more than once.
+func (p *queuePeer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		<-p.done
+		p.Peer.Close()
+	})
+}
+
+// deliverQueued sends messages from the queue to the peer until the queue
+// peer is closed.
+func (p *queuePeer) deliverQueued() {
+	defer close(p.done)
+	for {
+		msg, ok := p.pop()
+		if !ok {
+			select {
+			case <-p.ready:
+				continue
+			case <-p.closing:
+				p.flush(nil)
+				return
+			}
+		}
+		if !p.deliver(msg, p.closing) {
+			p.flush(msg)
+			return
+		}
+	}
+}
+
+// flush delivers the given message, if not nil, followed by the messages
+// remaining in the queue.  Delivery stops if the flush timeout expires.
+func (p *queuePeer) flush(msg wamp.Message) {
+	expired := make(chan struct{})
+	timer := time.AfterFunc(sendQueueFlushTimeout, func() { close(expired) })
+	defer timer.Stop()
+	for {
+		if msg != nil && !p.deliver(msg, expired) {
+			return
+		}
+		var ok bool
+		if msg, ok = p.pop(); !ok {
+			return
+		}
+	}
+}
+
+// deliver sends a message to the peer.  If the peer is blocked, then sending
+// is retried, with backoff, until the peer accepts the message or the stop
+// channel is ready.  Returns false if stopped before the message is sent.
+func (p *queuePeer) deliver(msg wamp.Message, stop <-chan struct{}) bool {
+	delay := time.Millisecond
+	for p.Peer.TrySend(msg) == wamp.ErrBlocked {
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return false
+		}
+		if delay < maxSendQueueRetryDelay {
+			delay *= 2
+		}
+	}
+	return true
+}
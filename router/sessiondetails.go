@@ -0,0 +1,100 @@
+package router
+
+import (
+	"sort"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// SessionDetails is a read-only view of a session attached to a realm, for
+// applications that embed the router.  It is a copy of the session's details
+// taken when it was retrieved, so it does not change if the session does, and
+// changing what it returns does not change the session.
+type SessionDetails struct {
+	id      wamp.ID
+	realm   wamp.URI
+	details wamp.Dict
+}
+
+// ID returns the session ID.
+func (s *SessionDetails) ID() wamp.ID { return s.id }
+
+// Realm returns the URI of the realm the session is attached to.
+func (s *SessionDetails) Realm() wamp.URI { return s.realm }
+
+// AuthID returns the authid of the session.
+func (s *SessionDetails) AuthID() string {
+	return wamp.OptionString(s.details, "authid")
+}
+
+// AuthRole returns the authrole of the session.
+func (s *SessionDetails) AuthRole() string {
+	return wamp.OptionString(s.details, "authrole")
+}
+
+// AuthMethod returns the authmethod used to authenticate the session.
+func (s *SessionDetails) AuthMethod() string {
+	return wamp.OptionString(s.details, "authmethod")
+}
+
+// Roles returns the names of the roles that the client announced, in sorted
+// order.
+func (s *SessionDetails) Roles() []string {
+	roles := wamp.DictChild(s.details, "roles")
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasRole returns true if the client announced the role.
+func (s *SessionDetails) HasRole(role string) bool {
+	return wamp.Session{Details: s.details}.HasRole(role)
+}
+
+// HasFeature returns true if the client announced the feature for the role.
+func (s *SessionDetails) HasFeature(role, feature string) bool {
+	return wamp.Session{Details: s.details}.HasFeature(role, feature)
+}
+
+// Details returns a copy of all the details of the session, as returned by
+// the wamp.session.get meta procedure.
+func (s *SessionDetails) Details() wamp.Dict {
+	return copyValue(s.details).(wamp.Dict)
+}
+
+// newSessionDetails returns a view of the session, which is attached to the
+// realm.
+func newSessionDetails(sess *wamp.Session, realm wamp.URI) *SessionDetails {
+	return &SessionDetails{
+		id:      sess.ID,
+		realm:   realm,
+		details: copyValue(sessionInfo(sess)).(wamp.Dict),
+	}
+}
+
+// copyValue returns a copy of a value, copying any dictionaries and lists
+// nested in it.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case wamp.Dict:
+		d := make(wamp.Dict, len(v))
+		for k, val := range v {
+			d[k] = copyValue(val)
+		}
+		return d
+	case map[string]interface{}:
+		return copyValue(wamp.Dict(v))
+	case wamp.List:
+		l := make(wamp.List, len(v))
+		for i, val := range v {
+			l[i] = copyValue(val)
+		}
+		return l
+	case []interface{}:
+		return copyValue(wamp.List(v))
+	}
+	return v
+}
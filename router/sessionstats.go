@@ -0,0 +1,98 @@
+package router
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// SessionStats contains counters describing the activity of a session during
+// its lifetime in a realm.  These are delivered to RealmConfig.OnDetach when
+// the session leaves the realm, and are intended for per-session usage
+// accounting.
+//
+// Byte counts are not included, since messages are serialized by the
+// transport and the router only sees deserialized messages.
+type SessionStats struct {
+	// Number of messages the router delivered to the session's transport.
+	// If the realm has a send queue, then messages still in the queue when
+	// the session leaves are not counted.
+	MessagesSent uint64
+	// Number of messages the router received from the session.
+	MessagesRecvd uint64
+
+	// Number of subscriptions and registrations made by the session.  Only
+	// requests that succeeded, and were answered with SUBSCRIBED or
+	// REGISTERED, are counted.
+	Subscribes    uint64
+	Registrations uint64
+	// Number of CALL and PUBLISH requests made by the session, whether or not
+	// they succeeded.
+	Calls        uint64
+	Publications uint64
+
+	// Time the session joined the realm, and how long the session was
+	// attached to the realm.
+	Joined   time.Time
+	Duration time.Duration
+}
+
+// countRecvd updates the counters for a message received from the session.
+//
+// This is only called from the session's message handling goroutine, so the
+// received counters do not need to be updated atomically.
+func (s *SessionStats) countRecvd(msg wamp.Message) {
+	s.MessagesRecvd++
+	switch msg.(type) {
+	case *wamp.Call:
+		s.Calls++
+	case *wamp.Publish:
+		s.Publications++
+	}
+}
+
+// statsPeer wraps the Peer of a session to count the messages sent to the
+// session, and the successful subscriptions and registrations.  Messages are
+// sent to a session by the broker, dealer, and realm goroutines, or by the
+// session's send queue, so the counts are updated atomically.
+type statsPeer struct {
+	wamp.Peer
+	sent       uint64
+	subscribed uint64
+	registered uint64
+}
+
+func (p *statsPeer) Send(msg wamp.Message) error {
+	err := p.Peer.Send(msg)
+	if err == nil {
+		p.countSent(msg)
+	}
+	return err
+}
+
+func (p *statsPeer) TrySend(msg wamp.Message) error {
+	err := p.Peer.TrySend(msg)
+	if err == nil {
+		p.countSent(msg)
+	}
+	return err
+}
+
+// countSent updates the counters for a message sent to the peer.
+func (p *statsPeer) countSent(msg wamp.Message) {
+	atomic.AddUint64(&p.sent, 1)
+	switch msg.(type) {
+	case *wamp.Subscribed:
+		atomic.AddUint64(&p.subscribed, 1)
+	case *wamp.Registered:
+		atomic.AddUint64(&p.registered, 1)
+	}
+}
+
+// updateStats sets the counters, in stats, of messages sent to the peer.
+func (p *statsPeer) updateStats(stats *SessionStats) {
+	stats.MessagesSent = atomic.LoadUint64(&p.sent)
+	stats.Subscribes = atomic.LoadUint64(&p.subscribed)
+	stats.Registrations = atomic.LoadUint64(&p.registered)
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"sync/atomic"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// RealmStats contains counts describing the current state of a realm, and
+// its activity since the realm was created.
+type RealmStats struct {
+	// Number of client sessions attached to the realm.
+	Sessions int
+	// Number of subscriptions, counting each subscriber's subscription to a
+	// topic separately.
+	Subscriptions int
+	// Number of registrations, not including meta procedures.
+	Registrations int
+
+	// Number of messages routed by the realm's broker and dealer.
+	MessagesRouted uint64
+	// Number of publications routed to subscribers, including the meta events
+	// published by the router.
+	Publications uint64
+	// Number of EVENT messages sent to subscribers for publications.
+	Events uint64
+	// Number of CALL messages routed to callees.
+	Calls uint64
+}
+
+// StatsReporter is implemented by a Router that reports the statistics of its
+// realms.  The Router returned by NewRouter implements it.
+type StatsReporter interface {
+	// Stats returns the statistics of each realm on the router.
+	Stats() map[wamp.URI]RealmStats
+	// RealmStats returns the statistics of one realm.  Returns false if the
+	// router has no such realm.
+	RealmStats(realm wamp.URI) (RealmStats, bool)
+}
+
+// The counters below are updated atomically by the goroutines that handle
+// messages, so that reading statistics does not wait for message routing.
+// Each is allocated separately to keep its 64-bit fields aligned.
+
+type realmStats struct {
+	sessions int64
+}
+
+type brokerStats struct {
+	routed        uint64
+	publications  uint64
+	events        uint64
+	subscriptions int64
+}
+
+type dealerStats struct {
+	routed        uint64
+	calls         uint64
+	registrations int64
+}
+
+// stats returns the statistics of the realm and its broker and dealer.
+func (r *realm) stats() RealmStats {
+	return RealmStats{
+		Sessions:       int(atomic.LoadInt64(&r.counters.sessions)),
+		Subscriptions:  int(atomic.LoadInt64(&r.broker.stats.subscriptions)),
+		Registrations:  int(atomic.LoadInt64(&r.dealer.stats.registrations)),
+		MessagesRouted: atomic.LoadUint64(&r.broker.stats.routed) + atomic.LoadUint64(&r.dealer.stats.routed),
+		Publications:   atomic.LoadUint64(&r.broker.stats.publications),
+		Events:         atomic.LoadUint64(&r.broker.stats.events),
+		Calls:          atomic.LoadUint64(&r.dealer.stats.calls),
+	}
+}
+
+// Stats returns the statistics of each realm on the router.
+func (r *router) Stats() map[wamp.URI]RealmStats {
+	var realms []*realm
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		for _, realm := range r.realms {
+			realms = append(realms, realm)
+		}
+		close(sync)
+	}
+	<-sync
+	stats := make(map[wamp.URI]RealmStats, len(realms))
+	for _, realm := range realms {
+		stats[realm.uri] = realm.stats()
+	}
+	return stats
+}
+
+// RealmStats returns the statistics of the realm.  Returns false if the router
+// has no such realm.
+func (r *router) RealmStats(uri wamp.URI) (RealmStats, bool) {
+	retChan := make(chan *realm)
+	r.actionChan <- func() {
+		retChan <- r.realms[uri]
+	}
+	realm := <-retChan
+	if realm == nil {
+		return RealmStats{}, false
+	}
+	return realm.stats(), true
+}
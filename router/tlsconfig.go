@@ -0,0 +1,38 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// errNoCertificate is returned when a server is asked to use TLS without a
+// certificate to present to clients.
+var errNoCertificate = errors.New(
+	"TLS requires a certificate: tls.Config has no certificate, and no " +
+		"certFile and keyFile were given")
+
+// serverTLSConfig returns the TLS configuration for a server.  If tlscfg does
+// not already contain a certificate, then certFile and keyFile, if specified,
+// are used to load an X509 certificate.  An error is returned if there is no
+// certificate, so that the server fails when started instead of when clients
+// connect.
+func serverTLSConfig(tlscfg *tls.Config, certFile, keyFile string) (*tls.Config, error) {
+	var hasCert bool
+	if tlscfg == nil {
+		tlscfg = &tls.Config{}
+	} else if len(tlscfg.Certificates) > 0 || tlscfg.GetCertificate != nil {
+		hasCert = true
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading X509 key pair: %s", err)
+		}
+		tlscfg.Certificates = []tls.Certificate{cert}
+	} else if !hasCert {
+		return nil, errNoCertificate
+	}
+	return tlscfg, nil
+}
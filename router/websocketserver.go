@@ -1,22 +1,38 @@
 package router
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/transport/serialize"
+	"github.com/gammazero/nexus/wamp"
 	"github.com/gorilla/websocket"
 )
 
 const (
 	jsonWebsocketProtocol    = "wamp.2.json"
 	msgpackWebsocketProtocol = "wamp.2.msgpack"
+	cborWebsocketProtocol    = "wamp.2.cbor"
+
+	// Name of the tracking cookie, if WebsocketServer.CookieName is not set.
+	defaultCookieName = "nexus_cbtid"
+
+	// Time to wait, when closing the server, for clients to respond to the
+	// websocket close handshake before their connections are closed.
+	wsDrainTimeout = 5 * time.Second
 )
 
 type protocol struct {
@@ -33,10 +49,51 @@ type WebsocketServer struct {
 	// Serializer for binary frames.  Defaults to MessagePackSerializer.
 	BinarySerializer serialize.Serializer
 
+	// EnableCompression allows clients to negotiate per-message compression
+	// (permessage-deflate).  Only the "no context takeover" mode is
+	// supported, so no compression state is kept between messages.
+	// Compression can be turned off for individual realms using
+	// RealmConfig.DisableCompression.
+	EnableCompression bool
+	// When compression is used, messages smaller than this number of bytes
+	// are sent uncompressed.  Zero compresses all messages.
+	CompressionThreshold int
+
+	// Send a websocket ping to each client at this interval, and close the
+	// client's connection if a pong is not received within PongTimeout of a
+	// ping.  This detects dead connections, and keeps connections from being
+	// dropped by proxies and load balancers, when sessions are quiet.  If
+	// PongTimeout is zero, then it is the same as PingInterval.  Zero
+	// PingInterval, the default, disables pings.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// CookieStore enables tracking cookies, which let browser clients be
+	// authenticated by cookie when they reconnect.  Each client that does
+	// not present a cookie known to the store is given a new cookie with a
+	// random token, which is included in the transport details given to
+	// authenticators.  The same store must be given to the
+	// auth.CookieAuthenticator of each realm that accepts cookie
+	// authentication.  A cookie only authenticates the client in the realm
+	// that it was remembered in.  Nil, the default, disables tracking cookies.
+	CookieStore auth.CookieStore
+	// Name of the tracking cookie.  The default is "nexus_cbtid".
+	CookieName string
+	// Max-Age of the tracking cookie.  Zero, the default, makes the cookie
+	// last until the browser is closed.
+	CookieMaxAge time.Duration
+
 	router Router
 
 	protocols map[string]protocol
 	log       stdlog.StdLog
+
+	// Open connections and listeners, closed when the server is closed.
+	conns     map[*websocket.Conn]struct{}
+	listeners []io.Closer
+	connWait  sync.WaitGroup
+	closed    bool
+	closeLock sync.Mutex
 }
 
 // NewWebsocketServer takes a router instance and creates a new websocket
@@ -60,12 +117,15 @@ func NewWebsocketServer(r Router) *WebsocketServer {
 		router:    r,
 		protocols: map[string]protocol{},
 		log:       r.Logger(),
+		conns:     map[*websocket.Conn]struct{}{},
 	}
 	s.Upgrader = &websocket.Upgrader{}
 	s.addProtocol(jsonWebsocketProtocol, websocket.TextMessage,
 		&serialize.JSONSerializer{})
 	s.addProtocol(msgpackWebsocketProtocol, websocket.BinaryMessage,
 		&serialize.MessagePackSerializer{})
+	s.addProtocol(cborWebsocketProtocol, websocket.BinaryMessage,
+		&serialize.CBORSerializer{})
 
 	return s
 }
@@ -84,6 +144,9 @@ func (s *WebsocketServer) ListenAndServe(address string) (io.Closer, error) {
 		Handler: s,
 		Addr:    l.Addr().String(),
 	}
+	if err = s.addListener(l); err != nil {
+		return nil, err
+	}
 	go server.Serve(l)
 	return l, nil
 }
@@ -92,24 +155,15 @@ func (s *WebsocketServer) ListenAndServe(address string) (io.Closer, error) {
 // goroutine that accepts new TLS client connections until the returned
 // io.closer is closed.  If tls.Config does not already contain a certificate,
 // then certFile and keyFile, if specified, are used to load an X509
-// certificate.
+// certificate.  An error is returned if there is no certificate.
+//
+// To have clients present certificates, set ClientAuth in tls.Config.  The
+// subject of a client's certificate is included in the transport details
+// given to authenticators, and in the session details.
 func (s *WebsocketServer) ListenAndServeTLS(address string, tlscfg *tls.Config, certFile, keyFile string) (io.Closer, error) {
-	// With Go 1.9, code below, until tls.Listen, can be removed when using:
-	//go server.ServeTLS(l, certFile, keyFile)
-	var hasCert bool
-	if tlscfg == nil {
-		tlscfg = &tls.Config{}
-	} else if len(tlscfg.Certificates) > 0 || tlscfg.GetCertificate != nil {
-		hasCert = true
-	}
-
-	if !hasCert || certFile != "" || keyFile != "" {
-		var err error
-		tlscfg.Certificates = make([]tls.Certificate, 1)
-		tlscfg.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return nil, fmt.Errorf("error loading X509 key pair: %s", err)
-		}
+	tlscfg, err := serverTLSConfig(tlscfg, certFile, keyFile)
+	if err != nil {
+		return nil, err
 	}
 
 	l, err := tls.Listen("tcp", address, tlscfg)
@@ -124,6 +178,9 @@ func (s *WebsocketServer) ListenAndServeTLS(address string, tlscfg *tls.Config,
 		Addr:      l.Addr().String(),
 		TLSConfig: tlscfg,
 	}
+	if err = s.addListener(l); err != nil {
+		return nil, err
+	}
 
 	go server.Serve(l)
 	//go server.ServeTLS(l, certFile, keyFile)
@@ -133,13 +190,167 @@ func (s *WebsocketServer) ListenAndServeTLS(address string, tlscfg *tls.Config,
 
 // ServeHTTP handles HTTP connections.
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	s.closeLock.Lock()
+	closed := s.closed
+	s.closeLock.Unlock()
+	if closed {
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	upgrader := s.Upgrader
+	if s.EnableCompression && !upgrader.EnableCompression {
+		u := *upgrader
+		u.EnableCompression = true
+		upgrader = &u
+	}
+	header := http.Header{}
+	if websocket.IsWebSocketUpgrade(r) {
+		// Select the serializer that the client prefers, rather than let
+		// the upgrader select the first one that the server has.
+		proto, ok := s.selectProtocol(r)
+		if !ok {
+			s.log.Println("Websocket client offered no supported subprotocol:",
+				websocket.Subprotocols(r))
+			http.Error(w, "no supported websocket subprotocol, expected one of: "+
+				strings.Join(s.protocolNames(), ", "), http.StatusBadRequest)
+			return
+		}
+		u := *upgrader
+		u.Subprotocols = nil
+		upgrader = &u
+		header.Set("Sec-Websocket-Protocol", proto)
+	}
+	var cookie string
+	if s.CookieStore != nil {
+		cookie = s.trackingCookie(r, header)
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		s.log.Println("Error upgrading to websocket connection:", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.handleWebsocket(conn)
+	s.handleWebsocket(conn, cookie)
+}
+
+// trackingCookie returns the token of the client's tracking cookie, and adds
+// the cookie to the response header.  The client's cookie is used if it is
+// known to the cookie store.  Otherwise, a new cookie is created, so that a
+// client cannot choose the token of its cookie.
+func (s *WebsocketServer) trackingCookie(r *http.Request, header http.Header) string {
+	name := s.CookieName
+	if name == "" {
+		name = defaultCookieName
+	}
+	var token string
+	if c, err := r.Cookie(name); err == nil {
+		if _, ok := s.CookieStore.Get(c.Value); ok {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			s.log.Println("Error creating tracking cookie:", err)
+			return ""
+		}
+		token = hex.EncodeToString(b)
+	}
+	c := &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.CookieMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	}
+	header.Add("Set-Cookie", c.String())
+	return token
+}
+
+// Close stops the server from accepting new connections, and closes any
+// listeners started by the server's ListenAndServe methods.  Then, each
+// client connection is closed with a websocket close handshake, which the
+// router handles as the client leaving the realm.  Close returns when all
+// connections are closed.  Connections that do not finish the close
+// handshake within a few seconds are closed without it.
+func (s *WebsocketServer) Close() error {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = nil
+	conns := make([]*websocket.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.closeLock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway,
+		"server closing")
+	deadline := time.Now().Add(wsDrainTimeout)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wsDrainTimeout):
+		s.log.Println("Closing websocket connections that did not close")
+		for _, conn := range conns {
+			conn.Close()
+		}
+		<-done
+	}
+	return nil
+}
+
+// addListener records a listener to close when the server is closed.  If the
+// server is already closed, then the listener is closed and an error returned.
+func (s *WebsocketServer) addListener(l io.Closer) error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closed {
+		l.Close()
+		return errors.New("server closed")
+	}
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// selectProtocol returns the first of the websocket subprotocols requested by
+// the client, in the client's order of preference, that the server has a
+// serializer for.  Returns false if there is none.
+func (s *WebsocketServer) selectProtocol(r *http.Request) (string, bool) {
+	for _, proto := range websocket.Subprotocols(r) {
+		if _, ok := s.protocols[proto]; ok {
+			return proto, true
+		}
+	}
+	return "", false
+}
+
+// protocolNames returns the websocket subprotocols that the server has
+// serializers for, in sorted order.
+func (s *WebsocketServer) protocolNames() []string {
+	names := make([]string, 0, len(s.protocols))
+	for proto := range s.protocols {
+		names = append(names, proto)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // addProtocol registers a serializer for protocol and payload type.
@@ -155,7 +366,7 @@ func (s *WebsocketServer) addProtocol(proto string, payloadType int, serializer
 	return nil
 }
 
-func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
+func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn, cookie string) {
 	var serializer serialize.Serializer
 	var payloadType int
 	// Get serializer and payload type for protocol.
@@ -172,16 +383,104 @@ func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
 		case msgpackWebsocketProtocol:
 			serializer = &serialize.MessagePackSerializer{}
 			payloadType = websocket.BinaryMessage
+		case cborWebsocketProtocol:
+			serializer = &serialize.CBORSerializer{}
+			payloadType = websocket.BinaryMessage
 		default:
 			conn.Close()
 			return
 		}
 	}
 
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.connWait.Add(1)
+	s.closeLock.Unlock()
+
 	// Create a websocket peer from the websocket connection and attach the
-	// peer to the router.
-	peer := transport.NewWebsocketPeer(conn, serializer, payloadType, s.log)
+	// peer to the router.  The peer is wrapped so that the server knows when
+	// the router closes it.
+	peer := &wsServerPeer{
+		Peer:   transport.NewWebsocketPeer(conn, serializer, payloadType, s.log),
+		cookie: cookie,
+		done: func() {
+			s.closeLock.Lock()
+			delete(s.conns, conn)
+			s.closeLock.Unlock()
+			s.connWait.Done()
+		},
+	}
+	if s.EnableCompression {
+		peer.SetCompression(true, s.CompressionThreshold)
+	}
+	if s.PingInterval > 0 {
+		if k, ok := peer.Peer.(transport.KeepAliver); ok {
+			k.StartKeepAlive(s.PingInterval, s.PongTimeout)
+		}
+	}
 	if err := s.router.Attach(peer); err != nil {
 		s.log.Println("Error attaching to router:", err)
+		// The router does not close the peer for all errors.
+		peer.Close()
+	}
+}
+
+// wsServerPeer is a websocket peer that tells the server when it is closed.
+type wsServerPeer struct {
+	wamp.Peer
+	// Token of the client's tracking cookie, if any.
+	cookie    string
+	done      func()
+	closeOnce sync.Once
+}
+
+// Close closes the peer.  This is safe to call more than once.
+func (p *wsServerPeer) Close() {
+	p.closeOnce.Do(func() {
+		p.Peer.Close()
+		p.done()
+	})
+}
+
+// SetCompression sets whether messages sent to the client are compressed.
+func (p *wsServerPeer) SetCompression(enable bool, threshold int) {
+	if c, ok := p.Peer.(transport.Compressor); ok {
+		c.SetCompression(enable, threshold)
+	}
+}
+
+// SetRecvLimit sets the maximum size of messages received from the client.
+func (p *wsServerPeer) SetRecvLimit(limit int) {
+	if l, ok := p.Peer.(transport.RecvLimiter); ok {
+		l.SetRecvLimit(limit)
+	}
+}
+
+// LastActivity returns the time that the last ping or pong was received from
+// the client.
+func (p *wsServerPeer) LastActivity() time.Time {
+	if a, ok := p.Peer.(transport.ActivityReporter); ok {
+		return a.LastActivity()
+	}
+	return time.Time{}
+}
+
+// TransportDetails returns the details of the websocket transport.
+func (p *wsServerPeer) TransportDetails() wamp.Dict {
+	var details wamp.Dict
+	if td, ok := p.Peer.(transport.TransportDetailer); ok {
+		details = td.TransportDetails()
+	}
+	if p.cookie != "" {
+		if details == nil {
+			details = wamp.Dict{}
+		}
+		details[auth.CookieTransportDetail] = p.cookie
 	}
+	return details
 }
@@ -2,12 +2,21 @@ package router
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/router/auth"
 	"github.com/gammazero/nexus/transport"
 	"github.com/gammazero/nexus/transport/serialize"
 	"github.com/gammazero/nexus/wamp"
+	"github.com/gorilla/websocket"
 )
 
 var (
@@ -91,3 +100,513 @@ func TestWSHandshakeMsgpack(t *testing.T) {
 	}
 	client.Close()
 }
+
+func TestWSProtocolNegotiation(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	closer, err := NewWebsocketServer(r).ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	url := fmt.Sprintf("ws://%s/", wsAddr)
+	for _, offered := range [][]string{
+		{msgpackWebsocketProtocol, jsonWebsocketProtocol},
+		{jsonWebsocketProtocol, msgpackWebsocketProtocol},
+		{"wamp.2.unknown", cborWebsocketProtocol, jsonWebsocketProtocol},
+	} {
+		dialer := websocket.Dialer{Subprotocols: offered}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first protocol the server supports, in the client's order of
+		// preference, is selected.
+		expect := offered[0]
+		if expect == "wamp.2.unknown" {
+			expect = offered[1]
+		}
+		if conn.Subprotocol() != expect {
+			t.Errorf("offered %v, expected %s, got %s", offered, expect,
+				conn.Subprotocol())
+		}
+		conn.Close()
+	}
+
+	// Upgrade fails if there is no common protocol.
+	dialer := websocket.Dialer{Subprotocols: []string{"wamp.2.unknown"}}
+	_, rsp, err := dialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected error for unsupported protocol")
+	}
+	if rsp == nil || rsp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 Bad Request response, got", rsp)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	for _, proto := range []string{jsonWebsocketProtocol, msgpackWebsocketProtocol, cborWebsocketProtocol} {
+		if !strings.Contains(string(body), proto) {
+			t.Errorf("response %q does not list %s", body, proto)
+		}
+	}
+}
+
+func TestWSMaxMessageSize(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:            testRealm,
+				AnonymousAuth:  true,
+				MaxMessageSize: 1024,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	closer, err := NewWebsocketServer(r).ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	client, err := transport.ConnectWebsocketPeer(
+		fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, nil, r.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	checkMaxMessageSize(t, client)
+}
+
+func TestWSSessionSerializer(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	closer, err := NewWebsocketServer(r).ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	client, err := transport.ConnectWebsocketPeer(
+		fmt.Sprintf("ws://%s/", wsAddr), serialize.MSGPACK, nil, nil, r.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, ok := <-client.Recv()
+	if !ok {
+		t.Fatal("Receive buffer closed")
+	}
+	welcome, ok := msg.(*wamp.Welcome)
+	if !ok {
+		t.Fatalf("expected WELCOME, got %s: %+v", msg.MessageType(), msg)
+	}
+
+	client.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionGet,
+		Arguments: wamp.List{welcome.ID},
+	})
+	msg, ok = <-client.Recv()
+	if !ok {
+		t.Fatal("Receive buffer closed")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatalf("expected RESULT, got %s: %+v", msg.MessageType(), msg)
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing session details")
+	}
+	details := wamp.NormalizeDict(result.Arguments[0])
+	serializer, err := wamp.DictValue(details,
+		[]string{"transport", "serializer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := wamp.AsString(serializer); s != "msgpack" {
+		t.Fatal("expected msgpack serializer, got", serializer)
+	}
+	transportType, _ := wamp.DictValue(details, []string{"transport", "type"})
+	if s, _ := wamp.AsString(transportType); s != "websocket" {
+		t.Fatal("expected websocket transport, got", transportType)
+	}
+}
+
+func TestWSServerClose(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	if _, err = s.ListenAndServe(wsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := transport.ConnectWebsocketPeer(
+		fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, nil, r.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	msg, ok := <-client.Recv()
+	if !ok {
+		t.Fatal("recv chan closed")
+	}
+	if _, ok = msg.(*wamp.Welcome); !ok {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+
+	closeErr := make(chan error)
+	go func() { closeErr <- s.Close() }()
+
+	// The websocket close handshake from the server is seen as GOODBYE.
+	select {
+	case msg, ok = <-client.Recv():
+		if !ok {
+			t.Fatal("recv chan closed")
+		}
+		goodbye, ok := msg.(*wamp.Goodbye)
+		if !ok {
+			t.Fatal("expected GOODBYE, got", msg.MessageType())
+		}
+		if goodbye.Details["message"] != "server closing" {
+			t.Fatal("wrong GOODBYE message:", goodbye.Details["message"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GOODBYE")
+	}
+
+	// Close returns when the client completes the close handshake, which
+	// ends the session, without waiting for the drain timeout.
+	select {
+	case err = <-closeErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wsDrainTimeout / 2):
+		t.Fatal("server did not close connection")
+	}
+
+	// Server no longer accepts connections.
+	_, err = transport.ConnectWebsocketPeer(
+		fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, nil, r.Logger())
+	if err == nil {
+		t.Fatal("expected error connecting to closed server")
+	}
+}
+
+// countConn counts the bytes read from a connection.
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestWSCompression(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const (
+		noCompressRealm = wamp.URI("nexus.test.nocompress")
+		testTopic       = wamp.URI("nexus.test.topic")
+	)
+	r, err := NewRouter(&RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+			{
+				URI:                noCompressRealm,
+				AnonymousAuth:      true,
+				DisableCompression: true,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.EnableCompression = true
+	s.CompressionThreshold = 1024
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	payload := strings.Repeat("a", 64*1024)
+
+	// Publish a large, easily compressed, event to self and return the number
+	// of bytes read from the connection to receive it.
+	recvEvent := func(realm wamp.URI) int64 {
+		var nread int64
+		dial := func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countConn{conn, &nread}, nil
+		}
+		client, err := transport.ConnectWebsocketPeerConfig(
+			fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, dial,
+			r.Logger(), &transport.WebsocketConfig{EnableCompression: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		client.Send(&wamp.Hello{Realm: realm, Details: clientRoles})
+		if msg := <-client.Recv(); msg.MessageType() != wamp.WELCOME {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		client.Send(&wamp.Subscribe{Request: 1, Topic: testTopic})
+		if msg := <-client.Recv(); msg.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+		}
+		before := atomic.LoadInt64(&nread)
+		client.Send(&wamp.Publish{
+			Request:   2,
+			Options:   wamp.Dict{"exclude_me": false},
+			Topic:     testTopic,
+			Arguments: wamp.List{payload},
+		})
+		msg := <-client.Recv()
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if arg, _ := wamp.AsString(event.Arguments[0]); arg != payload {
+			t.Fatal("event payload was not received intact")
+		}
+		return atomic.LoadInt64(&nread) - before
+	}
+
+	if n := recvEvent(testRealm); n >= int64(len(payload)) {
+		t.Fatal("event was not compressed, read", n, "bytes")
+	}
+	if n := recvEvent(noCompressRealm); n < int64(len(payload)) {
+		t.Fatal("event was compressed in realm with compression disabled")
+	}
+}
+
+func TestWSCookieAuth(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
+	}
+	cookieStore := auth.NewMemoryCookieStore()
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				Authenticators: []auth.Authenticator{
+					auth.NewCookieAuthenticator(cookieStore, time.Minute),
+					auth.NewTicketAuthenticator(keyStore, time.Second),
+				},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.CookieStore = cookieStore
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// join connects with the cookie jar, and joins the realm offering cookie
+	// and ticket authentication.  Returns the authmethod used.
+	join := func(jar http.CookieJar) string {
+		client, err := transport.ConnectWebsocketPeerConfig(
+			fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, nil,
+			r.Logger(), &transport.WebsocketConfig{Jar: jar})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		client.Send(&wamp.Hello{
+			Realm: testRealm,
+			Details: wamp.Dict{
+				"authid":      "jdoe",
+				"authmethods": wamp.List{"cookie", "ticket"},
+				"roles":       clientRoles["roles"],
+			},
+		})
+		msg := <-client.Recv()
+		if _, ok := msg.(*wamp.Challenge); ok {
+			client.Send(&wamp.Authenticate{Signature: "squeemishosafradge"})
+			msg = <-client.Recv()
+		}
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got:", msg)
+		}
+		if wamp.OptionString(welcome.Details, "authid") != "jdoe" {
+			t.Fatal("wrong authid in WELCOME:", welcome.Details)
+		}
+
+		// The cookie is not in the session details.
+		client.Send(&wamp.Call{
+			Request:   wamp.GlobalID(),
+			Procedure: wamp.MetaProcSessionGet,
+			Arguments: wamp.List{welcome.ID},
+		})
+		result, ok := (<-client.Recv()).(*wamp.Result)
+		if !ok || len(result.Arguments) == 0 {
+			t.Fatal("expected session details")
+		}
+		details := wamp.NormalizeDict(result.Arguments[0])
+		if _, err = wamp.DictValue(details, []string{"transport", auth.CookieTransportDetail}); err == nil {
+			t.Fatal("cookie in session details")
+		}
+		return wamp.OptionString(welcome.Details, "authmethod")
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new cookie is not authenticated, so the ticket is used.
+	if method := join(jar); method != "ticket" {
+		t.Fatal("expected ticket authentication, got", method)
+	}
+	// The returning client is authenticated by its cookie.
+	if method := join(jar); method != "cookie" {
+		t.Fatal("expected cookie authentication, got", method)
+	}
+	// A client without the cookie uses the ticket.
+	if method := join(nil); method != "ticket" {
+		t.Fatal("expected ticket authentication, got", method)
+	}
+}
+
+func TestWSCookieAuthRealm(t *testing.T) {
+	defer leaktest.Check(t)()
+	const otherRealm = wamp.URI("nexus.test.other")
+
+	keyStore := &auth.SecretKeyStore{
+		Secret: func(authid string) (string, error) {
+			return "squeemishosafradge", nil
+		},
+	}
+	// Both realms share the cookie store, as the websocket server does.
+	cookieStore := auth.NewMemoryCookieStore()
+	cookieAuth := auth.NewCookieAuthenticator(cookieStore, time.Minute)
+	config := &RouterConfig{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				Authenticators: []auth.Authenticator{
+					cookieAuth,
+					auth.NewTicketAuthenticator(keyStore, time.Second),
+				},
+			},
+			{
+				URI:            otherRealm,
+				Authenticators: []auth.Authenticator{cookieAuth},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.CookieStore = cookieStore
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// join connects with the cookie jar, and joins the realm offering the
+	// authmethods.  Returns the WELCOME or ABORT.
+	join := func(jar http.CookieJar, realm wamp.URI, authmethods wamp.List) wamp.Message {
+		client, err := transport.ConnectWebsocketPeerConfig(
+			fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, nil,
+			r.Logger(), &transport.WebsocketConfig{Jar: jar})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		client.Send(&wamp.Hello{
+			Realm: realm,
+			Details: wamp.Dict{
+				"authid":      "eve",
+				"authmethods": authmethods,
+				"roles":       clientRoles["roles"],
+			},
+		})
+		msg := <-client.Recv()
+		if _, ok := msg.(*wamp.Challenge); ok {
+			client.Send(&wamp.Authenticate{Signature: "squeemishosafradge"})
+			msg = <-client.Recv()
+		}
+		return msg
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := join(jar, testRealm, wamp.List{"ticket"}); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got:", msg)
+	}
+	// The cookie authenticates the client in the realm it was earned in.
+	if msg := join(jar, testRealm, wamp.List{"cookie"}); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got:", msg)
+	}
+	// The cookie does not authenticate the client in another realm.
+	if msg := join(jar, otherRealm, wamp.List{"cookie"}); msg.MessageType() != wamp.ABORT {
+		t.Fatal("expected ABORT, got:", msg)
+	}
+}
@@ -2,6 +2,17 @@
 Package stdlog provides a minimal logging interface to allow nexus to use
 nearly any logging implementation.
 
+The standard library *log.Logger implements StdLog, as do the loggers of
+many logging packages, such as logrus.  A logger that has leveled methods
+instead, such as zap or slog, is used by wrapping it in a type with these
+methods that logs at the desired level.  Verbose tracing is only logged when
+debug is enabled, as by the Debug field of the router configuration.
+
+The router calls the logger from the goroutines that route messages, so the
+logger must not block for long.  A logger that writes to a slow destination
+should buffer its output, and drop messages rather than wait when the
+buffer is full.
+
 */
 package stdlog
 
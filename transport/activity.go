@@ -0,0 +1,13 @@
+package transport
+
+import "time"
+
+// ActivityReporter is implemented by peers that receive keepalive messages,
+// such as rawsocket PING, that are handled by the transport and are not
+// delivered as WAMP messages.  The router counts these messages as activity
+// of the session when deciding whether the session is idle.
+type ActivityReporter interface {
+	// LastActivity returns the time that the peer last received a keepalive
+	// message, or the zero time if it has not received any.
+	LastActivity() time.Time
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/gammazero/nexus/transport/serialize"
+	"github.com/gammazero/nexus/wamp"
+)
+
+// TransportDetailer is implemented by peers that are able to describe the
+// transport they communicate over.  The router includes these details in the
+// session details, under the "transport" key, when the session is attached.
+type TransportDetailer interface {
+	TransportDetails() wamp.Dict
+}
+
+// Values of the "type" transport detail.
+const (
+	transportTypeWebsocket = "websocket"
+	transportTypeRawSocket = "rawsocket"
+)
+
+// serializerName returns the name of the serialization implemented by the
+// given serializer, or an empty string if the serializer is not known.
+func serializerName(serializer serialize.Serializer) string {
+	switch serializer.(type) {
+	case *serialize.JSONSerializer:
+		return "json"
+	case *serialize.MessagePackSerializer:
+		return "msgpack"
+	case *serialize.CBORSerializer:
+		return "cbor"
+	}
+	return ""
+}
+
+// tlsDetails returns the details of a TLS connection, or nil if the
+// connection does not use TLS.  If the other side presented a certificate,
+// then the details include its subject, so that an authenticator can map the
+// certificate to an authid.
+func tlsDetails(conn net.Conn) wamp.Dict {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	details := wamp.Dict{}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) != 0 {
+		cert := state.PeerCertificates[0]
+		details["peer_cert"] = wamp.Dict{
+			"subject":     cert.Subject.String(),
+			"common_name": cert.Subject.CommonName,
+			"issuer":      cert.Issuer.String(),
+			"serial":      cert.SerialNumber.String(),
+		}
+	}
+	return details
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// RecvLimiter is implemented by peers that are able to limit the size of the
+// messages they receive.  The router sets the limit configured for the realm
+// that a session joins.
+type RecvLimiter interface {
+	// SetRecvLimit sets the maximum size, in bytes, of a serialized message
+	// received by the peer.  A larger message is not deserialized.  Instead,
+	// the peer sends an ABORT, with reason wamp.error.protocol_violation, to
+	// the other side and closes the connection.  Zero means no limit other
+	// than any limit of the transport itself.
+	SetRecvLimit(limit int)
+}
+
+// errMessageTooBig is returned when reading a message that is larger than the
+// receive limit.
+var errMessageTooBig = errors.New("message exceeds size limit")
+
+// tooBigAbort returns the ABORT sent to the other side of a connection that
+// sent a message larger than the receive limit.
+func tooBigAbort(limit int64) *wamp.Abort {
+	return &wamp.Abort{
+		Reason: wamp.ErrProtocolViolation,
+		Details: wamp.Dict{
+			"message": fmt.Sprintf("message exceeds size limit of %d bytes",
+				limit),
+		},
+	}
+}
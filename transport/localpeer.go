@@ -1,22 +1,53 @@
 package transport
 
 import (
-	"errors"
-
 	"github.com/gammazero/nexus/wamp"
 )
 
 const linkedPeersOutQueueSize = 16
 
-// LinkedPeers creates two connected peers.  Messages sent to one peer appear
-// in the Recv of the other.  This is used for connecting client sessions to
-// the router.
+// LinkedPeers creates two connected peers, returning the client peer and the
+// router peer.  Messages sent to one peer appear in the Recv of the other.
+// This is used for connecting client sessions to the router.
+//
+// The channel carrying messages from the router to the client has room for
+// 16 messages, as for LinkedPeersBuffered(16).
 func LinkedPeers() (wamp.Peer, wamp.Peer) {
+	return LinkedPeersBuffered(linkedPeersOutQueueSize)
+}
+
+// LinkedPeersBuffered creates two connected peers, as LinkedPeers does, where
+// the channel carrying messages from the router to the client has room for n
+// messages.  The channels behave as follows:
+//
+// Each peer's Recv returns the same channel every time it is called.  The
+// client's Recv channel has capacity n.  The router's Recv channel is
+// unbuffered, since the router reads each message as soon as it can, so a
+// client's Send returns only once the router has taken the message.
+//
+// The router's TrySend returns wamp.ErrBlocked, without sending the message,
+// if the client's Recv channel is full.  The router's Send waits for room.
+// Either peer's Close closes the Recv channel of the other peer, once the
+// messages already in it are read.  A peer must not send after it is closed.
+func LinkedPeersBuffered(n int) (wamp.Peer, wamp.Peer) {
+	return linkedPeers(n, false)
+}
+
+// LinkedPeersLossy creates two connected peers, as LinkedPeersBuffered does,
+// except that the router's Send drops the message, and returns
+// wamp.ErrBlocked, if the client's Recv channel is full, instead of waiting
+// for room.  This simulates a slow client whose transport drops messages,
+// which is useful for testing how the router handles slow consumers.
+func LinkedPeersLossy(n int) (wamp.Peer, wamp.Peer) {
+	return linkedPeers(n, true)
+}
+
+func linkedPeers(n int, lossy bool) (wamp.Peer, wamp.Peer) {
 	// The channel used for the router to send messages to the client should be
 	// large enough to prevent blocking while waiting for a slow client, as a
 	// client may block on I/O.  If the client does block, then the message
 	// should be dropped.
-	rToC := make(chan wamp.Message, linkedPeersOutQueueSize)
+	rToC := make(chan wamp.Message, n)
 
 	// The router will read from this channen and immediately dispatch the
 	// message to the broker or dealer.  Therefore this channel can be
@@ -24,7 +55,7 @@ func LinkedPeers() (wamp.Peer, wamp.Peer) {
 	cToR := make(chan wamp.Message)
 
 	// router reads from and writes to client
-	r := &localPeer{rd: cToR, wr: rToC}
+	r := &localPeer{rd: cToR, wr: rToC, lossy: lossy}
 	// client reads from and writes to router
 	c := &localPeer{rd: rToC, wr: cToR}
 
@@ -35,9 +66,13 @@ func LinkedPeers() (wamp.Peer, wamp.Peer) {
 type localPeer struct {
 	rd <-chan wamp.Message
 	wr chan<- wamp.Message
+
+	// If set, Send does not wait for room in the outbound channel.
+	lossy bool
 }
 
-// Recv returns the channel this peer reads incoming messages from.
+// Recv returns the channel this peer reads incoming messages from.  The same
+// channel is returned by every call.
 func (p *localPeer) Recv() <-chan wamp.Message { return p.rd }
 
 // TrySend writes a message to the peer's outbound message channel.
@@ -45,15 +80,19 @@ func (p *localPeer) TrySend(msg wamp.Message) error {
 	select {
 	case p.wr <- msg:
 	default:
-		return errors.New("blocked")
+		return wamp.ErrBlocked
 	}
 	return nil
 }
 
 // Send writes a message to the peer's outbound message channel.
 // Typically called by clients, since it is OK for the router to block a client
-// since this will not block other clients.
+// since this will not block other clients.  If the peer is lossy, then the
+// message is dropped if the channel is full.
 func (p *localPeer) Send(msg wamp.Message) error {
+	if p.lossy {
+		return p.TrySend(msg)
+	}
 	p.wr <- msg
 	return nil
 }
@@ -54,7 +54,7 @@ func TestDropOnBlockedClient(t *testing.T) {
 	case <-time.After(time.Second):
 		t.Fatal("Send should have dropped and not blocked")
 	}
-	if err == nil || err.Error() != "blocked" {
+	if err != wamp.ErrBlocked {
 		t.Fatal("Expected blocked error")
 	}
 }
@@ -78,6 +78,67 @@ func TestBlockOnBlockedRouter(t *testing.T) {
 	<-done
 }
 
+func TestLinkedPeersBuffered(t *testing.T) {
+	c, r := LinkedPeersBuffered(3)
+	if c.Recv() != c.Recv() || r.Recv() != r.Recv() {
+		t.Fatal("Recv should return the same channel each time")
+	}
+	if cap(c.Recv()) != 3 {
+		t.Fatal("wrong client channel capacity:", cap(c.Recv()))
+	}
+	if cap(r.Recv()) != 0 {
+		t.Fatal("router channel should be unbuffered")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := r.TrySend(&wamp.Publish{}); err != nil {
+			t.Fatal("TrySend failed with room in channel:", err)
+		}
+	}
+	if err := r.TrySend(&wamp.Publish{}); err != wamp.ErrBlocked {
+		t.Fatal("Expected blocked error")
+	}
+
+	// Messages sent before closing are still received.
+	r.Close()
+	for i := 0; i < 3; i++ {
+		if msg := <-c.Recv(); msg == nil {
+			t.Fatal("Expected message sent before close")
+		}
+	}
+	if _, ok := <-c.Recv(); ok {
+		t.Fatal("Expected closed channel")
+	}
+}
+
+func TestLinkedPeersLossy(t *testing.T) {
+	c, r := LinkedPeersLossy(2)
+
+	// Send drops, rather than blocks, when the client channel is full.
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 3; i++ {
+			err = r.Send(&wamp.Event{Publication: wamp.ID(i)})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != wamp.ErrBlocked {
+			t.Fatal("Expected blocked error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send should have dropped and not blocked")
+	}
+	if len(c.Recv()) != 2 {
+		t.Fatal("Expected 2 messages, got", len(c.Recv()))
+	}
+	if evt := (<-c.Recv()).(*wamp.Event); evt.Publication != 0 {
+		t.Fatal("Expected oldest message kept")
+	}
+}
+
 func BenchmarkClientToRouter(b *testing.B) {
 	c, r := LinkedPeers()
 
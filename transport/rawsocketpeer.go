@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/gammazero/nexus/stdlog"
@@ -17,6 +18,14 @@ import (
 // rawSocketPeer implements the Peer interface, connecting the Send and Recv
 // methods to a socket.
 type rawSocketPeer struct {
+	// Maximum size of received WAMP messages, set by SetRecvLimit, in
+	// addition to the limit negotiated in the handshake.  Zero means no
+	// additional limit.  Accessed atomically.
+	msgLimit int64
+	// Time the last PING or PONG was received, in nanoseconds since the Unix
+	// epoch.  Accessed atomically.
+	lastPing int64
+
 	conn       net.Conn
 	serializer serialize.Serializer
 	sendLimit  int
@@ -38,6 +47,7 @@ const (
 	// Serializers
 	rawsocketJSON    = 1
 	rawsocketMsgpack = 2
+	rawsocketCBOR    = 3
 
 	// RawSocket header ID.
 	magic = 0x7f
@@ -156,11 +166,38 @@ func newRawSocketPeer(conn net.Conn, serializer serialize.Serializer, logger std
 
 func (rs *rawSocketPeer) Recv() <-chan wamp.Message { return rs.rd }
 
+// TransportDetails returns the details of the rawsocket transport used by
+// this peer.
+func (rs *rawSocketPeer) TransportDetails() wamp.Dict {
+	details := wamp.Dict{
+		"type":       transportTypeRawSocket,
+		"serializer": serializerName(rs.serializer),
+	}
+	if td := tlsDetails(rs.conn); td != nil {
+		details["tls"] = td
+	}
+	return details
+}
+
+// SetRecvLimit sets the maximum size of WAMP messages received by the peer.
+// This only lowers the limit negotiated in the handshake.
+func (rs *rawSocketPeer) SetRecvLimit(limit int) {
+	atomic.StoreInt64(&rs.msgLimit, int64(limit))
+}
+
+// LastActivity returns the time that the last PING or PONG was received.
+func (rs *rawSocketPeer) LastActivity() time.Time {
+	if t := atomic.LoadInt64(&rs.lastPing); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
 func (rs *rawSocketPeer) TrySend(msg wamp.Message) error {
 	select {
 	case rs.wr <- msg:
 	default:
-		return errors.New("blocked")
+		return wamp.ErrBlocked
 	}
 	return nil
 }
@@ -231,44 +268,64 @@ func (rs *rawSocketPeer) recvHandler() {
 	// When done, close read channel to cause router to remove session if not
 	// already removed.
 	defer close(rs.rd)
+	// closeConn stops sendHandler, unless the peer was closed explicitly, and
+	// closes the socket connection.
+	closeConn := func() {
+		select {
+		case <-rs.closed:
+			// Peer was closed explicitly. sendHandler should have already
+			// been told to exit.
+		default:
+			// Cause sendHandler to exit without closing the write channel (in
+			// case writes still happening) and allow it to finish sending any
+			// queued messages.
+			rs.wr <- nil
+			<-rs.writerDone
+
+			// Close socket connection.
+			rs.conn.Close()
+		}
+	}
 MsgLoop:
 	for {
 		var header [4]byte
 		_, err := io.ReadFull(rs.conn, header[:])
 		if err != nil {
-			select {
-			case <-rs.closed:
-				// Peer was closed explicitly. sendHandler should have already
-				// been told to exit.
-			default:
-				// Peer received control message to close.  Cause sendHandler
-				// to exit without closing the write channel (in case writes
-				// still happening) and allow it to finish sending any queued
-				// messages.
-				rs.wr <- nil
-				<-rs.writerDone
-
-				// Close socket connection.
-				rs.conn.Close()
-			}
+			// Peer received control message to close.
+			closeConn()
 			return
 		}
 
+		// The other side must not send messages larger than the length
+		// negotiated in the handshake.  The connection is failed if it does.
 		length := bytesToInt(header[1:])
 		if length > rs.recvLimit {
-			rs.log.Print("Received message that exceeded size limit, closing")
-			rs.conn.Close()
-			break
+			rs.log.Println("Received message size", length,
+				"exceeds limit of", rs.recvLimit, "- closing connection")
+			closeConn()
+			return
 		}
 
 		var msg wamp.Message
 		switch header[0] & 0x07 {
 		case 0: // WAMP message
+			// A message larger than the limit set for the session is not
+			// read, and the session is aborted.
+			if limit := atomic.LoadInt64(&rs.msgLimit); limit > 0 && int64(length) > limit {
+				rs.log.Println("Received message size", length,
+					"exceeds size limit of", limit, "- aborting session")
+				select {
+				case rs.wr <- tooBigAbort(limit):
+				default:
+				}
+				closeConn()
+				return
+			}
 			buf := make([]byte, length)
 			_, err = io.ReadFull(rs.conn, buf)
 			if err != nil {
 				rs.log.Println("Error reading message:", err)
-				rs.conn.Close()
+				closeConn()
 				return
 			}
 			msg, err = rs.serializer.Deserialize(buf)
@@ -278,23 +335,25 @@ MsgLoop:
 				continue MsgLoop
 			}
 		case 1: // PING
+			atomic.StoreInt64(&rs.lastPing, time.Now().UnixNano())
 			header[0] = 0x02
 			if _, err = rs.conn.Write(header[:]); err != nil {
 				rs.log.Println("Error writing header responding to PING:", err)
-				rs.conn.Close()
+				closeConn()
 				return
 			}
 			if _, err = io.CopyN(rs.conn, rs.conn, int64(length)); err != nil {
 				rs.log.Println("Error responding to PING:", err)
-				rs.conn.Close()
+				closeConn()
 				return
 			}
 			continue MsgLoop
 		case 2: // PONG
+			atomic.StoreInt64(&rs.lastPing, time.Now().UnixNano())
 			_, err = io.CopyN(ioutil.Discard, rs.conn, int64(length))
 			if err != nil {
 				rs.log.Println("Error reading PONG:", err)
-				rs.conn.Close()
+				closeConn()
 				return
 			}
 			continue MsgLoop
@@ -369,6 +428,8 @@ func clientHandshake(conn net.Conn, logger stdlog.StdLog, protocol byte, recvLim
 		serializer = &serialize.JSONSerializer{}
 	case rawsocketMsgpack:
 		serializer = &serialize.MessagePackSerializer{}
+	case rawsocketCBOR:
+		serializer = &serialize.CBORSerializer{}
 	}
 
 	sendLimit := byteToLength(buf[1] >> 4)
@@ -400,6 +461,8 @@ func serverHandshake(conn net.Conn, logger stdlog.StdLog, recvLimit int) (*rawSo
 		serializer = &serialize.JSONSerializer{}
 	case rawsocketMsgpack:
 		serializer = &serialize.MessagePackSerializer{}
+	case rawsocketCBOR:
+		serializer = &serialize.CBORSerializer{}
 	default:
 		conn.Write([]byte{magic, byte(0x1 << 4), 0, 0})
 		return nil, errors.New("serializer unsupported")
@@ -470,6 +533,8 @@ func getProtoByte(serialization serialize.Serialization) (byte, error) {
 		return rawsocketJSON, nil
 	case serialize.MSGPACK:
 		return rawsocketMsgpack, nil
+	case serialize.CBOR:
+		return rawsocketCBOR, nil
 	default:
 		return 0, errors.New("serialization not supported by rawsocket")
 	}
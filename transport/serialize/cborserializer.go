@@ -0,0 +1,45 @@
+package serialize
+
+import (
+	"errors"
+
+	"github.com/gammazero/nexus/wamp"
+	"github.com/ugorji/go/codec"
+)
+
+// CBORSerializer is an implementation of Serializer that handles serializing
+// and deserializing CBOR encoded payloads.
+type CBORSerializer struct{}
+
+// Serialize encodes a Message into a CBOR payload.
+//
+// Strings are encoded as CBOR text strings, and byte slices as CBOR byte
+// strings, so that binary payloads are decoded as []byte.
+func (s *CBORSerializer) Serialize(msg wamp.Message) ([]byte, error) {
+	var b []byte
+	return b, codec.NewEncoderBytes(&b, &codec.CborHandle{}).Encode(
+		msgToList(msg))
+}
+
+// Deserialize decodes a CBOR payload into a Message.
+//
+// Unsigned integers are decoded as int64, the same as negative integers, so
+// that IDs and other integer values keep their type.
+func (s *CBORSerializer) Deserialize(data []byte) (wamp.Message, error) {
+	var v []interface{}
+	ch := &codec.CborHandle{}
+	ch.SignedInteger = true
+	err := codec.NewDecoderBytes(data, ch).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, errors.New("invalid message")
+	}
+
+	typ, ok := v[0].(int64)
+	if !ok {
+		return nil, errors.New("unsupported message format")
+	}
+	return listToMsg(wamp.MessageType(typ), v)
+}
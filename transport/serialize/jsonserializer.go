@@ -4,6 +4,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"reflect"
+	"strings"
 
 	"github.com/gammazero/nexus/wamp"
 )
@@ -13,11 +15,24 @@ import (
 type JSONSerializer struct{}
 
 // Serialize encodes a message into a JSON payload.
+//
+// Byte slices in the message arguments are encoded as BinaryData strings,
+// since JSON has no binary type.  The message is not modified.
 func (s *JSONSerializer) Serialize(msg wamp.Message) ([]byte, error) {
-	return json.Marshal(msgToList(msg))
+	list := msgToList(msg)
+	for _, i := range payloadFields[msg.MessageType()] {
+		if i < len(list) {
+			list[i], _ = encodeBinary(list[i])
+		}
+	}
+	return json.Marshal(list)
 }
 
 // Deserialize decodes a JSON payload into a message.
+//
+// Strings in the message arguments that hold BinaryData are decoded as
+// []byte, so that binary payloads from JSON peers are the same as from peers
+// using a binary serializer.
 func (s *JSONSerializer) Deserialize(data []byte) (wamp.Message, error) {
 	var v []interface{}
 	if err := json.Unmarshal(data, &v); err != nil {
@@ -31,9 +46,40 @@ func (s *JSONSerializer) Deserialize(data []byte) (wamp.Message, error) {
 	if !ok {
 		return nil, errors.New("unsupported message format")
 	}
+	for _, i := range payloadFields[wamp.MessageType(typ)] {
+		if i < len(v) {
+			v[i] = decodeBinary(v[i])
+		}
+	}
 	return listToMsg(wamp.MessageType(typ), v)
 }
 
+// payloadFields maps each message type to the positions, in the list form of
+// the message, of its application payload: the Arguments and ArgumentsKw
+// fields.  Only the payload is converted to and from BinaryData, so that a
+// URI, or a string in Details or Options, that starts with NUL keeps its type.
+var payloadFields = func() map[wamp.MessageType][]int {
+	fields := map[wamp.MessageType][]int{}
+	for typ := wamp.MessageType(0); typ < 256; typ++ {
+		msg := wamp.NewMessage(typ)
+		if msg == nil {
+			continue
+		}
+		t := reflect.TypeOf(msg)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		for i := 0; i < t.NumField(); i++ {
+			switch t.Field(i).Name {
+			case "Arguments", "ArgumentsKw":
+				// The message type is the first item of the list.
+				fields[typ] = append(fields[typ], i+1)
+			}
+		}
+	}
+	return fields
+}()
+
 // Binary data follows a convention for conversion to JSON strings.
 //
 // A byte array is converted to a JSON string as follows:
@@ -48,6 +94,90 @@ func (b BinaryData) MarshalJSON() ([]byte, error) {
 	return json.Marshal("\x00" + s)
 }
 
+// encodeBinary returns the value with each byte slice in it, including those
+// nested in dictionaries and lists, replaced by BinaryData.  Dictionaries and
+// lists holding byte slices are copied, rather than modified, since the same
+// message may be sent to many peers.  Returns true if anything was replaced.
+func encodeBinary(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return BinaryData(v), true
+	case wamp.Dict:
+		return encodeBinaryDict(v)
+	case map[string]interface{}:
+		return encodeBinaryDict(v)
+	case wamp.List:
+		return encodeBinaryList(v)
+	case []interface{}:
+		return encodeBinaryList(v)
+	}
+	return v, false
+}
+
+func encodeBinaryDict(d map[string]interface{}) (interface{}, bool) {
+	var out map[string]interface{}
+	for k, val := range d {
+		enc, ok := encodeBinary(val)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]interface{}, len(d))
+			for k2, val2 := range d {
+				out[k2] = val2
+			}
+		}
+		out[k] = enc
+	}
+	if out == nil {
+		return d, false
+	}
+	return out, true
+}
+
+func encodeBinaryList(l []interface{}) (interface{}, bool) {
+	var out []interface{}
+	for i, val := range l {
+		enc, ok := encodeBinary(val)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make([]interface{}, len(l))
+			copy(out, l)
+		}
+		out[i] = enc
+	}
+	if out == nil {
+		return l, false
+	}
+	return out, true
+}
+
+// decodeBinary returns the value with each string holding BinaryData in it,
+// including those nested in dictionaries and lists, replaced by the decoded
+// []byte.  Dictionaries and lists are modified in place.  A string that starts
+// with NUL but is not valid base64 is left as is.
+func decodeBinary(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "\x00") {
+			if b, err := base64.StdEncoding.DecodeString(v[1:]); err == nil {
+				return b
+			}
+		}
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = decodeBinary(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = decodeBinary(val)
+		}
+	}
+	return v
+}
+
 func (b *BinaryData) UnmarshalJSON(v []byte) error {
 	var s string
 	err := json.Unmarshal(v, &s)
@@ -12,10 +12,14 @@ import (
 type MessagePackSerializer struct{}
 
 // Serialize encodes a Message into a msgpack payload.
+//
+// Strings are encoded using the msgpack str type, and byte slices are encoded
+// using the bin type, so that binary payloads are decoded as []byte.
 func (s *MessagePackSerializer) Serialize(msg wamp.Message) ([]byte, error) {
 	var b []byte
 	mph := &codec.MsgpackHandle{
 		RawToString: true,
+		WriteExt:    true,
 	}
 	return b, codec.NewEncoderBytes(&b, mph).Encode(
 		msgToList(msg))
@@ -288,3 +288,175 @@ func TestMsgPackToJSON(t *testing.T) {
 		t.Fatal("JSON deserialize error: did not get argument, got:", e2.Arguments[0])
 	}
 }
+
+// newTestMessage returns a message of the given type with every field set.
+// If binary is true, then the arguments include binary data.  If
+// binaryDetails is true, then the other dictionaries, such as details and
+// options, also include binary data.
+func newTestMessage(msgType wamp.MessageType, binary, binaryDetails bool) wamp.Message {
+	msg := wamp.NewMessage(msgType)
+	val := reflect.ValueOf(msg).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		f := val.Field(i)
+		isPayload := val.Type().Field(i).Name == "ArgumentsKw"
+		switch f.Interface().(type) {
+		case wamp.ID:
+			f.Set(reflect.ValueOf(wamp.ID(4321)))
+		case wamp.URI:
+			f.Set(reflect.ValueOf(wamp.URI("nexus.test.uri")))
+		case string:
+			f.SetString("test string")
+		case wamp.MessageType:
+			f.Set(reflect.ValueOf(wamp.CALL))
+		case wamp.Dict:
+			d := wamp.Dict{"key": "value", "flag": true}
+			if (isPayload && binary) || (!isPayload && binaryDetails) {
+				d["bin"] = []byte{0x00, 0x01, 0xfe, 0xff}
+			}
+			f.Set(reflect.ValueOf(d))
+		case wamp.List:
+			l := wamp.List{"arg", false}
+			if binary {
+				l = append(l, []byte{0xde, 0xad, 0xbe, 0xef})
+			}
+			f.Set(reflect.ValueOf(l))
+		default:
+			panic("unhandled field type " + f.Type().String())
+		}
+	}
+	return msg
+}
+
+func TestRoundTripAllMessages(t *testing.T) {
+	// JSON only converts binary data in the message arguments.
+	serializers := []struct {
+		name          string
+		s             Serializer
+		binary        bool
+		binaryDetails bool
+	}{
+		{"json", &JSONSerializer{}, true, false},
+		{"msgpack", &MessagePackSerializer{}, true, true},
+		{"cbor", &CBORSerializer{}, true, true},
+	}
+	var count int
+	for msgType := wamp.MessageType(0); msgType < 100; msgType++ {
+		if wamp.NewMessage(msgType) == nil {
+			continue
+		}
+		count++
+		for _, ser := range serializers {
+			msg := newTestMessage(msgType, ser.binary, ser.binaryDetails)
+			b, err := ser.s.Serialize(msg)
+			if err != nil {
+				t.Fatalf("%s serialize %s error: %s", ser.name, msgType, err)
+			}
+			out, err := ser.s.Deserialize(b)
+			if err != nil {
+				t.Fatalf("%s deserialize %s error: %s", ser.name, msgType, err)
+			}
+			if !reflect.DeepEqual(msg, out) {
+				t.Fatalf("%s round trip of %s: got %+v, expected %+v",
+					ser.name, msgType, out, msg)
+			}
+		}
+	}
+	if count == 0 {
+		t.Fatal("no message types tested")
+	}
+}
+
+func TestJSONBinaryOnlyInArguments(t *testing.T) {
+	// A PUBLISH whose options, topic, arguments, and keyword arguments each
+	// have a string holding BinaryData.
+	data := []byte(`[16, 1, {"x": "\u0000AAE="}, "\u0000AAE=", ["\u0000AAE="], {"k": "\u0000AAE="}]`)
+	s := &JSONSerializer{}
+	msg, err := s.Deserialize(data)
+	if err != nil {
+		t.Fatal("JSON deserialize error:", err)
+	}
+	pub := msg.(*wamp.Publish)
+	bin := []byte{0x00, 0x01}
+	if b, ok := pub.Arguments[0].([]byte); !ok || !bytes.Equal(b, bin) {
+		t.Fatal("binary argument not decoded:", pub.Arguments[0])
+	}
+	if b, ok := pub.ArgumentsKw["k"].([]byte); !ok || !bytes.Equal(b, bin) {
+		t.Fatal("binary keyword argument not decoded:", pub.ArgumentsKw["k"])
+	}
+	// Strings outside of the arguments keep their type.
+	if pub.Topic != "\x00AAE=" {
+		t.Fatal("topic changed:", pub.Topic)
+	}
+	if pub.Options["x"] != "\x00AAE=" {
+		t.Fatal("option changed:", pub.Options["x"])
+	}
+}
+
+func TestCBORCallBinaryArgs(t *testing.T) {
+	payload := []byte{0x00, 0x01, 0x7f, 0x80, 0xfe, 0xff}
+	call := &wamp.Call{
+		Request:   wamp.ID(9007199254740992),
+		Options:   wamp.Dict{"timeout": 1000, "disclose_me": true},
+		Procedure: wamp.URI("nexus.test.cbor"),
+		Arguments: wamp.List{payload, 3.5, -42, "text"},
+		ArgumentsKw: wamp.Dict{
+			"data":   payload,
+			"nested": wamp.Dict{"list": wamp.List{1, wamp.Dict{"x": payload}}},
+		},
+	}
+	s := &CBORSerializer{}
+	b, err := s.Serialize(call)
+	if err != nil {
+		t.Fatal("serialization error:", err)
+	}
+	msg, err := s.Deserialize(b)
+	if err != nil {
+		t.Fatal("deserialization error:", err)
+	}
+	out, ok := msg.(*wamp.Call)
+	if !ok {
+		t.Fatal("expected CALL, got", msg.MessageType())
+	}
+	if out.Request != call.Request {
+		t.Fatal("wrong request ID:", out.Request)
+	}
+	if out.Procedure != call.Procedure {
+		t.Fatal("wrong procedure:", out.Procedure)
+	}
+	if timeout, ok := out.Options["timeout"].(int64); !ok || timeout != 1000 {
+		t.Fatalf("timeout not decoded as integer: %#v", out.Options["timeout"])
+	}
+	if len(out.Arguments) != 4 {
+		t.Fatal("wrong number of arguments:", len(out.Arguments))
+	}
+	if b, ok := out.Arguments[0].([]byte); !ok || !bytes.Equal(b, payload) {
+		t.Fatalf("binary argument not preserved: %#v", out.Arguments[0])
+	}
+	if f, ok := out.Arguments[1].(float64); !ok || f != 3.5 {
+		t.Fatalf("float argument not preserved: %#v", out.Arguments[1])
+	}
+	if i, ok := out.Arguments[2].(int64); !ok || i != -42 {
+		t.Fatalf("integer argument not preserved: %#v", out.Arguments[2])
+	}
+	if s, ok := out.Arguments[3].(string); !ok || s != "text" {
+		t.Fatalf("string argument not preserved: %#v", out.Arguments[3])
+	}
+	if b, ok := out.ArgumentsKw["data"].([]byte); !ok || !bytes.Equal(b, payload) {
+		t.Fatalf("binary kwarg not preserved: %#v", out.ArgumentsKw["data"])
+	}
+	x, err := wamp.DictValue(out.ArgumentsKw, []string{"nested", "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, ok := wamp.AsList(x)
+	if !ok || len(list) != 2 {
+		t.Fatalf("nested list not preserved: %#v", x)
+	}
+	nested, ok := wamp.AsDict(list[1])
+	if !ok {
+		t.Fatalf("nested dict not preserved: %#v", list[1])
+	}
+	if b, ok := nested["x"].([]byte); !ok || !bytes.Equal(b, payload) {
+		t.Fatalf("nested binary not preserved: %#v", nested["x"])
+	}
+}
@@ -2,10 +2,12 @@ package transport
 
 import (
 	"crypto/tls"
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gammazero/nexus/stdlog"
@@ -30,14 +32,74 @@ type websocketPeer struct {
 
 	writerDone chan struct{}
 
+	// Minimum size, in bytes, of outbound messages to compress, if
+	// compression was negotiated.  The zero value compresses all messages,
+	// and SetCompression stores -1 to disable compression.  Accessed
+	// atomically.
+	compressMin int64
+	// Maximum size, in bytes, of received messages, set by SetRecvLimit.
+	// Zero means no limit.  Accessed atomically.
+	recvLimit int64
+	// Time the last ping or pong was received, in nanoseconds since the Unix
+	// epoch.  Accessed atomically.
+	lastPing int64
+
 	log stdlog.StdLog
 }
 
+// WebsocketConfig is used to configure client websocket settings.
+type WebsocketConfig struct {
+	// Request per-message compression (permessage-deflate) when connecting
+	// to the server.  The server may decline to use compression.
+	EnableCompression bool
+	// Messages smaller than this number of bytes are sent uncompressed,
+	// since compressing small messages costs more than it saves.  Zero
+	// compresses all messages.
+	CompressionThreshold int
+	// Send a websocket ping to the server at this interval, and close the
+	// connection if a pong is not received within PongTimeout of a ping.
+	// This keeps the connection from being dropped by proxies and load
+	// balancers when no messages are sent.  If PongTimeout is zero, then it
+	// is the same as PingInterval.  Zero PingInterval, the default, disables
+	// pings.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// Jar keeps the cookies set by the server, such as a tracking cookie
+	// used for cookie authentication, and sends them when connecting.  Nil,
+	// the default, sends no cookies.
+	Jar http.CookieJar
+}
+
+// KeepAliver is implemented by peers whose transport is able to send
+// keepalive pings, independently of the WAMP messages sent over it.
+type KeepAliver interface {
+	// StartKeepAlive starts sending a ping every interval, until the peer is
+	// closed.  If a pong is not received within timeout of a ping, then the
+	// connection is closed.  If timeout is zero, then it is the same as
+	// interval.  This must be called no more than once.
+	StartKeepAlive(interval, timeout time.Duration)
+}
+
+// Compressor is implemented by peers whose transport is able to compress
+// outbound messages.
+//
+// Only the "no context takeover" mode of permessage-deflate is negotiated, so
+// the compression state is not kept between messages.  This keeps memory use
+// per connection small, at some cost in compression ratio.
+type Compressor interface {
+	// SetCompression sets whether outbound messages are compressed, and the
+	// size in bytes below which messages are sent uncompressed.  Messages are
+	// only compressed if compression was negotiated with the other side.
+	// Inbound compressed messages are always decompressed.
+	SetCompression(enable bool, threshold int)
+}
+
 const (
 	// WAMP uses the following WebSocket subprotocol identifiers for unbatched
 	// modes:
 	jsonWebsocketProtocol    = "wamp.2.json"
 	msgpackWebsocketProtocol = "wamp.2.msgpack"
+	cborWebsocketProtocol    = "wamp.2.cbor"
 
 	outQueueSize = 16
 	ctrlTimeout  = 5 * time.Second
@@ -48,6 +110,12 @@ type DialFunc func(network, addr string) (net.Conn, error)
 // ConnectWebsocketPeer creates a new websocketPeer with the specified config,
 // and connects it to the websocket server at the specified URL.
 func ConnectWebsocketPeer(url string, serialization serialize.Serialization, tlsConfig *tls.Config, dial DialFunc, logger stdlog.StdLog) (wamp.Peer, error) {
+	return ConnectWebsocketPeerConfig(url, serialization, tlsConfig, dial, logger, nil)
+}
+
+// ConnectWebsocketPeerConfig is ConnectWebsocketPeer with additional websocket
+// settings.  A nil wsCfg uses the default websocket settings.
+func ConnectWebsocketPeerConfig(url string, serialization serialize.Serialization, tlsConfig *tls.Config, dial DialFunc, logger stdlog.StdLog, wsCfg *WebsocketConfig) (wamp.Peer, error) {
 	var (
 		protocol    string
 		payloadType int
@@ -63,22 +131,38 @@ func ConnectWebsocketPeer(url string, serialization serialize.Serialization, tls
 		protocol = msgpackWebsocketProtocol
 		payloadType = websocket.BinaryMessage
 		serializer = &serialize.MessagePackSerializer{}
+	case serialize.CBOR:
+		protocol = cborWebsocketProtocol
+		payloadType = websocket.BinaryMessage
+		serializer = &serialize.CBORSerializer{}
 	default:
 		return nil, fmt.Errorf("unsupported serialization: %v", serialization)
 	}
 
+	if wsCfg == nil {
+		wsCfg = &WebsocketConfig{}
+	}
 	dialer := websocket.Dialer{
-		Subprotocols:    []string{protocol},
-		TLSClientConfig: tlsConfig,
-		Proxy:           http.ProxyFromEnvironment,
-		NetDial:         dial,
+		Subprotocols:      []string{protocol},
+		TLSClientConfig:   tlsConfig,
+		Proxy:             http.ProxyFromEnvironment,
+		NetDial:           dial,
+		EnableCompression: wsCfg.EnableCompression,
+		Jar:               wsCfg.Jar,
 	}
 
 	conn, _, err := dialer.Dial(url, nil)
 	if err != nil {
 		return nil, err
 	}
-	return NewWebsocketPeer(conn, serializer, payloadType, logger), nil
+	peer := NewWebsocketPeer(conn, serializer, payloadType, logger)
+	if wsCfg.EnableCompression {
+		peer.(Compressor).SetCompression(true, wsCfg.CompressionThreshold)
+	}
+	if wsCfg.PingInterval > 0 {
+		peer.(KeepAliver).StartKeepAlive(wsCfg.PingInterval, wsCfg.PongTimeout)
+	}
+	return peer, nil
 }
 
 // NewWebsocketPeer creates a websocket peer from an existing websocket
@@ -105,6 +189,17 @@ func NewWebsocketPeer(conn *websocket.Conn, serializer serialize.Serializer, pay
 
 		log: logger,
 	}
+	// Record the pings and pongs received, which are handled by the
+	// goroutine that reads from the websocket.
+	handlePing := conn.PingHandler()
+	conn.SetPingHandler(func(appData string) error {
+		w.touch()
+		return handlePing(appData)
+	})
+	conn.SetPongHandler(func(string) error {
+		w.touch()
+		return nil
+	})
 	// Sending to and receiving from websocket is handled concurrently.
 	go w.recvHandler()
 	go w.sendHandler()
@@ -114,11 +209,95 @@ func NewWebsocketPeer(conn *websocket.Conn, serializer serialize.Serializer, pay
 
 func (w *websocketPeer) Recv() <-chan wamp.Message { return w.rd }
 
+// TransportDetails returns the details of the websocket transport used by
+// this peer.
+func (w *websocketPeer) TransportDetails() wamp.Dict {
+	details := wamp.Dict{
+		"type":       transportTypeWebsocket,
+		"serializer": serializerName(w.serializer),
+	}
+	if td := tlsDetails(w.conn.UnderlyingConn()); td != nil {
+		details["tls"] = td
+	}
+	return details
+}
+
+// SetCompression sets whether outbound messages are compressed, and the
+// minimum size of messages to compress.
+func (w *websocketPeer) SetCompression(enable bool, threshold int) {
+	min := int64(threshold)
+	if !enable {
+		min = -1
+	} else if min < 0 {
+		min = 0
+	}
+	atomic.StoreInt64(&w.compressMin, min)
+}
+
+// StartKeepAlive starts sending pings to the other side of the websocket.
+func (w *websocketPeer) StartKeepAlive(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	go w.keepAlive(interval, timeout)
+}
+
+// keepAlive sends a ping every interval until the peer is closed.  If a ping
+// or pong is not received within timeout of sending a ping, then the
+// connection is closed, which ends the session.
+func (w *websocketPeer) keepAlive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.closed:
+			return
+		}
+		sent := time.Now()
+		err := w.conn.WriteControl(websocket.PingMessage, nil,
+			sent.Add(timeout))
+		if err != nil {
+			// The connection is closed, or closing.
+			return
+		}
+		select {
+		case <-time.After(timeout):
+		case <-w.closed:
+			return
+		}
+		if atomic.LoadInt64(&w.lastPing) < sent.UnixNano() {
+			w.log.Println("No pong received within", timeout,
+				"- closing websocket connection")
+			w.conn.Close()
+			return
+		}
+	}
+}
+
+// touch records that a ping or pong was received.
+func (w *websocketPeer) touch() {
+	atomic.StoreInt64(&w.lastPing, time.Now().UnixNano())
+}
+
+// LastActivity returns the time that the last ping or pong was received.
+func (w *websocketPeer) LastActivity() time.Time {
+	if t := atomic.LoadInt64(&w.lastPing); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// SetRecvLimit sets the maximum size of messages received by the peer.
+func (w *websocketPeer) SetRecvLimit(limit int) {
+	atomic.StoreInt64(&w.recvLimit, int64(limit))
+}
+
 func (w *websocketPeer) TrySend(msg wamp.Message) error {
 	select {
 	case w.wr <- msg:
 	default:
-		return errors.New("blocked")
+		return wamp.ErrBlocked
 	}
 	return nil
 }
@@ -166,6 +345,11 @@ func (w *websocketPeer) sendHandler() {
 			w.log.Print(err)
 		}
 
+		// Compression only happens if it was negotiated when the websocket
+		// connection was established.
+		min := atomic.LoadInt64(&w.compressMin)
+		w.conn.EnableWriteCompression(min >= 0 && int64(len(b)) >= min)
+
 		if err = w.conn.WriteMessage(w.payloadType, b); err != nil {
 			if !wamp.IsGoodbyeAck(msg) {
 				w.log.Print(err)
@@ -174,6 +358,44 @@ func (w *websocketPeer) sendHandler() {
 	}
 }
 
+// sendGoodbye pushes a GOODBYE to the read channel, in place of a websocket
+// close message received from the other side.  If the GOODBYE is not read
+// within one second, then it is dropped.
+func (w *websocketPeer) sendGoodbye(ce *websocket.CloseError) {
+	details := wamp.Dict{}
+	if ce.Text != "" {
+		details["message"] = ce.Text
+	}
+	goodbye := &wamp.Goodbye{
+		Reason:  wamp.ErrCloseRealm,
+		Details: details,
+	}
+	select {
+	case w.rd <- goodbye:
+	case <-w.closed:
+	case <-time.After(time.Second):
+	}
+}
+
+// readMessage reads the next message from the websocket.  If the message is
+// larger than the receive limit, then only the part of the message up to the
+// limit is read, and errMessageTooBig is returned.
+func (w *websocketPeer) readMessage() (int, []byte, error) {
+	limit := atomic.LoadInt64(&w.recvLimit)
+	if limit <= 0 {
+		return w.conn.ReadMessage()
+	}
+	msgType, r, err := w.conn.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(b)) > limit {
+		err = errMessageTooBig
+	}
+	return msgType, b, err
+}
+
 // recvHandler pulls messages from the websocket and pushes them to the read
 // channel.
 func (w *websocketPeer) recvHandler() {
@@ -182,7 +404,19 @@ func (w *websocketPeer) recvHandler() {
 	defer close(w.rd)
 	defer w.conn.Close()
 	for {
-		msgType, b, err := w.conn.ReadMessage()
+		msgType, b, err := w.readMessage()
+		if err == errMessageTooBig {
+			limit := atomic.LoadInt64(&w.recvLimit)
+			w.log.Println("Received message exceeds size limit of", limit,
+				"- aborting session")
+			select {
+			case w.wr <- tooBigAbort(limit):
+			default:
+			}
+			w.wr <- nil
+			<-w.writerDone
+			return
+		}
 		if err != nil {
 			select {
 			case <-w.closed:
@@ -195,6 +429,13 @@ func (w *websocketPeer) recvHandler() {
 				// messages.
 				w.wr <- nil
 				<-w.writerDone
+
+				// If the other side closed the websocket with a close
+				// handshake, then give the router a GOODBYE, so that the
+				// session ends as if the client had left the realm.
+				if ce, ok := err.(*websocket.CloseError); ok && ce.Code != websocket.CloseAbnormalClosure {
+					w.sendGoodbye(ce)
+				}
 			}
 			// The error is only one of these erors.  It is generally not
 			// helpful to log this, so keeping this commented out.
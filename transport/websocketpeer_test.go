@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/transport/serialize"
+	"github.com/gammazero/nexus/wamp"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketCloseToGoodbye(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	peers := make(chan wamp.Peer, 1)
+	upgrader := &websocket.Upgrader{
+		Subprotocols: []string{jsonWebsocketProtocol},
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			peers <- NewWebsocketPeer(conn, &serialize.JSONSerializer{},
+				websocket.TextMessage, logger)
+		}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	client, err := ConnectWebsocketPeer(url, serialize.JSON, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPeer := <-peers
+	defer serverPeer.Close()
+
+	// Closing the client sends a websocket close message, which the server
+	// peer delivers as GOODBYE.
+	client.Close()
+	select {
+	case msg, ok := <-serverPeer.Recv():
+		if !ok {
+			t.Fatal("recv chan closed without GOODBYE")
+		}
+		goodbye, ok := msg.(*wamp.Goodbye)
+		if !ok {
+			t.Fatal("expected GOODBYE, got", msg.MessageType())
+		}
+		if goodbye.Reason != wamp.ErrCloseRealm {
+			t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GOODBYE")
+	}
+
+	select {
+	case _, ok := <-serverPeer.Recv():
+		if ok {
+			t.Fatal("expected recv chan to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recv chan not closed")
+	}
+}
+
+func TestWebsocketKeepAlive(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	peers := make(chan wamp.Peer, 1)
+	upgrader := &websocket.Upgrader{
+		Subprotocols: []string{jsonWebsocketProtocol},
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			peer := NewWebsocketPeer(conn, &serialize.JSONSerializer{},
+				websocket.TextMessage, logger)
+			peer.(KeepAliver).StartKeepAlive(20*time.Millisecond,
+				50*time.Millisecond)
+			peers <- peer
+		}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A client that reads from its connection answers pings, so the
+	// connection stays open.
+	client, err := ConnectWebsocketPeer(url, serialize.JSON, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPeer := <-peers
+	select {
+	case <-serverPeer.Recv():
+		t.Fatal("connection closed while client answers pings")
+	case <-time.After(200 * time.Millisecond):
+	}
+	last := serverPeer.(ActivityReporter).LastActivity()
+	if time.Since(last) > 100*time.Millisecond {
+		t.Fatal("pong not recorded as activity, last activity:", last)
+	}
+	client.Close()
+	serverPeer.Close()
+
+	// A client that does not read from its connection never answers pings,
+	// so the server closes the connection.
+	dialer := websocket.Dialer{Subprotocols: []string{jsonWebsocketProtocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverPeer = <-peers
+	defer serverPeer.Close()
+	select {
+	case _, ok := <-serverPeer.Recv():
+		if ok {
+			t.Fatal("expected recv chan to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed when client did not answer ping")
+	}
+}
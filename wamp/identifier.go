@@ -33,6 +33,11 @@ var (
 
 // ValidURI returs true if the URI complies with formatting rules determined by
 // the strict flag and match type.
+//
+// Strict URIs have components containing only lower-case letters, digits, and
+// underscores.  Loose URIs have components that contain no whitespace, '.', or
+// '#'.  Components must not be empty, except that a prefix pattern may end with
+// an empty component and any component of a wildcard pattern may be empty.
 func (u URI) ValidURI(strict bool, match string) bool {
 	if strict {
 		if match == MatchWildcard {
@@ -2,6 +2,7 @@ package wamp
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,41 @@ func GlobalID() ID {
 	return ID(rand.Int63n(maxID))
 }
 
+// IDGenerator is a source of WAMP IDs.  An IDGenerator given to the router
+// is called from many goroutines, so its Next method must be safe for
+// concurrent use.
+type IDGenerator interface {
+	Next() ID
+}
+
+// RandomIDGen generates random IDs in the global scope, as GlobalID does.
+type RandomIDGen struct{}
+
+// Next returns a random ID.
+func (RandomIDGen) Next() ID {
+	return GlobalID()
+}
+
+// SyncIDGen is a sequential ID generator, like IDGen, that is safe for
+// concurrent use.
+type SyncIDGen struct {
+	lock sync.Mutex
+	gen  IDGen
+}
+
+// NewSyncIDGen returns a new sequential ID generator that is safe for
+// concurrent use.
+func NewSyncIDGen() *SyncIDGen {
+	return &SyncIDGen{}
+}
+
+// Next returns next ID.
+func (g *SyncIDGen) Next() ID {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.gen.Next()
+}
+
 // ID generator for WAMP request IDs.
 //
 // WAMP request IDs are sequential per WAMP session, starting at 1 and wrapping
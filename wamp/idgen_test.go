@@ -28,3 +28,23 @@ func TestIDGen(t *testing.T) {
 		t.Fatal("Sequential IDs should wrap at 1 << 53")
 	}
 }
+
+func TestSyncIDGen(t *testing.T) {
+	var gen IDGenerator = NewSyncIDGen()
+	ids := make(chan ID)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				ids <- gen.Next()
+			}
+		}()
+	}
+	seen := map[ID]bool{}
+	for i := 0; i < 1000; i++ {
+		id := <-ids
+		if seen[id] || id < 1 || id > 1000 {
+			t.Fatal("unexpected ID:", id)
+		}
+		seen[id] = true
+	}
+}
@@ -267,8 +267,15 @@ func (msg *Unsubscribe) MessageType() MessageType { return UNSUBSCRIBE }
 // Acknowledge sent by a Broker to a Subscriber to acknowledge unsubscription.
 //
 // [UNSUBSCRIBED, UNSUBSCRIBE.Request|id]
+//
+// A Broker that removes a Subscriber's subscription, without the Subscriber
+// asking, may tell the Subscriber by sending an UNSUBSCRIBED message with a
+// Request of zero, and with the subscription ID and reason in the Details:
+//
+// [UNSUBSCRIBED, 0, Details|dict]
 type Unsubscribed struct {
 	Request ID
+	Details Dict `wamp:"omitempty"`
 }
 
 func (msg *Unsubscribed) MessageType() MessageType { return UNSUBSCRIBED }
@@ -331,8 +338,15 @@ func (msg *Unregister) MessageType() MessageType { return UNREGISTER }
 // the Callee:
 //
 // [UNREGISTERED, UNREGISTER.Request|id]
+//
+// A Dealer that removes a Callee from a registration, without the Callee
+// asking, may tell the Callee by sending an UNREGISTERED message with a
+// Request of zero, and with the registration ID and reason in the Details:
+//
+// [UNREGISTERED, 0, Details|dict]
 type Unregistered struct {
 	Request ID
+	Details Dict `wamp:"omitempty"`
 }
 
 func (msg *Unregistered) MessageType() MessageType { return UNREGISTERED }
@@ -4,16 +4,23 @@ package wamp
 const (
 	// Message option keywords.
 	OptAcknowledge     = "acknowledge"
+	OptDescribe        = "describe"
 	OptDiscloseCaller  = "disclose_caller"
 	OptDiscloseMe      = "disclose_me"
 	OptError           = "error"
 	OptExcludeMe       = "exclude_me"
+	OptFallback        = "fallback"
+	OptGetRetained     = "get_retained"
 	OptInvoke          = "invoke"
 	OptMatch           = "match"
 	OptMode            = "mode"
 	OptProgress        = "progress"
 	OptReceiveProgress = "receive_progress"
+	OptRetain          = "retain"
+	OptRKey            = "rkey"
+	OptRunMode         = "runmode"
 	OptTimeout         = "timeout"
+	OptTopicSuffix     = "topic_suffix"
 
 	// Values for URI matching mode.
 	MatchExact    = "exact"
@@ -32,6 +39,10 @@ const (
 	InvokeFirst      = "first"
 	InvokeLast       = "last"
 
+	// Values for call run mode.
+	RunModeGather    = "gather"
+	RunModePartition = "partition"
+
 	// Options for subscriber filtering.
 	BlacklistKey = "exclude"
 	WhitelistKey = "eligible"
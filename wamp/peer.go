@@ -5,6 +5,12 @@ import (
 	"time"
 )
 
+// ErrBlocked is returned by Peer.TrySend when the message cannot be sent
+// without blocking.  This is a transient error, and sending may succeed if
+// tried again later.  Any other error from TrySend means the peer cannot
+// receive messages.
+var ErrBlocked = errors.New("blocked")
+
 // Peer is the interface implemented by endpoints communicating via WAMP.
 type Peer interface {
 	// Sends the message to the peer.
@@ -34,6 +34,10 @@ const (
 	// this error.
 	ErrInvalidArgument = URI("wamp.error.invalid_argument")
 
+	// A request included options that the Router does not recognize, and the
+	// Router is configured to reject such requests.
+	ErrInvalidOptions = URI("wamp.error.invalid_options")
+
 	// -- Session Close --
 
 	// The Peer is shutting down completely - used as a GOODBYE (or ABORT)
@@ -47,6 +51,22 @@ const (
 	// reason.
 	ErrGoodbyeAndOut = URI("wamp.error.goodbye_and_out")
 
+	// The Peer's session was killed by the router - used as a GOODBYE reason.
+	ErrSessionKilled = URI("wamp.close.killed")
+
+	// The Peer's session was closed by the router because the Peer sent
+	// nothing for too long - used as a GOODBYE reason.
+	ErrSessionIdle = URI("wamp.close.idle_timeout")
+
+	// The Peer's session was closed by the router because the session reached
+	// its maximum lifetime - used as a GOODBYE reason.  The Peer may join the
+	// realm again with a new session.
+	ErrSessionExpired = URI("wamp.close.lifetime_expired")
+
+	// A Peer sent a message that is not allowed, such as a message larger
+	// than the size limit - used as an ABORT reason.
+	ErrProtocolViolation = URI("wamp.error.protocol_violation")
+
 	// -- Authorization --
 
 	// A join, call, register, publish or subscribe failed, since the Peer is
@@ -76,6 +96,9 @@ const (
 	// No authentication method the peer offered is available or active. *
 	ErrNoAuthMethod = URI("wamp.error.no_auth_method")
 
+	// The authentication exchange did not complete in the time allowed.
+	ErrAuthenticationTimeout = URI("wamp.error.authentication_timeout")
+
 	// ----- Advanced Profile -----
 
 	// A Dealer or Callee canceled a call previously issued.
@@ -116,6 +139,17 @@ const (
 	// Retrieves information on a specific session.
 	MetaProcSessionGet = URI("wamp.session.get")
 
+	// Kills a single session identified by session ID.
+	MetaProcSessionKill = URI("wamp.session.kill")
+
+	// Kills all sessions currently attached to the realm with the given
+	// authid.
+	MetaProcSessionKillByAuthid = URI("wamp.session.kill_by_authid")
+
+	// Kills all sessions currently attached to the realm with the given
+	// authrole.
+	MetaProcSessionKillByAuthrole = URI("wamp.session.kill_by_authrole")
+
 	// No session with the given ID exists on the router.
 	ErrNoSuchSession = URI("wamp.error.no_such_session")
 
@@ -194,7 +228,67 @@ const (
 	MetaProcSubListCallees = URI("wamp.subscription.list_subscribers")
 
 	// Obtains the number of sessions currently attached to the subscription.
-	MetaProcSubCountCallees = URI("wamp.subscription.count_suscribers")
+	MetaProcSubCountCallees = URI("wamp.subscription.count_subscribers")
+
+	// Retrieves the recent events of a subscription, when the router keeps
+	// event history.
+	MetaProcSubGetEvents = URI("wamp.subscription.get_events")
+
+	// -- Registration Meta Procedures (not part of WAMP spec) --
+
+	// Obtains the number of registrations and the maximum number allowed.
+	MetaProcRegStats = URI("wamp.registration.stats")
+
+	// Removes a callee from a registration, telling the callee if it supports
+	// registration revocation.
+	MetaProcRegRemoveCallee = URI("wamp.registration.remove_callee")
+
+	// -- Subscription Meta Procedures (not part of WAMP spec) --
+
+	// Removes a subscriber from a subscription, telling the subscriber if it
+	// supports subscription revocation.
+	MetaProcSubRemoveSubscriber = URI("wamp.subscription.remove_subscriber")
+
+	// -- Topic Meta Procedures (not part of WAMP spec) --
+
+	// Obtains the number of subscribers for each subscribed topic.
+	MetaProcTopicStats = URI("wamp.topic.stats")
+
+	// -- Router Meta Procedures (not part of WAMP spec) --
+
+	// Returns the router's current time, allowing clients to measure round
+	// trip time and clock skew.
+	MetaProcRouterPing = URI("wamp.router.ping")
+
+	// Returns the router's software version, uptime, and the features enabled
+	// for the realm.
+	MetaProcRouterInfo = URI("wamp.router.info")
+
+	// Lists the URIs of the realms on the router.  This is only available in
+	// the router's admin realm.
+	MetaProcRouterRealmList = URI("wamp.router.realm.list")
+
+	// Returns the number of sessions in the realm, and the numbers of
+	// registrations and subscriptions for each match policy, in one call.
+	MetaProcRealmCount = URI("wamp.realm.count")
+
+	// -- Reflection Meta Procedures (not part of WAMP spec) --
+
+	// Lists the URIs of the registered procedures.
+	MetaProcReflectProcedureList = URI("wamp.reflect.procedure.list")
+
+	// Lists the URIs of the subscribed topics.
+	MetaProcReflectTopicList = URI("wamp.reflect.topic.list")
+
+	// Describes the procedure and topic for a URI, including the descriptions
+	// given in the describe option when registering and subscribing.
+	MetaProcReflectDescribe = URI("wamp.reflect.describe")
+
+	// -- Authorization Meta Procedures --
+
+	// Checks whether the calling session would be authorized to perform an
+	// action on a URI, without performing the action.
+	MetaProcAuthzCheck = URI("wamp.authz.check")
 
 	// -- Testament Meta Procedures --
 